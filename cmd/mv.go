@@ -1,12 +1,15 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/johanan/mvr/core"
@@ -24,9 +27,12 @@ var mvFormat string
 var mvFilename string
 var mvSql string
 var mvCompression string
+var mvCompressionLevel int
 var mvName string
 var mvBatchSize int
 var mvColumns string
+var mvDestTable string
+var mvMode string
 
 func parseColumns(data []byte) ([]d.Column, error) {
 	// Try JSON first
@@ -46,6 +52,81 @@ func parseColumns(data []byte) ([]d.Column, error) {
 	return nil, fmt.Errorf("failed to parse as JSON (%v) or YAML (%v)", jsonErr, yamlErr)
 }
 
+// buildReader picks the file reader for file sources, everything else is a database
+func buildReader(connUrl *url.URL) (d.DBReaderConn, error) {
+	switch connUrl.Scheme {
+	case "file", "azure", "azurite":
+		return file.NewFileDataReader(connUrl)
+	default:
+		return core.BuildDBReader(connUrl)
+	}
+}
+
+// buildWriter loads database destinations directly, commits table formats to path, everything else is written as a file
+func buildWriter(ctx context.Context, destUrl, path *url.URL, sConfig *d.StreamConfig, ds *d.DataStream, writer, counter io.WriteCloser) (d.DataWriter, error) {
+	if core.IsDBDestination(destUrl) {
+		return core.BuildDBWriter(ctx, destUrl, ds, sConfig)
+	}
+	if file.IsTableFormat(sConfig.Format) {
+		return file.AddTableWriter(ctx, sConfig.Format, sConfig.GetMode(), path, ds, counter)
+	}
+	return file.AddFileWriter(sConfig, ds, writer)
+}
+
+// destPath is where the data ends up, the table for a database destination
+func destPath(destUrl *url.URL, sConfig *d.StreamConfig) (*url.URL, error) {
+	if core.IsDBDestination(destUrl) {
+		return destUrl.JoinPath(sConfig.GetDestTable()), nil
+	}
+	return file.BuildFullPath(destUrl, sConfig.Filename)
+}
+
+// bindWatermark binds the value saved by the last run of an incremental stream,
+// the first run starts from the value in params
+func bindWatermark(ctx context.Context, destUrl *url.URL, sConfig *d.StreamConfig) (*url.URL, error) {
+	location, err := file.StateLocation(destUrl, sConfig)
+	if err != nil {
+		return nil, err
+	}
+	state, err := file.LoadWatermark(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+
+	inc := sConfig.Incremental
+	if state == nil {
+		if _, ok := sConfig.Params[inc.Param]; !ok {
+			return nil, fmt.Errorf("incremental param %s needs a starting value in params", inc.Param)
+		}
+		log.Info().Msgf("No incremental state at %s, starting from params", location.Path)
+		return location, nil
+	}
+	if !strings.EqualFold(state.Column, inc.Column) {
+		return nil, fmt.Errorf("incremental state %s is for column %s, not %s", location.Path, state.Column, inc.Column)
+	}
+	sConfig.BindWatermark(state.Value)
+	log.Info().Str("watermark", state.Value).Msgf("Extracting rows past the last %s", inc.Column)
+	return location, nil
+}
+
+// saveWatermark keeps the largest cursor value for the next run, a run without
+// rows keeps the value it started from
+func saveWatermark(ctx context.Context, location *url.URL, sConfig *d.StreamConfig, ds *d.DataStream) error {
+	value, err := ds.Watermark.Value()
+	if err != nil {
+		return err
+	}
+	if value == "" {
+		value = sConfig.Params[sConfig.Incremental.Param].Value
+	}
+	state := &file.WatermarkState{Column: ds.Watermark.Column, Value: value, Rows: ds.TotalRows, UpdatedAt: time.Now().UTC()}
+	if err := file.SaveWatermark(ctx, location, state); err != nil {
+		return err
+	}
+	log.Info().Str("watermark", value).Msg("Saved incremental state")
+	return nil
+}
+
 var mvCmd = &cobra.Command{
 	Use:   "mv",
 	Short: "mv is what mvs the data",
@@ -91,13 +172,16 @@ var mvCmd = &cobra.Command{
 		}
 
 		cliArgs := &d.StreamConfig{
-			Format:      mvFormat,
-			Filename:    mvFilename,
-			SQL:         mvSql,
-			Compression: mvCompression,
-			StreamName:  mvName,
-			BatchSize:   mvBatchSize,
-			Columns:     columns,
+			Format:           mvFormat,
+			Filename:         mvFilename,
+			SQL:              mvSql,
+			Compression:      mvCompression,
+			CompressionLevel: mvCompressionLevel,
+			StreamName:       mvName,
+			BatchSize:        mvBatchSize,
+			Columns:          columns,
+			DestTable:        mvDestTable,
+			Mode:             mvMode,
 		}
 
 		sConfig, err := d.BuildConfig(templateData, cliArgs)
@@ -139,13 +223,24 @@ var mvCmd = &cobra.Command{
 			bar = file.NewProgressBar()
 		}
 
-		path, err := file.BuildFullPath(config.DestConn.ParsedUrl, sConfig.Filename)
+		path, err := destPath(config.DestConn.ParsedUrl, sConfig)
 		if err != nil {
 			return fmt.Errorf("error building path: %v", err)
 		}
 
 		result := core.NewFlowResult(config.SourceConn.ParsedUrl, sConfig, time.Now()).SetPath(path)
 		isStdout := config.DestConn.ParsedUrl.Scheme == "stdout"
+		isDatabase := core.IsDBDestination(config.DestConn.ParsedUrl)
+
+		// the state is read before anything is written so a bad one stops the run
+		var statePath *url.URL
+		if sConfig.Incremental != nil {
+			statePath, err = bindWatermark(ctx, config.DestConn.ParsedUrl, sConfig)
+			if err != nil {
+				result.Error(err.Error()).LogContext(log.Error()).Send()
+				return err
+			}
+		}
 
 		cleanup := func(executionErr error, writer io.WriteCloser, fileWriter d.DataWriter) error {
 			if executionErr != nil && isStdout && writer != nil {
@@ -155,46 +250,25 @@ var mvCmd = &cobra.Command{
 				}
 			}
 
-			var closeErr error
-
-			// Close fileWriter if it was created
-			if fileWriter != nil {
-				if err := fileWriter.Flush(); err != nil {
-					closeErr = errors.Join(closeErr, fmt.Errorf("flush writer: %w", err))
-				}
-				if err := fileWriter.Close(); err != nil {
-					closeErr = errors.Join(closeErr, fmt.Errorf("close writer: %w", err))
-				}
-			}
-
-			// Close writer if it was created
-			if writer != nil {
-				if err := writer.Close(); err != nil {
-					closeErr = errors.Join(closeErr, fmt.Errorf("close writer: %w", err))
-				}
-			}
-
-			if closeErr != nil {
-				return closeErr
-			}
-			log.Trace().Msg("Flushed writer")
-
-			if executionErr != nil {
-				return executionErr
-			}
-
-			return nil
+			return closeWriters(executionErr, writer, fileWriter)
 		}
 
-		writer, err := file.GetPathAndIO(ctx, path, bar, sConfig.Compression, sConfig.Format)
-		if err != nil {
-			errFmt := fmt.Errorf("error getting path and io: %v", err)
-			result.Error(errFmt.Error()).LogContext(log.Error()).Send()
-			return errFmt
+		var writer io.WriteCloser
+		if isDatabase {
+			log.Info().Msgf("Loading into %s", sConfig.GetDestTable())
+		} else if file.IsTableFormat(sConfig.Format) {
+			log.Info().Msgf("Committing to %s", path)
+		} else {
+			writer, err = file.GetPathAndIO(ctx, path, bar, sConfig)
+			if err != nil {
+				errFmt := fmt.Errorf("error getting path and io: %v", err)
+				result.Error(errFmt.Error()).LogContext(log.Error()).Send()
+				return errFmt
+			}
+			log.Info().Msgf("Writing to %s", path)
 		}
-		log.Info().Msgf("Writing to %s", path)
 
-		reader, err := core.BuildDBReader(config.SourceConn.ParsedUrl)
+		reader, err := buildReader(config.SourceConn.ParsedUrl)
 		if err != nil {
 			return cleanup(err, writer, nil)
 		}
@@ -207,7 +281,15 @@ var mvCmd = &cobra.Command{
 			return cleanup(err, writer, nil)
 		}
 
-		fileWriter, err := file.AddFileWriter(sConfig.Format, datastream, writer)
+		if statePath != nil {
+			datastream.Watermark, err = d.NewWatermark(sConfig.Incremental.Column, datastream.Columns)
+			if err != nil {
+				result.Error(err.Error()).LogContext(log.Error()).Send()
+				return cleanup(err, writer, nil)
+			}
+		}
+
+		fileWriter, err := buildWriter(ctx, config.DestConn.ParsedUrl, path, sConfig, datastream, writer, bar)
 		if err != nil {
 			result.Error(err.Error()).LogContext(log.Error()).Send()
 			return cleanup(err, writer, nil)
@@ -225,6 +307,14 @@ var mvCmd = &cobra.Command{
 			return acc
 		}
 
+		// only once the writer has closed, a failed run extracts the same rows again
+		if statePath != nil {
+			if err := saveWatermark(ctx, statePath, sConfig, datastream); err != nil {
+				result.Error(err.Error()).LogContext(log.Error()).Send()
+				return err
+			}
+		}
+
 		result.SetRows(datastream.TotalRows).SetBytes(bar.State().CurrentBytes).Success()
 		result.LogContext(log.Info()).Msg("Finished writing data")
 
@@ -238,7 +328,61 @@ func init() {
 	mvCmd.Flags().StringVar(&mvFilename, "filename", "", "output file name")
 	mvCmd.Flags().StringVar(&mvSql, "sql", "", "sql query to run")
 	mvCmd.Flags().StringVar(&mvCompression, "compression", "", "compression type")
+	mvCmd.Flags().IntVar(&mvCompressionLevel, "compression-level", 0, "compression level, 0 is the codec default")
 	mvCmd.Flags().StringVar(&mvName, "name", "", "stream name")
 	mvCmd.Flags().StringVar(&mvColumns, "columns", "", "columns to include")
 	mvCmd.Flags().IntVar(&mvBatchSize, "batch-size", 0, "batch size")
+	mvCmd.Flags().StringVar(&mvDestTable, "dest-table", "", "table to load for a database destination")
+	mvCmd.Flags().StringVar(&mvMode, "mode", "", "how a database or table destination is loaded: append, truncate, swap (postgres), create or replace (sqlserver), overwrite (delta, iceberg)")
+}
+
+// closeWriters closes the fileWriter and then the file it writes to. When the run
+// failed what was written is thrown away if the writers can, and the error of the
+// run is returned with any from closing, never replaced by one.
+func closeWriters(executionErr error, writer io.WriteCloser, fileWriter d.DataWriter) error {
+	var closeErr error
+
+	// throw away a partial file first so closing the fileWriter cannot publish it,
+	// a file that can only be closed is closed after the fileWriter like a success
+	aborted := executionErr != nil && file.CanAbort(writer)
+	if aborted {
+		if err := writer.(d.Aborter).Abort(); err != nil {
+			closeErr = errors.Join(closeErr, fmt.Errorf("abort file: %w", err))
+		}
+	}
+
+	// Close fileWriter if it was created, throwing away what was written if it can
+	if aborter, ok := fileWriter.(d.Aborter); ok && executionErr != nil {
+		if err := aborter.Abort(); err != nil {
+			closeErr = errors.Join(closeErr, fmt.Errorf("abort writer: %w", err))
+		}
+	} else if fileWriter != nil {
+		if err := fileWriter.Flush(); err != nil {
+			closeErr = errors.Join(closeErr, fmt.Errorf("flush writer: %w", err))
+		}
+		if err := fileWriter.Close(); err != nil {
+			closeErr = errors.Join(closeErr, fmt.Errorf("close writer: %w", err))
+		}
+	}
+
+	// Close writer if it was created
+	if writer != nil && !aborted {
+		if err := writer.Close(); err != nil {
+			closeErr = errors.Join(closeErr, fmt.Errorf("close writer: %w", err))
+		}
+	}
+
+	// the error of the run is never hidden by one from closing
+	if executionErr != nil {
+		if closeErr != nil {
+			return errors.Join(executionErr, closeErr)
+		}
+		return executionErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	log.Trace().Msg("Flushed writer")
+
+	return nil
 }
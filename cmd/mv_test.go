@@ -1,8 +1,16 @@
 package cmd
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
+	"io"
 	"testing"
+
+	"github.com/johanan/mvr/data"
+	"github.com/johanan/mvr/file"
+	"github.com/zeebo/assert"
 )
 
 func TestColumnParsing(t *testing.T) {
@@ -48,3 +56,67 @@ func TestColumnParsing(t *testing.T) {
 		})
 	}
 }
+
+type fileRecorder struct {
+	bytes.Buffer
+	closed  bool
+	aborted bool
+}
+
+func (f *fileRecorder) Close() error { f.closed = true; return nil }
+
+type abortingFile struct {
+	fileRecorder
+}
+
+func (a *abortingFile) Abort() error { a.aborted = true; return nil }
+
+func TestCloseWriters(t *testing.T) {
+	runErr := errors.New("source failed")
+	tests := []struct {
+		name    string
+		runErr  error
+		abort   bool
+		aborted bool
+	}{
+		{name: "Success", runErr: nil},
+		{name: "Local file is closed", runErr: runErr},
+		{name: "Remote file is aborted", runErr: runErr, abort: true, aborted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out *fileRecorder
+			var bufWriter *file.BufferedWriter
+			if tt.abort {
+				remote := &abortingFile{}
+				out = &remote.fileRecorder
+				bufWriter = file.NewBufferedWriter(remote, remote)
+			} else {
+				out = &fileRecorder{}
+				bufWriter = file.NewBufferedWriter(out, out)
+			}
+			writer, err := file.CreateCompressedWriter(bufWriter, "gzip", 0, "arrow")
+			assert.NoError(t, err)
+			ds := &data.DataStream{BatchSize: 10, DestColumns: []data.Column{{Name: "id", Type: "BIGINT"}}}
+			fileWriter, err := file.AddFileWriter(&data.StreamConfig{Format: "arrow", Compression: "gzip"}, ds, writer)
+			assert.NoError(t, err)
+			assert.NoError(t, fileWriter.CreateBatchWriter().WriteBatch(data.Batch{Rows: [][]any{{int64(1)}}}))
+
+			err = closeWriters(tt.runErr, writer, fileWriter)
+			// the error of the run comes back as it is, not one from closing
+			assert.Equal(t, tt.runErr, err)
+			assert.Equal(t, tt.aborted, out.aborted)
+			assert.Equal(t, !tt.aborted, out.closed)
+			if tt.aborted {
+				return
+			}
+
+			// a file that cannot be thrown away is still a whole file
+			gz, err := gzip.NewReader(&out.Buffer)
+			assert.NoError(t, err)
+			_, err = io.ReadAll(gz)
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -3,6 +3,8 @@ package cmd
 import (
 	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"runtime"
 	"strings"
@@ -76,12 +78,23 @@ var mvsCmd = &cobra.Command{
 			return fmt.Errorf("error setting up task: %v", err)
 		}
 
-		reader, err := core.BuildDBReader(config.SourceConn.ParsedUrl)
+		reader, err := buildReader(config.SourceConn.ParsedUrl)
 		if err != nil {
 			return err
 		}
 		defer reader.Close()
 
+		if multiConfig.ConsistentSnapshot {
+			snapshotter, ok := reader.(data.Snapshotter)
+			if !ok {
+				return fmt.Errorf("consistent_snapshot is not supported for %s sources", config.SourceConn.ParsedUrl.Scheme)
+			}
+			if err := snapshotter.ExportSnapshot(ctx); err != nil {
+				return err
+			}
+			defer snapshotter.ReleaseSnapshot()
+		}
+
 		silent, _ := cmd.Flags().GetBool("silent")
 		quiet, _ := cmd.Flags().GetBool("quiet")
 		cliConcurrency, _ := cmd.Flags().GetInt("concurrency")
@@ -114,13 +127,22 @@ var mvsCmd = &cobra.Command{
 			}
 			log.Debug().Interface("config", sConfig).Msg("Config")
 
-			path, err := file.BuildFullPath(config.DestConn.ParsedUrl, sConfig.Filename)
+			path, err := destPath(config.DestConn.ParsedUrl, sConfig)
 			if err != nil {
 				return fmt.Errorf("error building path: %v", err)
 			}
 
 			result := core.NewFlowResult(config.SourceConn.ParsedUrl, sConfig, time.Now()).SetPath(path)
 
+			var statePath *url.URL
+			if sConfig.Incremental != nil {
+				statePath, err = bindWatermark(ctx, config.DestConn.ParsedUrl, sConfig)
+				if err != nil {
+					result.Error(err.Error()).LogContext(log.Error()).Send()
+					return err
+				}
+			}
+
 			var bar *progressbar.ProgressBar
 			if quiet || silent {
 				bar = progressbar.DefaultBytesSilent(-1)
@@ -128,22 +150,38 @@ var mvsCmd = &cobra.Command{
 				bar = file.NewProgressBar()
 			}
 
-			writer, err := file.GetPathAndIO(ctx, path, bar, sConfig.Compression, sConfig.Format)
-			if err != nil {
-				errFmt := fmt.Errorf("error getting path and IO: %v", err)
-				result.Error(errFmt.Error()).LogContext(log.Error()).Send()
-				return errFmt
+			isDatabase := core.IsDBDestination(config.DestConn.ParsedUrl)
+			var writer io.WriteCloser
+			if isDatabase {
+				log.Info().Msgf("Loading into %s", sConfig.GetDestTable())
+			} else if file.IsTableFormat(sConfig.Format) {
+				log.Info().Msgf("Committing to %s", path)
+			} else {
+				writer, err = file.GetPathAndIO(ctx, path, bar, sConfig)
+				if err != nil {
+					errFmt := fmt.Errorf("error getting path and IO: %v", err)
+					result.Error(errFmt.Error()).LogContext(log.Error()).Send()
+					return errFmt
+				}
+
+				log.Info().Msgf("Writing to %s", path)
 			}
 
-			log.Info().Msgf("Writing to %s", path)
-
 			datastream, err := reader.CreateDataStream(ctx, config.SourceConn.ParsedUrl, sConfig)
 			if err != nil {
 				result.Error(err.Error()).LogContext(log.Error()).Send()
 				return err
 			}
 
-			fileWriter, err := file.AddFileWriter(sConfig.Format, datastream, writer)
+			if statePath != nil {
+				datastream.Watermark, err = data.NewWatermark(sConfig.Incremental.Column, datastream.Columns)
+				if err != nil {
+					result.Error(err.Error()).LogContext(log.Error()).Send()
+					return err
+				}
+			}
+
+			fileWriter, err := buildWriter(ctx, config.DestConn.ParsedUrl, path, sConfig, datastream, writer, bar)
 			if err != nil {
 				result.Error(err.Error()).LogContext(log.Error()).Send()
 				return err
@@ -152,7 +190,7 @@ var mvsCmd = &cobra.Command{
 			err = core.Execute(ctx, concurrency, sConfig, datastream, reader, fileWriter)
 			if err != nil {
 				result.Error(err.Error()).LogContext(log.Error()).Send()
-				return err
+				return closeWriters(err, writer, fileWriter)
 			}
 
 			if err := fileWriter.Flush(); err != nil {
@@ -163,8 +201,10 @@ var mvsCmd = &cobra.Command{
 				acc = errors.Join(acc, fmt.Errorf("close writer: %w", err))
 
 			}
-			if err := writer.Close(); err != nil {
-				acc = errors.Join(acc, fmt.Errorf("close writer: %w", err))
+			if writer != nil {
+				if err := writer.Close(); err != nil {
+					acc = errors.Join(acc, fmt.Errorf("close writer: %w", err))
+				}
 			}
 
 			if acc != nil {
@@ -173,6 +213,13 @@ var mvsCmd = &cobra.Command{
 			}
 			log.Trace().Msg("Flushed writer")
 
+			if statePath != nil {
+				if err := saveWatermark(ctx, statePath, sConfig, datastream); err != nil {
+					result.Error(err.Error()).LogContext(log.Error()).Send()
+					return err
+				}
+			}
+
 			result.SetRows(datastream.TotalRows).SetBytes(bar.State().CurrentBytes).Success()
 			result.LogContext(log.Info()).Msg("Finished writing data")
 		}
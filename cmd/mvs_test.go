@@ -5,6 +5,7 @@ import (
 
 	"github.com/johanan/mvr/data"
 	"github.com/zeebo/assert"
+	"gopkg.in/yaml.v2"
 )
 
 func TestTableFilter(t *testing.T) {
@@ -42,3 +43,11 @@ func TestTableFilter(t *testing.T) {
 		})
 	}
 }
+
+func TestConsistentSnapshotConfig(t *testing.T) {
+	var multiConfig data.MultiStreamConfig
+	assert.NoError(t, yaml.Unmarshal([]byte("format: csv\nconsistent_snapshot: true\ntables:\n  - stream_name: public.users\n"), &multiConfig))
+	assert.True(t, multiConfig.ConsistentSnapshot)
+	assert.Equal(t, "csv", multiConfig.Format)
+	assert.Equal(t, 1, len(multiConfig.Tables))
+}
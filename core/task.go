@@ -56,6 +56,8 @@ func BuildDbExec(connURL *url.URL) (data.DBExec, error) {
 		exec, err = database.NewPGDataReader(connURL)
 	case "snowflake":
 		exec, err = database.NewSnowflakeDataReader(connURL)
+	case "mysql":
+		exec, err = database.NewMySQLDataReader(connURL)
 	default:
 		log.Fatal().Msgf("Unsupported source: %s", source)
 	}
@@ -77,6 +79,10 @@ func BuildDBReader(connURL *url.URL) (data.DBReaderConn, error) {
 		reader, err = database.NewMSDataReader(connURL)
 	case "snowflake":
 		reader, err = database.NewSnowflakeDataReader(connURL)
+	case "mysql":
+		reader, err = database.NewMySQLDataReader(connURL)
+	case "sqlite":
+		reader, err = database.NewSQLiteDataReader(connURL)
 	default:
 		log.Fatal().Msgf("Unsupported source: %s", source)
 	}
@@ -86,6 +92,35 @@ func BuildDBReader(connURL *url.URL) (data.DBReaderConn, error) {
 	return reader, nil
 }
 
+// IsDBDestination is true when the destination is a database table rather than a file
+func IsDBDestination(connURL *url.URL) bool {
+	switch connURL.Scheme {
+	case "postgres", "sqlserver":
+		return true
+	default:
+		return false
+	}
+}
+
+func BuildDBWriter(ctx context.Context, connURL *url.URL, datastream *data.DataStream, config *data.StreamConfig) (data.DataWriter, error) {
+	dest := connURL.Scheme
+	var writer data.DataWriter
+	var err error
+
+	switch dest {
+	case "postgres":
+		writer, err = database.NewPGDataWriter(ctx, connURL, datastream, config)
+	case "sqlserver":
+		writer, err = database.NewMSDataWriter(ctx, connURL, datastream, config)
+	default:
+		return nil, fmt.Errorf("unsupported destination: %s", dest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
 func Execute(ctx context.Context, concurrency int, config *data.StreamConfig, datastream *data.DataStream, reader data.DBReaderConn, writer data.DataWriter) error {
 	ctx, cancel := context.WithCancel(ctx)
 
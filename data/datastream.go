@@ -14,26 +14,117 @@ import (
 	"time"
 
 	"github.com/Masterminds/sprig/v3"
+	"github.com/apache/arrow-go/v18/arrow"
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v2"
 )
 
 type StreamConfig struct {
-	StreamName  string           `json:"stream_name,omitempty" yaml:"stream_name,omitempty"`
-	Filename    string           `json:"filename,omitempty" yaml:"filename,omitempty"`
-	Format      string           `json:"format,omitempty" yaml:"format,omitempty"`
-	SQL         string           `json:"sql,omitempty" yaml:"sql,omitempty"`
-	Compression string           `json:"compression,omitempty" yaml:"compression,omitempty"`
-	Columns     []Column         `json:"columns,omitempty" yaml:"columns,omitempty"`
-	Params      map[string]Param `json:"params,omitempty" yaml:"params,omitempty"`
-	ParamKeys   []string
-	BatchSize   int `json:"batch_size,omitempty" yaml:"batch_size,omitempty"`
-	BatchCount  int `json:"batch_count,omitempty" yaml:"batch_count,omitempty"`
+	StreamName       string           `json:"stream_name,omitempty" yaml:"stream_name,omitempty"`
+	Filename         string           `json:"filename,omitempty" yaml:"filename,omitempty"`
+	Format           string           `json:"format,omitempty" yaml:"format,omitempty"`
+	SQL              string           `json:"sql,omitempty" yaml:"sql,omitempty"`
+	Compression      string           `json:"compression,omitempty" yaml:"compression,omitempty"`
+	CompressionLevel int              `json:"compression_level,omitempty" yaml:"compression_level,omitempty"`
+	Columns          []Column         `json:"columns,omitempty" yaml:"columns,omitempty"`
+	Params           map[string]Param `json:"params,omitempty" yaml:"params,omitempty"`
+	ParamKeys        []string
+	BatchSize        int                 `json:"batch_size,omitempty" yaml:"batch_size,omitempty"`
+	BatchCount       int                 `json:"batch_count,omitempty" yaml:"batch_count,omitempty"`
+	DestTable        string              `json:"dest_table,omitempty" yaml:"dest_table,omitempty"`
+	Mode             string              `json:"mode,omitempty" yaml:"mode,omitempty"`
+	CSV              *CSVOptions         `json:"csv,omitempty" yaml:"csv,omitempty"`
+	FixedWidth       *FixedWidthOptions  `json:"fixed_width,omitempty" yaml:"fixed_width,omitempty"`
+	Parquet          *ParquetOptions     `json:"parquet,omitempty" yaml:"parquet,omitempty"`
+	Arrow            *ArrowOptions       `json:"arrow,omitempty" yaml:"arrow,omitempty"`
+	Incremental      *IncrementalOptions `json:"incremental,omitempty" yaml:"incremental,omitempty"`
+	Partition        *PartitionOptions   `json:"partition,omitempty" yaml:"partition,omitempty"`
+}
+
+// CSVOptions is the dialect of csv and tsv files, anything left out is the default
+type CSVOptions struct {
+	// Delimiter is a single character or one of tab, pipe, comma or semicolon
+	Delimiter string `json:"delimiter,omitempty" yaml:"delimiter,omitempty"`
+	Quote     string `json:"quote,omitempty" yaml:"quote,omitempty"`
+	// QuoteAll quotes every value that is not null
+	QuoteAll bool  `json:"quote_all,omitempty" yaml:"quote_all,omitempty"`
+	Header   *bool `json:"header,omitempty" yaml:"header,omitempty"`
+	// NullValue is written for nulls, a pointer so it can be the empty string
+	NullValue *string `json:"null_value,omitempty" yaml:"null_value,omitempty"`
+	// LineTerminator is lf or crlf
+	LineTerminator string `json:"line_terminator,omitempty" yaml:"line_terminator,omitempty"`
+	BOM            bool   `json:"bom,omitempty" yaml:"bom,omitempty"`
+}
+
+// FixedWidthOptions are the records of a fixed width file, the widths come from the column lengths
+type FixedWidthOptions struct {
+	// Overflow is fail, the default, or truncate for values wider than their column
+	Overflow string `json:"overflow,omitempty" yaml:"overflow,omitempty"`
+	// ZeroPad pads numbers with zeros instead of spaces
+	ZeroPad bool `json:"zero_pad,omitempty" yaml:"zero_pad,omitempty"`
+	// Header starts the file with a record of the column names
+	Header bool `json:"header,omitempty" yaml:"header,omitempty"`
+	// Trailer ends the file with a record of TrailerPrefix and the row count
+	Trailer        bool   `json:"trailer,omitempty" yaml:"trailer,omitempty"`
+	TrailerPrefix  string `json:"trailer_prefix,omitempty" yaml:"trailer_prefix,omitempty"`
+	LineTerminator string `json:"line_terminator,omitempty" yaml:"line_terminator,omitempty"`
+}
+
+// ParquetOptions are the layout of a parquet file, the codec is Compression
+type ParquetOptions struct {
+	// RowGroupRows and RowGroupBytes close a row group when either is reached,
+	// batches are split or combined to fill them
+	RowGroupRows  int64 `json:"row_group_rows,omitempty" yaml:"row_group_rows,omitempty"`
+	RowGroupBytes int64 `json:"row_group_bytes,omitempty" yaml:"row_group_bytes,omitempty"`
+	DataPageSize  int64 `json:"data_page_size,omitempty" yaml:"data_page_size,omitempty"`
+	// Dictionary is the default for every column, DictionaryColumns by column name
+	Dictionary        *bool           `json:"dictionary,omitempty" yaml:"dictionary,omitempty"`
+	DictionaryColumns map[string]bool `json:"dictionary_columns,omitempty" yaml:"dictionary_columns,omitempty"`
+	// Statistics are the min, max and null count of each column chunk
+	Statistics *bool `json:"statistics,omitempty" yaml:"statistics,omitempty"`
+	// PageStatistics writes the column and offset indexes with the statistics of each page
+	PageStatistics bool `json:"page_statistics,omitempty" yaml:"page_statistics,omitempty"`
+}
+
+// ArrowOptions are the IPC format of arrow files, lz4 and zstd Compression compress the buffers
+type ArrowOptions struct {
+	// IPCFormat is stream, the default, or file for random access with a footer
+	IPCFormat string `json:"ipc_format,omitempty" yaml:"ipc_format,omitempty"`
+	// DictionaryColumns are text columns with few values to write as dictionaries
+	DictionaryColumns []string `json:"dictionary_columns,omitempty" yaml:"dictionary_columns,omitempty"`
+}
+
+// IncrementalOptions extract only the rows past the last successful run
+type IncrementalOptions struct {
+	// Column is the cursor, a timestamp or an id that only goes up
+	Column string `json:"column,omitempty" yaml:"column,omitempty"`
+	// Param is bound to the last value of the cursor, its value in params is the start
+	Param string `json:"param,omitempty" yaml:"param,omitempty"`
+	// State is the file the last value is kept in, relative to the destination or a full url
+	State string `json:"state,omitempty" yaml:"state,omitempty"`
+}
+
+// PartitionOptions split the query into ranges of a column that are read at the same time
+type PartitionOptions struct {
+	// Column is a whole number or a timestamp, used in the SQL as it is written
+	Column string `json:"column,omitempty" yaml:"column,omitempty"`
+	// Count ranges of the same width between the min and max of the column
+	Count int `json:"count,omitempty" yaml:"count,omitempty"`
+	// Ranges are explicit bounds instead of Count
+	Ranges []PartitionRange `json:"ranges,omitempty" yaml:"ranges,omitempty"`
+}
+
+// PartitionRange is from Lower up to but not including Upper, an empty bound is open
+type PartitionRange struct {
+	Lower string `json:"lower,omitempty" yaml:"lower,omitempty"`
+	Upper string `json:"upper,omitempty" yaml:"upper,omitempty"`
 }
 
 type MultiStreamConfig struct {
 	StreamConfig `json:",inline" yaml:",inline"`
 	Tables       []StreamConfig `json:"tables" yaml:"tables"`
+	// ConsistentSnapshot reads every table from the same point in time
+	ConsistentSnapshot bool `json:"consistent_snapshot,omitempty" yaml:"consistent_snapshot,omitempty"`
 }
 
 type Param struct {
@@ -50,10 +141,15 @@ type Column struct {
 	Position     int    `json:"position" yaml:"position"`
 	Scale        int64  `json:"scale,omitempty" yaml:"scale,omitempty"`
 	Precision    int64  `json:"precision,omitempty" yaml:"precision,omitempty"`
+	// Fields are the schema of a STRUCT column, or of the elements of a list of them
+	Fields []Column `json:"fields,omitempty" yaml:"fields,omitempty"`
 }
 
 type Batch struct {
 	Rows [][]any
+	// Record is the batch as typed columns, sent instead of Rows by readers
+	// that read columns. The writer releases it.
+	Record arrow.RecordBatch
 }
 
 type DataStream struct {
@@ -63,12 +159,20 @@ type DataStream struct {
 	BatchSize   int
 	Columns     []Column
 	DestColumns []Column
+	// Watermark keeps the largest cursor value written by an incremental stream
+	Watermark *Watermark
 }
 
 type BatchWriter interface {
 	WriteBatch(batch Batch) error
 }
 
+// RecordWriter is implemented by batch writers that write the columns of a
+// Record as they are, the other writers are given its rows
+type RecordWriter interface {
+	WriteRecord(record arrow.RecordBatch) error
+}
+
 type DataWriter interface {
 	CreateBatchWriter() BatchWriter
 	Flush() error
@@ -81,6 +185,19 @@ type DBReaderConn interface {
 	Close() error
 }
 
+// Aborter is implemented by writers that can throw away what they have written
+// when the run fails, instead of committing it on Close
+type Aborter interface {
+	Abort() error
+}
+
+// Snapshotter is implemented by readers that can read every stream of a run
+// from the same point in time
+type Snapshotter interface {
+	ExportSnapshot(ctx context.Context) error
+	ReleaseSnapshot() error
+}
+
 type DBExec interface {
 	ExecuteCommand(ctx context.Context, sql_command string) (string, error)
 }
@@ -99,6 +216,21 @@ func (sc *StreamConfig) GetBatchCount() int {
 	return sc.BatchCount
 }
 
+// GetDestTable is the table a database destination loads, defaulting to the stream name
+func (sc *StreamConfig) GetDestTable() string {
+	if sc.DestTable == "" {
+		return sc.StreamName
+	}
+	return sc.DestTable
+}
+
+func (sc *StreamConfig) GetMode() string {
+	if sc.Mode == "" {
+		return "append"
+	}
+	return strings.ToLower(sc.Mode)
+}
+
 func (sc *StreamConfig) Validate() error {
 	if sc.StreamName == "" && sc.SQL == "" {
 		return errors.New("stream_name or sql must be provided")
@@ -108,9 +240,41 @@ func (sc *StreamConfig) Validate() error {
 		sc.SQL = "SELECT * FROM " + sc.StreamName
 	}
 
+	if sc.Incremental != nil && (sc.Incremental.Column == "" || sc.Incremental.Param == "") {
+		return errors.New("incremental needs a column and a param")
+	}
+
+	if p := sc.Partition; p != nil {
+		if p.Column == "" {
+			return errors.New("partition needs a column")
+		}
+		if (p.Count > 0) == (len(p.Ranges) > 0) {
+			return errors.New("partition needs a count or ranges, not both")
+		}
+	}
+
 	return nil
 }
 
+// BindWatermark sets the incremental param to the last value of the cursor,
+// keeping the type it was given in params
+func (sc *StreamConfig) BindWatermark(value string) {
+	if sc.Params == nil {
+		sc.Params = make(map[string]Param)
+	}
+	p, found := sc.Params[sc.Incremental.Param]
+	if p.Type == "" {
+		p.Type = "TEXT"
+	}
+	p.Value = value
+	sc.Params[sc.Incremental.Param] = p
+
+	if !found {
+		sc.ParamKeys = append(sc.ParamKeys, sc.Incremental.Param)
+		SortKeys(sc.ParamKeys)
+	}
+}
+
 func (sc *StreamConfig) OverrideValues(cliArgs *StreamConfig) {
 	if cliArgs.StreamName != "" {
 		sc.StreamName = cliArgs.StreamName
@@ -132,6 +296,10 @@ func (sc *StreamConfig) OverrideValues(cliArgs *StreamConfig) {
 		sc.Compression = cliArgs.Compression
 	}
 
+	if cliArgs.CompressionLevel != 0 {
+		sc.CompressionLevel = cliArgs.CompressionLevel
+	}
+
 	if cliArgs.BatchSize != 0 {
 		sc.BatchSize = cliArgs.BatchSize
 	}
@@ -143,6 +311,38 @@ func (sc *StreamConfig) OverrideValues(cliArgs *StreamConfig) {
 	if len(cliArgs.Params) > 0 {
 		sc.Params = cliArgs.Params
 	}
+
+	if cliArgs.DestTable != "" {
+		sc.DestTable = cliArgs.DestTable
+	}
+
+	if cliArgs.Mode != "" {
+		sc.Mode = cliArgs.Mode
+	}
+
+	if cliArgs.CSV != nil {
+		sc.CSV = cliArgs.CSV
+	}
+
+	if cliArgs.FixedWidth != nil {
+		sc.FixedWidth = cliArgs.FixedWidth
+	}
+
+	if cliArgs.Parquet != nil {
+		sc.Parquet = cliArgs.Parquet
+	}
+
+	if cliArgs.Arrow != nil {
+		sc.Arrow = cliArgs.Arrow
+	}
+
+	if cliArgs.Incremental != nil {
+		sc.Incremental = cliArgs.Incremental
+	}
+
+	if cliArgs.Partition != nil {
+		sc.Partition = cliArgs.Partition
+	}
 }
 
 func ParseAndExecuteTemplate(data []byte, config *StreamConfig) ([]byte, error) {
@@ -163,13 +363,43 @@ func ext(config *StreamConfig) string {
 	var ext string
 	switch strings.ToLower(config.Format) {
 	case "arrow":
-		ext = ".arrow"
+		// only the file format has the footer of .arrow
+		ext = ".arrows"
+		if config.Arrow != nil && strings.ToLower(config.Arrow.IPCFormat) == "file" {
+			ext = ".arrow"
+		}
+		// these compress the buffers inside the file
+		switch strings.ToLower(config.Compression) {
+		case "lz4", "zstd":
+			return ext
+		}
 	case "csv":
 		ext = ".csv"
+	case "tsv":
+		ext = ".tsv"
+	case "fixedwidth":
+		ext = ".txt"
 	case "jsonl":
 		ext = ".jsonl"
 	case "parquet":
-		ext = ".parquet"
+		// the codec is inside the file, named the way spark does
+		switch strings.ToLower(config.Compression) {
+		case "snappy", "zstd", "lz4", "brotli":
+			return "." + strings.ToLower(config.Compression) + ".parquet"
+		case "gzip":
+			return ".gz.parquet"
+		}
+		return ".parquet"
+	case "avro":
+		// the codec is inside the file, not around it
+		return ".avro"
+	case "orc":
+		return ".orc"
+	case "xlsx":
+		return ".xlsx"
+	case "delta", "iceberg":
+		// a table is a directory
+		return ""
 	default:
 		ext = ""
 	}
@@ -177,7 +407,14 @@ func ext(config *StreamConfig) string {
 	case "gzip":
 		ext += ".gz"
 	case "snappy":
-		ext = ".snappy" + ext
+		// framed snappy
+		ext += ".sz"
+	case "zstd":
+		ext += ".zst"
+	case "lz4":
+		ext += ".lz4"
+	case "bzip2":
+		ext += ".bz2"
 	}
 
 	return ext
@@ -317,12 +554,18 @@ func (ds *DataStream) BatchesToWriter(ctx context.Context, writer BatchWriter) e
 			log.Trace().Msg("Context done")
 			return ctx.Err()
 		default:
-			err := writer.WriteBatch(batch)
+			err := writeBatch(writer, batch)
+			if err == nil && ds.Watermark != nil {
+				err = ds.Watermark.ObserveBatch(batch)
+			}
+			if batch.Record != nil {
+				batch.Record.Release()
+			}
 			if err != nil {
 				return err
 			}
 			ds.Mux.Lock()
-			ds.TotalRows += len(batch.Rows)
+			ds.TotalRows += batch.Len()
 			ds.Mux.Unlock()
 		}
 		log.Trace().Int("total_rows", ds.TotalRows).Msg("Batch written")
@@ -331,6 +574,18 @@ func (ds *DataStream) BatchesToWriter(ctx context.Context, writer BatchWriter) e
 	return nil
 }
 
+// writeBatch gives a record to the writer as columns when it takes them and as
+// rows when it does not
+func writeBatch(writer BatchWriter, batch Batch) error {
+	if batch.Record == nil {
+		return writer.WriteBatch(batch)
+	}
+	if rw, ok := writer.(RecordWriter); ok {
+		return rw.WriteRecord(batch.Record)
+	}
+	return writer.WriteBatch(Batch{Rows: RecordRows(batch.Record)})
+}
+
 // TypeAlias corrects for the various ways that Postgres types are named
 // the goal is to only have the name column from this table https://www.postgresql.org/docs/current/datatype.html#DATATYPE-TABLE
 func TypeAlias(columnType string) string {
@@ -382,8 +637,52 @@ func OverrideColumns(original []Column, overrides []Column) []Column {
 			if overrideCol.Precision != 0 {
 				original[i].Precision = overrideCol.Precision
 			}
+			if len(overrideCol.Fields) > 0 {
+				original[i].Fields = normalizeFields(overrideCol.Fields)
+				// fields on a JSON column make it a struct
+				if overrideCol.Type == "" && !IsList(original[i]) {
+					original[i].Type = "STRUCT"
+				}
+			}
 		}
 	}
 
 	return original
 }
+
+// normalizeFields aliases the types of the struct fields like the columns themselves
+func normalizeFields(fields []Column) []Column {
+	normalized := make([]Column, len(fields))
+	for i, field := range fields {
+		normalized[i] = field
+		normalized[i].Type = TypeAlias(strings.ToUpper(field.Type))
+		if normalized[i].Type == "" {
+			normalized[i].Type = "TEXT"
+		}
+		if len(field.Fields) > 0 {
+			normalized[i].Fields = normalizeFields(field.Fields)
+			if field.Type == "" {
+				normalized[i].Type = "STRUCT"
+			}
+		}
+	}
+	return normalized
+}
+
+// IsList is true for array columns, postgres names them with a leading underscore like _INT4
+func IsList(col Column) bool {
+	return strings.HasPrefix(col.Type, "_")
+}
+
+// IsStruct is true for columns with a schema of fields
+func IsStruct(col Column) bool {
+	return !IsList(col) && len(col.Fields) > 0
+}
+
+// ListElement is the column of the elements of a list
+func ListElement(col Column) Column {
+	element := col
+	element.Name = "element"
+	element.Type = TypeAlias(strings.TrimPrefix(col.Type, "_"))
+	return element
+}
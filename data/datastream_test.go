@@ -65,6 +65,7 @@ params:
 }
 
 func TestBuildConfig(t *testing.T) {
+	disabled, emptyNull := false, ""
 	tests := []struct {
 		name           string
 		inputData      []byte
@@ -143,6 +144,70 @@ batch_size: 1000`),
 			},
 			expectError: false,
 		},
+		{
+			name: "Database Destination",
+			inputData: []byte(`
+stream_name: "public.users"
+dest_table: "staging.users"
+mode: "append"`),
+			cliArgs: &StreamConfig{
+				Mode: "swap",
+			},
+			expectedConfig: &StreamConfig{
+				StreamName: "public.users",
+				DestTable:  "staging.users",
+				Mode:       "swap",
+			},
+			expectError: false,
+		},
+		{
+			name: "CSV Dialect",
+			inputData: []byte(`
+stream_name: "public.users"
+format: "csv"
+csv:
+  delimiter: pipe
+  header: false
+  null_value: ""
+  line_terminator: crlf`),
+			cliArgs: &StreamConfig{},
+			expectedConfig: &StreamConfig{
+				StreamName: "public.users",
+				Format:     "csv",
+				CSV:        &CSVOptions{Delimiter: "pipe", Header: &disabled, NullValue: &emptyNull, LineTerminator: "crlf"},
+			},
+			expectError: false,
+		},
+		{
+			name: "Parquet Options",
+			inputData: []byte(`
+stream_name: "public.users"
+format: "parquet"
+compression: zstd
+compression_level: 9
+parquet:
+  row_group_rows: 1000000
+  row_group_bytes: 134217728
+  dictionary: false
+  dictionary_columns:
+    status: true
+  page_statistics: true`),
+			cliArgs: &StreamConfig{CompressionLevel: 3},
+			expectedConfig: &StreamConfig{
+				StreamName:       "public.users",
+				Format:           "parquet",
+				Compression:      "zstd",
+				CompressionLevel: 3,
+				Parquet: &ParquetOptions{
+					RowGroupRows:      1000000,
+					RowGroupBytes:     134217728,
+					Dictionary:        &disabled,
+					DictionaryColumns: map[string]bool{"status": true},
+					PageStatistics:    true,
+				},
+			},
+			expectError: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -162,6 +227,11 @@ batch_size: 1000`),
 				assert.Equal(t, tt.expectedConfig.Compression, config.Compression)
 				assert.Equal(t, tt.expectedConfig.Columns, config.Columns)
 				assert.Equal(t, tt.expectedConfig.BatchSize, config.BatchSize)
+				assert.Equal(t, tt.expectedConfig.DestTable, config.DestTable)
+				assert.Equal(t, tt.expectedConfig.Mode, config.Mode)
+				assert.DeepEqual(t, tt.expectedConfig.CSV, config.CSV)
+				assert.Equal(t, tt.expectedConfig.CompressionLevel, config.CompressionLevel)
+				assert.DeepEqual(t, tt.expectedConfig.Parquet, config.Parquet)
 
 				// Add more field assertions as necessary
 			}
@@ -207,6 +277,62 @@ func Test_CustomFilename(t *testing.T) {
 			},
 			expectedFilename: "folder/file.csv.gz",
 		},
+		{
+			name: "ext for jsonl with zstd",
+			cliArgs: &StreamConfig{
+				Format:      "jsonl",
+				Compression: "zstd",
+				Filename:    "folder/file{{ext}}",
+			},
+			expectedFilename: "folder/file.jsonl.zst",
+		},
+		{
+			name: "ext for arrow file with zstd",
+			cliArgs: &StreamConfig{
+				Format:      "arrow",
+				Compression: "zstd",
+				Filename:    "folder/file{{ext}}",
+				Arrow:       &ArrowOptions{IPCFormat: "file"},
+			},
+			expectedFilename: "folder/file.arrow",
+		},
+		{
+			name: "ext for arrow stream with gzip",
+			cliArgs: &StreamConfig{
+				Format:      "arrow",
+				Compression: "gzip",
+				Filename:    "folder/file{{ext}}",
+				Arrow:       &ArrowOptions{IPCFormat: "stream"},
+			},
+			expectedFilename: "folder/file.arrows.gz",
+		},
+		{
+			name: "ext for arrow with snappy is the stream format",
+			cliArgs: &StreamConfig{
+				Format:      "arrow",
+				Compression: "snappy",
+				Filename:    "folder/file{{ext}}",
+			},
+			expectedFilename: "folder/file.arrows.sz",
+		},
+		{
+			name: "ext for csv with lz4 and bzip2",
+			cliArgs: &StreamConfig{
+				Format:      "csv",
+				Compression: "bzip2",
+				Filename:    "folder/file{{ext}}.lz4",
+			},
+			expectedFilename: "folder/file.csv.bz2.lz4",
+		},
+		{
+			name: "ext for parquet with snappy",
+			cliArgs: &StreamConfig{
+				Format:      "parquet",
+				Compression: "snappy",
+				Filename:    "folder/file{{ext}}",
+			},
+			expectedFilename: "folder/file.snappy.parquet",
+		},
 		{
 			name: "ext for jsonl",
 			cliArgs: &StreamConfig{
@@ -215,6 +341,24 @@ func Test_CustomFilename(t *testing.T) {
 			},
 			expectedFilename: "folder/file.jsonl",
 		},
+		{
+			name: "ext for parquet with zstd",
+			cliArgs: &StreamConfig{
+				Format:      "parquet",
+				Compression: "zstd",
+				Filename:    "folder/file{{ext}}",
+			},
+			expectedFilename: "folder/file.zstd.parquet",
+		},
+		{
+			name: "ext for parquet with gzip",
+			cliArgs: &StreamConfig{
+				Format:      "parquet",
+				Compression: "gzip",
+				Filename:    "folder/file{{ext}}",
+			},
+			expectedFilename: "folder/file.gz.parquet",
+		},
 		{
 			name: "ext for parquet",
 			cliArgs: &StreamConfig{
@@ -223,6 +367,66 @@ func Test_CustomFilename(t *testing.T) {
 			},
 			expectedFilename: "folder/file.parquet",
 		},
+		{
+			name: "ext for avro ignores the codec",
+			cliArgs: &StreamConfig{
+				Format:      "avro",
+				Compression: "snappy",
+				Filename:    "folder/file{{ext}}",
+			},
+			expectedFilename: "folder/file.avro",
+		},
+		{
+			name: "ext for orc ignores the codec",
+			cliArgs: &StreamConfig{
+				Format:      "orc",
+				Compression: "zlib",
+				Filename:    "folder/file{{ext}}",
+			},
+			expectedFilename: "folder/file.orc",
+		},
+		{
+			name: "ext for xlsx",
+			cliArgs: &StreamConfig{
+				Format:   "xlsx",
+				Filename: "folder/file{{ext}}",
+			},
+			expectedFilename: "folder/file.xlsx",
+		},
+		{
+			name: "ext for fixedwidth",
+			cliArgs: &StreamConfig{
+				Format:   "fixedwidth",
+				Filename: "folder/file{{ext}}",
+			},
+			expectedFilename: "folder/file.txt",
+		},
+		{
+			name: "ext for tsv",
+			cliArgs: &StreamConfig{
+				Format:      "tsv",
+				Compression: "gzip",
+				Filename:    "folder/file{{ext}}",
+			},
+			expectedFilename: "folder/file.tsv.gz",
+		},
+		{
+			name: "delta tables have no ext",
+			cliArgs: &StreamConfig{
+				Format:      "delta",
+				Compression: "snappy",
+				Filename:    "tables/users{{ext}}",
+			},
+			expectedFilename: "tables/users",
+		},
+		{
+			name: "iceberg tables have no ext",
+			cliArgs: &StreamConfig{
+				Format:   "iceberg",
+				Filename: "tables/users{{ext}}",
+			},
+			expectedFilename: "tables/users",
+		},
 	}
 
 	for _, tt := range tests {
@@ -234,3 +438,65 @@ func Test_CustomFilename(t *testing.T) {
 		})
 	}
 }
+
+func TestOverrideColumnsNested(t *testing.T) {
+	original := []Column{
+		{Name: "tags", Type: "_TEXT"},
+		{Name: "address", Type: "JSONB"},
+		{Name: "points", Type: "_JSONB"},
+	}
+	overrides := []Column{
+		{Name: "address", Fields: []Column{
+			{Name: "city", Type: "text"},
+			{Name: "zip", Type: "int4"},
+			{Name: "geo", Fields: []Column{{Name: "lat", Type: "float8"}}},
+		}},
+		{Name: "points", Type: "_STRUCT", Fields: []Column{{Name: "x", Type: "int8"}}},
+	}
+
+	columns := OverrideColumns(original, overrides)
+
+	assert.True(t, IsList(columns[0]))
+	assert.Equal(t, Column{Name: "element", Type: "TEXT"}, ListElement(columns[0]))
+
+	assert.True(t, IsStruct(columns[1]))
+	assert.Equal(t, "STRUCT", columns[1].Type)
+	assert.Equal(t, "INTEGER", columns[1].Fields[1].Type)
+	assert.Equal(t, "STRUCT", columns[1].Fields[2].Type)
+	assert.Equal(t, "DOUBLE", columns[1].Fields[2].Fields[0].Type)
+
+	// a list of structs
+	assert.True(t, IsList(columns[2]))
+	assert.False(t, IsStruct(columns[2]))
+	element := ListElement(columns[2])
+	assert.True(t, IsStruct(element))
+	assert.Equal(t, "BIGINT", element.Fields[0].Type)
+}
+
+func TestBindWatermark(t *testing.T) {
+	sc := &StreamConfig{
+		StreamName:  "public.users",
+		Params:      map[string]Param{"P2": {Value: "true", Type: "BOOLEAN"}, "P1": {Value: "1", Type: "INT8"}},
+		ParamKeys:   []string{"P1", "P2"},
+		Incremental: &IncrementalOptions{Column: "id", Param: "P1"},
+	}
+	assert.NoError(t, sc.Validate())
+
+	// the type from params is kept
+	sc.BindWatermark("42")
+	assert.Equal(t, Param{Value: "42", Type: "INT8"}, sc.Params["P1"])
+	assert.DeepEqual(t, []string{"P1", "P2"}, sc.ParamKeys)
+
+	// a param that is not in params is text and takes its place in the order
+	sc.Incremental.Param = "P0"
+	sc.BindWatermark("2024-10-08T17:22:00Z")
+	assert.Equal(t, Param{Value: "2024-10-08T17:22:00Z", Type: "TEXT"}, sc.Params["P0"])
+	assert.DeepEqual(t, []string{"P0", "P1", "P2"}, sc.ParamKeys)
+
+	sc.Incremental.Column = ""
+	assert.Error(t, sc.Validate())
+
+	built, err := BuildConfig([]byte("stream_name: public.users\nincremental:\n  column: updated_at\n  param: P1\n  state: users.json\n"), &StreamConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, IncrementalOptions{Column: "updated_at", Param: "P1", State: "users.json"}, *built.Incremental)
+}
@@ -0,0 +1,94 @@
+package data
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Partition is one range of the partition column, a nil bound is open
+type Partition struct {
+	Lower any
+	Upper any
+	// Nulls adds the rows where the column is null
+	Nulls bool
+}
+
+// RangePartitions are the explicit ranges, bound as text for the database to convert
+func (opts *PartitionOptions) RangePartitions() []Partition {
+	partitions := make([]Partition, len(opts.Ranges))
+	for i, r := range opts.Ranges {
+		if r.Lower != "" {
+			partitions[i].Lower = r.Lower
+		}
+		if r.Upper != "" {
+			partitions[i].Upper = r.Upper
+		}
+	}
+	return partitions
+}
+
+// SplitPartitions splits the min to max of the column into count ranges of the
+// same width. The first and last are open so every row is in one of them, the
+// last has the nulls too.
+func SplitPartitions(lower, upper any, count int) ([]Partition, error) {
+	if lower == nil || upper == nil {
+		// no rows, or only nulls
+		return []Partition{{Nulls: true}}, nil
+	}
+
+	var bounds []any
+	switch lo := lower.(type) {
+	case time.Time:
+		hi, ok := upper.(time.Time)
+		if !ok {
+			return nil, fmt.Errorf("partition bounds %T and %T do not match", lower, upper)
+		}
+		step := hi.Sub(lo) / time.Duration(count)
+		for i := 1; i < count && step > 0; i++ {
+			bounds = append(bounds, lo.Add(step*time.Duration(i)))
+		}
+	default:
+		lo64, err := partitionInt(lower)
+		if err != nil {
+			return nil, err
+		}
+		hi64, err := partitionInt(upper)
+		if err != nil {
+			return nil, err
+		}
+		// the values are whole so there are never more ranges than values
+		span := uint64(hi64-lo64) + 1
+		step := max(span/uint64(count), 1)
+		if span%uint64(count) != 0 && span > uint64(count) {
+			step++
+		}
+		for i := 1; i < count; i++ {
+			b := lo64 + int64(step)*int64(i)
+			// past the max, or wrapped around
+			if b > hi64 || b <= lo64 {
+				break
+			}
+			bounds = append(bounds, b)
+		}
+	}
+
+	partitions := make([]Partition, len(bounds)+1)
+	for i, b := range bounds {
+		partitions[i].Upper = b
+		partitions[i+1].Lower = b
+	}
+	partitions[len(bounds)].Nulls = true
+	return partitions, nil
+}
+
+// partitionInt is the min or max of a whole number column, the drivers return many types for them
+func partitionInt(value any) (int64, error) {
+	if n, err := cursorValue(value); err == nil {
+		if v, ok := n.(decimal.Decimal); ok && v.IsInteger() && v.BigInt().IsInt64() {
+			return v.IntPart(), nil
+		}
+	}
+	return 0, fmt.Errorf("partition column must be a whole number or a timestamp, not %T %v, use ranges for other types", value, value)
+}
@@ -0,0 +1,72 @@
+package data
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/zeebo/assert"
+)
+
+func TestSplitPartitions(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		lower    any
+		upper    any
+		count    int
+		expected []Partition
+	}{
+		{name: "Empty", lower: nil, upper: nil, count: 4, expected: []Partition{{Nulls: true}}},
+		{name: "Even", lower: int64(1), upper: int64(100), count: 4, expected: []Partition{
+			{Upper: int64(26)}, {Lower: int64(26), Upper: int64(51)}, {Lower: int64(51), Upper: int64(76)}, {Lower: int64(76), Nulls: true},
+		}},
+		{name: "Uneven", lower: int32(1), upper: int32(10), count: 4, expected: []Partition{
+			{Upper: int64(4)}, {Lower: int64(4), Upper: int64(7)}, {Lower: int64(7), Upper: int64(10)}, {Lower: int64(10), Nulls: true},
+		}},
+		{name: "More ranges than values", lower: int64(5), upper: int64(6), count: 8, expected: []Partition{
+			{Upper: int64(6)}, {Lower: int64(6), Nulls: true},
+		}},
+		{name: "One value", lower: big.NewInt(7), upper: decimal.NewFromInt(7), count: 3, expected: []Partition{{Nulls: true}}},
+		{name: "Negative", lower: int64(-10), upper: int64(9), count: 2, expected: []Partition{
+			{Upper: int64(0)}, {Lower: int64(0), Nulls: true},
+		}},
+		{name: "Timestamps", lower: start, upper: start.Add(30 * time.Hour), count: 3, expected: []Partition{
+			{Upper: start.Add(10 * time.Hour)}, {Lower: start.Add(10 * time.Hour), Upper: start.Add(20 * time.Hour)}, {Lower: start.Add(20 * time.Hour), Nulls: true},
+		}},
+		{name: "Same timestamp", lower: start, upper: start, count: 3, expected: []Partition{{Nulls: true}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			partitions, err := SplitPartitions(tt.lower, tt.upper, tt.count)
+			assert.NoError(t, err)
+			assert.DeepEqual(t, tt.expected, partitions)
+		})
+	}
+}
+
+func TestSplitPartitionsErrors(t *testing.T) {
+	_, err := SplitPartitions(1.5, 10.5, 2)
+	assert.Error(t, err)
+	_, err = SplitPartitions(decimal.RequireFromString("1.5"), decimal.NewFromInt(10), 2)
+	assert.Error(t, err)
+	_, err = SplitPartitions(time.Now(), int64(1), 2)
+	assert.Error(t, err)
+}
+
+func TestRangePartitions(t *testing.T) {
+	opts := &PartitionOptions{Column: "id", Ranges: []PartitionRange{{Upper: "100"}, {Lower: "100", Upper: "200"}, {Lower: "200"}}}
+	assert.DeepEqual(t, []Partition{{Upper: "100"}, {Lower: "100", Upper: "200"}, {Lower: "200"}}, opts.RangePartitions())
+
+	sc := &StreamConfig{StreamName: "users", Partition: opts}
+	assert.NoError(t, sc.Validate())
+	opts.Count = 4
+	assert.Error(t, sc.Validate())
+	opts.Ranges = nil
+	assert.NoError(t, sc.Validate())
+	opts.Column = ""
+	assert.Error(t, sc.Validate())
+}
@@ -0,0 +1,120 @@
+package data
+
+import (
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// Len is the number of rows in the batch, whether it is rows or a record
+func (b Batch) Len() int {
+	if b.Record != nil {
+		return int(b.Record.NumRows())
+	}
+	return len(b.Rows)
+}
+
+// RecordRows is the row adapter for the writers that only take rows, the values
+// are the same ones ArrowValue gives
+func RecordRows(record arrow.RecordBatch) [][]any {
+	numRows := int(record.NumRows())
+	rows := make([][]any, numRows)
+	for i := range rows {
+		rows[i] = make([]any, record.NumCols())
+	}
+
+	for c, arr := range record.Columns() {
+		for i := 0; i < numRows; i++ {
+			rows[i][c] = ArrowValue(arr, i)
+		}
+	}
+	return rows
+}
+
+// ArrowValue is the value at i as the go type a database reader would give,
+// nil when it is null
+func ArrowValue(arr arrow.Array, i int) any {
+	if arr.IsNull(i) {
+		return nil
+	}
+
+	switch a := arr.(type) {
+	case array.ExtensionArray:
+		value := ArrowValue(a.Storage(), i)
+		if b, ok := value.([]byte); ok && a.ExtensionType().ExtensionName() == "arrow.uuid" {
+			if u, err := uuid.FromBytes(b); err == nil {
+				return u
+			}
+		}
+		return value
+	case *array.Dictionary:
+		return ArrowValue(a.Dictionary(), a.GetValueIndex(i))
+	case *array.Boolean:
+		return a.Value(i)
+	case *array.Int8:
+		return int16(a.Value(i))
+	case *array.Uint8:
+		return int16(a.Value(i))
+	case *array.Int16:
+		return a.Value(i)
+	case *array.Uint16:
+		return int32(a.Value(i))
+	case *array.Int32:
+		return a.Value(i)
+	case *array.Uint32:
+		return int64(a.Value(i))
+	case *array.Int64:
+		return a.Value(i)
+	case *array.Uint64:
+		return a.Value(i)
+	case *array.Float16:
+		return a.Value(i).Float32()
+	case *array.Float32:
+		return a.Value(i)
+	case *array.Float64:
+		return a.Value(i)
+	case *array.Decimal128:
+		return decimal.NewFromBigInt(a.Value(i).BigInt(), -a.DataType().(arrow.DecimalType).GetScale())
+	case *array.Decimal256:
+		return decimal.NewFromBigInt(a.Value(i).BigInt(), -a.DataType().(arrow.DecimalType).GetScale())
+	case *array.Date32:
+		return a.Value(i).ToTime()
+	case *array.Date64:
+		return a.Value(i).ToTime()
+	case *array.Timestamp:
+		unit := a.DataType().(*arrow.TimestampType).Unit
+		return a.Value(i).ToTime(unit).UTC()
+	case *array.String:
+		return a.Value(i)
+	case *array.LargeString:
+		return a.Value(i)
+	case *array.StringView:
+		return a.Value(i)
+	case *array.FixedSizeBinary:
+		return append([]byte(nil), a.Value(i)...)
+	case *array.Binary:
+		return append([]byte(nil), a.Value(i)...)
+	case *array.LargeBinary:
+		return append([]byte(nil), a.Value(i)...)
+	case *array.BinaryView:
+		return append([]byte(nil), a.Value(i)...)
+	case *array.List, *array.LargeList:
+		list := a.(array.ListLike)
+		start, end := list.ValueOffsets(i)
+		items := make([]any, 0, end-start)
+		for j := start; j < end; j++ {
+			items = append(items, ArrowValue(list.ListValues(), int(j)))
+		}
+		return items
+	case *array.Struct:
+		fields := a.DataType().(*arrow.StructType).Fields()
+		value := make(map[string]any, len(fields))
+		for j, field := range fields {
+			value[field.Name] = ArrowValue(a.Field(j), i)
+		}
+		return value
+	default:
+		return arr.ValueStr(i)
+	}
+}
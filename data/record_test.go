@@ -0,0 +1,128 @@
+package data
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/decimal128"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/shopspring/decimal"
+	"github.com/zeebo/assert"
+)
+
+func testRecord(mem memory.Allocator) arrow.RecordBatch {
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "id", Type: arrow.PrimitiveTypes.Int64, Nullable: true},
+		{Name: "amount", Type: &arrow.Decimal128Type{Precision: 10, Scale: 2}, Nullable: true},
+		{Name: "updated_at", Type: &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}, Nullable: true},
+	}, nil)
+	rb := array.NewRecordBuilder(mem, schema)
+	defer rb.Release()
+
+	updated := time.Date(2024, 10, 8, 17, 22, 0, 0, time.UTC)
+	rb.Field(0).(*array.Int64Builder).AppendValues([]int64{1, 2, 3}, nil)
+	amounts := rb.Field(1).(*array.Decimal128Builder)
+	amounts.Append(decimal128.FromI64(1050))
+	amounts.AppendNull()
+	amounts.Append(decimal128.FromI64(-325))
+	rb.Field(2).(*array.TimestampBuilder).AppendValues([]arrow.Timestamp{arrow.Timestamp(updated.UnixMicro()), 0, arrow.Timestamp(updated.Add(time.Hour).UnixMicro())}, []bool{true, false, true})
+	return rb.NewRecordBatch()
+}
+
+type rowWriter struct {
+	rows [][]any
+}
+
+func (w *rowWriter) WriteBatch(batch Batch) error {
+	w.rows = append(w.rows, batch.Rows...)
+	return nil
+}
+
+type recordWriter struct {
+	rowWriter
+	records int
+}
+
+func (w *recordWriter) WriteRecord(record arrow.RecordBatch) error {
+	w.records++
+	return nil
+}
+
+func TestRecordRows(t *testing.T) {
+	record := testRecord(memory.DefaultAllocator)
+	defer record.Release()
+
+	updated := time.Date(2024, 10, 8, 17, 22, 0, 0, time.UTC)
+	rows := RecordRows(record)
+	assert.Equal(t, 3, Batch{Record: record}.Len())
+	assert.Equal(t, 3, len(rows))
+	assert.Equal(t, int64(1), rows[0][0])
+	assert.True(t, rows[0][1].(decimal.Decimal).Equal(decimal.RequireFromString("10.50")))
+	assert.Nil(t, rows[1][1])
+	assert.Nil(t, rows[1][2])
+	assert.Equal(t, updated, rows[0][2])
+}
+
+func TestBatchesToWriterRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		writer  BatchWriter
+		records int
+		rows    int
+	}{
+		{name: "Record writer", writer: &recordWriter{}, records: 2},
+		{name: "Rows from records", writer: &rowWriter{}, rows: 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := memory.NewCheckedAllocator(memory.DefaultAllocator)
+			defer mem.AssertSize(t, 0)
+
+			columns := []Column{{Name: "id"}, {Name: "amount"}, {Name: "updated_at"}}
+			watermark, err := NewWatermark("updated_at", columns)
+			assert.NoError(t, err)
+			ds := &DataStream{BatchChan: make(chan Batch, 2), Watermark: watermark}
+			ds.BatchChan <- Batch{Record: testRecord(mem)}
+			ds.BatchChan <- Batch{Record: testRecord(mem)}
+			close(ds.BatchChan)
+
+			// the writer releases the records
+			assert.NoError(t, ds.BatchesToWriter(context.Background(), tt.writer))
+			assert.Equal(t, 6, ds.TotalRows)
+			value, err := watermark.Value()
+			assert.NoError(t, err)
+			assert.Equal(t, "2024-10-08T18:22:00Z", value)
+			switch w := tt.writer.(type) {
+			case *recordWriter:
+				assert.Equal(t, tt.records, w.records)
+				assert.Equal(t, 0, len(w.rows))
+			case *rowWriter:
+				assert.Equal(t, tt.rows, len(w.rows))
+			}
+		})
+	}
+}
+
+func TestWatermarkDecimalRecord(t *testing.T) {
+	mem := memory.NewCheckedAllocator(memory.DefaultAllocator)
+	defer mem.AssertSize(t, 0)
+
+	schema := arrow.NewSchema([]arrow.Field{{Name: "id", Type: &arrow.Decimal128Type{Precision: 38, Scale: 0}, Nullable: true}}, nil)
+	rb := array.NewRecordBuilder(mem, schema)
+	defer rb.Release()
+	rb.Field(0).(*array.Decimal128Builder).Append(decimal128.FromI64(987654321))
+	record := rb.NewRecordBatch()
+	defer record.Release()
+
+	// a FIXED cursor read from ArrowBatches
+	watermark, err := NewWatermark("id", []Column{{Name: "id"}})
+	assert.NoError(t, err)
+	assert.NoError(t, watermark.ObserveBatch(Batch{Record: record}))
+	value, err := watermark.Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "987654321", value)
+}
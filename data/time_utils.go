@@ -1,5 +1,12 @@
 package data
 
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
 const (
 	RFC3339MicroNoTZ = "2006-01-02T15:04:05.999999"
 	RFC3339MicroTZ   = "2006-01-02T15:04:05.999999Z07:00"
@@ -32,3 +39,35 @@ func ConvertSQLServerUUID(sqlBytes []byte) []byte {
 
 	return converted
 }
+
+// ByteaToString matches the Postgres hex output for bytea
+func ByteaToString(value []byte) string {
+	return "\\x" + hex.EncodeToString(value)
+}
+
+// timestampLayouts are the text formats accepted when a timestamp has to be
+// parsed from a string, most specific first
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	RFC3339MicroNoTZ,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999-07",
+	// what time.Time.String() writes
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	time.DateOnly,
+}
+
+// ParseTimestamp parses the common text representations of a timestamp.
+// Values without a timezone are returned in UTC.
+func ParseTimestamp(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unable to parse timestamp: %s", value)
+}
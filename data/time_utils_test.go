@@ -0,0 +1,75 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zeebo/assert"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     string
+		expected  time.Time
+		expectErr bool
+	}{
+		{
+			name:     "RFC3339 with timezone",
+			value:    "2024-10-08T17:22:00Z",
+			expected: time.Date(2024, 10, 8, 17, 22, 0, 0, time.UTC),
+		},
+		{
+			name:     "RFC3339 with offset",
+			value:    "2024-10-08T13:22:00-04:00",
+			expected: time.Date(2024, 10, 8, 17, 22, 0, 0, time.UTC),
+		},
+		{
+			name:     "No timezone with micros",
+			value:    "2024-10-08T17:22:00.123456",
+			expected: time.Date(2024, 10, 8, 17, 22, 0, 123456000, time.UTC),
+		},
+		{
+			name:     "Space separated",
+			value:    "2024-10-08 17:22:00",
+			expected: time.Date(2024, 10, 8, 17, 22, 0, 0, time.UTC),
+		},
+		{
+			name:     "Postgres text output",
+			value:    "2024-10-08 17:22:00+00",
+			expected: time.Date(2024, 10, 8, 17, 22, 0, 0, time.UTC),
+		},
+		{
+			name:     "Go time string",
+			value:    "2024-10-08 00:00:00 +0000 UTC",
+			expected: time.Date(2024, 10, 8, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "Date only",
+			value:    "2024-10-08",
+			expected: time.Date(2024, 10, 8, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "Not a timestamp",
+			value:     "yesterday",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := ParseTimestamp(tt.value)
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, tt.expected.Equal(actual))
+		})
+	}
+}
+
+func TestByteaToString(t *testing.T) {
+	assert.Equal(t, "\\x", ByteaToString(nil))
+	assert.Equal(t, "\\x00ff10", ByteaToString([]byte{0, 255, 16}))
+}
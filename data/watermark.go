@@ -0,0 +1,157 @@
+package data
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Watermark is the largest value of the cursor column an incremental stream has written
+type Watermark struct {
+	Column string
+	index  int
+	value  any
+	mux    sync.Mutex
+}
+
+// NewWatermark finds the cursor column in the columns of the stream
+func NewWatermark(column string, columns []Column) (*Watermark, error) {
+	for i, col := range columns {
+		if strings.EqualFold(col.Name, column) {
+			return &Watermark{Column: col.Name, index: i}, nil
+		}
+	}
+	return nil, fmt.Errorf("incremental column %s is not in the stream", column)
+}
+
+// Observe keeps the largest cursor value of the rows, nulls are skipped
+func (w *Watermark) Observe(rows [][]any) error {
+	return w.observe(len(rows), func(i int) any { return rows[i][w.index] })
+}
+
+// ObserveBatch is Observe for rows or a record, only the cursor column of a
+// record is converted
+func (w *Watermark) ObserveBatch(batch Batch) error {
+	if batch.Record == nil {
+		return w.Observe(batch.Rows)
+	}
+	column := batch.Record.Column(w.index)
+	return w.observe(int(batch.Record.NumRows()), func(i int) any { return ArrowValue(column, i) })
+}
+
+func (w *Watermark) observe(n int, cursor func(i int) any) error {
+	var largest any
+	for i := range n {
+		value := cursor(i)
+		if value == nil {
+			continue
+		}
+		value, err := cursorValue(value)
+		if err != nil {
+			return fmt.Errorf("incremental column %s: %w", w.Column, err)
+		}
+		if largest == nil {
+			largest = value
+			continue
+		}
+		c, err := compareCursor(value, largest)
+		if err != nil {
+			return fmt.Errorf("incremental column %s: %w", w.Column, err)
+		}
+		if c > 0 {
+			largest = value
+		}
+	}
+	if largest == nil {
+		return nil
+	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.value != nil {
+		c, err := compareCursor(largest, w.value)
+		if err != nil {
+			return fmt.Errorf("incremental column %s: %w", w.Column, err)
+		}
+		if c <= 0 {
+			return nil
+		}
+	}
+	w.value = largest
+	return nil
+}
+
+// Value is the largest cursor value as text to bind on the next run, empty
+// when there were no rows
+func (w *Watermark) Value() (string, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	switch v := w.value.(type) {
+	case nil:
+		return "", nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case string:
+		return v, nil
+	case decimal.Decimal:
+		return v.String(), nil
+	default:
+		return "", fmt.Errorf("incremental column %s: %T values cannot be a cursor", w.Column, v)
+	}
+}
+
+// cursorValue keeps timestamps and text, every kind of whole number becomes a
+// decimal so ints, uints, big ints and NUMERIC ids compare with each other
+func cursorValue(value any) (any, error) {
+	switch v := value.(type) {
+	case time.Time, string, decimal.Decimal:
+		return v, nil
+	case *big.Int:
+		return decimal.NewFromBigInt(v, 0), nil
+	case uint64:
+		return decimal.NewFromUint64(v), nil
+	case uint:
+		return decimal.NewFromUint64(uint64(v)), nil
+	case int:
+		return decimal.NewFromInt(int64(v)), nil
+	case int8:
+		return decimal.NewFromInt(int64(v)), nil
+	case int16:
+		return decimal.NewFromInt(int64(v)), nil
+	case int32:
+		return decimal.NewFromInt(int64(v)), nil
+	case int64:
+		return decimal.NewFromInt(v), nil
+	case uint8:
+		return decimal.NewFromInt(int64(v)), nil
+	case uint16:
+		return decimal.NewFromInt(int64(v)), nil
+	case uint32:
+		return decimal.NewFromInt(int64(v)), nil
+	default:
+		return nil, fmt.Errorf("%T values cannot be a cursor", value)
+	}
+}
+
+// compareCursor compares two values from cursorValue
+func compareCursor(a, b any) (int, error) {
+	switch x := a.(type) {
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			return x.Compare(y), nil
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), nil
+		}
+	case decimal.Decimal:
+		if y, ok := b.(decimal.Decimal); ok {
+			return x.Cmp(y), nil
+		}
+	}
+	return 0, fmt.Errorf("%T values cannot be compared with %T", a, b)
+}
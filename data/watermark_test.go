@@ -0,0 +1,62 @@
+package data
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/zeebo/assert"
+)
+
+func TestWatermark(t *testing.T) {
+	earlier := time.Date(2024, 10, 8, 17, 22, 0, 0, time.UTC)
+	later := earlier.Add(90 * time.Minute).Add(123 * time.Microsecond)
+
+	tests := []struct {
+		name     string
+		batches  [][][]any
+		expected string
+	}{
+		{name: "No rows", batches: nil, expected: ""},
+		{name: "Only nulls", batches: [][][]any{{{nil, "a"}}}, expected: ""},
+		{name: "Timestamps", batches: [][][]any{{{later, "a"}, {nil, "b"}}, {{earlier, "c"}}}, expected: "2024-10-08T18:52:00.000123Z"},
+		{name: "Ids across batches", batches: [][][]any{{{int64(3), "a"}}, {{int64(10), "b"}, {int64(7), "c"}}}, expected: "10"},
+		{name: "Small ids", batches: [][][]any{{{int32(9), "a"}, {int32(12), "b"}}}, expected: "12"},
+		{name: "Big ids", batches: [][][]any{{{big.NewInt(5), "a"}, {big.NewInt(50), "b"}}}, expected: "50"},
+		{name: "Unsigned ids", batches: [][][]any{{{uint64(18446744073709551615), "a"}, {uint64(7), "b"}}}, expected: "18446744073709551615"},
+		{name: "Decimal ids", batches: [][][]any{{{decimal.RequireFromString("99999999999999999999"), "a"}}, {{decimal.NewFromInt(42), "b"}}}, expected: "99999999999999999999"},
+		{name: "Single decimal", batches: [][][]any{{{decimal.NewFromInt(1234), "a"}}}, expected: "1234"},
+		{name: "Decimals and ints", batches: [][][]any{{{int64(5), "a"}}, {{decimal.NewFromInt(6), "b"}}}, expected: "6"},
+		{name: "Text", batches: [][][]any{{{"2024-01-02", "a"}, {"2024-01-10", "b"}}}, expected: "2024-01-10"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := NewWatermark("UPDATED_AT", []Column{{Name: "updated_at"}, {Name: "name"}})
+			assert.NoError(t, err)
+			assert.Equal(t, "updated_at", w.Column)
+			for _, batch := range tt.batches {
+				assert.NoError(t, w.Observe(batch))
+			}
+			value, err := w.Value()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, value)
+		})
+	}
+}
+
+func TestWatermarkErrors(t *testing.T) {
+	_, err := NewWatermark("missing", []Column{{Name: "id"}})
+	assert.Error(t, err)
+
+	w, err := NewWatermark("id", []Column{{Name: "id"}})
+	assert.NoError(t, err)
+	assert.Error(t, w.Observe([][]any{{int64(1)}, {"2"}}))
+	assert.Error(t, w.Observe([][]any{{1.5}, {2.5}}))
+	// a single value is checked even though it is not compared
+	assert.Error(t, w.Observe([][]any{{1.5}}))
+	// a batch is compared with the batches before it too
+	assert.NoError(t, w.Observe([][]any{{int64(1)}}))
+	assert.Error(t, w.Observe([][]any{{time.Now()}}))
+}
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 	"net/url"
+	"slices"
 
 	"github.com/johanan/mvr/data"
 	_ "github.com/microsoft/go-mssqldb"
@@ -34,12 +35,7 @@ func (reader *MSDataReader) CreateDataStream(ctx context.Context, connUrl *url.U
 	col_query := "SELECT * FROM (" + config.SQL + ") as sub ORDER BY (SELECT NULL) OFFSET 0 ROWS FETCH NEXT 1 ROWS ONLY"
 	log.Debug().Str("sql", col_query).Msg("Getting columns")
 
-	paramValues := BuildParams(config)
-	sqlParams := make([]interface{}, 0, len(config.ParamKeys))
-	for i, key := range config.ParamKeys {
-		sqlParams = append(sqlParams, sql.Named(key, paramValues[i]))
-	}
-	rows, err := reader.Conn.QueryContext(ctx, col_query, sqlParams...)
+	rows, err := reader.Conn.QueryContext(ctx, col_query, msParams(config)...)
 	if err != nil {
 		return nil, err
 	}
@@ -64,34 +60,47 @@ func (reader *MSDataReader) CreateDataStream(ctx context.Context, connUrl *url.U
 }
 
 func (reader *MSDataReader) ExecuteDataStream(ctx context.Context, ds *DataStream, config *data.StreamConfig) error {
-	log.Debug().Str("sql", config.SQL).Msg("Executing data stream")
-	paramValues := BuildParams(config)
-	sqlParams := make([]interface{}, 0, len(config.ParamKeys))
-	for i, key := range config.ParamKeys {
-		sqlParams = append(sqlParams, sql.Named(key, paramValues[i]))
-	}
-	rows, err := reader.Conn.QueryContext(ctx, config.SQL, sqlParams...)
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-
-	batch := Batch{Rows: make([][]any, 0, ds.BatchSize)}
 	defer func() {
 		close(ds.BatchChan)
 		log.Debug().Msg("Closed batch channel")
 	}()
 
-	for rows.Next() {
-		row := make([]any, len(ds.Columns))
-		rowPtrs := make([]any, len(ds.Columns))
-		for i := range row {
-			rowPtrs[i] = &row[i]
-		}
-		if err := rows.Scan(rowPtrs...); err != nil {
-			return fmt.Errorf("failed to scan row: %w", err)
+	sqlParams := msParams(config)
+	if config.Partition == nil {
+		log.Debug().Str("sql", config.SQL).Msg("Executing data stream")
+		return reader.readQuery(ctx, ds, config.SQL, sqlParams)
+	}
+
+	column := config.Partition.Column
+	partitions, err := partitionsFor(config.Partition, func() (lower, upper any, err error) {
+		err = reader.Conn.QueryRowContext(ctx, boundsSQL(config.SQL, column), sqlParams...).Scan(&lower, &upper)
+		return lower, upper, err
+	})
+	if err != nil {
+		return err
+	}
+	return readPartitions(ctx, partitions, func(ctx context.Context, p data.Partition) error {
+		query, bounds := partitionSQL(config.SQL, column, p, func(n int) string {
+			return fmt.Sprintf("@mvr_bound_%d", n)
+		})
+		log.Debug().Str("sql", query).Interface("bounds", bounds).Msg("Executing partition")
+		args := slices.Clone(sqlParams)
+		for n, bound := range bounds {
+			args = append(args, sql.Named(fmt.Sprintf("mvr_bound_%d", n), bound))
 		}
+		return reader.readQuery(ctx, ds, query, args)
+	})
+}
+
+// readQuery sends the rows of one query to the stream
+func (reader *MSDataReader) readQuery(ctx context.Context, ds *DataStream, query string, args []any) error {
+	rows, err := reader.Conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 
+	return sendRows(ctx, rows, ds, func(row []any) {
 		// fix MS SQL Server wrong endianness for UUID
 		for i, col := range ds.DestColumns {
 			if !reader.KeepOriginalUUID && col.Type == "UUID" {
@@ -105,33 +114,17 @@ func (reader *MSDataReader) ExecuteDataStream(ctx context.Context, ds *DataStrea
 				}
 			}
 		}
+	})
+}
 
-		batch.Rows = append(batch.Rows, row)
-
-		if len(batch.Rows) >= ds.BatchSize {
-			log.Trace().Msg("Sending batch")
-			select {
-			case ds.BatchChan <- batch:
-				batch = data.Batch{Rows: make([][]any, 0, ds.BatchSize)}
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		}
-	}
-
-	// Send any remaining rows
-	if len(batch.Rows) > 0 {
-		log.Trace().Msg("Sending remaining batch")
-		select {
-		case ds.BatchChan <- batch:
-		case <-ctx.Done():
-			return ctx.Err()
-		}
+// msParams are the params named by their keys
+func msParams(config *data.StreamConfig) []any {
+	paramValues := BuildParams(config)
+	sqlParams := make([]interface{}, 0, len(config.ParamKeys))
+	for i, key := range config.ParamKeys {
+		sqlParams = append(sqlParams, sql.Named(key, paramValues[i]))
 	}
-
-	log.Debug().Msg("Finished reading rows")
-
-	return nil
+	return sqlParams
 }
 
 func msColumnsToPg(columns []Column) []Column {
@@ -0,0 +1,438 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/johanan/mvr/data"
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cast"
+)
+
+// MSDataWriter loads a DataStream into a SQL Server table with bulk copy. Every
+// batch writer runs its own bulk copy in its own transaction.
+type MSDataWriter struct {
+	ctx              context.Context
+	conn             *sql.DB
+	datastream       *data.DataStream
+	mode             string
+	tableName        string
+	table            string
+	loadTable        string
+	identity         bool
+	columns          []string
+	KeepOriginalUUID bool
+	mux              sync.Mutex
+	closed           bool
+}
+
+type MSBatchWriter struct {
+	dataWriter *MSDataWriter
+}
+
+func NewMSDataWriter(ctx context.Context, connUrl *url.URL, datastream *data.DataStream, config *data.StreamConfig) (*MSDataWriter, error) {
+	tableName := config.GetDestTable()
+	if tableName == "" {
+		return nil, errors.New("dest_table or stream_name is required for a sqlserver destination")
+	}
+
+	db, err := sql.Open("sqlserver", connUrl.String())
+	if err != nil {
+		return nil, err
+	}
+
+	writer := &MSDataWriter{
+		ctx:              ctx,
+		conn:             db,
+		datastream:       datastream,
+		mode:             config.GetMode(),
+		tableName:        tableName,
+		table:            msIdentifier(tableName),
+		KeepOriginalUUID: connUrl.Query().Get("KeepOriginalUUID") == "true",
+	}
+	writer.loadTable = writer.table
+
+	if err := writer.prepare(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+// prepare creates or validates the target table and gets it ready for the mode
+func (w *MSDataWriter) prepare() error {
+	existing, err := w.tableColumns()
+	if err != nil {
+		return err
+	}
+
+	switch w.mode {
+	case "append":
+	case "create":
+		if existing != nil {
+			return fmt.Errorf("table %s already exists", w.table)
+		}
+	case "truncate", "replace":
+		// the rows are loaded into a staging table that takes the place of the rows
+		// or the table on Close, so a failed run leaves the table as it was
+		if existing != nil || w.mode == "replace" {
+			w.loadTable = msIdentifier(w.tableName + "_mvr_staging")
+			if _, err := w.conn.ExecContext(w.ctx, "DROP TABLE IF EXISTS "+w.loadTable); err != nil {
+				return fmt.Errorf("failed to drop staging table %s: %w", w.loadTable, err)
+			}
+		}
+		if w.mode == "replace" {
+			existing = nil
+		}
+	default:
+		return fmt.Errorf("unsupported mode for sqlserver: %s", w.mode)
+	}
+
+	if existing == nil {
+		log.Debug().Str("table", w.loadTable).Msg("Creating table")
+		if _, err := w.conn.ExecContext(w.ctx, msCreateTable(w.loadTable, w.datastream.DestColumns)); err != nil {
+			return fmt.Errorf("failed to create table %s: %w", w.loadTable, err)
+		}
+		for _, col := range w.datastream.DestColumns {
+			w.columns = append(w.columns, col.Name)
+		}
+		return nil
+	}
+
+	// bulk copy matches names exactly, so use the names the table has
+	var missing []string
+	for _, col := range w.datastream.DestColumns {
+		name, ok := existing[strings.ToLower(col.Name)]
+		if !ok {
+			missing = append(missing, col.Name)
+			continue
+		}
+		w.columns = append(w.columns, name)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("table %s is missing columns: %s", w.table, strings.Join(missing, ", "))
+	}
+
+	if w.loadTable != w.table {
+		log.Debug().Str("table", w.loadTable).Msg("Creating staging table")
+		if _, err := w.conn.ExecContext(w.ctx, "SELECT TOP 0 * INTO "+w.loadTable+" FROM "+w.table); err != nil {
+			return fmt.Errorf("failed to create staging table %s: %w", w.loadTable, err)
+		}
+		// an identity column that is loaded is numbered by the staging table, the
+		// same way the truncated table would number it, so its values are kept
+		var identity sql.NullString
+		if err := w.conn.QueryRowContext(w.ctx, "SELECT MAX(name) FROM sys.identity_columns WHERE object_id = OBJECT_ID(@p1)", w.table).Scan(&identity); err != nil {
+			return fmt.Errorf("failed to look up table %s: %w", w.table, err)
+		}
+		w.identity = identity.Valid && slices.Contains(w.columns, identity.String)
+	}
+	return nil
+}
+
+// tableColumns returns the lower cased column names of the table, or nil if it does not exist
+func (w *MSDataWriter) tableColumns() (map[string]string, error) {
+	var objectID sql.NullInt64
+	if err := w.conn.QueryRowContext(w.ctx, "SELECT OBJECT_ID(@p1, 'U')", w.table).Scan(&objectID); err != nil {
+		return nil, fmt.Errorf("failed to look up table %s: %w", w.table, err)
+	}
+	if !objectID.Valid {
+		return nil, nil
+	}
+
+	rows, err := w.conn.QueryContext(w.ctx, "SELECT name FROM sys.columns WHERE object_id = @p1", objectID.Int64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up columns for %s: %w", w.table, err)
+	}
+	defer rows.Close()
+
+	columns := make(map[string]string)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to look up columns for %s: %w", w.table, err)
+		}
+		columns[strings.ToLower(name)] = name
+	}
+	return columns, rows.Err()
+}
+
+func (w *MSDataWriter) CreateBatchWriter() data.BatchWriter {
+	return &MSBatchWriter{dataWriter: w}
+}
+
+func (bw *MSBatchWriter) WriteBatch(batch data.Batch) error {
+	w := bw.dataWriter
+	tx, err := w.conn.BeginTx(w.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start bulk copy into %s: %w", w.table, err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(w.ctx, mssql.CopyIn(w.loadTable, mssql.BulkOptions{}, w.columns...))
+	if err != nil {
+		return fmt.Errorf("failed to start bulk copy into %s: %w", w.loadTable, err)
+	}
+	defer stmt.Close()
+
+	for _, row := range batch.Rows {
+		values := make([]any, len(row))
+		for j, col := range w.datastream.DestColumns {
+			value, err := msValue(row[j], col, w.KeepOriginalUUID)
+			if err != nil {
+				return fmt.Errorf("failed to convert column %s: %w", col.Name, err)
+			}
+			values[j] = value
+		}
+		if _, err := stmt.ExecContext(w.ctx, values...); err != nil {
+			return fmt.Errorf("failed to copy into %s: %w", w.loadTable, err)
+		}
+	}
+
+	// an empty exec sends the rows
+	result, err := stmt.ExecContext(w.ctx)
+	if err != nil {
+		return fmt.Errorf("failed to copy into %s: %w", w.loadTable, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit bulk copy into %s: %w", w.loadTable, err)
+	}
+
+	copied, _ := result.RowsAffected()
+	log.Trace().Int64("rows", copied).Msg("Copied batch")
+	return nil
+}
+
+func (w *MSDataWriter) Flush() error {
+	return nil
+}
+
+// Close moves the staging table in when the mode is truncate or replace
+func (w *MSDataWriter) Close() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.conn.Close()
+
+	if w.loadTable == w.table {
+		return nil
+	}
+
+	tx, err := w.conn.BeginTx(w.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start swap: %w", err)
+	}
+	defer tx.Rollback()
+
+	var statements []string
+	switch w.mode {
+	case "truncate":
+		columns := make([]string, len(w.columns))
+		for i, name := range w.columns {
+			columns[i] = msIdentifier(name)
+		}
+		insert := "INSERT INTO " + w.table + " (" + strings.Join(columns, ", ") + ") SELECT " + strings.Join(columns, ", ") + " FROM " + w.loadTable
+		statements = append(statements, "TRUNCATE TABLE "+w.table)
+		if w.identity {
+			statements = append(statements, "SET IDENTITY_INSERT "+w.table+" ON", insert, "SET IDENTITY_INSERT "+w.table+" OFF")
+		} else {
+			statements = append(statements, insert)
+		}
+		statements = append(statements, "DROP TABLE "+w.loadTable)
+	case "replace":
+		// sp_rename takes the new name without the schema or brackets
+		parts := strings.Split(w.tableName, ".")
+		statements = []string{
+			"DROP TABLE IF EXISTS " + w.table,
+			"EXEC sp_rename " + msString(w.loadTable) + ", " + msString(parts[len(parts)-1]),
+		}
+	}
+	for _, statement := range statements {
+		log.Debug().Str("sql", statement).Msg("Swapping table")
+		if _, err := tx.ExecContext(w.ctx, statement); err != nil {
+			return fmt.Errorf("failed to swap %s: %w", w.table, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Abort drops the staging table so a failed truncate or replace leaves the
+// target untouched, batches that already committed to the target stay in it
+func (w *MSDataWriter) Abort() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.conn.Close()
+
+	if w.loadTable == w.table {
+		log.Warn().Str("mode", w.mode).Str("table", w.table).Msg("Rows already copied are not rolled back")
+		return nil
+	}
+
+	if _, err := w.conn.ExecContext(context.Background(), "DROP TABLE IF EXISTS "+w.loadTable); err != nil {
+		return fmt.Errorf("failed to drop staging table %s: %w", w.loadTable, err)
+	}
+	return nil
+}
+
+// msIdentifier quotes each part of a possibly schema qualified name
+func msIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = "[" + strings.ReplaceAll(part, "]", "]]") + "]"
+	}
+	return strings.Join(parts, ".")
+}
+
+// msString is a unicode string literal
+func msString(s string) string {
+	return "N'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func msCreateTable(table string, columns []data.Column) string {
+	defs := make([]string, len(columns))
+	for i, col := range columns {
+		defs[i] = msIdentifier(col.Name) + " " + msColumnType(col)
+	}
+	return "CREATE TABLE " + table + " (" + strings.Join(defs, ", ") + ")"
+}
+
+// msColumnType turns the abstract type back into SQL Server DDL, the other way from msColumnsToPg
+func msColumnType(col data.Column) string {
+	colType := data.TypeAlias(strings.ToUpper(col.Type))
+	switch colType {
+	case "BOOLEAN":
+		return "BIT"
+	case "INTEGER":
+		return "INT"
+	case "DOUBLE":
+		return "FLOAT"
+	case "NUMERIC":
+		if col.Precision > 0 {
+			return fmt.Sprintf("DECIMAL(%d, %d)", col.Precision, col.Scale)
+		}
+		// an unconstrained numeric would be DECIMAL(18, 0) and lose the fraction
+		return "DECIMAL(38, 18)"
+	case "UUID":
+		return "UNIQUEIDENTIFIER"
+	case "TIMESTAMP":
+		return "DATETIME2"
+	case "TIMESTAMPTZ":
+		return "DATETIMEOFFSET"
+	case "VARCHAR":
+		if col.Length > 0 && col.Length <= 4000 {
+			return fmt.Sprintf("NVARCHAR(%d)", col.Length)
+		}
+		return "NVARCHAR(MAX)"
+	case "BYTEA":
+		return "VARBINARY(MAX)"
+	// already SQL Server types when the source is SQL Server
+	case "SMALLINT", "BIGINT", "REAL", "DATE", "TINYINT", "FLOAT", "DATETIME", "DATETIME2", "SMALLDATETIME", "TIME", "MONEY", "SMALLMONEY":
+		return colType
+	default:
+		return "NVARCHAR(MAX)"
+	}
+}
+
+// msValue turns values into what bulk copy can encode for the column
+func msValue(value any, col data.Column, keepOriginalUUID bool) (any, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	switch data.TypeAlias(strings.ToUpper(col.Type)) {
+	case "BOOLEAN":
+		return cast.ToBoolE(value)
+	case "SMALLINT", "INTEGER", "BIGINT", "TINYINT":
+		// bulk copy only knows int, int32 and int64
+		return cast.ToInt64E(value)
+	case "REAL", "DOUBLE", "FLOAT":
+		return cast.ToFloat64E(value)
+	case "NUMERIC":
+		switch v := value.(type) {
+		case []byte:
+			// MS SQL hands back decimals as text
+			return string(v), nil
+		case *big.Float:
+			return v.Text('f', -1), nil
+		case *big.Int:
+			return v.String(), nil
+		}
+	case "UUID":
+		var id uuid.UUID
+		var err error
+		switch v := value.(type) {
+		case [16]byte:
+			id = uuid.UUID(v)
+		case uuid.UUID:
+			id = v
+		case []byte:
+			id, err = uuid.FromBytes(v)
+		case string:
+			id, err = uuid.Parse(v)
+		default:
+			return nil, fmt.Errorf("unsupported uuid value: %T", value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if keepOriginalUUID {
+			return id[:], nil
+		}
+		// undo the reader, SQL Server wants the first three groups little endian
+		return data.ConvertSQLServerUUID(id[:]), nil
+	case "BYTEA":
+		if v, ok := value.(string); ok && strings.HasPrefix(v, "\\x") {
+			return hex.DecodeString(v[2:])
+		}
+	case "DATE", "TIMESTAMP", "TIMESTAMPTZ", "DATETIME", "DATETIME2", "SMALLDATETIME":
+		if v, ok := value.(string); ok {
+			return data.ParseTimestamp(v)
+		}
+	default:
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case []byte:
+			return string(v), nil
+		case time.Time:
+			return v.Format(time.RFC3339Nano), nil
+		case map[string]any, []any:
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			return string(encoded), nil
+		}
+		if s, err := cast.ToStringE(value); err == nil {
+			return s, nil
+		}
+		// anything else, like arrays from postgres, goes in as JSON
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		return string(encoded), nil
+	}
+
+	return value, nil
+}
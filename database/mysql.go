@@ -0,0 +1,398 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/johanan/mvr/data"
+	"github.com/rs/zerolog/log"
+	"github.com/shopspring/decimal"
+	"github.com/spf13/cast"
+)
+
+type MySQLDataReader struct {
+	Conn *sql.DB
+}
+
+func NewMySQLDataReader(connUrl *url.URL) (*MySQLDataReader, error) {
+	if connUrl.Scheme != "mysql" {
+		return nil, errors.New("only mysql connections are supported")
+	}
+
+	db, err := sql.Open("mysql", mysqlDSN(connUrl))
+	if err != nil {
+		return nil, err
+	}
+
+	return &MySQLDataReader{Conn: db}, nil
+}
+
+// mysqlDSN builds the DSN from the parts of the url, the driver does not take one
+func mysqlDSN(connUrl *url.URL) string {
+	cfg := mysql.NewConfig()
+	cfg.User = connUrl.User.Username()
+	cfg.Passwd, _ = connUrl.User.Password()
+	cfg.Net = "tcp"
+	cfg.Addr = connUrl.Host
+	cfg.DBName = strings.TrimPrefix(connUrl.Path, "/")
+	cfg.ParseTime = true
+	// TIMESTAMP is shown in the session time zone and parsed as UTC, so the
+	// session has to be UTC for the values to be right
+	cfg.Params = map[string]string{"time_zone": "'+00:00'"}
+
+	dsn := cfg.FormatDSN()
+	if connUrl.RawQuery != "" {
+		// any driver options on the url are passed straight through
+		dsn += "&" + connUrl.RawQuery
+	}
+	return dsn
+}
+
+func (reader *MySQLDataReader) Close() error {
+	return reader.Conn.Close()
+}
+
+func (reader *MySQLDataReader) CreateDataStream(ctx context.Context, connUrl *url.URL, config *data.StreamConfig) (*DataStream, error) {
+	col_query := "SELECT * FROM (" + config.SQL + ") AS sub LIMIT 0"
+	log.Debug().Str("sql", col_query).Msg("Getting columns")
+
+	paramValues := BuildParams(config)
+	rows, err := reader.Conn.QueryContext(ctx, col_query, paramValues...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dbCols, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := MapToMvrColumns(dbCols)
+	// the driver does not report lengths, which is the only way to tell
+	// TINYINT(1) and BINARY(16) apart from their wider siblings
+	var lengths map[string]int64
+	if config.StreamName != "" {
+		lengths = reader.columnLengths(ctx, config.StreamName)
+	}
+	if len(lengths) == 0 {
+		lengths = reader.queryColumnLengths(ctx, config.SQL, paramValues)
+	}
+	for i, col := range columns {
+		if length, ok := lengths[strings.ToLower(col.Name)]; ok {
+			columns[i].Length = length
+		}
+	}
+
+	destColumns := mysqlColumnsToPg(columns)
+	srcColumns := mysqlColumnsToPg(columns)
+
+	if len(config.Columns) > 0 {
+		destColumns = data.OverrideColumns(destColumns, config.Columns)
+	}
+
+	batchChan := make(chan Batch, config.GetBatchCount())
+	logColumns(columns, destColumns)
+	return &DataStream{TotalRows: 0, BatchChan: batchChan, BatchSize: config.GetBatchSize(), Columns: srcColumns, DestColumns: destColumns}, nil
+}
+
+func (reader *MySQLDataReader) ExecuteDataStream(ctx context.Context, ds *DataStream, config *data.StreamConfig) error {
+	log.Debug().Str("sql", config.SQL).Msg("Executing data stream")
+	paramValues := BuildParams(config)
+	rows, err := reader.Conn.QueryContext(ctx, config.SQL, paramValues...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	batch := Batch{Rows: make([][]any, 0, ds.BatchSize)}
+	defer func() {
+		close(ds.BatchChan)
+		log.Debug().Msg("Closed batch channel")
+	}()
+
+	for rows.Next() {
+		row := make([]any, len(ds.Columns))
+		rowPtrs := make([]any, len(ds.Columns))
+		for i := range row {
+			rowPtrs[i] = &row[i]
+		}
+		if err := rows.Scan(rowPtrs...); err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		// the text protocol hands back most values as bytes
+		for i, col := range ds.DestColumns {
+			value, err := mysqlValue(row[i], col)
+			if err != nil {
+				return fmt.Errorf("failed to convert column %s: %w", col.Name, err)
+			}
+			row[i] = value
+		}
+
+		batch.Rows = append(batch.Rows, row)
+
+		if len(batch.Rows) >= ds.BatchSize {
+			log.Trace().Msg("Sending batch")
+			select {
+			case ds.BatchChan <- batch:
+				batch = data.Batch{Rows: make([][]any, 0, ds.BatchSize)}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Send any remaining rows
+	if len(batch.Rows) > 0 {
+		log.Trace().Msg("Sending remaining batch")
+		select {
+		case ds.BatchChan <- batch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	log.Debug().Msg("Finished reading rows")
+
+	return nil
+}
+
+func (reader *MySQLDataReader) ExecuteCommand(ctx context.Context, sqlCommand string) (string, error) {
+	result, err := reader.Conn.ExecContext(ctx, sqlCommand)
+	if err != nil {
+		return "", fmt.Errorf("failed to execute command: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return "", fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	return fmt.Sprintf("%d rows affected", affected), nil
+}
+
+// columnLengths looks up the declared column types for a table and returns the
+// display width or byte length of each column, ie tinyint(1) -> 1
+func (reader *MySQLDataReader) columnLengths(ctx context.Context, streamName string) map[string]int64 {
+	lengths := make(map[string]int64)
+
+	schema := ""
+	table := streamName
+	if parts := strings.SplitN(streamName, ".", 2); len(parts) == 2 {
+		schema = parts[0]
+		table = parts[1]
+	}
+
+	rows, err := reader.Conn.QueryContext(ctx,
+		"SELECT COLUMN_NAME, COLUMN_TYPE FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = COALESCE(NULLIF(?, ''), DATABASE()) AND TABLE_NAME = ?",
+		schema, table)
+	if err != nil {
+		log.Debug().Err(err).Str("stream_name", streamName).Msg("Failed to look up column types")
+		return lengths
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, columnType string
+		if err := rows.Scan(&name, &columnType); err != nil {
+			log.Debug().Err(err).Msg("Failed to scan column type")
+			return lengths
+		}
+		if length, ok := mysqlTypeLength(columnType); ok {
+			lengths[strings.ToLower(name)] = length
+		}
+	}
+
+	return lengths
+}
+
+// queryColumnLengths copies the columns of the query into an empty temporary
+// table to read their declared types, for queries that are not a single table
+func (reader *MySQLDataReader) queryColumnLengths(ctx context.Context, query string, params []any) map[string]int64 {
+	lengths := make(map[string]int64)
+
+	// a temporary table only exists on the connection that made it
+	conn, err := reader.Conn.Conn(ctx)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to look up column types")
+		return lengths
+	}
+	defer conn.Close()
+
+	create := "CREATE TEMPORARY TABLE mvr_columns AS SELECT * FROM (" + query + ") AS sub LIMIT 0"
+	if _, err := conn.ExecContext(ctx, create, params...); err != nil {
+		log.Debug().Err(err).Msg("Failed to look up column types")
+		return lengths
+	}
+	defer conn.ExecContext(context.Background(), "DROP TEMPORARY TABLE IF EXISTS mvr_columns")
+
+	rows, err := conn.QueryContext(ctx, "SHOW COLUMNS FROM mvr_columns")
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to look up column types")
+		return lengths
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		// Field, Type, Null, Key, Default and Extra
+		var name, columnType string
+		var rest [4]sql.RawBytes
+		if err := rows.Scan(&name, &columnType, &rest[0], &rest[1], &rest[2], &rest[3]); err != nil {
+			log.Debug().Err(err).Msg("Failed to scan column type")
+			return lengths
+		}
+		if length, ok := mysqlTypeLength(columnType); ok {
+			lengths[strings.ToLower(name)] = length
+		}
+	}
+
+	return lengths
+}
+
+// mysqlTypeLength is the display width or byte length of a column type, ie
+// tinyint(1) -> 1
+func mysqlTypeLength(columnType string) (int64, bool) {
+	start := strings.Index(columnType, "(")
+	end := strings.Index(columnType, ")")
+	if start == -1 || end < start {
+		return 0, false
+	}
+	// decimal(38,15) also matches, but precision and scale come from the driver
+	length, err := strconv.ParseInt(columnType[start+1:end], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return length, true
+}
+
+func mysqlValue(value any, col Column) (any, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	switch col.Type {
+	case "BOOLEAN":
+		switch v := value.(type) {
+		case []byte:
+			// BIT(1) comes back as a single byte
+			for _, b := range v {
+				if b != 0 {
+					return true, nil
+				}
+			}
+			return false, nil
+		default:
+			return cast.ToInt64(v) != 0, nil
+		}
+	case "SMALLINT", "INTEGER", "BIGINT":
+		switch v := value.(type) {
+		case []byte:
+			if col.DatabaseType == "BIT" {
+				var bits int64
+				for _, b := range v {
+					bits = bits<<8 | int64(b)
+				}
+				return bits, nil
+			}
+			return strconv.ParseInt(string(v), 10, 64)
+		default:
+			return cast.ToInt64E(v)
+		}
+	case "NUMERIC":
+		switch v := value.(type) {
+		case []byte:
+			return decimal.NewFromString(string(v))
+		case uint64:
+			return decimal.NewFromUint64(v), nil
+		case int64:
+			return decimal.NewFromInt(v), nil
+		default:
+			return value, nil
+		}
+	case "UUID":
+		return value, nil
+	case "BYTEA":
+		if v, ok := value.([]byte); ok {
+			return data.ByteaToString(v), nil
+		}
+		return value, nil
+	default:
+		if v, ok := value.([]byte); ok {
+			return string(v), nil
+		}
+		return value, nil
+	}
+}
+
+func mysqlColumnsToPg(columns []Column) []Column {
+	pgCols := make([]Column, len(columns))
+	copy(pgCols, columns)
+	for i, col := range pgCols {
+		pgCols[i].Type = col.DatabaseType
+		switch col.DatabaseType {
+		case "TINYINT":
+			// TINYINT(1) is how MySQL spells boolean
+			if col.Length == 1 {
+				pgCols[i].Type = "BOOLEAN"
+			} else {
+				pgCols[i].Type = "SMALLINT"
+			}
+		case "BIT":
+			if col.Length == 1 {
+				pgCols[i].Type = "BOOLEAN"
+			} else {
+				pgCols[i].Type = "BIGINT"
+			}
+		case "UNSIGNED TINYINT", "SMALLINT", "YEAR":
+			pgCols[i].Type = "SMALLINT"
+		case "UNSIGNED SMALLINT", "MEDIUMINT", "UNSIGNED MEDIUMINT", "INT":
+			pgCols[i].Type = "INTEGER"
+		case "UNSIGNED INT", "BIGINT":
+			pgCols[i].Type = "BIGINT"
+		case "UNSIGNED BIGINT":
+			// does not fit in a BIGINT
+			pgCols[i].Type = "NUMERIC"
+			pgCols[i].Precision = 20
+			pgCols[i].Scale = 0
+		case "DECIMAL":
+			pgCols[i].Type = "NUMERIC"
+			pgCols[i].Precision = col.Precision
+			pgCols[i].Scale = col.Scale
+		case "FLOAT":
+			pgCols[i].Type = "REAL"
+		case "DOUBLE":
+			pgCols[i].Type = "DOUBLE"
+		case "DATETIME":
+			pgCols[i].Type = "TIMESTAMP"
+		case "TIMESTAMP":
+			// MySQL stores TIMESTAMP as UTC and converts to the session time zone
+			pgCols[i].Type = "TIMESTAMPTZ"
+		case "JSON":
+			pgCols[i].Type = "JSONB"
+		case "BINARY":
+			if col.Length == 16 {
+				pgCols[i].Type = "UUID"
+			} else {
+				pgCols[i].Type = "BYTEA"
+			}
+		case "VARBINARY", "TINYBLOB", "BLOB", "MEDIUMBLOB", "LONGBLOB":
+			pgCols[i].Type = "BYTEA"
+		case "CHAR", "VARCHAR":
+			pgCols[i].Type = "VARCHAR"
+		case "TINYTEXT", "TEXT", "MEDIUMTEXT", "LONGTEXT", "ENUM", "SET":
+			pgCols[i].Type = "TEXT"
+		}
+	}
+	return pgCols
+}
@@ -0,0 +1,133 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/johanan/mvr/data"
+	"github.com/rs/zerolog/log"
+)
+
+// rowScanner is what pgx and database/sql rows have in common
+type rowScanner interface {
+	Next() bool
+	Scan(dest ...any) error
+	Err() error
+}
+
+// sendRows scans the rows into batches on the channel, it is left open for
+// the other partitions. fix changes a row in place before it is sent.
+func sendRows(ctx context.Context, rows rowScanner, ds *DataStream, fix func(row []any)) error {
+	batch := Batch{Rows: make([][]any, 0, ds.BatchSize)}
+	for rows.Next() {
+		row := make([]any, len(ds.Columns))
+		rowPtrs := make([]any, len(ds.Columns))
+		for i := range row {
+			rowPtrs[i] = &row[i]
+		}
+		if err := rows.Scan(rowPtrs...); err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		if fix != nil {
+			fix(row)
+		}
+
+		batch.Rows = append(batch.Rows, row)
+
+		if len(batch.Rows) >= ds.BatchSize {
+			log.Trace().Msg("Sending batch")
+			select {
+			case ds.BatchChan <- batch:
+				batch = data.Batch{Rows: make([][]any, 0, ds.BatchSize)}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Send any remaining rows
+	if len(batch.Rows) > 0 {
+		log.Trace().Msg("Sending remaining batch")
+		select {
+		case ds.BatchChan <- batch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	log.Debug().Msg("Finished reading rows")
+	return nil
+}
+
+// boundsSQL finds the min and max of the partition column
+func boundsSQL(query, column string) string {
+	return fmt.Sprintf("SELECT MIN(%s), MAX(%s) FROM (%s) AS mvr_bounds", column, column, query)
+}
+
+// partitionsFor are the explicit ranges, or count ranges between the bounds
+func partitionsFor(opts *data.PartitionOptions, bounds func() (any, any, error)) ([]data.Partition, error) {
+	if len(opts.Ranges) > 0 {
+		return opts.RangePartitions(), nil
+	}
+	lower, upper, err := bounds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the partition bounds: %w", err)
+	}
+	log.Debug().Interface("min", lower).Interface("max", upper).Msg("Partition bounds")
+	return data.SplitPartitions(lower, upper, opts.Count)
+}
+
+// partitionSQL bounds the query to one partition, marker is the bind marker of
+// the nth bound which come after the params of the query
+func partitionSQL(query, column string, p data.Partition, marker func(n int) string) (string, []any) {
+	var conditions []string
+	var bounds []any
+	if p.Lower != nil {
+		conditions = append(conditions, fmt.Sprintf("%s >= %s", column, marker(len(bounds))))
+		bounds = append(bounds, p.Lower)
+	}
+	if p.Upper != nil {
+		conditions = append(conditions, fmt.Sprintf("%s < %s", column, marker(len(bounds))))
+		bounds = append(bounds, p.Upper)
+	}
+	if len(conditions) == 0 {
+		return query, nil
+	}
+
+	where := strings.Join(conditions, " AND ")
+	if p.Nulls {
+		where = fmt.Sprintf("(%s) OR %s IS NULL", where, column)
+	}
+	return fmt.Sprintf("SELECT * FROM (%s) AS mvr_partition WHERE %s", query, where), bounds
+}
+
+// readPartitions reads every partition at once into the same batch channel,
+// the first error stops the others
+func readPartitions(ctx context.Context, partitions []data.Partition, read func(ctx context.Context, p data.Partition) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	log.Debug().Int("partitions", len(partitions)).Msg("Reading partitions")
+
+	errCh := make(chan error, len(partitions))
+	var wg sync.WaitGroup
+	for i, p := range partitions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := read(ctx, p); err != nil {
+				errCh <- fmt.Errorf("partition %d: %w", i, err)
+				cancel()
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errCh)
+	// the first error, nil when there was none
+	return <-errCh
+}
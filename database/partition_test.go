@@ -0,0 +1,135 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/johanan/mvr/data"
+	"github.com/zeebo/assert"
+)
+
+func TestPartitionSQL(t *testing.T) {
+	pgMarker := func(n int) string { return fmt.Sprintf("$%d", n+2) }
+	tests := []struct {
+		name      string
+		partition data.Partition
+		expected  string
+		bounds    []any
+	}{
+		{name: "Whole query", partition: data.Partition{Nulls: true}, expected: "SELECT * FROM users WHERE active = $1"},
+		{name: "First", partition: data.Partition{Upper: int64(10)}, expected: "SELECT * FROM (SELECT * FROM users WHERE active = $1) AS mvr_partition WHERE id < $2", bounds: []any{int64(10)}},
+		{name: "Middle", partition: data.Partition{Lower: int64(10), Upper: int64(20)}, expected: "SELECT * FROM (SELECT * FROM users WHERE active = $1) AS mvr_partition WHERE id >= $2 AND id < $3", bounds: []any{int64(10), int64(20)}},
+		{name: "Last has the nulls", partition: data.Partition{Lower: int64(20), Nulls: true}, expected: "SELECT * FROM (SELECT * FROM users WHERE active = $1) AS mvr_partition WHERE (id >= $2) OR id IS NULL", bounds: []any{int64(20)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, bounds := partitionSQL("SELECT * FROM users WHERE active = $1", "id", tt.partition, pgMarker)
+			assert.Equal(t, tt.expected, query)
+			assert.DeepEqual(t, tt.bounds, bounds)
+		})
+	}
+}
+
+// sliceRows are rows from memory
+type sliceRows struct {
+	rows [][]any
+	next int
+	err  error
+}
+
+func (s *sliceRows) Next() bool {
+	s.next++
+	return s.next <= len(s.rows)
+}
+
+func (s *sliceRows) Scan(dest ...any) error {
+	for i, d := range dest {
+		*d.(*any) = s.rows[s.next-1][i]
+	}
+	return nil
+}
+
+func (s *sliceRows) Err() error {
+	return s.err
+}
+
+func TestReadPartitions(t *testing.T) {
+	ctx := context.Background()
+	ds := &DataStream{BatchChan: make(chan Batch, 10), BatchSize: 2, Columns: []Column{{Name: "id"}}}
+	partitions := []data.Partition{{Upper: int64(3)}, {Lower: int64(3), Nulls: true}}
+
+	// every partition sends to the same channel
+	err := readPartitions(ctx, partitions, func(ctx context.Context, p data.Partition) error {
+		if p.Upper != nil {
+			return sendRows(ctx, &sliceRows{rows: [][]any{{int64(1)}, {int64(2)}}}, ds, nil)
+		}
+		return sendRows(ctx, &sliceRows{rows: [][]any{{int64(3)}, {int64(4)}, {nil}}}, ds, func(row []any) {
+			if row[0] == nil {
+				row[0] = int64(0)
+			}
+		})
+	})
+	assert.NoError(t, err)
+	close(ds.BatchChan)
+
+	var ids []int64
+	for batch := range ds.BatchChan {
+		for _, row := range batch.Rows {
+			ids = append(ids, row[0].(int64))
+		}
+	}
+	assert.Equal(t, 5, len(ids))
+
+	// a failed partition stops the others
+	failed := errors.New("connection lost")
+	err = readPartitions(ctx, partitions, func(ctx context.Context, p data.Partition) error {
+		if p.Upper != nil {
+			return sendRows(ctx, &sliceRows{err: failed}, ds, nil)
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.True(t, errors.Is(err, failed))
+}
+
+func TestPGPartitionedRead(t *testing.T) {
+	ctx := context.Background()
+	pgUrl, _ := url.Parse(local_db_url)
+	pool, err := newPGPool(pgUrl)
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	tests := []struct {
+		name      string
+		partition *data.PartitionOptions
+	}{
+		{name: "Count", partition: &data.PartitionOptions{Column: "bigint_value", Count: 3}},
+		{name: "Timestamps", partition: &data.PartitionOptions{Column: "created", Count: 2}},
+		{name: "Ranges", partition: &data.PartitionOptions{Column: "bigint_value", Ranges: []data.PartitionRange{{Upper: "2"}, {Lower: "2"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := "numbers"
+			if tt.partition.Column == "created" {
+				table = "users"
+			}
+			dest := "public.mvr_" + table + "_partitioned"
+			_, err = pool.Exec(ctx, "DROP TABLE IF EXISTS "+dest)
+			assert.NoError(t, err)
+
+			config := &data.StreamConfig{StreamName: "public." + table, DestTable: dest, BatchSize: 1, Partition: tt.partition}
+			assert.NoError(t, config.Validate())
+			copyTable(t, ctx, pgUrl, config)
+
+			var source, copied int
+			assert.NoError(t, pool.QueryRow(ctx, "SELECT COUNT(*) FROM public."+table).Scan(&source))
+			assert.NoError(t, pool.QueryRow(ctx, "SELECT COUNT(*) FROM "+dest).Scan(&copied))
+			assert.Equal(t, source, copied)
+		})
+	}
+}
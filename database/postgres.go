@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"slices"
 
 	pgxdecimal "github.com/jackc/pgx-shopspring-decimal"
 	"github.com/jackc/pgx/v5"
@@ -16,9 +17,35 @@ import (
 
 type PGDataReader struct {
 	Pool *pgxpool.Pool
+	// copyBinary reads with COPY TO in the binary format instead of a query
+	copyBinary bool
+	// snapshot is exported by a transaction kept open until it is released,
+	// every read imports it so they all see the same rows
+	snapshot *pgSnapshot
+}
+
+type pgSnapshot struct {
+	tx pgx.Tx
+	id string
 }
 
 func NewPGDataReader(connUrl *url.URL) (*PGDataReader, error) {
+	// CopyBinary is for mvr, postgres would reject it as a setting
+	cleaned := *connUrl
+	query := cleaned.Query()
+	copyBinary := query.Get("CopyBinary") == "true"
+	query.Del("CopyBinary")
+	cleaned.RawQuery = query.Encode()
+
+	dbpool, err := newPGPool(&cleaned)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PGDataReader{Pool: dbpool, copyBinary: copyBinary}, nil
+}
+
+func newPGPool(connUrl *url.URL) (*pgxpool.Pool, error) {
 	connString := connUrl.String()
 	scheme := connUrl.Scheme
 	if scheme == "postgres" {
@@ -39,19 +66,70 @@ func NewPGDataReader(connUrl *url.URL) (*PGDataReader, error) {
 		return nil
 	}
 
-	dbpool, err := pgxpool.NewWithConfig(context.Background(), config)
-	if err != nil {
-		return nil, err
-	}
-
-	return &PGDataReader{Pool: dbpool}, nil
+	return pgxpool.NewWithConfig(context.Background(), config)
 }
 
 func (pool *PGDataReader) Close() error {
+	err := pool.ReleaseSnapshot()
 	pool.Pool.Close()
+	return err
+}
+
+// ExportSnapshot opens a repeatable read transaction and exports its snapshot,
+// the reads until ReleaseSnapshot all see the database as it was now
+func (pool *PGDataReader) ExportSnapshot(ctx context.Context) error {
+	if pool.snapshot != nil {
+		return nil
+	}
+	tx, err := pool.Pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return fmt.Errorf("failed to start the snapshot transaction: %w", err)
+	}
+	var id string
+	if err := tx.QueryRow(ctx, "SELECT pg_export_snapshot()").Scan(&id); err != nil {
+		tx.Rollback(ctx)
+		return fmt.Errorf("failed to export snapshot: %w", err)
+	}
+	log.Debug().Str("snapshot", id).Msg("Exported snapshot")
+	pool.snapshot = &pgSnapshot{tx: tx, id: id}
 	return nil
 }
 
+// ReleaseSnapshot ends the transaction that exported the snapshot
+func (pool *PGDataReader) ReleaseSnapshot() error {
+	if pool.snapshot == nil {
+		return nil
+	}
+	// nothing was written, there is nothing to commit
+	err := pool.snapshot.tx.Rollback(context.Background())
+	pool.snapshot = nil
+	return err
+}
+
+// withConn runs fn on a connection of the pool, in a transaction that imported
+// the snapshot when there is one
+func (pool *PGDataReader) withConn(ctx context.Context, fn func(conn *pgx.Conn) error) error {
+	conn, err := pool.Pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	if pool.snapshot == nil {
+		return fn(conn.Conn())
+	}
+
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+	// the id comes from postgres and SET does not take params
+	if _, err := tx.Exec(ctx, fmt.Sprintf("SET TRANSACTION SNAPSHOT '%s'", pool.snapshot.id)); err != nil {
+		return fmt.Errorf("failed to import snapshot %s: %w", pool.snapshot.id, err)
+	}
+	return fn(conn.Conn())
+}
+
 func (pool *PGDataReader) CreateDataStream(ctx context.Context, connUrl *url.URL, config *data.StreamConfig) (ds *DataStream, err error) {
 	// switch to sql to get the columns
 	// this will use the code from pqx stdlib to map columns to a common interface
@@ -94,56 +172,57 @@ func (pool *PGDataReader) CreateDataStream(ctx context.Context, connUrl *url.URL
 }
 
 func (pool *PGDataReader) ExecuteDataStream(ctx context.Context, ds *DataStream, config *data.StreamConfig) error {
-	log.Debug().Str("sql", config.SQL).Msg("Executing data stream")
-	paramValues := BuildParams(config)
-	rows, err := pool.Pool.Query(ctx, config.SQL, paramValues...)
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-
-	batch := Batch{Rows: make([][]any, 0, ds.BatchSize)}
 	defer func() {
 		close(ds.BatchChan)
 		log.Debug().Msg("Closed batch channel")
 	}()
 
-	for rows.Next() {
-		row := make([]any, len(ds.Columns))
-		rowPtrs := make([]any, len(ds.Columns))
-		for i := range row {
-			rowPtrs[i] = &row[i]
-		}
-		if err := rows.Scan(rowPtrs...); err != nil {
-			return fmt.Errorf("failed to scan row: %w", err)
-		}
-
-		batch.Rows = append(batch.Rows, row)
-
-		if len(batch.Rows) >= ds.BatchSize {
-			log.Trace().Msg("Sending batch")
-			select {
-			case ds.BatchChan <- batch:
-				batch = data.Batch{Rows: make([][]any, 0, ds.BatchSize)}
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		}
+	paramValues := BuildParams(config)
+	if config.Partition == nil {
+		log.Debug().Str("sql", config.SQL).Msg("Executing data stream")
+		return pool.readQuery(ctx, ds, config.SQL, paramValues)
 	}
 
-	// Send any remaining rows
-	if len(batch.Rows) > 0 {
-		log.Trace().Msg("Sending remaining batch")
-		select {
-		case ds.BatchChan <- batch:
-		case <-ctx.Done():
-			return ctx.Err()
+	// the partitions are separate queries, the snapshot makes them one point in time
+	if pool.snapshot == nil {
+		if err := pool.ExportSnapshot(ctx); err != nil {
+			return err
 		}
+		defer pool.ReleaseSnapshot()
 	}
 
-	log.Debug().Msg("Finished reading rows")
+	column := config.Partition.Column
+	partitions, err := partitionsFor(config.Partition, func() (lower, upper any, err error) {
+		err = pool.withConn(ctx, func(conn *pgx.Conn) error {
+			return conn.QueryRow(ctx, boundsSQL(config.SQL, column), paramValues...).Scan(&lower, &upper)
+		})
+		return lower, upper, err
+	})
+	if err != nil {
+		return err
+	}
+	return readPartitions(ctx, partitions, func(ctx context.Context, p data.Partition) error {
+		query, bounds := partitionSQL(config.SQL, column, p, func(n int) string {
+			return fmt.Sprintf("$%d", len(paramValues)+n+1)
+		})
+		log.Debug().Str("sql", query).Interface("bounds", bounds).Msg("Executing partition")
+		return pool.readQuery(ctx, ds, query, append(slices.Clone(paramValues), bounds...))
+	})
+}
 
-	return nil
+// readQuery sends the rows of one query to the stream, the pool gives each partition its own connection
+func (pool *PGDataReader) readQuery(ctx context.Context, ds *DataStream, query string, args []any) error {
+	if pool.copyBinary {
+		return pool.readCopy(ctx, ds, query, args)
+	}
+	return pool.withConn(ctx, func(conn *pgx.Conn) error {
+		rows, err := conn.Query(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		return sendRows(ctx, rows, ds, nil)
+	})
 }
 
 func (pool *PGDataReader) ExecuteCommand(ctx context.Context, sqlCommand string) (string, error) {
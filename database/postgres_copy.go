@@ -0,0 +1,312 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/shopspring/decimal"
+)
+
+// pgCopySignature starts every COPY in the binary format
+var pgCopySignature = []byte("PGCOPY\n\377\r\n\000")
+
+// readCopy sends the rows of one query to the stream with COPY TO in the binary
+// format, the values are decoded by the type map of the connection like a query would
+func (pool *PGDataReader) readCopy(ctx context.Context, ds *DataStream, query string, args []any) error {
+	return pool.withConn(ctx, func(conn *pgx.Conn) error {
+		// describing the query gives the types of the columns without running it
+		sd, err := conn.PgConn().Prepare(ctx, "", query, nil)
+		if err != nil {
+			return err
+		}
+		oids := make([]uint32, len(sd.Fields))
+		for i, field := range sd.Fields {
+			oids[i] = field.DataTypeOID
+		}
+		rows, err := newPGCopyRows(conn.TypeMap(), oids)
+		if err != nil {
+			return err
+		}
+
+		// COPY does not take params
+		inlined, err := inlineParams(query, args, conn.PgConn())
+		if err != nil {
+			return err
+		}
+
+		reader, writer := io.Pipe()
+		copyErr := make(chan error, 1)
+		go func() {
+			_, err := conn.PgConn().CopyTo(ctx, writer, "COPY ("+inlined+") TO STDOUT (FORMAT binary)")
+			writer.CloseWithError(err)
+			copyErr <- err
+		}()
+
+		rows.reader = bufio.NewReaderSize(reader, 64*1024)
+		err = sendRows(ctx, rows, ds, nil)
+		// stops the copy when the rows were not all read
+		reader.CloseWithError(errors.New("copy stopped"))
+		if cErr := <-copyErr; err == nil {
+			err = cErr
+		}
+		return err
+	})
+}
+
+// pgCopyRows are the tuples of a binary COPY, read as rows
+type pgCopyRows struct {
+	reader *bufio.Reader
+	plans  []pgtype.ScanPlan
+	oids   []uint32
+	values []any
+	buf    []byte
+	header bool
+	err    error
+}
+
+func newPGCopyRows(typeMap *pgtype.Map, oids []uint32) (*pgCopyRows, error) {
+	rows := &pgCopyRows{plans: make([]pgtype.ScanPlan, len(oids)), oids: oids, values: make([]any, len(oids))}
+	for i, oid := range oids {
+		if _, ok := typeMap.TypeForOID(oid); !ok {
+			return nil, fmt.Errorf("COPY binary cannot decode column %d of type oid %d, read it without CopyBinary", i+1, oid)
+		}
+		rows.plans[i] = typeMap.PlanScan(oid, pgtype.BinaryFormatCode, &rows.values[i])
+	}
+	return rows, nil
+}
+
+func (r *pgCopyRows) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	if !r.header {
+		if r.err = r.readHeader(); r.err != nil {
+			return false
+		}
+		r.header = true
+	}
+
+	var count int16
+	if r.err = binary.Read(r.reader, binary.BigEndian, &count); r.err != nil {
+		return false
+	}
+	// the trailer
+	if count == -1 {
+		r.err = io.EOF
+		return false
+	}
+	if int(count) != len(r.oids) {
+		r.err = fmt.Errorf("COPY tuple has %d fields, expected %d", count, len(r.oids))
+		return false
+	}
+
+	for i := range r.values {
+		var length int32
+		if r.err = binary.Read(r.reader, binary.BigEndian, &length); r.err != nil {
+			return false
+		}
+		if length == -1 {
+			r.values[i] = nil
+			continue
+		}
+		// the decoded values never keep the buffer, so it is used again
+		if cap(r.buf) < int(length) {
+			r.buf = make([]byte, length)
+		}
+		src := r.buf[:length]
+		if _, r.err = io.ReadFull(r.reader, src); r.err != nil {
+			return false
+		}
+		if r.err = r.plans[i].Scan(src, &r.values[i]); r.err != nil {
+			r.err = fmt.Errorf("failed to decode column %d: %w", i+1, r.err)
+			return false
+		}
+	}
+	return true
+}
+
+// readHeader checks the signature and skips the flags and the extension area
+func (r *pgCopyRows) readHeader() error {
+	signature := make([]byte, len(pgCopySignature))
+	if _, err := io.ReadFull(r.reader, signature); err != nil {
+		return err
+	}
+	if !bytes.Equal(signature, pgCopySignature) {
+		return errors.New("COPY output is not in the binary format")
+	}
+	var flags, extension uint32
+	if err := binary.Read(r.reader, binary.BigEndian, &flags); err != nil {
+		return err
+	}
+	if err := binary.Read(r.reader, binary.BigEndian, &extension); err != nil {
+		return err
+	}
+	_, err := r.reader.Discard(int(extension))
+	return err
+}
+
+func (r *pgCopyRows) Scan(dest ...any) error {
+	for i, d := range dest {
+		*d.(*any) = r.values[i]
+	}
+	return nil
+}
+
+// Err is nil once the trailer has been read
+func (r *pgCopyRows) Err() error {
+	if errors.Is(r.err, io.EOF) {
+		return nil
+	}
+	return r.err
+}
+
+// inlineParams replaces the $n markers with the params as literals, skipping
+// the strings, quoted names and comments of the query
+func inlineParams(query string, args []any, pgConn *pgconn.PgConn) (string, error) {
+	if len(args) == 0 {
+		return query, nil
+	}
+	// without it backslashes in strings are escapes
+	if pgConn != nil && pgConn.ParameterStatus("standard_conforming_strings") != "on" {
+		return "", errors.New("COPY binary needs standard_conforming_strings to bind params")
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(query); {
+		rest := query[i:]
+		switch {
+		case rest[0] == '\'' || rest[0] == '"':
+			// E'' strings escape with backslashes
+			escapes := rest[0] == '\'' && i > 0 && (query[i-1] == 'E' || query[i-1] == 'e') && (i < 2 || !isIdentChar(query[i-2]))
+			end := closingQuote(rest, escapes)
+			b.WriteString(rest[:end])
+			i += end
+		case strings.HasPrefix(rest, "--"):
+			end := strings.IndexByte(rest, '\n')
+			if end == -1 {
+				end = len(rest)
+			}
+			b.WriteString(rest[:end])
+			i += end
+		case strings.HasPrefix(rest, "/*"):
+			end := strings.Index(rest[2:], "*/")
+			if end == -1 {
+				end = len(rest)
+			} else {
+				end += 4
+			}
+			b.WriteString(rest[:end])
+			i += end
+		case rest[0] == '$' && (i == 0 || !isIdentChar(query[i-1])):
+			digits := 1
+			for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+				digits++
+			}
+			if digits > 1 {
+				n, _ := strconv.Atoi(rest[1:digits])
+				if n < 1 || n > len(args) {
+					return "", fmt.Errorf("query uses $%d but there are %d params", n, len(args))
+				}
+				literal, err := pgLiteral(args[n-1])
+				if err != nil {
+					return "", err
+				}
+				b.WriteString(literal)
+				i += digits
+				continue
+			}
+			if tag, ok := dollarTag(rest); ok {
+				end := strings.Index(rest[len(tag):], tag)
+				if end == -1 {
+					end = len(rest)
+				} else {
+					end += 2 * len(tag)
+				}
+				b.WriteString(rest[:end])
+				i += end
+				continue
+			}
+			b.WriteByte('$')
+			i++
+		default:
+			b.WriteByte(rest[0])
+			i++
+		}
+	}
+	return b.String(), nil
+}
+
+// closingQuote is the index after the quote that ends the string starting at s[0],
+// a doubled quote is part of the string
+func closingQuote(s string, escapes bool) int {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case escapes && s[i] == '\\':
+			i++
+		case s[i] == quote:
+			if i+1 < len(s) && s[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+// dollarTag is the $tag$ that starts a dollar quoted string
+func dollarTag(s string) (string, bool) {
+	for i := 1; i < len(s); i++ {
+		if s[i] == '$' {
+			return s[:i+1], true
+		}
+		if !isIdentChar(s[i]) || (i == 1 && s[i] >= '0' && s[i] <= '9') {
+			return "", false
+		}
+	}
+	return "", false
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80
+}
+
+// pgLiteral is the param as SQL, text is left untyped so postgres gives it the
+// type the query needs like it does for a param. Numbers are wrapped so a
+// negative one can not turn `x-$1` into the start of a comment.
+func pgLiteral(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "NULL", nil
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'", nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return "(" + strconv.Itoa(v) + ")", nil
+	case int16:
+		return "(" + strconv.FormatInt(int64(v), 10) + ")", nil
+	case int32:
+		return "(" + strconv.FormatInt(int64(v), 10) + ")", nil
+	case int64:
+		return "(" + strconv.FormatInt(v, 10) + ")", nil
+	case time.Time:
+		return "'" + v.Format(time.RFC3339Nano) + "'::timestamptz", nil
+	case decimal.Decimal:
+		return "(" + v.String() + ")", nil
+	default:
+		return "", fmt.Errorf("cannot bind %T in COPY binary", value)
+	}
+}
@@ -0,0 +1,226 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/url"
+	"testing"
+	"time"
+
+	pgxdecimal "github.com/jackc/pgx-shopspring-decimal"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/johanan/mvr/data"
+	"github.com/shopspring/decimal"
+	"github.com/zeebo/assert"
+)
+
+func TestInlineParams(t *testing.T) {
+	args := []any{"O'Brien", int64(42), time.Date(2024, 10, 8, 17, 22, 0, 0, time.UTC), int32(-5), decimal.RequireFromString("-1.5")}
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+		isError  bool
+	}{
+		{name: "Params", query: "SELECT * FROM users WHERE name = $1 AND id > $2", expected: "SELECT * FROM users WHERE name = 'O''Brien' AND id > (42)"},
+		{name: "Used twice", query: "SELECT $2, $2", expected: "SELECT (42), (42)"},
+		{name: "Timestamp", query: "SELECT * FROM users WHERE created >= $3", expected: "SELECT * FROM users WHERE created >= '2024-10-08T17:22:00Z'::timestamptz"},
+		{name: "Negative numbers", query: "SELECT x-$4, x-$5 FROM t", expected: "SELECT x-(-5), x-(-1.5) FROM t"},
+		{name: "Strings are skipped", query: "SELECT '$1', 'it''s $2', $1", expected: "SELECT '$1', 'it''s $2', 'O''Brien'"},
+		{name: "Escape strings", query: `SELECT E'\'$1', $2`, expected: `SELECT E'\'$1', (42)`},
+		{name: "Quoted names", query: `SELECT "$1" FROM t WHERE a = $2`, expected: `SELECT "$1" FROM t WHERE a = (42)`},
+		{name: "Comments", query: "SELECT $2 -- $1\n/* $1 */ FROM t", expected: "SELECT (42) -- $1\n/* $1 */ FROM t"},
+		{name: "Dollar quotes", query: "SELECT $$ $1 $$, $tag$ $2 $tag$, $2", expected: "SELECT $$ $1 $$, $tag$ $2 $tag$, (42)"},
+		{name: "Names with dollars", query: "SELECT a$1 FROM t", expected: "SELECT a$1 FROM t"},
+		{name: "Missing param", query: "SELECT $6", isError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inlined, err := inlineParams(tt.query, args, nil)
+			if tt.isError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, inlined)
+		})
+	}
+
+	_, err := pgLiteral(struct{}{})
+	assert.Error(t, err)
+}
+
+// copyStream is the binary COPY output of the rows
+func copyStream(t *testing.T, typeMap *pgtype.Map, oids []uint32, rows [][]any) []byte {
+	var buf bytes.Buffer
+	buf.Write(pgCopySignature)
+	// no flags, a 4 byte extension that must be skipped
+	binary.Write(&buf, binary.BigEndian, uint32(0))
+	binary.Write(&buf, binary.BigEndian, uint32(4))
+	buf.Write([]byte{1, 2, 3, 4})
+	for _, row := range rows {
+		binary.Write(&buf, binary.BigEndian, int16(len(row)))
+		for i, value := range row {
+			if value == nil {
+				binary.Write(&buf, binary.BigEndian, int32(-1))
+				continue
+			}
+			encoded, err := typeMap.Encode(oids[i], pgtype.BinaryFormatCode, value, nil)
+			assert.NoError(t, err)
+			binary.Write(&buf, binary.BigEndian, int32(len(encoded)))
+			buf.Write(encoded)
+		}
+	}
+	binary.Write(&buf, binary.BigEndian, int16(-1))
+	return buf.Bytes()
+}
+
+func TestPGCopyRows(t *testing.T) {
+	typeMap := pgtype.NewMap()
+	pgxdecimal.Register(typeMap)
+	oids := []uint32{pgtype.Int8OID, pgtype.TextOID, pgtype.NumericOID, pgtype.TimestamptzOID, pgtype.ByteaOID, pgtype.TextArrayOID}
+	created := time.Date(2024, 10, 8, 17, 22, 0, 0, time.UTC)
+	rows := [][]any{
+		{int64(1), "John", decimal.RequireFromString("12345.678900000000001"), created, []byte{1, 2}, []any{"a", "b"}},
+		{int64(2), nil, nil, nil, nil, nil},
+		{int64(3), "", decimal.NewFromInt(-3), created.Add(time.Hour), []byte{}, []any{}},
+	}
+
+	copyRows, err := newPGCopyRows(typeMap, oids)
+	assert.NoError(t, err)
+	copyRows.reader = bufio.NewReader(bytes.NewReader(copyStream(t, typeMap, oids, rows)))
+
+	var result [][]any
+	for copyRows.Next() {
+		row := make([]any, len(oids))
+		dest := make([]any, len(oids))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		assert.NoError(t, copyRows.Scan(dest...))
+		result = append(result, row)
+	}
+	assert.NoError(t, copyRows.Err())
+	assert.Equal(t, len(rows), len(result))
+	for i := range rows {
+		assert.Equal(t, rows[i][0], result[i][0])
+		assert.Equal(t, rows[i][1], result[i][1])
+		if rows[i][2] != nil {
+			assert.True(t, rows[i][2].(decimal.Decimal).Equal(result[i][2].(decimal.Decimal)))
+		}
+		if rows[i][3] != nil {
+			assert.True(t, rows[i][3].(time.Time).Equal(result[i][3].(time.Time)))
+		}
+		assert.DeepEqual(t, rows[i][4], result[i][4])
+		assert.DeepEqual(t, rows[i][5], result[i][5])
+	}
+
+	// a stream cut short is an error, not the end
+	stream := copyStream(t, typeMap, oids, rows)
+	copyRows, _ = newPGCopyRows(typeMap, oids)
+	copyRows.reader = bufio.NewReader(bytes.NewReader(stream[:len(stream)-10]))
+	for copyRows.Next() {
+	}
+	assert.Error(t, copyRows.Err())
+
+	copyRows, _ = newPGCopyRows(typeMap, oids)
+	copyRows.reader = bufio.NewReader(bytes.NewReader([]byte("id,name\n1,John\n")))
+	assert.False(t, copyRows.Next())
+	assert.Error(t, copyRows.Err())
+
+	_, err = newPGCopyRows(typeMap, []uint32{999999})
+	assert.Error(t, err)
+}
+
+// readAll reads the whole stream the way core.Execute would
+func readAll(ctx context.Context, reader *PGDataReader, config *data.StreamConfig) ([][]any, error) {
+	pgUrl, _ := url.Parse(local_db_url)
+	ds, err := reader.CreateDataStream(ctx, pgUrl, config)
+	if err != nil {
+		return nil, err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- reader.ExecuteDataStream(ctx, ds, config)
+	}()
+	var rows [][]any
+	for batch := range ds.BatchChan {
+		rows = append(rows, batch.Rows...)
+	}
+	return rows, <-errCh
+}
+
+func newCopyReaders(t testing.TB) (*PGDataReader, *PGDataReader) {
+	pgUrl, _ := url.Parse(local_db_url)
+	queryReader, err := NewPGDataReader(pgUrl)
+	assert.NoError(t, err)
+	copyUrl, _ := url.Parse(local_db_url + "&CopyBinary=true")
+	copyReader, err := NewPGDataReader(copyUrl)
+	assert.NoError(t, err)
+	assert.True(t, copyReader.copyBinary)
+	return queryReader, copyReader
+}
+
+func TestPGCopyBinary(t *testing.T) {
+	ctx := context.Background()
+	queryReader, copyReader := newCopyReaders(t)
+	defer queryReader.Close()
+	defer copyReader.Close()
+
+	tests := []struct {
+		name   string
+		config *data.StreamConfig
+	}{
+		{name: "Users", config: &data.StreamConfig{StreamName: "public.users"}},
+		{name: "Numbers", config: &data.StreamConfig{StreamName: "public.numbers"}},
+		{name: "Strings", config: &data.StreamConfig{StreamName: "public.strings"}},
+		{name: "Params", config: &data.StreamConfig{
+			SQL:       "SELECT * FROM public.users WHERE name = $1 AND active = $2",
+			Params:    map[string]data.Param{"P1": {Value: "John Doe", Type: "TEXT"}, "P2": {Value: "true", Type: "BOOLEAN"}},
+			ParamKeys: []string{"P1", "P2"},
+		}},
+		{name: "Partitions", config: &data.StreamConfig{StreamName: "public.numbers", Partition: &data.PartitionOptions{Column: "bigint_value", Count: 2}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.NoError(t, tt.config.Validate())
+			expected, err := readAll(ctx, queryReader, tt.config)
+			assert.NoError(t, err)
+			actual, err := readAll(ctx, copyReader, tt.config)
+			assert.NoError(t, err)
+			assert.Equal(t, len(expected), len(actual))
+			if tt.config.Partition == nil {
+				assert.DeepEqual(t, expected, actual)
+			}
+		})
+	}
+}
+
+func BenchmarkPGRead(b *testing.B) {
+	ctx := context.Background()
+	queryReader, copyReader := newCopyReaders(b)
+	defer queryReader.Close()
+	defer copyReader.Close()
+
+	for _, table := range []string{"public.numbers", "public.strings"} {
+		for _, reader := range []struct {
+			name   string
+			reader *PGDataReader
+		}{{"query", queryReader}, {"copy", copyReader}} {
+			b.Run(table+"/"+reader.name, func(b *testing.B) {
+				// a large table so the rows are most of the time
+				config := &data.StreamConfig{SQL: "SELECT t.* FROM " + table + " t, generate_series(1, 10000)", BatchSize: 10000}
+				for b.Loop() {
+					if _, err := readAll(ctx, reader.reader, config); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/johanan/mvr/data"
+	"github.com/zeebo/assert"
+)
+
+// countRows reads the whole stream the way core.Execute would
+func countRows(t *testing.T, ctx context.Context, reader *PGDataReader, config *data.StreamConfig) int {
+	pgUrl, _ := url.Parse(local_db_url)
+	ds, err := reader.CreateDataStream(ctx, pgUrl, config)
+	assert.NoError(t, err)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- reader.ExecuteDataStream(ctx, ds, config)
+	}()
+	rows := 0
+	for batch := range ds.BatchChan {
+		rows += len(batch.Rows)
+	}
+	assert.NoError(t, <-errCh)
+	return rows
+}
+
+func TestPGSnapshot(t *testing.T) {
+	ctx := context.Background()
+	pgUrl, _ := url.Parse(local_db_url)
+	reader, err := NewPGDataReader(pgUrl)
+	assert.NoError(t, err)
+	defer reader.Close()
+
+	_, err = reader.Pool.Exec(ctx, "DROP TABLE IF EXISTS public.mvr_snapshot; CREATE TABLE public.mvr_snapshot AS SELECT generate_series(1, 100) AS id")
+	assert.NoError(t, err)
+
+	config := &data.StreamConfig{StreamName: "public.mvr_snapshot", BatchSize: 10}
+	assert.NoError(t, config.Validate())
+	partitioned := &data.StreamConfig{StreamName: "public.mvr_snapshot", BatchSize: 10, Partition: &data.PartitionOptions{Column: "id", Count: 4}}
+	assert.NoError(t, partitioned.Validate())
+
+	assert.NoError(t, reader.ExportSnapshot(ctx))
+	// rows added after the export are not seen by any read, partitioned or not
+	_, err = reader.Pool.Exec(ctx, "INSERT INTO public.mvr_snapshot SELECT generate_series(101, 150)")
+	assert.NoError(t, err)
+	assert.Equal(t, 100, countRows(t, ctx, reader, config))
+	assert.Equal(t, 100, countRows(t, ctx, reader, partitioned))
+
+	assert.NoError(t, reader.ReleaseSnapshot())
+	assert.Equal(t, 150, countRows(t, ctx, reader, config))
+	// a partitioned read exports its own snapshot and releases it
+	assert.Equal(t, 150, countRows(t, ctx, reader, partitioned))
+	assert.Nil(t, reader.snapshot)
+}
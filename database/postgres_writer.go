@@ -0,0 +1,404 @@
+package database
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/johanan/mvr/data"
+	"github.com/rs/zerolog/log"
+	"github.com/shopspring/decimal"
+)
+
+// PGDataWriter loads a DataStream into a Postgres table with COPY. Every batch
+// writer runs its own COPY on its own connection from the pool.
+type PGDataWriter struct {
+	ctx        context.Context
+	pool       *pgxpool.Pool
+	datastream *data.DataStream
+	mode       string
+	table      pgx.Identifier
+	loadTable  pgx.Identifier
+	columns    []string
+	mux        sync.Mutex
+	closed     bool
+}
+
+type PGBatchWriter struct {
+	dataWriter *PGDataWriter
+}
+
+func NewPGDataWriter(ctx context.Context, connUrl *url.URL, datastream *data.DataStream, config *data.StreamConfig) (*PGDataWriter, error) {
+	tableName := config.GetDestTable()
+	if tableName == "" {
+		return nil, errors.New("dest_table or stream_name is required for a postgres destination")
+	}
+
+	pool, err := newPGPool(connUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := &PGDataWriter{
+		ctx:        ctx,
+		pool:       pool,
+		datastream: datastream,
+		mode:       config.GetMode(),
+		table:      pgIdentifier(tableName),
+	}
+	writer.loadTable = writer.table
+
+	if err := writer.prepare(); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+// prepare creates or validates the target table and gets it ready for the mode
+func (w *PGDataWriter) prepare() error {
+	existing, err := w.tableColumns(w.table)
+	if err != nil {
+		return err
+	}
+
+	if existing == nil {
+		log.Debug().Str("table", w.table.Sanitize()).Msg("Creating table")
+		if _, err := w.pool.Exec(w.ctx, pgCreateTable(w.table, w.datastream.DestColumns)); err != nil {
+			return fmt.Errorf("failed to create table %s: %w", w.table.Sanitize(), err)
+		}
+		for _, col := range w.datastream.DestColumns {
+			w.columns = append(w.columns, col.Name)
+		}
+	} else {
+		// match the stream to the table without caring about case
+		var missing []string
+		for _, col := range w.datastream.DestColumns {
+			name, ok := existing[strings.ToLower(col.Name)]
+			if !ok {
+				missing = append(missing, col.Name)
+				continue
+			}
+			w.columns = append(w.columns, name)
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("table %s is missing columns: %s", w.table.Sanitize(), strings.Join(missing, ", "))
+		}
+	}
+
+	switch w.mode {
+	case "append":
+	case "truncate":
+		// a table that was just created is already empty
+		if existing == nil {
+			break
+		}
+		// the rows are loaded into a staging table with the loaded columns, Close
+		// truncates the table and moves them in, so a failed run leaves it as it was
+		w.loadTable = pgSuffixed(w.table, "_mvr_staging")
+		columns := make([]string, len(w.columns))
+		for i, name := range w.columns {
+			columns[i] = pgx.Identifier{name}.Sanitize()
+		}
+		log.Debug().Str("table", w.loadTable.Sanitize()).Msg("Creating staging table")
+		statements := []string{
+			"DROP TABLE IF EXISTS " + w.loadTable.Sanitize(),
+			"CREATE TABLE " + w.loadTable.Sanitize() + " AS SELECT " + strings.Join(columns, ", ") + " FROM " + w.table.Sanitize() + " WITH NO DATA",
+		}
+		for _, statement := range statements {
+			if _, err := w.pool.Exec(w.ctx, statement); err != nil {
+				return fmt.Errorf("failed to create staging table %s: %w", w.loadTable.Sanitize(), err)
+			}
+		}
+	case "swap":
+		// the old table is dropped after the swap, which fails on anything that
+		// depends on it, so find out before loading anything
+		dependents, err := w.tableDependents(w.table)
+		if err != nil {
+			return err
+		}
+		if len(dependents) > 0 {
+			return fmt.Errorf("table %s can not be swapped, %s depend on it, use truncate instead", w.table.Sanitize(), strings.Join(dependents, ", "))
+		}
+		w.loadTable = pgSuffixed(w.table, "_mvr_staging")
+		log.Debug().Str("table", w.loadTable.Sanitize()).Msg("Creating staging table")
+		statements := []string{
+			"DROP TABLE IF EXISTS " + w.loadTable.Sanitize(),
+			"CREATE TABLE " + w.loadTable.Sanitize() + " (LIKE " + w.table.Sanitize() + " INCLUDING ALL)",
+		}
+		for _, statement := range statements {
+			if _, err := w.pool.Exec(w.ctx, statement); err != nil {
+				return fmt.Errorf("failed to create staging table %s: %w", w.loadTable.Sanitize(), err)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported mode for postgres: %s", w.mode)
+	}
+
+	return nil
+}
+
+// tableColumns returns the lower cased column names of a table, or nil if it does not exist
+func (w *PGDataWriter) tableColumns(table pgx.Identifier) (map[string]string, error) {
+	var exists bool
+	if err := w.pool.QueryRow(w.ctx, "SELECT to_regclass($1) IS NOT NULL", table.Sanitize()).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to look up table %s: %w", table.Sanitize(), err)
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	rows, err := w.pool.Query(w.ctx, "SELECT attname FROM pg_attribute WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped", table.Sanitize())
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up columns for %s: %w", table.Sanitize(), err)
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up columns for %s: %w", table.Sanitize(), err)
+	}
+
+	columns := make(map[string]string, len(names))
+	for _, name := range names {
+		columns[strings.ToLower(name)] = name
+	}
+	return columns, nil
+}
+
+// tableDependents names the views, serial sequences and foreign keys that stop
+// the table from being dropped
+func (w *PGDataWriter) tableDependents(table pgx.Identifier) ([]string, error) {
+	query := `SELECT 'view ' || r.ev_class::regclass::text FROM pg_depend d JOIN pg_rewrite r ON r.oid = d.objid
+		WHERE d.classid = 'pg_rewrite'::regclass AND d.refclassid = 'pg_class'::regclass AND d.refobjid = $1::regclass AND r.ev_class <> d.refobjid
+		UNION
+		SELECT 'sequence ' || d.objid::regclass::text FROM pg_depend d JOIN pg_class c ON c.oid = d.objid
+		WHERE d.classid = 'pg_class'::regclass AND d.refclassid = 'pg_class'::regclass AND d.refobjid = $1::regclass AND d.deptype = 'a' AND c.relkind = 'S'
+		UNION
+		SELECT 'foreign key ' || conname || ' on ' || conrelid::regclass::text FROM pg_constraint
+		WHERE contype = 'f' AND confrelid = $1::regclass AND conrelid <> confrelid
+		ORDER BY 1`
+	rows, err := w.pool.Query(w.ctx, query, table.Sanitize())
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up dependents of %s: %w", table.Sanitize(), err)
+	}
+	dependents, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up dependents of %s: %w", table.Sanitize(), err)
+	}
+	return dependents, nil
+}
+
+func (w *PGDataWriter) CreateBatchWriter() data.BatchWriter {
+	return &PGBatchWriter{dataWriter: w}
+}
+
+func (bw *PGBatchWriter) WriteBatch(batch data.Batch) error {
+	w := bw.dataWriter
+	rows := make([][]any, len(batch.Rows))
+	for i, row := range batch.Rows {
+		values := make([]any, len(row))
+		for j, col := range w.datastream.DestColumns {
+			value, err := pgValue(row[j], col)
+			if err != nil {
+				return fmt.Errorf("failed to convert column %s: %w", col.Name, err)
+			}
+			values[j] = value
+		}
+		rows[i] = values
+	}
+
+	copied, err := w.pool.CopyFrom(w.ctx, w.loadTable, w.columns, pgx.CopyFromRows(rows))
+	if err != nil {
+		return fmt.Errorf("failed to copy into %s: %w", w.loadTable.Sanitize(), err)
+	}
+	log.Trace().Int64("rows", copied).Msg("Copied batch")
+	return nil
+}
+
+func (w *PGDataWriter) Flush() error {
+	return nil
+}
+
+// Close moves the staging table in when the mode is truncate or swap
+func (w *PGDataWriter) Close() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.pool.Close()
+
+	if w.loadTable.Sanitize() == w.table.Sanitize() {
+		return nil
+	}
+
+	tx, err := w.pool.Begin(w.ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start swap: %w", err)
+	}
+	defer tx.Rollback(w.ctx)
+
+	var statements []string
+	switch w.mode {
+	case "truncate":
+		columns := make([]string, len(w.columns))
+		for i, name := range w.columns {
+			columns[i] = pgx.Identifier{name}.Sanitize()
+		}
+		statements = []string{
+			"TRUNCATE TABLE " + w.table.Sanitize(),
+			"INSERT INTO " + w.table.Sanitize() + " (" + strings.Join(columns, ", ") + ") SELECT " + strings.Join(columns, ", ") + " FROM " + w.loadTable.Sanitize(),
+			"DROP TABLE " + w.loadTable.Sanitize(),
+		}
+	case "swap":
+		old := pgSuffixed(w.table, "_mvr_old")
+		tableName := pgx.Identifier{w.table[len(w.table)-1]}.Sanitize()
+		oldName := pgx.Identifier{old[len(old)-1]}.Sanitize()
+		statements = []string{
+			"ALTER TABLE " + w.table.Sanitize() + " RENAME TO " + oldName,
+			"ALTER TABLE " + w.loadTable.Sanitize() + " RENAME TO " + tableName,
+			"DROP TABLE " + old.Sanitize(),
+		}
+	}
+	for _, statement := range statements {
+		log.Debug().Str("sql", statement).Msg("Swapping table")
+		if _, err := tx.Exec(w.ctx, statement); err != nil {
+			return fmt.Errorf("failed to swap %s: %w", w.table.Sanitize(), err)
+		}
+	}
+
+	return tx.Commit(w.ctx)
+}
+
+// Abort drops the staging table so a failed truncate or swap leaves the target
+// untouched, batches that already copied into the target stay in it
+func (w *PGDataWriter) Abort() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.pool.Close()
+
+	if w.loadTable.Sanitize() == w.table.Sanitize() {
+		log.Warn().Str("mode", w.mode).Str("table", w.table.Sanitize()).Msg("Rows already copied are not rolled back")
+		return nil
+	}
+
+	if _, err := w.pool.Exec(context.Background(), "DROP TABLE IF EXISTS "+w.loadTable.Sanitize()); err != nil {
+		return fmt.Errorf("failed to drop staging table %s: %w", w.loadTable.Sanitize(), err)
+	}
+	return nil
+}
+
+func pgIdentifier(name string) pgx.Identifier {
+	return pgx.Identifier(strings.Split(name, "."))
+}
+
+func pgSuffixed(table pgx.Identifier, suffix string) pgx.Identifier {
+	suffixed := make(pgx.Identifier, len(table))
+	copy(suffixed, table)
+	suffixed[len(suffixed)-1] += suffix
+	return suffixed
+}
+
+func pgCreateTable(table pgx.Identifier, columns []data.Column) string {
+	defs := make([]string, len(columns))
+	for i, col := range columns {
+		defs[i] = pgx.Identifier{col.Name}.Sanitize() + " " + pgColumnType(col)
+	}
+	return "CREATE TABLE " + table.Sanitize() + " (" + strings.Join(defs, ", ") + ")"
+}
+
+// pgColumnType turns the abstract type back into DDL
+func pgColumnType(col data.Column) string {
+	colType := data.TypeAlias(strings.ToUpper(col.Type))
+	if strings.HasPrefix(colType, "_") {
+		return pgColumnType(data.Column{Type: data.TypeAlias(strings.TrimPrefix(colType, "_"))}) + "[]"
+	}
+
+	switch colType {
+	case "DOUBLE":
+		return "DOUBLE PRECISION"
+	case "NUMERIC":
+		if col.Precision > 0 {
+			return fmt.Sprintf("NUMERIC(%d, %d)", col.Precision, col.Scale)
+		}
+		return "NUMERIC"
+	case "VARCHAR":
+		if col.Length > 0 {
+			return fmt.Sprintf("VARCHAR(%d)", col.Length)
+		}
+		return "VARCHAR"
+	case "BOOLEAN", "SMALLINT", "INTEGER", "BIGINT", "REAL", "UUID", "DATE", "TIMESTAMP", "TIMESTAMPTZ", "TEXT", "JSON", "JSONB", "BYTEA":
+		return colType
+	default:
+		return "TEXT"
+	}
+}
+
+// pgValue undoes what the other readers do to values so pgx can encode them
+func pgValue(value any, col data.Column) (any, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	switch data.TypeAlias(col.Type) {
+	case "NUMERIC":
+		switch v := value.(type) {
+		case []byte:
+			// MS SQL hands back decimals as text
+			return decimal.NewFromString(string(v))
+		case string:
+			return decimal.NewFromString(v)
+		case float32:
+			return decimal.NewFromFloat32(v), nil
+		case float64:
+			return decimal.NewFromFloat(v), nil
+		case *big.Float:
+			return decimal.NewFromString(v.Text('f', -1))
+		case *big.Int:
+			return decimal.NewFromBigInt(v, 0), nil
+		}
+	case "UUID":
+		switch v := value.(type) {
+		case uuid.UUID:
+			return [16]byte(v), nil
+		case []byte:
+			if len(v) == 16 {
+				return [16]byte(v), nil
+			}
+			return string(v), nil
+		}
+	case "BYTEA":
+		if v, ok := value.(string); ok && strings.HasPrefix(v, "\\x") {
+			return hex.DecodeString(v[2:])
+		}
+	case "JSON", "JSONB":
+		if v, ok := value.([]byte); ok {
+			return string(v), nil
+		}
+	default:
+		if v, ok := value.(string); ok && strings.HasPrefix(col.Type, "_") {
+			// arrays that were flattened to JSON on the way out
+			var values []any
+			if err := json.Unmarshal([]byte(v), &values); err != nil {
+				return nil, err
+			}
+			return values, nil
+		}
+	}
+
+	return value, nil
+}
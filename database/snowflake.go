@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"slices"
 	"strings"
 
 	"github.com/johanan/mvr/data"
@@ -16,6 +17,8 @@ import (
 
 type SnowflakeDataReader struct {
 	Snowflake *sql.DB
+	// arrowBatches reads the arrow chunks of a result instead of scanning rows
+	arrowBatches bool
 }
 
 func NewSnowflakeDataReader(connUrl *url.URL) (*SnowflakeDataReader, error) {
@@ -46,6 +49,14 @@ func NewSnowflakeDataReader(connUrl *url.URL) (*SnowflakeDataReader, error) {
 		connUrl.RawQuery = q.Encode()
 	}
 
+	// ArrowBatches is for mvr, gosnowflake would send it as a session parameter
+	q := connUrl.Query()
+	arrowBatches := q.Get("ArrowBatches") == "true"
+	if q.Has("ArrowBatches") {
+		q.Del("ArrowBatches")
+		connUrl.RawQuery = q.Encode()
+	}
+
 	connString := connUrl.String()
 	connString = strings.ReplaceAll(connString, "snowflake://", "")
 
@@ -54,7 +65,7 @@ func NewSnowflakeDataReader(connUrl *url.URL) (*SnowflakeDataReader, error) {
 		return nil, err
 	}
 
-	return &SnowflakeDataReader{Snowflake: db}, nil
+	return &SnowflakeDataReader{Snowflake: db, arrowBatches: arrowBatches}, nil
 }
 
 func (sf *SnowflakeDataReader) Close() error {
@@ -100,62 +111,55 @@ func (sf *SnowflakeDataReader) CreateDataStream(ctx context.Context, connUrl *ur
 }
 
 func (sf *SnowflakeDataReader) ExecuteDataStream(ctx context.Context, ds *DataStream, config *data.StreamConfig) error {
-	log.Debug().Str("sql", config.SQL).Msg("Executing query")
-	db := sf.Snowflake
-	stmt, err := db.PrepareContext(gosnowflake.WithHigherPrecision(ctx), config.SQL)
-	if err != nil {
-		log.Fatal().Msgf("Failed to prepare query: %v", err)
-	}
-	defer stmt.Close()
-
-	paramValues := BuildParams(config)
-	result, err := stmt.QueryContext(gosnowflake.WithHigherPrecision(ctx), paramValues...)
-	if err != nil {
-		log.Fatal().Msgf("Failed to execute query: %v", err)
-	}
-	defer result.Close()
 	defer func() {
 		close(ds.BatchChan)
 		log.Debug().Msg("Closed batch channel")
 	}()
 
-	batch := Batch{Rows: make([][]any, 0, ds.BatchSize)}
-
-	for result.Next() {
-		row := make([]any, len(ds.Columns))
-		rowPtrs := make([]any, len(ds.Columns))
-		for i := range row {
-			rowPtrs[i] = &row[i]
-		}
-		if err := result.Scan(rowPtrs...); err != nil {
-			return fmt.Errorf("failed to scan row: %w", err)
-		}
+	paramValues := BuildParams(config)
+	if config.Partition == nil {
+		log.Debug().Str("sql", config.SQL).Msg("Executing query")
+		return sf.readQuery(ctx, ds, config.SQL, paramValues)
+	}
 
-		batch.Rows = append(batch.Rows, row)
+	column := config.Partition.Column
+	partitions, err := partitionsFor(config.Partition, func() (lower, upper any, err error) {
+		err = sf.Snowflake.QueryRowContext(gosnowflake.WithHigherPrecision(ctx), boundsSQL(config.SQL, column), paramValues...).Scan(&lower, &upper)
+		return lower, upper, err
+	})
+	if err != nil {
+		return err
+	}
+	return readPartitions(ctx, partitions, func(ctx context.Context, p data.Partition) error {
+		// the bounds come after the query so they are the last of the ? markers
+		query, bounds := partitionSQL(config.SQL, column, p, func(int) string { return "?" })
+		log.Debug().Str("sql", query).Interface("bounds", bounds).Msg("Executing partition")
+		return sf.readQuery(ctx, ds, query, append(slices.Clone(paramValues), bounds...))
+	})
+}
 
-		if len(batch.Rows) >= ds.BatchSize {
-			log.Trace().Msg("Sending batch")
-			select {
-			case ds.BatchChan <- batch:
-				batch = data.Batch{Rows: make([][]any, 0, ds.BatchSize)}
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		}
+// readQuery sends the rows of one query to the stream
+func (sf *SnowflakeDataReader) readQuery(ctx context.Context, ds *DataStream, query string, args []any) error {
+	if sf.arrowBatches {
+		return sf.readArrow(ctx, ds, query, args)
 	}
+	return sf.queryRows(ctx, ds, query, args)
+}
 
-	// Send any remaining rows
-	if len(batch.Rows) > 0 {
-		log.Trace().Msg("Sending remaining batch")
-		select {
-		case ds.BatchChan <- batch:
-		case <-ctx.Done():
-			return ctx.Err()
-		}
+// queryRows scans the rows of one query into the stream
+func (sf *SnowflakeDataReader) queryRows(ctx context.Context, ds *DataStream, query string, args []any) error {
+	stmt, err := sf.Snowflake.PrepareContext(gosnowflake.WithHigherPrecision(ctx), query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare query: %w", err)
 	}
+	defer stmt.Close()
 
-	log.Debug().Msg("Finished reading rows")
-	return nil
+	result, err := stmt.QueryContext(gosnowflake.WithHigherPrecision(ctx), args...)
+	if err != nil {
+		return fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer result.Close()
+	return sendRows(ctx, result, ds, nil)
 }
 
 func (sf *SnowflakeDataReader) ExecuteCommand(ctx context.Context, sql_command string) (string, error) {
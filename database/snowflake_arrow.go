@@ -0,0 +1,604 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/decimal128"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/rs/zerolog/log"
+	"github.com/shopspring/decimal"
+	"github.com/snowflakedb/gosnowflake"
+)
+
+// sfFetchWorkers is how many chunks are downloaded at the same time
+const sfFetchWorkers = 4
+
+// sfArrowChunk is a chunk of a result as arrow records, gosnowflake's ArrowBatch
+// downloads it when it is fetched
+type sfArrowChunk interface {
+	Fetch() (*[]arrow.Record, error)
+}
+
+// readArrow sends one query to the stream from the arrow chunks of the result,
+// as records or as rows converted a column at a time instead of scanned
+func (sf *SnowflakeDataReader) readArrow(ctx context.Context, ds *DataStream, query string, args []any) error {
+	conn, err := sf.Snowflake.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	loc, err := sfSessionLocation(ctx, conn, ds.Columns)
+	if err != nil {
+		return err
+	}
+
+	// the timestamps are left as snowflake sends them so none overflow
+	arrowCtx := gosnowflake.WithArrowBatchesTimestampOption(gosnowflake.WithArrowBatches(gosnowflake.WithHigherPrecision(ctx)), gosnowflake.UseOriginalTimestamp)
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	var rows driver.Rows
+	err = conn.Raw(func(driverConn any) error {
+		queryer, ok := driverConn.(driver.QueryerContext)
+		if !ok {
+			return errors.New("snowflake connection cannot query")
+		}
+		rows, err = queryer.QueryContext(arrowCtx, query, named)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	batches, err := rows.(gosnowflake.SnowflakeRows).GetArrowBatches()
+	var sfErr *gosnowflake.SnowflakeError
+	if errors.As(err, &sfErr) && sfErr.Number == gosnowflake.ErrNonArrowResponseInArrowBatches {
+		// some results only come back as JSON
+		log.Debug().Msg("Result is not arrow, reading rows")
+		return sf.queryRows(ctx, ds, query, args)
+	}
+	if err != nil {
+		return err
+	}
+
+	chunks := make([]sfArrowChunk, len(batches))
+	for i, batch := range batches {
+		chunks[i] = batch.WithContext(ctx)
+	}
+	return sendArrowChunks(ctx, chunks, ds, loc)
+}
+
+// sfSessionLocation is the timezone TIMESTAMP_LTZ is shown in, the same one a
+// query would use
+func sfSessionLocation(ctx context.Context, conn *sql.Conn, columns []Column) (*time.Location, error) {
+	for _, col := range columns {
+		if col.DatabaseType == "TIMESTAMP_LTZ" {
+			var now time.Time
+			if err := conn.QueryRowContext(ctx, "SELECT CURRENT_TIMESTAMP()").Scan(&now); err != nil {
+				return nil, fmt.Errorf("failed to find the session timezone: %w", err)
+			}
+			return now.Location(), nil
+		}
+	}
+	return time.UTC, nil
+}
+
+// sfChunk is a chunk converted to records or rows
+type sfChunk struct {
+	records []arrow.RecordBatch
+	rows    [][]any
+	err     error
+}
+
+// errSfRows is a chunk that cannot be sent as records without losing digits
+var errSfRows = errors.New("chunk has to be read as rows")
+
+// sendArrowChunks fetches and converts the chunks with a few workers and sends
+// them in the order of the chunks, so an ORDER BY holds
+func sendArrowChunks(ctx context.Context, chunks []sfArrowChunk, ds *DataStream, loc *time.Location) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	results := make([]chan sfChunk, len(chunks))
+	for i := range results {
+		results[i] = make(chan sfChunk, 1)
+	}
+	defer func() {
+		cancel()
+		wg.Wait()
+		// the records of chunks that were never sent
+		for _, result := range results {
+			select {
+			case chunk := <-result:
+				releaseRecords(chunk.records)
+			default:
+			}
+		}
+	}()
+
+	columnar := sfColumnar(ds.Columns, ds.DestColumns)
+	// only a few chunks are held in memory ahead of the one being sent
+	ahead := make(chan struct{}, 2*sfFetchWorkers)
+	next := make(chan int)
+	go func() {
+		defer close(next)
+		for i := range chunks {
+			select {
+			case ahead <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case next <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for range min(sfFetchWorkers, len(chunks)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] <- fetchChunk(chunks[i], ds.Columns, loc, columnar)
+			}
+		}()
+	}
+
+	batch := Batch{Rows: make([][]any, 0, ds.BatchSize)}
+	send := func() error {
+		log.Trace().Msg("Sending batch")
+		select {
+		case ds.BatchChan <- batch:
+			batch = Batch{Rows: make([][]any, 0, ds.BatchSize)}
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for i := range chunks {
+		var chunk sfChunk
+		select {
+		case chunk = <-results[i]:
+			<-ahead
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if chunk.err != nil {
+			return fmt.Errorf("failed to read chunk %d: %w", i, chunk.err)
+		}
+		if len(chunk.records) > 0 {
+			// the rows of the chunks before go first
+			if len(batch.Rows) > 0 {
+				if err := send(); err != nil {
+					releaseRecords(chunk.records)
+					return err
+				}
+			}
+			if err := sendChunkRecords(ctx, ds, chunk.records); err != nil {
+				return err
+			}
+			continue
+		}
+		for len(chunk.rows) > 0 {
+			n := min(ds.BatchSize-len(batch.Rows), len(chunk.rows))
+			batch.Rows = append(batch.Rows, chunk.rows[:n]...)
+			chunk.rows = chunk.rows[n:]
+			if len(batch.Rows) >= ds.BatchSize {
+				if err := send(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if len(batch.Rows) > 0 {
+		log.Trace().Msg("Sending remaining batch")
+		if err := send(); err != nil {
+			return err
+		}
+	}
+	log.Debug().Msg("Finished reading chunks")
+	return nil
+}
+
+// sendChunkRecords sends the records sliced to the batch size and releases them
+func sendChunkRecords(ctx context.Context, ds *DataStream, records []arrow.RecordBatch) error {
+	defer releaseRecords(records)
+	size := int64(ds.BatchSize)
+	for _, record := range records {
+		for start := int64(0); start < record.NumRows(); start += size {
+			slice := record.NewSlice(start, min(start+size, record.NumRows()))
+			log.Trace().Msg("Sending record")
+			select {
+			case ds.BatchChan <- Batch{Record: slice}:
+			case <-ctx.Done():
+				slice.Release()
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+func releaseRecords(records []arrow.RecordBatch) {
+	for _, record := range records {
+		record.Release()
+	}
+}
+
+// sfColumnar is true when every column can be sent as arrow and give the
+// writers the same values the rows would, a column that was overridden is
+// converted as a row
+func sfColumnar(columns, destColumns []Column) bool {
+	if len(columns) != len(destColumns) {
+		return false
+	}
+	for i, col := range columns {
+		dest := destColumns[i]
+		if dest.Type != col.Type || dest.Precision != col.Precision || dest.Scale != col.Scale {
+			return false
+		}
+		switch col.DatabaseType {
+		case "FIXED":
+			if col.Precision <= 0 || col.Precision > 38 {
+				return false
+			}
+		case "TEXT", "BOOLEAN", "REAL", "BINARY", "DATE", "TIMESTAMP_NTZ", "VARIANT", "OBJECT", "ARRAY":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// fetchChunk downloads a chunk and converts it to records when the stream is
+// columnar, or to rows when it is not or the chunk has to be. The fetched
+// records are released once they are converted.
+func fetchChunk(chunk sfArrowChunk, columns []Column, loc *time.Location, columnar bool) sfChunk {
+	fetched, err := chunk.Fetch()
+	if err != nil {
+		return sfChunk{err: err}
+	}
+	if fetched == nil {
+		return sfChunk{}
+	}
+	records := *fetched
+	defer releaseRecords(records)
+
+	for _, record := range records {
+		if int(record.NumCols()) != len(columns) {
+			return sfChunk{err: fmt.Errorf("chunk has %d columns, expected %d", record.NumCols(), len(columns))}
+		}
+	}
+	if columnar {
+		converted, err := sfChunkRecords(records, columns)
+		if !errors.Is(err, errSfRows) {
+			return sfChunk{records: converted, err: err}
+		}
+		log.Trace().Msg("Reading chunk as rows")
+	}
+	rows, err := sfChunkRows(records, columns, loc)
+	return sfChunk{rows: rows, err: err}
+}
+
+// sfChunkRecords converts the records to the arrow types of the columns, whole
+// numbers and decimals are both decimal128 and timestamps are microseconds
+func sfChunkRecords(records []arrow.RecordBatch, columns []Column) ([]arrow.RecordBatch, error) {
+	converted := make([]arrow.RecordBatch, 0, len(records))
+	for _, record := range records {
+		fields := make([]arrow.Field, len(columns))
+		arrays := make([]arrow.Array, len(columns))
+		for c, col := range columns {
+			arr, err := sfArrowColumn(record.Column(c), record.Schema().Field(c), col)
+			if err != nil {
+				releaseArrays(arrays)
+				releaseRecords(converted)
+				if errors.Is(err, errSfRows) {
+					return nil, err
+				}
+				return nil, fmt.Errorf("column %s: %w", col.Name, err)
+			}
+			arrays[c] = arr
+			fields[c] = arrow.Field{Name: col.Name, Type: arr.DataType(), Nullable: true}
+		}
+		converted = append(converted, array.NewRecordBatch(arrow.NewSchema(fields, nil), arrays, record.NumRows()))
+		releaseArrays(arrays)
+	}
+	return converted, nil
+}
+
+func releaseArrays(arrays []arrow.Array) {
+	for _, arr := range arrays {
+		if arr != nil {
+			arr.Release()
+		}
+	}
+}
+
+// sfArrowColumn is the column as the arrow type the writers take, the types
+// snowflake already sends that way are kept as they are
+func sfArrowColumn(arr arrow.Array, field arrow.Field, col Column) (arrow.Array, error) {
+	switch col.DatabaseType {
+	case "FIXED":
+		return sfFixedColumn(arr, col)
+	case "TIMESTAMP_NTZ":
+		return sfTimestampColumn(arr, field, col)
+	}
+
+	switch arr.(type) {
+	case *array.String, *array.Boolean, *array.Float64, *array.Binary, *array.Date32:
+		arr.Retain()
+		return arr, nil
+	}
+	return nil, fmt.Errorf("cannot read %s as %s from arrow, read it without ArrowBatches", col.DatabaseType, arr.DataType())
+}
+
+// sfFixedColumn is the unscaled numbers as a decimal of the column's precision and scale
+func sfFixedColumn(arr arrow.Array, col Column) (arrow.Array, error) {
+	var value func(i int) decimal128.Num
+	switch a := arr.(type) {
+	case *array.Int8:
+		value = func(i int) decimal128.Num { return decimal128.FromI64(int64(a.Value(i))) }
+	case *array.Int16:
+		value = func(i int) decimal128.Num { return decimal128.FromI64(int64(a.Value(i))) }
+	case *array.Int32:
+		value = func(i int) decimal128.Num { return decimal128.FromI64(int64(a.Value(i))) }
+	case *array.Int64:
+		value = func(i int) decimal128.Num { return decimal128.FromI64(a.Value(i)) }
+	case *array.Decimal128:
+		value = a.Value
+	default:
+		return nil, fmt.Errorf("cannot read FIXED as %s from arrow", arr.DataType())
+	}
+
+	b := array.NewDecimal128Builder(memory.DefaultAllocator, &arrow.Decimal128Type{Precision: int32(col.Precision), Scale: int32(col.Scale)})
+	defer b.Release()
+	b.Reserve(arr.Len())
+	for i := range arr.Len() {
+		if arr.IsNull(i) {
+			b.AppendNull()
+			continue
+		}
+		b.Append(value(i))
+	}
+	return b.NewArray(), nil
+}
+
+// sfTimestampColumn is a TIMESTAMP_NTZ as microseconds without a timezone, a
+// finer scale has to be read as rows to keep its digits
+func sfTimestampColumn(arr arrow.Array, field arrow.Field, col Column) (arrow.Array, error) {
+	scale, err := sfFieldScale(field)
+	if err != nil || scale > 6 {
+		return nil, errSfRows
+	}
+	value, _, err := sfTimestamps(arr, field, col)
+	if err != nil {
+		return nil, err
+	}
+
+	b := array.NewTimestampBuilder(memory.DefaultAllocator, &arrow.TimestampType{Unit: arrow.Microsecond})
+	defer b.Release()
+	b.Reserve(arr.Len())
+	for i := range arr.Len() {
+		if arr.IsNull(i) {
+			b.AppendNull()
+			continue
+		}
+		b.Append(arrow.Timestamp(value(i).UnixMicro()))
+	}
+	return b.NewArray(), nil
+}
+
+// sfChunkRows converts the records to rows
+func sfChunkRows(records []arrow.RecordBatch, columns []Column, loc *time.Location) ([][]any, error) {
+	var rows [][]any
+	for _, record := range records {
+		start := len(rows)
+		for range record.NumRows() {
+			rows = append(rows, make([]any, len(columns)))
+		}
+		for c, col := range columns {
+			if err := sfArrowValues(record.Column(c), record.Schema().Field(c), col, loc, rows[start:], c); err != nil {
+				return nil, fmt.Errorf("column %s: %w", col.Name, err)
+			}
+		}
+	}
+	return rows, nil
+}
+
+// sfArrowValues sets column c of the rows from one arrow column, the values are
+// the same ones a query gives except scaled numbers are exact decimals
+func sfArrowValues(arr arrow.Array, field arrow.Field, col Column, loc *time.Location, rows [][]any, c int) error {
+	set := func(value func(i int) any) {
+		for i := range rows {
+			if arr.IsNull(i) {
+				continue
+			}
+			rows[i][c] = value(i)
+		}
+	}
+
+	switch col.DatabaseType {
+	case "FIXED":
+		return sfFixedValues(arr, col, rows, c)
+	case "TIMESTAMP_NTZ", "TIMESTAMP_LTZ", "TIMESTAMP_TZ":
+		return sfTimestampValues(arr, field, col, loc, rows, c)
+	}
+
+	// strings and bytes are copied, they point into the record
+	switch a := arr.(type) {
+	case *array.String:
+		set(func(i int) any { return strings.Clone(a.Value(i)) })
+	case *array.Boolean:
+		set(func(i int) any { return a.Value(i) })
+	case *array.Float64:
+		set(func(i int) any { return a.Value(i) })
+	case *array.Binary:
+		set(func(i int) any { return bytes.Clone(a.Value(i)) })
+	case *array.Date32:
+		set(func(i int) any { return time.Unix(int64(a.Value(i))*86400, 0).UTC() })
+	case *array.Time64:
+		// gosnowflake casts times to nanoseconds
+		set(func(i int) any { return time.Time{}.Add(time.Duration(a.Value(i))) })
+	default:
+		return fmt.Errorf("cannot read %s as %s from arrow, read it without ArrowBatches", col.DatabaseType, arr.DataType())
+	}
+	return nil
+}
+
+// sfFixedValues are whole numbers as int64, or *big.Int when the precision does
+// not fit one, and decimals when there is a scale
+func sfFixedValues(arr arrow.Array, col Column, rows [][]any, c int) error {
+	scale := int32(col.Scale)
+	fromInt := func(v int64) any {
+		switch {
+		case scale != 0:
+			return decimal.New(v, -scale)
+		case col.Precision >= 19:
+			return big.NewInt(v)
+		default:
+			return v
+		}
+	}
+
+	var value func(i int) any
+	switch a := arr.(type) {
+	case *array.Int8:
+		value = func(i int) any { return fromInt(int64(a.Value(i))) }
+	case *array.Int16:
+		value = func(i int) any { return fromInt(int64(a.Value(i))) }
+	case *array.Int32:
+		value = func(i int) any { return fromInt(int64(a.Value(i))) }
+	case *array.Int64:
+		value = func(i int) any { return fromInt(a.Value(i)) }
+	case *array.Decimal128:
+		value = func(i int) any {
+			unscaled := a.Value(i).BigInt()
+			if scale != 0 {
+				return decimal.NewFromBigInt(unscaled, -scale)
+			}
+			return unscaled
+		}
+	default:
+		return fmt.Errorf("cannot read FIXED as %s from arrow", arr.DataType())
+	}
+	for i := range rows {
+		if !arr.IsNull(i) {
+			rows[i][c] = value(i)
+		}
+	}
+	return nil
+}
+
+// sfTimestampValues sets column c of the rows from the timestamps. NTZ is UTC,
+// LTZ is in the session timezone and TZ keeps its offset, like a query.
+func sfTimestampValues(arr arrow.Array, field arrow.Field, col Column, loc *time.Location, rows [][]any, c int) error {
+	value, offset, err := sfTimestamps(arr, field, col)
+	if err != nil {
+		return err
+	}
+
+	for i := range rows {
+		if arr.IsNull(i) {
+			continue
+		}
+		t := value(i)
+		switch col.DatabaseType {
+		case "TIMESTAMP_NTZ":
+			t = t.UTC()
+		case "TIMESTAMP_LTZ":
+			t = t.In(loc)
+		case "TIMESTAMP_TZ":
+			t = t.In(offset(i))
+		}
+		rows[i][c] = t
+	}
+	return nil
+}
+
+// sfTimestamps decodes the timestamps as snowflake sends them, a whole number
+// of the field's scale or a struct of the seconds and nanoseconds, TZ has the
+// offset in minutes plus 1440 as the last field
+func sfTimestamps(arr arrow.Array, field arrow.Field, col Column) (func(i int) time.Time, func(i int) *time.Location, error) {
+	// gosnowflake reports no scale for timestamp columns, only the field has it
+	scale, scaleErr := sfFieldScale(field)
+	fromScaled := func(v int64) time.Time {
+		unit := int64(math.Pow10(scale))
+		return time.Unix(v/unit, (v%unit)*int64(math.Pow10(9-scale)))
+	}
+	typeErr := fmt.Errorf("cannot read %s as %s from arrow", col.DatabaseType, arr.DataType())
+
+	var value func(i int) time.Time
+	var offset func(i int) *time.Location
+	switch a := arr.(type) {
+	case *array.Int64:
+		if scaleErr != nil {
+			return nil, nil, scaleErr
+		}
+		value = func(i int) time.Time { return fromScaled(a.Value(i)) }
+	case *array.Struct:
+		epoch, ok := a.Field(0).(*array.Int64)
+		if !ok {
+			return nil, nil, typeErr
+		}
+		fields := a.NumField()
+		if col.DatabaseType == "TIMESTAMP_TZ" {
+			tz, ok := a.Field(fields - 1).(*array.Int32)
+			if !ok {
+				return nil, nil, typeErr
+			}
+			offset = func(i int) *time.Location { return gosnowflake.Location(int(tz.Value(i)) - 1440) }
+			fields--
+		}
+		switch fields {
+		case 1:
+			if scaleErr != nil {
+				return nil, nil, scaleErr
+			}
+			value = func(i int) time.Time { return fromScaled(epoch.Value(i)) }
+		case 2:
+			fraction, ok := a.Field(1).(*array.Int32)
+			if !ok {
+				return nil, nil, typeErr
+			}
+			value = func(i int) time.Time { return time.Unix(epoch.Value(i), int64(fraction.Value(i))) }
+		default:
+			return nil, nil, typeErr
+		}
+	default:
+		return nil, nil, typeErr
+	}
+	if col.DatabaseType == "TIMESTAMP_TZ" && offset == nil {
+		return nil, nil, typeErr
+	}
+	return value, offset, nil
+}
+
+// sfFieldScale is the scale snowflake puts in the metadata of a field
+func sfFieldScale(field arrow.Field) (int, error) {
+	idx := field.Metadata.FindKey("scale")
+	if idx == -1 {
+		return 0, fmt.Errorf("field %s has no scale", field.Name)
+	}
+	scale, err := strconv.Atoi(field.Metadata.Values()[idx])
+	if err != nil || scale < 0 || scale > 9 {
+		return 0, fmt.Errorf("field %s has a scale of %q", field.Name, field.Metadata.Values()[idx])
+	}
+	return scale, nil
+}
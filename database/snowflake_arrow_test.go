@@ -0,0 +1,419 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/decimal128"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/johanan/mvr/data"
+	"github.com/shopspring/decimal"
+	"github.com/zeebo/assert"
+)
+
+// recordedChunk is a chunk as gosnowflake hands it back with the original timestamps
+type recordedChunk struct {
+	records []arrow.Record
+	delay   time.Duration
+	err     error
+}
+
+func (c recordedChunk) Fetch() (*[]arrow.Record, error) {
+	time.Sleep(c.delay)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &c.records, nil
+}
+
+var sfTimestampStruct = arrow.StructOf(
+	arrow.Field{Name: "epoch", Type: arrow.PrimitiveTypes.Int64},
+	arrow.Field{Name: "fraction", Type: arrow.PrimitiveTypes.Int32},
+)
+
+var sfTimestampTZStruct = arrow.StructOf(
+	arrow.Field{Name: "epoch", Type: arrow.PrimitiveTypes.Int64},
+	arrow.Field{Name: "fraction", Type: arrow.PrimitiveTypes.Int32},
+	arrow.Field{Name: "timezone", Type: arrow.PrimitiveTypes.Int32},
+)
+
+var sfTimestampTZScaledStruct = arrow.StructOf(
+	arrow.Field{Name: "epoch", Type: arrow.PrimitiveTypes.Int64},
+	arrow.Field{Name: "timezone", Type: arrow.PrimitiveTypes.Int32},
+)
+
+// sfRecordedColumns are the columns of the recorded chunks the way CreateDataStream
+// builds them, gosnowflake reports no precision or scale for timestamps
+func sfRecordedColumns() []Column {
+	return sfColumnsToPg([]Column{
+		{Name: "ID", DatabaseType: "FIXED", Precision: 38},
+		{Name: "AMOUNT", DatabaseType: "FIXED", Precision: 10, Scale: 2},
+		{Name: "HUGE", DatabaseType: "FIXED", Precision: 38},
+		{Name: "SMALL", DatabaseType: "FIXED", Precision: 9},
+		{Name: "NAME", DatabaseType: "TEXT"},
+		{Name: "ACTIVE", DatabaseType: "BOOLEAN"},
+		{Name: "SCORE", DatabaseType: "REAL"},
+		{Name: "BORN", DatabaseType: "DATE"},
+		{Name: "AT", DatabaseType: "TIME", Precision: 9},
+		{Name: "NTZ", DatabaseType: "TIMESTAMP_NTZ"},
+		{Name: "NTZ3", DatabaseType: "TIMESTAMP_NTZ"},
+		{Name: "LTZ", DatabaseType: "TIMESTAMP_LTZ"},
+		{Name: "TZ", DatabaseType: "TIMESTAMP_TZ"},
+		{Name: "TZ3", DatabaseType: "TIMESTAMP_TZ"},
+		{Name: "DATA", DatabaseType: "BINARY"},
+		{Name: "DOC", DatabaseType: "VARIANT"},
+	})
+}
+
+// sfScale is the field metadata snowflake sends with the scale of a timestamp
+func sfScale(scale string) arrow.Metadata {
+	return arrow.NewMetadata([]string{"scale"}, []string{scale})
+}
+
+// sfRecord is one row of values and one row of nulls
+func sfRecord(t *testing.T, pool memory.Allocator, at time.Time) arrow.Record {
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "ID", Type: arrow.PrimitiveTypes.Int8, Nullable: true},
+		{Name: "AMOUNT", Type: arrow.PrimitiveTypes.Int32, Nullable: true},
+		{Name: "HUGE", Type: &arrow.Decimal128Type{Precision: 38}, Nullable: true},
+		{Name: "SMALL", Type: arrow.PrimitiveTypes.Int64, Nullable: true},
+		{Name: "NAME", Type: arrow.BinaryTypes.String, Nullable: true},
+		{Name: "ACTIVE", Type: arrow.FixedWidthTypes.Boolean, Nullable: true},
+		{Name: "SCORE", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+		{Name: "BORN", Type: arrow.FixedWidthTypes.Date32, Nullable: true},
+		{Name: "AT", Type: arrow.FixedWidthTypes.Time64ns, Nullable: true},
+		{Name: "NTZ", Type: sfTimestampStruct, Nullable: true, Metadata: sfScale("9")},
+		{Name: "NTZ3", Type: arrow.PrimitiveTypes.Int64, Nullable: true, Metadata: sfScale("3")},
+		{Name: "LTZ", Type: sfTimestampStruct, Nullable: true, Metadata: sfScale("9")},
+		{Name: "TZ", Type: sfTimestampTZStruct, Nullable: true, Metadata: sfScale("9")},
+		{Name: "TZ3", Type: sfTimestampTZScaledStruct, Nullable: true, Metadata: sfScale("3")},
+		{Name: "DATA", Type: arrow.BinaryTypes.Binary, Nullable: true},
+		{Name: "DOC", Type: arrow.BinaryTypes.String, Nullable: true},
+	}, nil)
+	b := array.NewRecordBuilder(pool, schema)
+	defer b.Release()
+
+	huge, ok := new(big.Int).SetString("123456789012345678901234567890", 10)
+	assert.True(t, ok)
+	b.Field(0).(*array.Int8Builder).Append(7)
+	b.Field(1).(*array.Int32Builder).Append(-1050)
+	b.Field(2).(*array.Decimal128Builder).Append(decimal128.FromBigInt(huge))
+	b.Field(3).(*array.Int64Builder).Append(42)
+	b.Field(4).(*array.StringBuilder).Append("John Doe")
+	b.Field(5).(*array.BooleanBuilder).Append(true)
+	b.Field(6).(*array.Float64Builder).Append(1.5)
+	b.Field(7).(*array.Date32Builder).Append(arrow.Date32FromTime(at))
+	b.Field(8).(*array.Time64Builder).Append(arrow.Time64((17*time.Hour + 22*time.Minute + 123*time.Microsecond).Nanoseconds()))
+	appendStruct := func(sb *array.StructBuilder, values ...int64) {
+		sb.Append(true)
+		for i, v := range values {
+			switch fb := sb.FieldBuilder(i).(type) {
+			case *array.Int64Builder:
+				fb.Append(v)
+			case *array.Int32Builder:
+				fb.Append(int32(v))
+			}
+		}
+	}
+	appendStruct(b.Field(9).(*array.StructBuilder), at.Unix(), int64(at.Nanosecond()))
+	b.Field(10).(*array.Int64Builder).Append(at.UnixMilli())
+	appendStruct(b.Field(11).(*array.StructBuilder), at.Unix(), int64(at.Nanosecond()))
+	// -04:00 is 1440 - 240 minutes
+	appendStruct(b.Field(12).(*array.StructBuilder), at.Unix(), int64(at.Nanosecond()), 1200)
+	appendStruct(b.Field(13).(*array.StructBuilder), at.UnixMilli(), 1500)
+	b.Field(14).(*array.BinaryBuilder).Append([]byte{1, 2, 3})
+	b.Field(15).(*array.StringBuilder).Append(`{"a": 1}`)
+
+	for _, fb := range b.Fields() {
+		fb.AppendNull()
+	}
+	return b.NewRecord()
+}
+
+func TestSfArrowValues(t *testing.T) {
+	at := time.Date(2024, 10, 8, 17, 22, 0, 123456789, time.UTC)
+	ltz, err := time.LoadLocation("America/Chicago")
+	assert.NoError(t, err)
+	// the records are released once they are rows
+	pool := memory.NewCheckedAllocator(memory.DefaultAllocator)
+	defer pool.AssertSize(t, 0)
+	record := sfRecord(t, pool, at)
+
+	chunk := fetchChunk(recordedChunk{records: []arrow.Record{record}}, sfRecordedColumns(), ltz, false)
+	assert.NoError(t, chunk.err)
+	rows := chunk.rows
+	assert.Equal(t, 2, len(rows))
+
+	huge, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	tests := []struct {
+		name     string
+		expected any
+	}{
+		{name: "ID", expected: big.NewInt(7)},
+		{name: "AMOUNT", expected: decimal.RequireFromString("-10.50")},
+		{name: "HUGE", expected: huge},
+		{name: "SMALL", expected: int64(42)},
+		{name: "NAME", expected: "John Doe"},
+		{name: "ACTIVE", expected: true},
+		{name: "SCORE", expected: 1.5},
+		{name: "BORN", expected: time.Date(2024, 10, 8, 0, 0, 0, 0, time.UTC)},
+		{name: "AT", expected: time.Time{}.Add(17*time.Hour + 22*time.Minute + 123*time.Microsecond)},
+		{name: "NTZ", expected: at},
+		{name: "NTZ3", expected: at.Truncate(time.Millisecond)},
+		{name: "LTZ", expected: at.In(ltz)},
+		{name: "TZ", expected: at.In(time.FixedZone("", -4*60*60))},
+		{name: "TZ3", expected: at.Truncate(time.Millisecond).In(time.FixedZone("", 60*60))},
+		{name: "DATA", expected: []byte{1, 2, 3}},
+		{name: "DOC", expected: `{"a": 1}`},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := rows[0][i]
+			switch expected := tt.expected.(type) {
+			case time.Time:
+				value, ok := actual.(time.Time)
+				assert.True(t, ok)
+				assert.True(t, expected.Equal(value))
+				// the wall clock decides how a timestamp is written
+				assert.Equal(t, expected.Format(time.RFC3339Nano), value.Format(time.RFC3339Nano))
+			case decimal.Decimal:
+				value, ok := actual.(decimal.Decimal)
+				assert.True(t, ok)
+				assert.True(t, expected.Equal(value))
+			case *big.Int:
+				value, ok := actual.(*big.Int)
+				assert.True(t, ok)
+				assert.Equal(t, 0, expected.Cmp(value))
+			default:
+				assert.DeepEqual(t, tt.expected, actual)
+			}
+			assert.Nil(t, rows[1][i])
+		})
+	}
+}
+
+func TestSfArrowValuesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		columns func([]Column) []Column
+	}{
+		{name: "Fewer columns", columns: func(c []Column) []Column { return c[:3] }},
+		{name: "Text as a number", columns: func(c []Column) []Column { c[4].DatabaseType = "FIXED"; return c }},
+		{name: "Number as a timestamp", columns: func(c []Column) []Column { c[6].DatabaseType = "TIMESTAMP_NTZ"; return c }},
+		{name: "TZ without an offset", columns: func(c []Column) []Column { c[10].DatabaseType = "TIMESTAMP_TZ"; return c }},
+		{name: "Unknown arrow type", columns: func(c []Column) []Column { c[9].DatabaseType = "OBJECT"; return c }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := memory.NewCheckedAllocator(memory.DefaultAllocator)
+			defer pool.AssertSize(t, 0)
+			record := sfRecord(t, pool, time.Now())
+			chunk := fetchChunk(recordedChunk{records: []arrow.Record{record}}, tt.columns(sfRecordedColumns()), time.UTC, false)
+			assert.Error(t, chunk.err)
+		})
+	}
+
+	// a scaled timestamp cannot be read without the scale of its field
+	record := sfRecord(t, memory.DefaultAllocator, time.Now())
+	defer record.Release()
+	ntz3 := record.Schema().Field(10)
+	ntz3.Metadata = arrow.Metadata{}
+	noScale := array.NewRecord(arrow.NewSchema([]arrow.Field{ntz3}, nil), record.Columns()[10:11], record.NumRows())
+	chunk := fetchChunk(recordedChunk{records: []arrow.Record{noScale}}, sfRecordedColumns()[10:11], time.UTC, false)
+	assert.Error(t, chunk.err)
+}
+
+// sfSelect is a record of some of the columns of the record
+func sfSelect(record arrow.Record, columns ...int) arrow.Record {
+	fields := make([]arrow.Field, len(columns))
+	arrays := make([]arrow.Array, len(columns))
+	for i, c := range columns {
+		fields[i] = record.Schema().Field(c)
+		arrays[i] = record.Column(c)
+	}
+	return array.NewRecord(arrow.NewSchema(fields, nil), arrays, record.NumRows())
+}
+
+func TestSfArrowRecords(t *testing.T) {
+	at := time.Date(2024, 10, 8, 17, 22, 0, 123456789, time.UTC)
+	huge, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	// everything but the time, the timestamps with a timezone and NTZ
+	columnar := []int{0, 1, 2, 3, 4, 5, 6, 7, 10, 14, 15}
+	all := sfRecordedColumns()
+	columns := make([]Column, len(columnar))
+	for i, c := range columnar {
+		columns[i] = all[c]
+	}
+	assert.True(t, sfColumnar(columns, columns))
+
+	pool := memory.NewCheckedAllocator(memory.DefaultAllocator)
+	defer pool.AssertSize(t, 0)
+	record := sfRecord(t, pool, at)
+	selected := sfSelect(record, columnar...)
+	record.Release()
+
+	chunk := fetchChunk(recordedChunk{records: []arrow.Record{selected}}, columns, time.UTC, true)
+	assert.NoError(t, chunk.err)
+	assert.Nil(t, chunk.rows)
+	assert.Equal(t, 1, len(chunk.records))
+	converted := chunk.records[0]
+	defer converted.Release()
+
+	tests := []struct {
+		name     string
+		dataType arrow.DataType
+		expected any
+	}{
+		{name: "ID", dataType: &arrow.Decimal128Type{Precision: 38}, expected: decimal.NewFromInt(7)},
+		{name: "AMOUNT", dataType: &arrow.Decimal128Type{Precision: 10, Scale: 2}, expected: decimal.RequireFromString("-10.50")},
+		{name: "HUGE", dataType: &arrow.Decimal128Type{Precision: 38}, expected: decimal.NewFromBigInt(huge, 0)},
+		{name: "SMALL", dataType: &arrow.Decimal128Type{Precision: 9}, expected: decimal.NewFromInt(42)},
+		{name: "NAME", dataType: arrow.BinaryTypes.String, expected: "John Doe"},
+		{name: "ACTIVE", dataType: arrow.FixedWidthTypes.Boolean, expected: true},
+		{name: "SCORE", dataType: arrow.PrimitiveTypes.Float64, expected: 1.5},
+		{name: "BORN", dataType: arrow.FixedWidthTypes.Date32, expected: time.Date(2024, 10, 8, 0, 0, 0, 0, time.UTC)},
+		{name: "NTZ3", dataType: &arrow.TimestampType{Unit: arrow.Microsecond}, expected: at.Truncate(time.Millisecond)},
+		{name: "DATA", dataType: arrow.BinaryTypes.Binary, expected: []byte{1, 2, 3}},
+		{name: "DOC", dataType: arrow.BinaryTypes.String, expected: `{"a": 1}`},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arr := converted.Column(i)
+			assert.True(t, arrow.TypeEqual(tt.dataType, arr.DataType()))
+			actual := data.ArrowValue(arr, 0)
+			if expected, ok := tt.expected.(decimal.Decimal); ok {
+				assert.True(t, expected.Equal(actual.(decimal.Decimal)))
+			} else {
+				assert.DeepEqual(t, tt.expected, actual)
+			}
+			assert.True(t, arr.IsNull(1))
+		})
+	}
+
+	// NTZ keeps its nanoseconds as rows
+	record = sfRecord(t, pool, at)
+	ntz := sfSelect(record, 0, 9)
+	record.Release()
+	chunk = fetchChunk(recordedChunk{records: []arrow.Record{ntz}}, []Column{all[0], all[9]}, time.UTC, true)
+	assert.NoError(t, chunk.err)
+	assert.Nil(t, chunk.records)
+	assert.Equal(t, at, chunk.rows[0][1])
+}
+
+func TestSfColumnar(t *testing.T) {
+	columns := sfRecordedColumns()
+	tests := []struct {
+		name     string
+		columns  []Column
+		dest     func([]Column) []Column
+		expected bool
+	}{
+		{name: "Numbers and text", columns: columns[:8], dest: func(c []Column) []Column { return c }, expected: true},
+		{name: "Time", columns: columns[8:9], dest: func(c []Column) []Column { return c }},
+		{name: "Timestamps with a timezone", columns: columns[11:14], dest: func(c []Column) []Column { return c }},
+		{name: "Overridden type", columns: columns[:1], dest: func(c []Column) []Column { c[0].Type = "BIGINT"; return c }},
+		{name: "Overridden scale", columns: columns[1:2], dest: func(c []Column) []Column { c[0].Scale = 4; return c }},
+		{name: "No precision", columns: []Column{{Type: "NUMERIC", DatabaseType: "FIXED"}}, dest: func(c []Column) []Column { return c }},
+		{name: "No dest columns", columns: columns[:1], dest: func(c []Column) []Column { return nil }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := tt.dest(append([]Column{}, tt.columns...))
+			assert.Equal(t, tt.expected, sfColumnar(tt.columns, dest))
+		})
+	}
+}
+
+// idChunk is a chunk of records of sequential ids
+func idChunk(pool memory.Allocator, start int64, sizes ...int) []arrow.Record {
+	var records []arrow.Record
+	for _, size := range sizes {
+		b := array.NewInt64Builder(pool)
+		for range size {
+			b.Append(start)
+			start++
+		}
+		ids := b.NewArray()
+		b.Release()
+		schema := arrow.NewSchema([]arrow.Field{{Name: "ID", Type: arrow.PrimitiveTypes.Int64}}, nil)
+		records = append(records, array.NewRecord(schema, []arrow.Array{ids}, int64(size)))
+		ids.Release()
+	}
+	return records
+}
+
+func TestSendArrowChunks(t *testing.T) {
+	pool := memory.NewCheckedAllocator(memory.DefaultAllocator)
+	// the first chunks are the slowest so the later ones are ready first
+	newChunks := func() []sfArrowChunk {
+		chunks := []sfArrowChunk{
+			recordedChunk{records: idChunk(pool, 0, 4, 3), delay: 30 * time.Millisecond},
+			recordedChunk{records: idChunk(pool, 7, 5), delay: 20 * time.Millisecond},
+			recordedChunk{records: nil},
+			recordedChunk{records: idChunk(pool, 12, 1, 1, 1)},
+		}
+		for i := range 12 {
+			chunks = append(chunks, recordedChunk{records: idChunk(pool, int64(15+i*2), 2)})
+		}
+		return chunks
+	}
+	chunks := newChunks()
+	columns := []Column{{Name: "ID", DatabaseType: "FIXED", Precision: 18}}
+
+	ds := &DataStream{BatchChan: make(chan data.Batch, 100), BatchSize: 4, Columns: columns}
+	assert.NoError(t, sendArrowChunks(context.Background(), chunks, ds, time.UTC))
+	close(ds.BatchChan)
+
+	var ids []int64
+	for batch := range ds.BatchChan {
+		assert.True(t, len(batch.Rows) <= 4)
+		for _, row := range batch.Rows {
+			ids = append(ids, row[0].(int64))
+		}
+	}
+	assert.Equal(t, 39, len(ids))
+	for i, id := range ids {
+		assert.Equal(t, int64(i), id)
+	}
+	// every chunk was fetched, so every record was released
+	pool.AssertSize(t, 0)
+
+	// a columnar stream sends the chunks as records, still in order
+	pgColumns := sfColumnsToPg(columns)
+	ds = &DataStream{BatchChan: make(chan data.Batch, 100), BatchSize: 4, Columns: pgColumns, DestColumns: pgColumns}
+	assert.NoError(t, sendArrowChunks(context.Background(), newChunks(), ds, time.UTC))
+	close(ds.BatchChan)
+	ids = nil
+	for batch := range ds.BatchChan {
+		assert.Nil(t, batch.Rows)
+		assert.True(t, batch.Record.NumRows() <= 4)
+		for _, row := range data.RecordRows(batch.Record) {
+			ids = append(ids, row[0].(decimal.Decimal).IntPart())
+		}
+		batch.Record.Release()
+	}
+	assert.Equal(t, 39, len(ids))
+	for i, id := range ids {
+		assert.Equal(t, int64(i), id)
+	}
+	pool.AssertSize(t, 0)
+
+	failed := append(newChunks()[:2:2], recordedChunk{err: errors.New("download failed")})
+	ds = &DataStream{BatchChan: make(chan data.Batch, 100), BatchSize: 4, Columns: columns}
+	assert.Error(t, sendArrowChunks(context.Background(), failed, ds, time.UTC))
+
+	// nothing reads the batches, the context stops it
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ds = &DataStream{BatchChan: make(chan data.Batch), BatchSize: 4, Columns: columns}
+	assert.True(t, errors.Is(sendArrowChunks(ctx, newChunks(), ds, time.UTC), context.DeadlineExceeded))
+}
@@ -0,0 +1,295 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johanan/mvr/data"
+	"github.com/rs/zerolog/log"
+	"github.com/shopspring/decimal"
+	"github.com/spf13/cast"
+	_ "modernc.org/sqlite"
+)
+
+type SQLiteDataReader struct {
+	Conn *sql.DB
+}
+
+func NewSQLiteDataReader(connUrl *url.URL) (*SQLiteDataReader, error) {
+	if connUrl.Scheme != "sqlite" {
+		return nil, errors.New("only sqlite connections are supported")
+	}
+
+	// sqlite:///abs/path.db, sqlite://relative/path.db and sqlite:path.db all work
+	path := connUrl.Opaque
+	if path == "" {
+		path = connUrl.Host + connUrl.Path
+	}
+	if path == "" {
+		return nil, errors.New("sqlite connection requires a file path")
+	}
+
+	// never write to a database we were handed
+	q := connUrl.Query()
+	if q.Get("mode") == "" {
+		q.Set("mode", "ro")
+	}
+
+	db, err := sql.Open("sqlite", "file:"+path+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	return &SQLiteDataReader{Conn: db}, nil
+}
+
+func (reader *SQLiteDataReader) Close() error {
+	return reader.Conn.Close()
+}
+
+func (reader *SQLiteDataReader) CreateDataStream(ctx context.Context, connUrl *url.URL, config *data.StreamConfig) (*DataStream, error) {
+	col_query := "SELECT * FROM (" + config.SQL + ") LIMIT 0"
+	log.Debug().Str("sql", col_query).Msg("Getting columns")
+
+	paramValues := BuildParams(config)
+	rows, err := reader.Conn.QueryContext(ctx, col_query, paramValues...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dbCols, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := MapToMvrColumns(dbCols)
+	destColumns := sqliteColumnsToPg(columns)
+	srcColumns := sqliteColumnsToPg(columns)
+
+	if len(config.Columns) > 0 {
+		destColumns = data.OverrideColumns(destColumns, config.Columns)
+	}
+
+	batchChan := make(chan Batch, config.GetBatchCount())
+	logColumns(columns, destColumns)
+	return &DataStream{TotalRows: 0, BatchChan: batchChan, BatchSize: config.GetBatchSize(), Columns: srcColumns, DestColumns: destColumns}, nil
+}
+
+func (reader *SQLiteDataReader) ExecuteDataStream(ctx context.Context, ds *DataStream, config *data.StreamConfig) error {
+	log.Debug().Str("sql", config.SQL).Msg("Executing data stream")
+	paramValues := BuildParams(config)
+	rows, err := reader.Conn.QueryContext(ctx, config.SQL, paramValues...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	batch := Batch{Rows: make([][]any, 0, ds.BatchSize)}
+	defer func() {
+		close(ds.BatchChan)
+		log.Debug().Msg("Closed batch channel")
+	}()
+
+	for rows.Next() {
+		row := make([]any, len(ds.Columns))
+		rowPtrs := make([]any, len(ds.Columns))
+		for i := range row {
+			rowPtrs[i] = &row[i]
+		}
+		if err := rows.Scan(rowPtrs...); err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		// any column can hold any storage class, so coerce to the declared type
+		for i, col := range ds.DestColumns {
+			value, err := sqliteValue(row[i], col)
+			if err != nil {
+				return fmt.Errorf("failed to convert column %s: %w", col.Name, err)
+			}
+			row[i] = value
+		}
+
+		batch.Rows = append(batch.Rows, row)
+
+		if len(batch.Rows) >= ds.BatchSize {
+			log.Trace().Msg("Sending batch")
+			select {
+			case ds.BatchChan <- batch:
+				batch = data.Batch{Rows: make([][]any, 0, ds.BatchSize)}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Send any remaining rows
+	if len(batch.Rows) > 0 {
+		log.Trace().Msg("Sending remaining batch")
+		select {
+		case ds.BatchChan <- batch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	log.Debug().Msg("Finished reading rows")
+
+	return nil
+}
+
+func sqliteValue(value any, col Column) (any, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	switch col.Type {
+	case "BOOLEAN":
+		switch v := value.(type) {
+		case string:
+			return strconv.ParseBool(v)
+		default:
+			return cast.ToInt64(v) != 0, nil
+		}
+	case "SMALLINT", "INTEGER", "BIGINT":
+		return cast.ToInt64E(value)
+	case "REAL", "DOUBLE":
+		return cast.ToFloat64E(value)
+	case "NUMERIC":
+		switch v := value.(type) {
+		case int64:
+			return decimal.NewFromInt(v), nil
+		case float64:
+			return decimal.NewFromFloat(v), nil
+		case string:
+			return decimal.NewFromString(v)
+		default:
+			return value, nil
+		}
+	case "DATE", "TIMESTAMP", "TIMESTAMPTZ":
+		switch v := value.(type) {
+		case string:
+			return data.ParseTimestamp(v)
+		case int64:
+			// unix epoch seconds
+			return time.Unix(v, 0).UTC(), nil
+		case float64:
+			// julian day number
+			return time.Unix(int64((v-2440587.5)*86400), 0).UTC(), nil
+		default:
+			return value, nil
+		}
+	case "UUID":
+		return value, nil
+	case "BYTEA":
+		if v, ok := value.([]byte); ok {
+			return data.ByteaToString(v), nil
+		}
+		return cast.ToString(value), nil
+	default:
+		if v, ok := value.([]byte); ok {
+			return string(v), nil
+		}
+		return value, nil
+	}
+}
+
+// sqliteTypeArgs splits a declared type like DECIMAL(10, 2) into the name and its arguments
+func sqliteTypeArgs(declared string) (string, []int64) {
+	start := strings.Index(declared, "(")
+	if start == -1 {
+		return strings.TrimSpace(declared), nil
+	}
+
+	name := strings.TrimSpace(declared[:start])
+	end := strings.Index(declared, ")")
+	if end < start {
+		return name, nil
+	}
+
+	var args []int64
+	for _, arg := range strings.Split(declared[start+1:end], ",") {
+		n, err := strconv.ParseInt(strings.TrimSpace(arg), 10, 64)
+		if err != nil {
+			return name, nil
+		}
+		args = append(args, n)
+	}
+	return name, args
+}
+
+// sqliteColumnsToPg uses the declared type, falling back to the
+// affinity rules https://www.sqlite.org/datatype3.html#determination_of_column_affinity
+func sqliteColumnsToPg(columns []Column) []Column {
+	pgCols := make([]Column, len(columns))
+	copy(pgCols, columns)
+	for i, col := range pgCols {
+		name, args := sqliteTypeArgs(col.DatabaseType)
+		pgCols[i].Length = 0
+		pgCols[i].Precision = 0
+		pgCols[i].Scale = 0
+
+		switch name {
+		case "BOOLEAN", "BOOL":
+			pgCols[i].Type = "BOOLEAN"
+		case "DATE":
+			pgCols[i].Type = "DATE"
+		case "DATETIME", "TIMESTAMP":
+			pgCols[i].Type = "TIMESTAMP"
+		case "TIMESTAMPTZ":
+			pgCols[i].Type = "TIMESTAMPTZ"
+		case "UUID":
+			pgCols[i].Type = "UUID"
+		case "JSON", "JSONB":
+			pgCols[i].Type = "JSONB"
+		case "TINYINT", "SMALLINT", "INT2":
+			pgCols[i].Type = "SMALLINT"
+		case "MEDIUMINT", "INT4":
+			pgCols[i].Type = "INTEGER"
+		case "DECIMAL", "NUMERIC":
+			if len(args) > 0 {
+				pgCols[i].Type = "NUMERIC"
+				pgCols[i].Precision = args[0]
+				if len(args) > 1 {
+					pgCols[i].Scale = args[1]
+				}
+			} else {
+				// no precision to build a decimal from
+				pgCols[i].Type = "DOUBLE"
+			}
+		case "VARCHAR", "CHARACTER VARYING", "NVARCHAR", "VARYING CHARACTER", "NATIVE CHARACTER", "NCHAR", "CHAR", "CHARACTER":
+			pgCols[i].Type = "VARCHAR"
+			if len(args) > 0 {
+				pgCols[i].Length = args[0]
+			}
+		default:
+			switch {
+			case strings.Contains(name, "INT"):
+				// sqlite integers are always 64 bit
+				pgCols[i].Type = "BIGINT"
+			case strings.Contains(name, "CHAR"), strings.Contains(name, "CLOB"), strings.Contains(name, "TEXT"):
+				pgCols[i].Type = "TEXT"
+			case strings.Contains(name, "BLOB"):
+				pgCols[i].Type = "BYTEA"
+			case strings.Contains(name, "REAL"), strings.Contains(name, "FLOA"), strings.Contains(name, "DOUB"):
+				pgCols[i].Type = "DOUBLE"
+			case name == "":
+				// expressions have no declared type
+				pgCols[i].Type = "TEXT"
+			default:
+				pgCols[i].Type = "DOUBLE"
+			}
+		}
+	}
+	return pgCols
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"math/big"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,12 +21,20 @@ import (
 	"github.com/spf13/cast"
 )
 
+// ipcWriter is the stream or the file writer
+type ipcWriter interface {
+	Write(rec arrow.RecordBatch) error
+	Close() error
+}
+
 type ArrowDataWriter struct {
 	datastream *data.DataStream
-	writer     *ipc.Writer
+	writer     ipcWriter
 	schema     *arrow.Schema
 	alloc      memory.Allocator
-	mux        *sync.Mutex
+	// one builder for every batch writer keeps a single growing dictionary per column
+	recordBuilder *array.RecordBuilder
+	mux           *sync.Mutex
 }
 
 type ArrowBatchWriter struct {
@@ -33,8 +43,56 @@ type ArrowBatchWriter struct {
 	recordBuilder *array.RecordBuilder
 }
 
+// NewArrowDataWriter writes the uncompressed IPC stream format
 func NewArrowDataWriter(datastream *data.DataStream, w io.Writer) *ArrowDataWriter {
+	aw, err := NewArrowDataWriterWithOptions(datastream, w, "", 0, nil)
+	if err != nil {
+		panic(err)
+	}
+	return aw
+}
+
+// IsArrowBodyCompression is true for the codecs the IPC format compresses its buffers with,
+// the rest compress the stream around the file
+func IsArrowBodyCompression(compression string) bool {
+	switch strings.ToLower(compression) {
+	case "lz4", "zstd":
+		return true
+	}
+	return false
+}
+
+// NewArrowDataWriterWithOptions writes the IPC file or stream format, compressing
+// the buffers with lz4 or zstd and dictionary encoding the text columns asked for
+func NewArrowDataWriterWithOptions(datastream *data.DataStream, w io.Writer, compression string, level int, opts *data.ArrowOptions) (*ArrowDataWriter, error) {
+	if opts == nil {
+		opts = &data.ArrowOptions{}
+	}
 	alloc := memory.NewGoAllocator()
+	ipcOptions := []ipc.Option{ipc.WithAllocator(alloc)}
+
+	if IsArrowBodyCompression(compression) {
+		if level != 0 {
+			return nil, fmt.Errorf("arrow %s does not have compression levels", compression)
+		}
+		if strings.ToLower(compression) == "lz4" {
+			ipcOptions = append(ipcOptions, ipc.WithLZ4())
+		} else {
+			ipcOptions = append(ipcOptions, ipc.WithZstd())
+		}
+	}
+
+	dictionaries := make(map[string]bool, len(opts.DictionaryColumns))
+	for _, name := range opts.DictionaryColumns {
+		col := slices.IndexFunc(datastream.DestColumns, func(col data.Column) bool { return col.Name == name })
+		if col < 0 {
+			return nil, fmt.Errorf("arrow dictionary_columns has unknown column %s", name)
+		}
+		if mapToArrowDataType(datastream.DestColumns[col]).ID() != arrow.STRING {
+			return nil, fmt.Errorf("arrow dictionary column %s must be text, not %s", name, datastream.DestColumns[col].Type)
+		}
+		dictionaries[name] = true
+	}
 
 	fields := make([]arrow.Field, len(datastream.DestColumns))
 	for i, col := range datastream.DestColumns {
@@ -52,27 +110,49 @@ func NewArrowDataWriter(datastream *data.DataStream, w io.Writer) *ArrowDataWrit
 			Nullable: true,
 			Metadata: metadata,
 		}
+		if dictionaries[col.Name] {
+			fields[i].Type = &arrow.DictionaryType{IndexType: arrow.PrimitiveTypes.Int32, ValueType: arrow.BinaryTypes.String}
+		}
 	}
 
 	schema := arrow.NewSchema(fields, nil)
-	writer := ipc.NewWriter(w, ipc.WithSchema(schema), ipc.WithAllocator(alloc))
-	return &ArrowDataWriter{
-		datastream: datastream,
-		writer:     writer,
-		schema:     schema,
-		alloc:      alloc,
-		mux:        &sync.Mutex{},
+	ipcOptions = append(ipcOptions, ipc.WithSchema(schema))
+
+	var writer ipcWriter
+	switch strings.ToLower(opts.IPCFormat) {
+	case "file":
+		// a later batch with a new value would need a second dictionary
+		if len(dictionaries) > 0 {
+			return nil, fmt.Errorf("arrow dictionary_columns need the stream ipc_format, the file format can only have one dictionary per column")
+		}
+		fileWriter, err := ipc.NewFileWriter(w, ipcOptions...)
+		if err != nil {
+			return nil, err
+		}
+		writer = fileWriter
+	case "", "stream":
+		// later batches only send the new dictionary values
+		writer = ipc.NewWriter(w, append(ipcOptions, ipc.WithDictionaryDeltas(true))...)
+	default:
+		return nil, fmt.Errorf("arrow ipc_format must be file or stream: %s", opts.IPCFormat)
 	}
 
+	return &ArrowDataWriter{
+		datastream:    datastream,
+		writer:        writer,
+		schema:        schema,
+		alloc:         alloc,
+		recordBuilder: array.NewRecordBuilder(alloc, schema),
+		mux:           &sync.Mutex{},
+	}, nil
 }
 
 func (aw *ArrowDataWriter) CreateBatchWriter() data.BatchWriter {
-	recordBuilder := array.NewRecordBuilder(aw.alloc, aw.schema)
-
+	// the builder is only used under the lock
 	return &ArrowBatchWriter{
 		dataWriter:    aw,
-		recordBuilder: recordBuilder,
-		builders:      recordBuilder.Fields(),
+		recordBuilder: aw.recordBuilder,
+		builders:      aw.recordBuilder.Fields(),
 	}
 }
 
@@ -101,7 +181,7 @@ func (ab *ArrowBatchWriter) WriteBatch(batch data.Batch) error {
 	defer record.Release()
 
 	if err := ab.dataWriter.writer.Write(record); err != nil {
-		return err
+		return fmt.Errorf("failed to write arrow batch: %w", err)
 	}
 
 	// Reset builders for next batch
@@ -110,15 +190,71 @@ func (ab *ArrowBatchWriter) WriteBatch(batch data.Batch) error {
 	return nil
 }
 
+// WriteRecord writes the columns that already have the type of the file as they
+// are, the others are converted a value at a time like rows are
+func (ab *ArrowBatchWriter) WriteRecord(record arrow.RecordBatch) error {
+	ab.dataWriter.mux.Lock()
+	defer ab.dataWriter.mux.Unlock()
+
+	schema := ab.dataWriter.schema
+	if int(record.NumCols()) != len(schema.Fields()) {
+		return fmt.Errorf("record has %d columns, expected %d", record.NumCols(), len(schema.Fields()))
+	}
+	numRows := int(record.NumRows())
+	columns := make([]arrow.Array, len(ab.builders))
+	defer func() {
+		for _, column := range columns {
+			if column != nil {
+				column.Release()
+			}
+		}
+	}()
+
+	for i, builder := range ab.builders {
+		arr := record.Column(i)
+		if arrow.TypeEqual(arr.DataType(), schema.Field(i).Type) {
+			arr.Retain()
+			columns[i] = arr
+			continue
+		}
+		col := ab.dataWriter.datastream.DestColumns[i]
+		builder.Reserve(numRows)
+		for r := range numRows {
+			if err := appendToBuilder(builder, data.ArrowValue(arr, r), col); err != nil {
+				return err
+			}
+		}
+		columns[i] = builder.NewArray()
+	}
+
+	converted := array.NewRecordBatch(schema, columns, int64(numRows))
+	defer converted.Release()
+	if err := ab.dataWriter.writer.Write(converted); err != nil {
+		return fmt.Errorf("failed to write arrow batch: %w", err)
+	}
+	return nil
+}
+
 func (aw *ArrowDataWriter) Flush() error {
 	return nil
 }
 
 func (aw *ArrowDataWriter) Close() error {
+	aw.recordBuilder.Release()
 	return aw.writer.Close()
 }
 
 func mapToArrowDataType(col data.Column) arrow.DataType {
+	if data.IsList(col) {
+		return arrow.ListOf(mapToArrowDataType(data.ListElement(col)))
+	}
+	if data.IsStruct(col) {
+		fields := make([]arrow.Field, len(col.Fields))
+		for i, field := range col.Fields {
+			fields[i] = arrow.Field{Name: field.Name, Type: mapToArrowDataType(field), Nullable: true}
+		}
+		return arrow.StructOf(fields...)
+	}
 	aliased := data.TypeAlias(col.Type)
 
 	switch aliased {
@@ -147,7 +283,7 @@ func mapToArrowDataType(col data.Column) arrow.DataType {
 			return arrow.PrimitiveTypes.Float64
 		}
 		return &arrow.Decimal128Type{Precision: int32(col.Precision), Scale: int32(col.Scale)}
-	case "VARCHAR", "TEXT", "_TEXT":
+	case "VARCHAR", "TEXT":
 		return arrow.BinaryTypes.String
 	case "JSONB", "JSON":
 		// Use String type with metadata to indicate it's JSON
@@ -250,6 +386,16 @@ func appendToBuilder(builder array.Builder, val interface{}, col data.Column) er
 			}
 		}
 
+	case *array.BinaryDictionaryBuilder:
+		str, ok := val.(string)
+		if !ok {
+			var err error
+			if str, err = ValueToString(val, col); err != nil {
+				return err
+			}
+		}
+		return b.AppendString(str)
+
 	case *array.FixedSizeBinaryBuilder:
 		switch v := val.(type) {
 		case string:
@@ -321,6 +467,31 @@ func appendToBuilder(builder array.Builder, val interface{}, col data.Column) er
 			b.Append(decimalVal)
 		}
 
+	case *array.ListBuilder:
+		items, err := listItems(val)
+		if err != nil {
+			return err
+		}
+		b.Append(true)
+		element := data.ListElement(col)
+		for _, item := range items {
+			if err := appendToBuilder(b.ValueBuilder(), item, element); err != nil {
+				return err
+			}
+		}
+
+	case *array.StructBuilder:
+		fields, err := structFields(val)
+		if err != nil {
+			return err
+		}
+		b.Append(true)
+		for i, field := range col.Fields {
+			if err := appendToBuilder(b.FieldBuilder(i), structField(fields, field.Name), field); err != nil {
+				return err
+			}
+		}
+
 	default:
 		return fmt.Errorf("unsupported builder type %T for value %v", builder, val)
 	}
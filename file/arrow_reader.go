@@ -0,0 +1,254 @@
+package file
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/arrio"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/johanan/mvr/data"
+	"github.com/spf13/cast"
+)
+
+// recordRowReader turns arrow record batches into rows, used for both arrow and parquet
+type recordRowReader struct {
+	records arrio.Reader
+	closers []func() error
+	schema  *arrow.Schema
+	columns []data.Column
+	rows    [][]any
+	pos     int
+}
+
+func newArrowRowReader(input io.Reader, closer io.Closer) (*recordRowReader, error) {
+	alloc := memory.NewGoAllocator()
+	buffered := bufio.NewReader(input)
+
+	// the file format starts with a magic string, the stream format that NewArrowDataWriter writes does not
+	magic, _ := buffered.Peek(6)
+	if string(magic) == "ARROW1" {
+		var source io.Reader = buffered
+		if f, ok := input.(*os.File); ok {
+			source = f
+		}
+		rs, err := readerAt(source)
+		if err != nil {
+			return nil, err
+		}
+		fileReader, err := ipc.NewFileReader(rs, ipc.WithAllocator(alloc))
+		if err != nil {
+			return nil, fmt.Errorf("error opening arrow file: %s", err)
+		}
+		return &recordRowReader{
+			records: fileReader,
+			closers: []func() error{fileReader.Close, closer.Close},
+			schema:  fileReader.Schema(),
+			columns: arrowColumns(fileReader.Schema(), fieldMetadata(fileReader.Schema())),
+		}, nil
+	}
+
+	streamReader, err := ipc.NewReader(buffered, ipc.WithAllocator(alloc))
+	if err != nil {
+		return nil, fmt.Errorf("error opening arrow stream: %s", err)
+	}
+	return &recordRowReader{
+		records: streamReader,
+		closers: []func() error{func() error { streamReader.Release(); return nil }, closer.Close},
+		schema:  streamReader.Schema(),
+		columns: arrowColumns(streamReader.Schema(), fieldMetadata(streamReader.Schema())),
+	}, nil
+}
+
+func (r *recordRowReader) Columns() []data.Column {
+	return r.columns
+}
+
+func (r *recordRowReader) Next() ([]any, error) {
+	for r.pos >= len(r.rows) {
+		record, err := r.records.Read()
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			return nil, io.EOF
+		}
+		// the record is only valid until the next read, so copy everything out now
+		r.rows = data.RecordRows(record)
+		r.pos = 0
+	}
+
+	row := r.rows[r.pos]
+	r.rows[r.pos] = nil
+	r.pos++
+	return row, nil
+}
+
+// Columnar is true when the records can be sent as they are to the columns,
+// their values write the same as the ones fileValue makes from rows
+func (r *recordRowReader) Columnar(columns []data.Column) bool {
+	if len(columns) != len(r.schema.Fields()) {
+		return false
+	}
+	for i, col := range columns {
+		if !recordColumn(col, r.schema.Field(i).Type) {
+			return false
+		}
+	}
+	return true
+}
+
+// NextRecord is the next record instead of its rows, it stays valid after the
+// next read and the caller releases it
+func (r *recordRowReader) NextRecord() (arrow.RecordBatch, error) {
+	record, err := r.records.Read()
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, io.EOF
+	}
+	record.Retain()
+	return record, nil
+}
+
+// recordColumn is true for the types that need no conversion to the column,
+// lists, structs, uuids and bytes are converted from rows
+func recordColumn(col data.Column, dt arrow.DataType) bool {
+	switch col.Type {
+	case "BOOLEAN":
+		return dt.ID() == arrow.BOOL
+	case "SMALLINT", "INTEGER", "BIGINT":
+		// parquet has no smallint, so the width can be wider than the column
+		return dt.ID() == arrow.INT16 || dt.ID() == arrow.INT32 || dt.ID() == arrow.INT64
+	case "REAL":
+		return dt.ID() == arrow.FLOAT32
+	case "DOUBLE":
+		return dt.ID() == arrow.FLOAT64
+	case "NUMERIC":
+		t, ok := dt.(*arrow.Decimal128Type)
+		return ok && int64(t.Precision) == col.Precision && int64(t.Scale) == col.Scale
+	case "DATE":
+		return dt.ID() == arrow.DATE32
+	case "TIMESTAMP", "TIMESTAMPTZ":
+		t, ok := dt.(*arrow.TimestampType)
+		return ok && (t.TimeZone != "") == (col.Type == "TIMESTAMPTZ")
+	case "TEXT", "VARCHAR", "JSON", "JSONB":
+		return dt.ID() == arrow.STRING || dt.ID() == arrow.LARGE_STRING
+	}
+	return false
+}
+
+func (r *recordRowReader) Close() error {
+	var closeErr error
+	for _, closer := range r.closers {
+		if err := closer(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
+
+// fieldMetadata reads back the name, type and length that NewArrowDataWriter stores on each field
+func fieldMetadata(schema *arrow.Schema) []ColumnMetadata {
+	metadata := make([]ColumnMetadata, len(schema.Fields()))
+	for i, field := range schema.Fields() {
+		metadata[i].Name = field.Name
+		if colType, ok := field.Metadata.GetValue("type"); ok {
+			metadata[i].Type = colType
+		}
+		if length, ok := field.Metadata.GetValue("length"); ok {
+			metadata[i].Length = cast.ToInt32(length)
+		}
+	}
+	return metadata
+}
+
+// arrowColumns maps the arrow schema to columns, preferring the types mvr wrote into the metadata
+func arrowColumns(schema *arrow.Schema, metadata []ColumnMetadata) []data.Column {
+	columns := make([]data.Column, len(schema.Fields()))
+	for i, field := range schema.Fields() {
+		col := arrowTypeToColumn(field.Type)
+		col.Name = field.Name
+		col.Nullable = field.Nullable
+		col.Position = i
+
+		if i < len(metadata) && metadata[i].Name == field.Name && metadata[i].Type != "" {
+			col.Type = data.TypeAlias(metadata[i].Type)
+			col.Length = int64(metadata[i].Length)
+		}
+		columns[i] = col
+	}
+	return columns
+}
+
+func arrowTypeToColumn(dt arrow.DataType) data.Column {
+	col := data.Column{DatabaseType: dt.String()}
+	switch t := dt.(type) {
+	case arrow.ExtensionType:
+		if t.ExtensionName() == "arrow.uuid" {
+			col.Type = "UUID"
+			return col
+		}
+		storage := arrowTypeToColumn(t.StorageType())
+		storage.DatabaseType = col.DatabaseType
+		return storage
+	case *arrow.DictionaryType:
+		values := arrowTypeToColumn(t.ValueType)
+		values.DatabaseType = col.DatabaseType
+		return values
+	case *arrow.BooleanType:
+		col.Type = "BOOLEAN"
+	case *arrow.Int8Type, *arrow.Uint8Type, *arrow.Int16Type:
+		col.Type = "SMALLINT"
+	case *arrow.Uint16Type, *arrow.Int32Type:
+		col.Type = "INTEGER"
+	case *arrow.Uint32Type, *arrow.Int64Type:
+		col.Type = "BIGINT"
+	case *arrow.Uint64Type:
+		// does not fit in a BIGINT
+		col.Type = "NUMERIC"
+		col.Precision = 20
+	case *arrow.Float16Type, *arrow.Float32Type:
+		col.Type = "REAL"
+	case *arrow.Float64Type:
+		col.Type = "DOUBLE"
+	case arrow.DecimalType:
+		col.Type = "NUMERIC"
+		col.Precision = int64(t.GetPrecision())
+		col.Scale = int64(t.GetScale())
+	case *arrow.Date32Type, *arrow.Date64Type:
+		col.Type = "DATE"
+	case *arrow.TimestampType:
+		if t.TimeZone != "" {
+			col.Type = "TIMESTAMPTZ"
+		} else {
+			col.Type = "TIMESTAMP"
+		}
+	case *arrow.FixedSizeBinaryType:
+		if t.ByteWidth == 16 {
+			col.Type = "UUID"
+		} else {
+			col.Type = "BYTEA"
+		}
+	case *arrow.BinaryType, *arrow.LargeBinaryType, *arrow.BinaryViewType:
+		col.Type = "BYTEA"
+	case *arrow.ListType, *arrow.LargeListType:
+		element := arrowTypeToColumn(t.(arrow.ListLikeType).Elem())
+		col.Type = "_" + element.Type
+		col.Fields = element.Fields
+	case *arrow.StructType:
+		col.Type = "STRUCT"
+		col.Fields = make([]data.Column, t.NumFields())
+		for i, field := range t.Fields() {
+			col.Fields[i] = arrowTypeToColumn(field.Type)
+			col.Fields[i].Name = field.Name
+		}
+	default:
+		col.Type = "TEXT"
+	}
+	return col
+}
@@ -4,11 +4,16 @@ import (
 	"bytes"
 	"context"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/apache/arrow-go/v18/arrow"
 	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/decimal128"
 	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/google/uuid"
 	"github.com/johanan/mvr/core"
 	"github.com/johanan/mvr/data"
 	"github.com/johanan/mvr/database"
@@ -281,3 +286,220 @@ func GetArrowColumnValues[T arrowTypes](reader *ipc.Reader, colIndex int) ([]T,
 
 	return values, nulls, nil
 }
+
+func TestArrowWriterOptions(t *testing.T) {
+	columns := []data.Column{
+		{Name: "id", Type: "BIGINT"},
+		{Name: "status", Type: "TEXT"},
+	}
+	// the second batch adds a status, so the dictionary grows
+	batches := []data.Batch{
+		{Rows: [][]any{{int64(1), "active"}, {int64(2), nil}, {int64(3), "active"}}},
+		{Rows: [][]any{{int64(4), "closed"}, {int64(5), "active"}}},
+	}
+
+	tests := []struct {
+		name        string
+		compression string
+		ipcFormat   string
+		magic       bool
+	}{
+		{name: "Stream", ipcFormat: "stream"},
+		{name: "Stream lz4", compression: "lz4"},
+		{name: "File zstd", compression: "zstd", ipcFormat: "file", magic: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			ds := &data.DataStream{BatchSize: 3, DestColumns: columns}
+			opts := &data.ArrowOptions{IPCFormat: tt.ipcFormat, DictionaryColumns: []string{"status"}}
+			if tt.magic {
+				// the file format only allows one dictionary per column
+				opts.DictionaryColumns = nil
+			}
+			aw, err := NewArrowDataWriterWithOptions(ds, NewWriteCloseBuffer(&buf), tt.compression, 0, opts)
+			assert.NoError(t, err)
+			// separate batch writers share the dictionary
+			for _, batch := range batches {
+				assert.NoError(t, aw.CreateBatchWriter().WriteBatch(batch))
+			}
+			assert.NoError(t, aw.Close())
+
+			assert.Equal(t, tt.magic, bytes.HasPrefix(buf.Bytes(), []byte("ARROW1")))
+
+			rowReader, err := newArrowRowReader(bytes.NewReader(buf.Bytes()), NewWriteCloseBuffer(&bytes.Buffer{}))
+			assert.NoError(t, err)
+			defer rowReader.Close()
+			assert.Equal(t, "TEXT", rowReader.Columns()[1].Type)
+			assert.Equal(t, len(opts.DictionaryColumns) > 0, strings.HasPrefix(rowReader.Columns()[1].DatabaseType, "dictionary"))
+			var rows [][]any
+			for {
+				row, err := rowReader.Next()
+				if err != nil {
+					break
+				}
+				rows = append(rows, row)
+			}
+			assert.DeepEqual(t, append(batches[0].Rows, batches[1].Rows...), rows)
+		})
+	}
+}
+
+func TestArrowWriterOptionsErrors(t *testing.T) {
+	ds := &data.DataStream{DestColumns: []data.Column{{Name: "id", Type: "BIGINT"}, {Name: "status", Type: "TEXT"}}}
+	tests := []struct {
+		name        string
+		compression string
+		level       int
+		opts        *data.ArrowOptions
+	}{
+		{name: "Unknown ipc format", opts: &data.ArrowOptions{IPCFormat: "feather"}},
+		{name: "Zstd has no levels", compression: "zstd", level: 3},
+		{name: "Unknown dictionary column", opts: &data.ArrowOptions{DictionaryColumns: []string{"missing"}}},
+		{name: "Dictionary needs text", opts: &data.ArrowOptions{DictionaryColumns: []string{"id"}}},
+		{name: "Dictionary needs the stream format", opts: &data.ArrowOptions{IPCFormat: "file", DictionaryColumns: []string{"status"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewArrowDataWriterWithOptions(ds, &bytes.Buffer{}, tt.compression, tt.level, tt.opts)
+			assert.Error(t, err)
+		})
+	}
+
+}
+
+func TestArrowWriterNested(t *testing.T) {
+	columns, rows, expected := nestedColumns()
+
+	var buf bytes.Buffer
+	ds := &data.DataStream{BatchSize: 3, DestColumns: columns}
+	aw, err := NewArrowDataWriterWithOptions(ds, NewWriteCloseBuffer(&buf), "", 0, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "list<item: utf8, nullable>", aw.schema.Field(1).Type.String())
+	bw := aw.CreateBatchWriter()
+	assert.NoError(t, bw.WriteBatch(data.Batch{Rows: rows[:3]}))
+	assert.NoError(t, bw.WriteBatch(data.Batch{Rows: rows[3:]}))
+	assert.NoError(t, aw.Close())
+
+	rowReader, err := newArrowRowReader(bytes.NewReader(buf.Bytes()), NewWriteCloseBuffer(&bytes.Buffer{}))
+	assert.NoError(t, err)
+	defer rowReader.Close()
+	assert.Equal(t, "_INT4", rowReader.Columns()[2].Type)
+	assert.Equal(t, "_STRUCT", rowReader.Columns()[4].Type)
+	assert.Equal(t, "qty", rowReader.Columns()[4].Fields[1].Name)
+	var result [][]any
+	for {
+		row, err := rowReader.Next()
+		if err != nil {
+			break
+		}
+		result = append(result, row)
+	}
+	assert.DeepEqual(t, expected, result)
+}
+
+// recordTestColumns has the columns the writers copy from a record, then the
+// ones they convert a value at a time
+var recordTestColumns = []data.Column{
+	{Name: "id", Type: "BIGINT"},
+	{Name: "small", Type: "SMALLINT"},
+	{Name: "name", Type: "TEXT"},
+	{Name: "active", Type: "BOOLEAN"},
+	{Name: "amount", Type: "NUMERIC", Precision: 10, Scale: 2},
+	{Name: "big", Type: "NUMERIC", Precision: 38, Scale: 0},
+	{Name: "ratio", Type: "DOUBLE"},
+	{Name: "day", Type: "DATE"},
+	{Name: "created", Type: "TIMESTAMPTZ"},
+	{Name: "unique_id", Type: "UUID"},
+	{Name: "tags", Type: "_TEXT"},
+}
+
+func recordTestRecord() arrow.RecordBatch {
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "id", Type: arrow.PrimitiveTypes.Int64, Nullable: true},
+		{Name: "small", Type: arrow.PrimitiveTypes.Int16, Nullable: true},
+		{Name: "name", Type: arrow.BinaryTypes.String, Nullable: true},
+		{Name: "active", Type: arrow.FixedWidthTypes.Boolean, Nullable: true},
+		{Name: "amount", Type: &arrow.Decimal128Type{Precision: 10, Scale: 2}, Nullable: true},
+		{Name: "big", Type: &arrow.Decimal128Type{Precision: 38, Scale: 0}, Nullable: true},
+		{Name: "ratio", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+		{Name: "day", Type: arrow.FixedWidthTypes.Date32, Nullable: true},
+		{Name: "created", Type: &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}, Nullable: true},
+		{Name: "unique_id", Type: &arrow.FixedSizeBinaryType{ByteWidth: 16}, Nullable: true},
+		{Name: "tags", Type: arrow.ListOf(arrow.BinaryTypes.String), Nullable: true},
+	}, nil)
+	rb := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer rb.Release()
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC)
+	big, _ := decimal128.FromString("12345678901234567890123456789", 38, 0)
+	rb.Field(0).(*array.Int64Builder).AppendValues([]int64{1, 2, 3}, nil)
+	rb.Field(1).(*array.Int16Builder).AppendValues([]int16{-1, 0, 0}, []bool{true, true, false})
+	rb.Field(2).(*array.StringBuilder).AppendValues([]string{"John", "", ""}, []bool{true, true, false})
+	rb.Field(3).(*array.BooleanBuilder).AppendValues([]bool{true, false, false}, []bool{true, true, false})
+	rb.Field(4).(*array.Decimal128Builder).AppendValues([]decimal128.Num{decimal128.FromI64(1050), decimal128.FromI64(-325), {}}, []bool{true, true, false})
+	rb.Field(5).(*array.Decimal128Builder).AppendValues([]decimal128.Num{big, big.Negate(), {}}, []bool{true, true, false})
+	rb.Field(6).(*array.Float64Builder).AppendValues([]float64{1.5, -0.25, 0}, []bool{true, true, false})
+	rb.Field(7).(*array.Date32Builder).AppendValues([]arrow.Date32{arrow.Date32FromTime(created), 0, 0}, []bool{true, true, false})
+	rb.Field(8).(*array.TimestampBuilder).AppendValues([]arrow.Timestamp{arrow.Timestamp(created.UnixMicro()), 0, 0}, []bool{true, true, false})
+	id := uuid.MustParse("a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11")
+	rb.Field(9).(*array.FixedSizeBinaryBuilder).AppendValues([][]byte{id[:], id[:], nil}, []bool{true, true, false})
+	tags := rb.Field(10).(*array.ListBuilder)
+	tags.Append(true)
+	tags.ValueBuilder().(*array.StringBuilder).AppendValues([]string{"a", "b"}, nil)
+	tags.Append(true)
+	tags.AppendNull()
+	return rb.NewRecordBatch()
+}
+
+func TestArrowWriterRecord(t *testing.T) {
+	record := recordTestRecord()
+	defer record.Release()
+
+	write := func(batch data.Batch) ([][]any, error) {
+		var buf bytes.Buffer
+		ds := &data.DataStream{BatchSize: 3, DestColumns: recordTestColumns}
+		// name is a dictionary in the file, so it is built a value at a time
+		opts := &data.ArrowOptions{DictionaryColumns: []string{"name"}}
+		aw, err := NewArrowDataWriterWithOptions(ds, NewWriteCloseBuffer(&buf), "", 0, opts)
+		assert.NoError(t, err)
+		bw := aw.CreateBatchWriter()
+		if batch.Record != nil {
+			err = bw.(data.RecordWriter).WriteRecord(batch.Record)
+		} else {
+			err = bw.WriteBatch(batch)
+		}
+		if err != nil {
+			return nil, err
+		}
+		assert.NoError(t, aw.Close())
+
+		rowReader, err := newArrowRowReader(bytes.NewReader(buf.Bytes()), NewWriteCloseBuffer(&bytes.Buffer{}))
+		assert.NoError(t, err)
+		defer rowReader.Close()
+		var rows [][]any
+		for {
+			row, err := rowReader.Next()
+			if err != nil {
+				break
+			}
+			rows = append(rows, row)
+		}
+		return rows, nil
+	}
+
+	// a record writes the same file as its rows
+	expected, err := write(data.Batch{Rows: data.RecordRows(record)})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(expected))
+	actual, err := write(data.Batch{Record: record})
+	assert.NoError(t, err)
+	assert.DeepEqual(t, expected, actual)
+
+	short := array.NewRecordBatch(arrow.NewSchema(record.Schema().Fields()[:1], nil), record.Columns()[:1], record.NumRows())
+	defer short.Release()
+	_, err = write(data.Batch{Record: short})
+	assert.Error(t, err)
+}
@@ -0,0 +1,309 @@
+package file
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hamba/avro/v2/ocf"
+	"github.com/johanan/mvr/data"
+	"github.com/shopspring/decimal"
+	"github.com/spf13/cast"
+)
+
+var avroInvalidName = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+type AvroDataWriter struct {
+	datastream *data.DataStream
+	writer     io.Writer
+	encoder    *ocf.Encoder
+	names      []string
+	mux        *sync.Mutex
+}
+
+type AvroBatchWriter struct {
+	dataWriter *AvroDataWriter
+}
+
+func NewAvroDataWriter(datastream *data.DataStream, w io.Writer, compression string) (*AvroDataWriter, error) {
+	codec, err := avroCodec(compression)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(datastream.DestColumns))
+	fields := make([]map[string]any, len(datastream.DestColumns))
+	for i, col := range datastream.DestColumns {
+		names[i] = avroName(col.Name)
+		fields[i] = map[string]any{
+			"name":    names[i],
+			"type":    []any{"null", avroType(col)},
+			"default": nil,
+		}
+	}
+
+	schema, err := json.Marshal(map[string]any{"type": "record", "name": "row", "fields": fields})
+	if err != nil {
+		return nil, err
+	}
+
+	// the field names are sanitized, the cols metadata has the originals
+	cols, err := json.Marshal(mapColumnMetadata(datastream.DestColumns))
+	if err != nil {
+		return nil, err
+	}
+
+	encoder, err := ocf.NewEncoder(string(schema), w, ocf.WithCodec(codec), ocf.WithMetadata(map[string][]byte{"cols": cols}))
+	if err != nil {
+		return nil, fmt.Errorf("error creating avro encoder: %w", err)
+	}
+
+	return &AvroDataWriter{
+		datastream: datastream,
+		writer:     w,
+		encoder:    encoder,
+		names:      names,
+		mux:        &sync.Mutex{},
+	}, nil
+}
+
+func avroCodec(compression string) (ocf.CodecName, error) {
+	switch strings.ToLower(compression) {
+	case "":
+		return ocf.Null, nil
+	case "deflate":
+		return ocf.Deflate, nil
+	case "snappy":
+		return ocf.Snappy, nil
+	case "zstd", "zstandard":
+		return ocf.ZStandard, nil
+	default:
+		return "", fmt.Errorf("unsupported compression for avro: %s", compression)
+	}
+}
+
+// avroName makes a column name a valid avro name
+func avroName(name string) string {
+	name = avroInvalidName.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+func avroType(col data.Column) any {
+	switch data.TypeAlias(col.Type) {
+	case "BOOLEAN":
+		return "boolean"
+	case "SMALLINT", "INTEGER":
+		return "int"
+	case "BIGINT":
+		return "long"
+	case "REAL":
+		return "float"
+	case "DOUBLE":
+		return "double"
+	case "NUMERIC":
+		// a decimal needs a precision, without one a string keeps every digit
+		if col.Precision <= 0 {
+			return "string"
+		}
+		return map[string]any{"type": "bytes", "logicalType": "decimal", "precision": col.Precision, "scale": col.Scale}
+	case "UUID":
+		return map[string]any{"type": "string", "logicalType": "uuid"}
+	case "DATE":
+		return map[string]any{"type": "int", "logicalType": "date"}
+	case "TIMESTAMP":
+		return map[string]any{"type": "long", "logicalType": "local-timestamp-micros"}
+	case "TIMESTAMPTZ":
+		return map[string]any{"type": "long", "logicalType": "timestamp-micros"}
+	case "BYTEA":
+		return "bytes"
+	default:
+		return "string"
+	}
+}
+
+func (aw *AvroDataWriter) CreateBatchWriter() data.BatchWriter {
+	return &AvroBatchWriter{dataWriter: aw}
+}
+
+func (ab *AvroBatchWriter) WriteBatch(batch data.Batch) error {
+	aw := ab.dataWriter
+
+	records := make([]map[string]any, len(batch.Rows))
+	for r, row := range batch.Rows {
+		record := make(map[string]any, len(row))
+		for i, val := range row {
+			col := aw.datastream.DestColumns[i]
+			value, err := avroValue(val, col)
+			if err != nil {
+				return fmt.Errorf("failed to convert column %s: %w", col.Name, err)
+			}
+			record[aw.names[i]] = value
+		}
+		records[r] = record
+	}
+
+	aw.mux.Lock()
+	defer aw.mux.Unlock()
+	for _, record := range records {
+		if err := aw.encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	// every batch is its own block
+	return aw.encoder.Flush()
+}
+
+func (aw *AvroDataWriter) Flush() error {
+	aw.mux.Lock()
+	defer aw.mux.Unlock()
+	return aw.encoder.Flush()
+}
+
+func (aw *AvroDataWriter) Close() error {
+	if err := aw.encoder.Close(); err != nil {
+		return err
+	}
+	if closer, ok := aw.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// avroValue turns a value into the Go type the avro encoder wants for the column
+func avroValue(value any, col data.Column) (any, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	switch data.TypeAlias(col.Type) {
+	case "BOOLEAN":
+		return cast.ToBoolE(value)
+	case "SMALLINT", "INTEGER":
+		return cast.ToInt32E(value)
+	case "BIGINT":
+		return cast.ToInt64E(value)
+	case "REAL":
+		f, err := toFloat64(value)
+		return float32(f), err
+	case "DOUBLE":
+		return toFloat64(value)
+	case "NUMERIC":
+		dec, err := toDecimal(value)
+		if err != nil {
+			return nil, err
+		}
+		if col.Precision <= 0 {
+			return dec.String(), nil
+		}
+		// the encoder truncates, round it first
+		return dec.Round(int32(col.Scale)).Rat(), nil
+	case "UUID":
+		return toUUIDString(value)
+	case "DATE", "TIMESTAMP", "TIMESTAMPTZ":
+		t, err := toTime(value, col)
+		if err != nil {
+			return nil, err
+		}
+		switch col.Type {
+		case "TIMESTAMPTZ":
+			return t.UTC(), nil
+		case "TIMESTAMP":
+			// the encoder cannot pick local-timestamp-micros out of the union from a time.Time
+			return map[string]any{"long.local-timestamp-micros": t}, nil
+		}
+		return t, nil
+	case "BYTEA":
+		return toBytea(value)
+	}
+
+	return ValueToString(value, col)
+}
+
+// toBytea reads the Postgres hex format back, other text is its bytes
+func toBytea(value any) ([]byte, error) {
+	switch v := value.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		if strings.HasPrefix(v, "\\x") {
+			return hex.DecodeString(v[2:])
+		}
+		return []byte(v), nil
+	default:
+		return nil, fmt.Errorf("unable to cast %T to bytea", value)
+	}
+}
+
+func toDecimal(value any) (decimal.Decimal, error) {
+	switch v := value.(type) {
+	case decimal.Decimal:
+		return v, nil
+	case []byte:
+		return decimal.NewFromString(string(v))
+	case string:
+		return decimal.NewFromString(v)
+	case float32:
+		return decimal.NewFromFloat32(v), nil
+	case float64:
+		return decimal.NewFromFloat(v), nil
+	case *big.Float:
+		return decimal.NewFromString(v.Text('f', -1))
+	case *big.Int:
+		return decimal.NewFromBigInt(v, 0), nil
+	default:
+		return decimal.NewFromString(cast.ToString(value))
+	}
+}
+
+// toFloat64 is for NUMERIC values in a REAL or DOUBLE column, cast cannot
+// convert them
+func toFloat64(value any) (float64, error) {
+	switch value.(type) {
+	case decimal.Decimal, *big.Float, []byte:
+		dec, err := toDecimal(value)
+		if err != nil {
+			return 0, err
+		}
+		return dec.InexactFloat64(), nil
+	default:
+		return cast.ToFloat64E(value)
+	}
+}
+
+func toUUIDString(value any) (string, error) {
+	switch v := value.(type) {
+	case [16]byte:
+		return uuid.UUID(v).String(), nil
+	case uuid.UUID:
+		return v.String(), nil
+	case []byte:
+		id, err := uuid.FromBytes(v)
+		if err != nil {
+			return "", err
+		}
+		return id.String(), nil
+	default:
+		return cast.ToStringE(value)
+	}
+}
+
+func toTime(value any, col data.Column) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		return data.ParseTimestamp(v)
+	default:
+		return time.Time{}, fmt.Errorf("expected time.Time for %s column %s, got %T", col.Type, col.Name, value)
+	}
+}
@@ -0,0 +1,134 @@
+package file
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/hamba/avro/v2"
+	"github.com/hamba/avro/v2/ocf"
+	"github.com/johanan/mvr/data"
+	"github.com/shopspring/decimal"
+	"github.com/zeebo/assert"
+)
+
+func TestAvroDataWriter(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression string
+		codec       string
+		isError     bool
+	}{
+		{name: "No codec", codec: "null"},
+		{name: "Deflate", compression: "deflate", codec: "deflate"},
+		{name: "Snappy", compression: "snappy", codec: "snappy"},
+		{name: "Zstd", compression: "zstd", codec: "zstandard"},
+		{name: "Gzip is not an avro codec", compression: "gzip", isError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := &data.DataStream{BatchSize: 10, Columns: readerTestColumns, DestColumns: readerTestColumns}
+			var buf bytes.Buffer
+			writer, err := AddFileWriter(&data.StreamConfig{Format: "avro", Compression: tt.compression}, ds, NewBufferedWriter(&buf))
+			if tt.isError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			// two batch writers make two blocks
+			rows := readerTestRows()
+			assert.NoError(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: rows[:2]}))
+			assert.NoError(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: rows[2:]}))
+			assert.NoError(t, writer.Close())
+
+			decoder, err := ocf.NewDecoder(&buf)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.codec, string(decoder.Metadata()["avro.codec"]))
+			assert.True(t, len(decoder.Metadata()["cols"]) > 0)
+
+			var records []map[string]any
+			for decoder.HasNext() {
+				var record map[string]any
+				assert.NoError(t, decoder.Decode(&record))
+				records = append(records, record)
+			}
+			assert.NoError(t, decoder.Error())
+			assert.Equal(t, 3, len(records))
+
+			first := records[0]
+			assert.Equal(t, int32(1), first["id"])
+			assert.Equal(t, "John", first["name"])
+			assert.Equal(t, true, first["active"])
+			assert.Equal(t, "10.50", first["amount"].(*big.Rat).FloatString(2))
+			assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC), first["created"].(time.Time).UTC())
+			assert.Equal(t, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), first["day"].(time.Time).UTC())
+			assert.Equal(t, "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11", first["unique_id"])
+
+			last := records[2]
+			assert.Equal(t, nil, last["active"])
+			assert.Equal(t, nil, last["amount"])
+			assert.Equal(t, nil, last["unique_id"])
+		})
+	}
+}
+
+func TestAvroSchema(t *testing.T) {
+	columns := []data.Column{
+		{Name: "1st col", Type: "TIMESTAMP"},
+		{Name: "tz", Type: "TIMESTAMPTZ"},
+		{Name: "loose", Type: "NUMERIC"},
+		{Name: "doc", Type: "JSONB"},
+		{Name: "raw", Type: "BYTEA"},
+	}
+	ds := &data.DataStream{BatchSize: 10, Columns: columns, DestColumns: columns}
+	var buf bytes.Buffer
+	writer, err := NewAvroDataWriter(ds, &buf, "")
+	assert.NoError(t, err)
+	assert.NoError(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: [][]any{
+		{time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), "123456789012345678901234.5", map[string]any{"a": 1}, "\\x0102"},
+	}}))
+	assert.NoError(t, writer.Close())
+
+	decoder, err := ocf.NewDecoder(&buf)
+	assert.NoError(t, err)
+	fields := decoder.Schema().(*avro.RecordSchema).Fields()
+	assert.Equal(t, "_1st_col", fields[0].Name())
+	assert.Equal(t, "local-timestamp-micros", string(fields[0].Type().(*avro.UnionSchema).Types()[1].(avro.LogicalTypeSchema).Logical().Type()))
+	assert.Equal(t, "timestamp-micros", string(fields[1].Type().(*avro.UnionSchema).Types()[1].(avro.LogicalTypeSchema).Logical().Type()))
+	assert.Equal(t, avro.String, fields[2].Type().(*avro.UnionSchema).Types()[1].Type())
+
+	var record map[string]any
+	assert.True(t, decoder.HasNext())
+	assert.NoError(t, decoder.Decode(&record))
+	// the decoder hands local timestamps back in the union form
+	assert.Equal(t, "2024-01-02 03:04:05", record["_1st_col"].(map[string]any)["long.local-timestamp-micros"].(time.Time).Format(time.DateTime))
+	assert.Equal(t, "123456789012345678901234.5", record["loose"])
+	assert.Equal(t, `{"a":1}`, record["doc"])
+	assert.DeepEqual(t, []byte{1, 2}, record["raw"])
+}
+
+func TestAvroValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    any
+		col      data.Column
+		expected any
+	}{
+		{name: "Numeric as double", value: decimal.RequireFromString("10.25"), col: data.Column{Type: "DOUBLE"}, expected: 10.25},
+		{name: "Numeric as real", value: decimal.RequireFromString("2.5"), col: data.Column{Type: "REAL"}, expected: float32(2.5)},
+		{name: "Big float as double", value: big.NewFloat(1.5), col: data.Column{Type: "DOUBLE"}, expected: 1.5},
+		{name: "Numeric text as double", value: []byte("3.75"), col: data.Column{Type: "DOUBLE"}, expected: 3.75},
+		{name: "Double", value: float32(4.5), col: data.Column{Type: "DOUBLE"}, expected: 4.5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := avroValue(tt.value, tt.col)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, value)
+		})
+	}
+}
@@ -54,7 +54,7 @@ func (a *AzureBlob) Close() error {
 
 }
 
-func (a *AzureBlobConfig) GetWriter(ctx context.Context) (*AzureBlob, error) {
+func (a *AzureBlobConfig) getClient() (*azblob.Client, error) {
 	var client *azblob.Client
 	if a.sasToken == "" {
 		cred, err := azidentity.NewDefaultAzureCredential(nil)
@@ -75,6 +75,27 @@ func (a *AzureBlobConfig) GetWriter(ctx context.Context) (*AzureBlob, error) {
 			return nil, fmt.Errorf("AzureBlob: %v", err)
 		}
 	}
+	return client, nil
+}
+
+func (a *AzureBlobConfig) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	client, err := a.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.DownloadStream(ctx, a.container, a.blobName, nil)
+	if err != nil {
+		return nil, fmt.Errorf("AzureBlob: %v", err)
+	}
+	return resp.Body, nil
+}
+
+func (a *AzureBlobConfig) GetWriter(ctx context.Context) (*AzureBlob, error) {
+	client, err := a.getClient()
+	if err != nil {
+		return nil, err
+	}
 	pr, pw := io.Pipe()
 
 	wg := sync.WaitGroup{}
@@ -0,0 +1,198 @@
+package file
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/johanan/mvr/data"
+)
+
+type csvRowReader struct {
+	reader  *bufio.Reader
+	closer  io.Closer
+	dialect csvDialect
+	columns []data.Column
+	line    int
+	// first is the first row of a file without a header
+	first []any
+}
+
+// newCSVRowReader reads the dialect CSVDataWriter writes. encoding/csv only
+// knows the " quote and cannot tell a quoted value from a null, so the records
+// are parsed here.
+func newCSVRowReader(input io.Reader, closer io.Closer, format string, opts *data.CSVOptions) (*csvRowReader, error) {
+	dialect, err := newCSVDialect(format, opts)
+	if err != nil {
+		return nil, err
+	}
+	r := &csvRowReader{reader: bufio.NewReader(input), closer: closer, dialect: dialect}
+	// excel likes to start files with a byte order mark
+	if bom, _ := r.reader.Peek(3); string(bom) == "\uFEFF" {
+		r.reader.Discard(3)
+	}
+
+	fields, quoted, err := r.readRecord()
+	if err == io.EOF {
+		return nil, errors.New("csv file is empty, a header row is required")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading csv header: %s", err)
+	}
+
+	// csv has no types, everything is TEXT until a column override says otherwise
+	r.columns = make([]data.Column, len(fields))
+	for i, name := range fields {
+		if !dialect.header {
+			name = fmt.Sprintf("column_%d", i+1)
+		}
+		r.columns[i] = data.Column{Name: name, DatabaseType: "TEXT", Type: "TEXT", Nullable: true, Position: i}
+	}
+	if !dialect.header {
+		r.first = r.row(fields, quoted)
+	}
+
+	return r, nil
+}
+
+func (r *csvRowReader) Columns() []data.Column {
+	return r.columns
+}
+
+func (r *csvRowReader) Next() ([]any, error) {
+	if r.first != nil {
+		row := r.first
+		r.first = nil
+		return row, nil
+	}
+
+	fields, quoted, err := r.readRecord()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) != len(r.columns) {
+		return nil, fmt.Errorf("csv record on line %d has %d fields, the header has %d", r.line, len(fields), len(r.columns))
+	}
+	return r.row(fields, quoted), nil
+}
+
+// row matches what CSVDataWriter writes for nulls, they are never quoted
+func (r *csvRowReader) row(fields []string, quoted []bool) []any {
+	row := make([]any, len(fields))
+	for i, field := range fields {
+		if !quoted[i] && field == r.dialect.null {
+			row[i] = nil
+		} else {
+			row[i] = field
+		}
+	}
+	return row
+}
+
+// readRecord reads one record, a quoted field can have line breaks in it
+func (r *csvRowReader) readRecord() ([]string, []bool, error) {
+	if _, err := r.reader.Peek(1); err != nil {
+		return nil, nil, err
+	}
+	r.line++
+
+	var fields []string
+	var quoted []bool
+	for {
+		field, isQuoted, last, err := r.readField()
+		if err != nil {
+			return nil, nil, err
+		}
+		fields = append(fields, field)
+		quoted = append(quoted, isQuoted)
+		if last {
+			return fields, quoted, nil
+		}
+	}
+}
+
+// readField reads up to the next delimiter, last is true at the end of the
+// line or the file
+func (r *csvRowReader) readField() (string, bool, bool, error) {
+	var field strings.Builder
+	ru, _, err := r.reader.ReadRune()
+	if err == io.EOF {
+		return "", false, true, nil
+	}
+	if err != nil {
+		return "", false, false, err
+	}
+
+	if ru != r.dialect.quote {
+		for ru != r.dialect.delimiter && ru != '\n' {
+			field.WriteRune(ru)
+			ru, _, err = r.reader.ReadRune()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", false, false, err
+			}
+		}
+		value := field.String()
+		if ru != r.dialect.delimiter {
+			// the end of the line or the file, either can be crlf
+			return strings.TrimSuffix(value, "\r"), false, true, nil
+		}
+		return value, false, false, nil
+	}
+
+	start := r.line
+	for {
+		ru, _, err = r.reader.ReadRune()
+		if err == io.EOF {
+			return "", false, false, fmt.Errorf("csv record on line %d has a quote that is never closed", start)
+		}
+		if err != nil {
+			return "", false, false, err
+		}
+		if ru == r.dialect.quote {
+			ru, _, err = r.reader.ReadRune()
+			if err == nil && ru == r.dialect.quote {
+				field.WriteRune(ru)
+				continue
+			}
+			break
+		}
+		if ru == '\n' {
+			r.line++
+		}
+		field.WriteRune(ru)
+	}
+
+	// the closing quote ends the field
+	if err == io.EOF {
+		return field.String(), true, true, nil
+	}
+	if err != nil {
+		return "", false, false, err
+	}
+	if ru == '\r' {
+		ru, _, err = r.reader.ReadRune()
+		if err != nil && err != io.EOF {
+			return "", false, false, err
+		}
+		if err == io.EOF {
+			ru = '\n'
+		}
+	}
+	switch ru {
+	case r.dialect.delimiter:
+		return field.String(), true, false, nil
+	case '\n':
+		return field.String(), true, true, nil
+	default:
+		return "", false, false, fmt.Errorf("csv record on line %d has %q after a closing quote", r.line, ru)
+	}
+}
+
+func (r *csvRowReader) Close() error {
+	return r.closer.Close()
+}
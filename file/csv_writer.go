@@ -1,12 +1,15 @@
 package file
 
 import (
-	"encoding/csv"
+	"bufio"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgtype"
@@ -17,39 +20,151 @@ import (
 
 type CSVDataWriter struct {
 	datastream *data.DataStream
-	writer     *csv.Writer
+	dialect    csvDialect
+	writer     *bufio.Writer
 	resource   io.WriteCloser
 	mux        *sync.Mutex
 }
 
 type CSVBatchWriter struct {
 	dataWriter *CSVDataWriter
-	buffer     [][]string
+	buffer     []byte
+}
+
+// csvDialect is how the rows are written, encoding/csv only lets the delimiter
+// and line terminator change
+type csvDialect struct {
+	delimiter  rune
+	quote      rune
+	quoteAll   bool
+	header     bool
+	null       string
+	terminator string
+	bom        bool
+}
+
+var csvDelimiters = map[string]rune{"tab": '\t', "pipe": '|', "comma": ',', "semicolon": ';'}
+
+// newCSVDialect fills in the defaults, tsv is csv with a tab
+func newCSVDialect(format string, opts *data.CSVOptions) (csvDialect, error) {
+	dialect := csvDialect{delimiter: ',', quote: '"', header: true, null: "NULL", terminator: "\n"}
+	if strings.ToLower(format) == "tsv" {
+		dialect.delimiter = '\t'
+	}
+	if opts == nil {
+		return dialect, nil
+	}
+
+	if opts.Delimiter != "" {
+		if named, ok := csvDelimiters[strings.ToLower(opts.Delimiter)]; ok {
+			dialect.delimiter = named
+		} else if opts.Delimiter == "\\t" {
+			dialect.delimiter = '\t'
+		} else if utf8.RuneCountInString(opts.Delimiter) == 1 {
+			dialect.delimiter, _ = utf8.DecodeRuneInString(opts.Delimiter)
+		} else {
+			return dialect, fmt.Errorf("csv delimiter must be a single character or tab, pipe, comma or semicolon: %s", opts.Delimiter)
+		}
+	}
+	if opts.Quote != "" {
+		if utf8.RuneCountInString(opts.Quote) != 1 {
+			return dialect, fmt.Errorf("csv quote must be a single character: %s", opts.Quote)
+		}
+		dialect.quote, _ = utf8.DecodeRuneInString(opts.Quote)
+	}
+	if dialect.delimiter == dialect.quote || strings.ContainsRune("\r\n", dialect.delimiter) || strings.ContainsRune("\r\n", dialect.quote) {
+		return dialect, fmt.Errorf("csv delimiter %q and quote %q cannot be the same or a line break", dialect.delimiter, dialect.quote)
+	}
+
+	switch strings.ToLower(opts.LineTerminator) {
+	case "", "lf", "\\n":
+	case "crlf", "\\r\\n":
+		dialect.terminator = "\r\n"
+	default:
+		return dialect, fmt.Errorf("csv line_terminator must be lf or crlf: %s", opts.LineTerminator)
+	}
+
+	dialect.quoteAll = opts.QuoteAll
+	dialect.bom = opts.BOM
+	if opts.Header != nil {
+		dialect.header = *opts.Header
+	}
+	if opts.NullValue != nil {
+		dialect.null = *opts.NullValue
+	}
+	return dialect, nil
+}
+
+// needsQuotes is true when the field cannot be read back without them. A value
+// that looks like the null, including an empty string when nulls are empty, is
+// quoted so it stays a value.
+func (d csvDialect) needsQuotes(field string) bool {
+	if d.quoteAll || field == d.null {
+		return true
+	}
+	if field == "" {
+		return false
+	}
+	if strings.ContainsRune(field, d.delimiter) || strings.ContainsRune(field, d.quote) || strings.ContainsAny(field, "\r\n") {
+		return true
+	}
+	// encoding/csv trims leading spaces when reading
+	r, _ := utf8.DecodeRuneInString(field)
+	return r == ' ' || r == '\t'
+}
+
+// appendRow formats a row onto buf, nulls are never quoted
+func (d csvDialect) appendRow(buf []byte, fields []string, nulls []bool) []byte {
+	for i, field := range fields {
+		if i > 0 {
+			buf = utf8.AppendRune(buf, d.delimiter)
+		}
+		if (nulls != nil && nulls[i]) || !d.needsQuotes(field) {
+			buf = append(buf, field...)
+			continue
+		}
+
+		buf = utf8.AppendRune(buf, d.quote)
+		for _, r := range field {
+			if r == d.quote {
+				buf = utf8.AppendRune(buf, d.quote)
+			}
+			buf = utf8.AppendRune(buf, r)
+		}
+		buf = utf8.AppendRune(buf, d.quote)
+	}
+	return append(buf, d.terminator...)
 }
 
 func (cb *CSVBatchWriter) WriteBatch(batch data.Batch) error {
+	cw := cb.dataWriter
+	cb.buffer = cb.buffer[:0]
+	nulls := make([]bool, len(cw.datastream.DestColumns))
 	for _, row := range batch.Rows {
-		processed, err := cb.dataWriter.ProcessRow(row)
+		processed, err := cw.ProcessRow(row)
 		if err != nil {
 			return err
 		}
-		cb.buffer = append(cb.buffer, processed)
+		for i, val := range row {
+			nulls[i] = val == nil
+		}
+		cb.buffer = cw.dialect.appendRow(cb.buffer, processed, nulls)
 	}
 
-	cb.dataWriter.mux.Lock()
-	defer cb.dataWriter.mux.Unlock()
-	for _, row := range cb.buffer {
-		if err := cb.dataWriter.writer.Write(row); err != nil {
-			return err
-		}
+	cw.mux.Lock()
+	defer cw.mux.Unlock()
+	if _, err := cw.writer.Write(cb.buffer); err != nil {
+		return err
 	}
-	cb.dataWriter.writer.Flush()
-	cb.buffer = cb.buffer[:0]
 
-	return nil
+	return cw.writer.Flush()
 }
 
 func ValueToString(value any, col data.Column) (string, error) {
+	// lists and structs have no text form of their own, they are JSON
+	if data.IsList(col) || data.IsStruct(col) {
+		col.Type = "JSONB"
+	}
 	switch col.Type {
 	case "TIMESTAMP":
 		if t, ok := value.(time.Time); ok {
@@ -128,7 +243,7 @@ func (cw *CSVDataWriter) ProcessRow(row []any) ([]string, error) {
 	for i, col := range row {
 		dest := cw.datastream.DestColumns[i]
 		if col == nil {
-			stringRow[i] = "NULL"
+			stringRow[i] = cw.dialect.null
 			continue
 		}
 
@@ -143,8 +258,7 @@ func (cw *CSVDataWriter) ProcessRow(row []any) ([]string, error) {
 }
 
 func (cw *CSVDataWriter) Flush() error {
-	cw.writer.Flush()
-	return cw.writer.Error()
+	return cw.writer.Flush()
 }
 
 func (cw *CSVDataWriter) Close() error {
@@ -158,24 +272,42 @@ func (cw *CSVDataWriter) Close() error {
 }
 
 func (cw *CSVDataWriter) CreateBatchWriter() data.BatchWriter {
-	buffer := make([][]string, 0, cw.datastream.BatchSize)
-	return &CSVBatchWriter{dataWriter: cw, buffer: buffer}
+	return &CSVBatchWriter{dataWriter: cw}
 }
 
+// NewCSVDataWriter writes comma separated values with a header
 func NewCSVDataWriter(datastream *data.DataStream, writer io.WriteCloser) *CSVDataWriter {
-	w := csv.NewWriter(writer)
-	w.Comma = ','
-	if datastream == nil {
-		log.Fatalf("Datastream is nil")
+	cw, err := NewCSVDataWriterWithOptions(datastream, writer, "csv", nil)
+	if err != nil {
+		log.Fatalf("Failed to create csv writer: %v", err)
 	}
-	header := make([]string, 0, len(datastream.Columns))
-	for _, col := range datastream.Columns {
-		header = append(header, col.Name)
+	return cw
+}
+
+func NewCSVDataWriterWithOptions(datastream *data.DataStream, writer io.WriteCloser, format string, opts *data.CSVOptions) (*CSVDataWriter, error) {
+	if datastream == nil {
+		return nil, fmt.Errorf("datastream is nil")
 	}
-	err := w.Write(header)
+	dialect, err := newCSVDialect(format, opts)
 	if err != nil {
-		log.Fatalf("Failed to write header: %v", err)
+		return nil, err
+	}
+
+	w := bufio.NewWriter(writer)
+	if dialect.bom {
+		if _, err := w.WriteString("\uFEFF"); err != nil {
+			return nil, err
+		}
+	}
+	if dialect.header {
+		header := make([]string, 0, len(datastream.Columns))
+		for _, col := range datastream.Columns {
+			header = append(header, col.Name)
+		}
+		if _, err := w.Write(dialect.appendRow(nil, header, nil)); err != nil {
+			return nil, fmt.Errorf("failed to write header: %w", err)
+		}
 	}
 
-	return &CSVDataWriter{datastream: datastream, writer: w, mux: &sync.Mutex{}, resource: writer}
+	return &CSVDataWriter{datastream: datastream, dialect: dialect, writer: w, mux: &sync.Mutex{}, resource: writer}, nil
 }
@@ -3,8 +3,10 @@ package file
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"net/url"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -202,3 +204,197 @@ params:
 		})
 	}
 }
+
+func TestCsvWriter_FromMySQL(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		expected string
+	}{
+		{
+			name: "Numbers Test",
+			yaml: `stream_name: numbers
+format: csv
+sql: SELECT smallint_value, integer_value, bigint_value, decimal_value, double_value FROM numbers`,
+			expected: `smallint_value,integer_value,bigint_value,decimal_value,double_value
+1,1,1,1.000000000000000,1
+2,2,2,2.000000000000000,2
+3,3,3,3.000000000000000,3
+32767,2147483647,9223372036854775807,507531.111989867000000,123456789012345680000
+0,0,0,468797.177024568000000,1234567890.12345
+`,
+		},
+		{
+			name: "Default users Table Test",
+			yaml: `stream_name: users
+format: csv`,
+			expected: `name,created,createdz,unique_id,nullable_id,active
+John Doe,2024-10-08T17:22:00,2024-10-08T17:22:00Z,a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11,NULL,true
+Test Tester,2024-10-08T17:22:00,2024-10-08T17:22:00Z,a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a12,NULL,false
+`,
+		},
+		{
+			name: "Numbers Limit Test",
+			yaml: `stream_name: numbers
+format: csv
+sql: SELECT smallint_value, bigint_value FROM numbers WHERE smallint_value = ?
+params:
+  p1:
+    value: 1
+    type: INT8`,
+			expected: `smallint_value,bigint_value
+1,1
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writeCloser := NewWriteCloseBuffer(&buf)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			zerolog.SetGlobalLevel(zerolog.Disabled)
+
+			sc, err := data.BuildConfig([]byte(tt.yaml), &data.StreamConfig{})
+			assert.NoError(t, err)
+			err = sc.Validate()
+			assert.NoError(t, err)
+			local_url, _ := url.Parse(local_mysql_url)
+
+			myr, _ := database.NewMySQLDataReader(local_url)
+			myDs, err := myr.CreateDataStream(ctx, local_url, sc)
+			assert.NoError(t, err)
+			defer myr.Close()
+
+			writer := NewCSVDataWriter(myDs, writeCloser)
+
+			err = core.Execute(ctx, 1, sc, myDs, myr, writer)
+			assert.NoError(t, err)
+			writer.Close()
+
+			assert.Equal(t, tt.expected, buf.String())
+		})
+	}
+}
+
+// createSQLiteFixture mirrors the tables from scripts/test_setup.sh in a local sqlite file
+func createSQLiteFixture(t *testing.T) *url.URL {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fixture.db")
+	db, err := sql.Open("sqlite", path)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	statements := []string{
+		`CREATE TABLE users (
+  name VARCHAR(100) NOT NULL,
+  created DATETIME,
+  createdz TIMESTAMPTZ,
+  unique_id UUID,
+  nullable_id UUID NULL,
+  active BOOLEAN
+)`,
+		`INSERT INTO users VALUES
+('John Doe', '2024-10-08 17:22:00', '2024-10-08T17:22:00Z', 'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11', NULL, 1),
+('Test Tester', '2024-10-08 17:22:00', '2024-10-08T17:22:00Z', 'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a12', NULL, 0)`,
+		`CREATE TABLE numbers (
+  smallint_value SMALLINT,
+  integer_value INTEGER,
+  bigint_value BIGINT,
+  decimal_value DECIMAL(38, 15),
+  double_value DOUBLE PRECISION
+)`,
+		`INSERT INTO numbers VALUES
+(1, 1, 1, '1.0', 1.0),
+(32767, 2147483647, 9223372036854775807, '507531.111989867', 1234567890.12345)`,
+		`CREATE TABLE readings (device TEXT, reading, payload BLOB)`,
+		`INSERT INTO readings VALUES ('a', 1.5, x'cafe'), ('b', 'high', NULL)`,
+	}
+	for _, stmt := range statements {
+		_, err := db.Exec(stmt)
+		assert.NoError(t, err)
+	}
+
+	return &url.URL{Scheme: "sqlite", Path: path}
+}
+
+func TestCSVWriter_FromSQLite(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		expected string
+	}{
+		{
+			name: "Numbers Test",
+			yaml: `stream_name: numbers
+format: csv`,
+			expected: `smallint_value,integer_value,bigint_value,decimal_value,double_value
+1,1,1,1.000000000000000,1
+32767,2147483647,9223372036854775807,507531.111989867000000,1234567890.12345
+`,
+		},
+		{
+			name: "Default users Table Test",
+			yaml: `stream_name: users
+format: csv`,
+			expected: `name,created,createdz,unique_id,nullable_id,active
+John Doe,2024-10-08T17:22:00,2024-10-08T17:22:00Z,a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11,NULL,true
+Test Tester,2024-10-08T17:22:00,2024-10-08T17:22:00Z,a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a12,NULL,false
+`,
+		},
+		{
+			name: "Untyped Column Test",
+			yaml: `stream_name: readings
+format: csv
+columns:
+  - name: reading
+    type: TEXT`,
+			expected: `device,reading,payload
+a,1.5,\xcafe
+b,high,NULL
+`,
+		},
+		{
+			name: "Params Test",
+			yaml: `stream_name: numbers
+format: csv
+sql: SELECT smallint_value FROM numbers WHERE smallint_value > ?
+params:
+  p1:
+    value: 1
+    type: INT8`,
+			expected: `smallint_value
+32767
+`,
+		},
+	}
+	local_url := createSQLiteFixture(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writeCloser := NewWriteCloseBuffer(&buf)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			zerolog.SetGlobalLevel(zerolog.Disabled)
+
+			sc, err := data.BuildConfig([]byte(tt.yaml), &data.StreamConfig{})
+			assert.NoError(t, err)
+			err = sc.Validate()
+			assert.NoError(t, err)
+
+			slr, err := database.NewSQLiteDataReader(local_url)
+			assert.NoError(t, err)
+			slDs, err := slr.CreateDataStream(ctx, local_url, sc)
+			assert.NoError(t, err)
+			defer slr.Close()
+
+			writer := NewCSVDataWriter(slDs, writeCloser)
+
+			err = core.Execute(ctx, 1, sc, slDs, slr, writer)
+			assert.NoError(t, err)
+			writer.Close()
+
+			assert.Equal(t, tt.expected, buf.String())
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package file
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/johanan/mvr/data"
+	"github.com/zeebo/assert"
+)
+
+func TestCSVDialect(t *testing.T) {
+	columns := []data.Column{{Name: "id", Type: "INTEGER"}, {Name: "name", Type: "TEXT"}, {Name: "note", Type: "TEXT"}}
+	rows := [][]any{{1, "John", nil}, {2, "Smith|Jane", ""}, {3, `say "hi"`, " padded"}}
+	noHeader, empty := false, ""
+
+	tests := []struct {
+		name     string
+		format   string
+		opts     *data.CSVOptions
+		expected string
+	}{
+		{
+			name:     "Default",
+			format:   "csv",
+			expected: "id,name,note\n1,John,NULL\n2,Smith|Jane,\n3,\"say \"\"hi\"\"\",\" padded\"\n",
+		},
+		{
+			name:     "TSV",
+			format:   "tsv",
+			expected: "id\tname\tnote\n1\tJohn\tNULL\n2\tSmith|Jane\t\n3\t\"say \"\"hi\"\"\"\t\" padded\"\n",
+		},
+		{
+			name:     "Pipe with empty nulls",
+			format:   "csv",
+			opts:     &data.CSVOptions{Delimiter: "pipe", NullValue: &empty},
+			expected: "id|name|note\n1|John|\n2|\"Smith|Jane\"|\"\"\n3|\"say \"\"hi\"\"\"|\" padded\"\n",
+		},
+		{
+			name:     "Quote all without header",
+			format:   "csv",
+			opts:     &data.CSVOptions{QuoteAll: true, Header: &noHeader, Quote: "'", LineTerminator: "crlf"},
+			expected: "'1','John',NULL\r\n'2','Smith|Jane',''\r\n'3','say \"hi\"',' padded'\r\n",
+		},
+		{
+			name:     "BOM",
+			format:   "csv",
+			opts:     &data.CSVOptions{BOM: true, Delimiter: ";"},
+			expected: "\uFEFFid;name;note\n1;John;NULL\n2;Smith|Jane;\n3;\"say \"\"hi\"\"\";\" padded\"\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := &data.DataStream{BatchSize: 10, Columns: columns, DestColumns: columns}
+			var buf bytes.Buffer
+			writer, err := AddFileWriter(&data.StreamConfig{Format: tt.format, CSV: tt.opts}, ds, NewBufferedWriter(&buf))
+			assert.NoError(t, err)
+			assert.NoError(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: rows}))
+			assert.NoError(t, writer.Close())
+			assert.Equal(t, tt.expected, buf.String())
+		})
+	}
+}
+
+func TestCSVDialectErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *data.CSVOptions
+	}{
+		{name: "Long delimiter", opts: &data.CSVOptions{Delimiter: "||"}},
+		{name: "Delimiter is the quote", opts: &data.CSVOptions{Delimiter: `"`}},
+		{name: "Line break delimiter", opts: &data.CSVOptions{Delimiter: "\n"}},
+		{name: "Unknown line terminator", opts: &data.CSVOptions{LineTerminator: "cr"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newCSVDialect("csv", tt.opts)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,509 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/google/uuid"
+	"github.com/johanan/mvr/data"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	deltaLogDir = "_delta_log"
+	// how many times a commit is retried when another writer takes the version
+	deltaCommitAttempts = 10
+)
+
+// the writer features mvr knows how to keep, anything else needs a real delta writer
+var deltaSupportedWriterFeatures = []string{"timestampNtz"}
+
+type deltaAction struct {
+	CommitInfo *deltaCommitInfo `json:"commitInfo,omitempty"`
+	Protocol   *deltaProtocol   `json:"protocol,omitempty"`
+	MetaData   *deltaMetaData   `json:"metaData,omitempty"`
+	Add        *deltaAdd        `json:"add,omitempty"`
+	Remove     *deltaRemove     `json:"remove,omitempty"`
+}
+
+type deltaCommitInfo struct {
+	Timestamp           int64             `json:"timestamp"`
+	Operation           string            `json:"operation"`
+	OperationParameters map[string]string `json:"operationParameters"`
+	EngineInfo          string            `json:"engineInfo"`
+}
+
+type deltaProtocol struct {
+	MinReaderVersion int      `json:"minReaderVersion"`
+	MinWriterVersion int      `json:"minWriterVersion"`
+	ReaderFeatures   []string `json:"readerFeatures,omitempty"`
+	WriterFeatures   []string `json:"writerFeatures,omitempty"`
+}
+
+type deltaFormat struct {
+	Provider string            `json:"provider"`
+	Options  map[string]string `json:"options"`
+}
+
+type deltaMetaData struct {
+	ID               string            `json:"id"`
+	Format           deltaFormat       `json:"format"`
+	SchemaString     string            `json:"schemaString"`
+	PartitionColumns []string          `json:"partitionColumns"`
+	Configuration    map[string]string `json:"configuration"`
+	CreatedTime      int64             `json:"createdTime"`
+}
+
+type deltaAdd struct {
+	Path             string            `json:"path"`
+	PartitionValues  map[string]string `json:"partitionValues"`
+	Size             int64             `json:"size"`
+	ModificationTime int64             `json:"modificationTime"`
+	DataChange       bool              `json:"dataChange"`
+	Stats            string            `json:"stats,omitempty"`
+}
+
+type deltaRemove struct {
+	Path                 string            `json:"path"`
+	DeletionTimestamp    int64             `json:"deletionTimestamp"`
+	DataChange           bool              `json:"dataChange"`
+	ExtendedFileMetadata bool              `json:"extendedFileMetadata"`
+	PartitionValues      map[string]string `json:"partitionValues"`
+	Size                 int64             `json:"size"`
+}
+
+type deltaSchema struct {
+	Type   string             `json:"type"`
+	Fields []deltaSchemaField `json:"fields"`
+}
+
+type deltaSchemaField struct {
+	Name     string         `json:"name"`
+	Type     string         `json:"type"`
+	Nullable bool           `json:"nullable"`
+	Metadata map[string]any `json:"metadata"`
+}
+
+// deltaSnapshot is the table after replaying the log
+type deltaSnapshot struct {
+	version  int64
+	protocol *deltaProtocol
+	metaData *deltaMetaData
+	files    map[string]*deltaAdd
+}
+
+// DeltaDataWriter writes a single parquet file into the table directory and
+// commits it to the _delta_log when it is closed
+type DeltaDataWriter struct {
+	ctx      context.Context
+	store    tableStore
+	mode     string
+	fileName string
+	schema   deltaSchema
+	data     *ParquetDataWriter
+	file     *countingWriter
+	rows     int64
+	mux      *sync.Mutex
+}
+
+type DeltaBatchWriter struct {
+	dataWriter  *DeltaDataWriter
+	batchWriter data.BatchWriter
+}
+
+func NewDeltaDataWriter(ctx context.Context, tableUrl *url.URL, mode string, ds *data.DataStream, counter io.WriteCloser) (*DeltaDataWriter, error) {
+	switch mode {
+	case "append", "overwrite":
+	default:
+		return nil, fmt.Errorf("unsupported mode for delta: %s", mode)
+	}
+
+	schema, err := deltaSchemaFor(ds.DestColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newTableStore(tableUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	// check the table before writing any data
+	snapshot, err := loadDeltaSnapshot(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDeltaTable(snapshot, schema, mode); err != nil {
+		return nil, err
+	}
+
+	fileName := fmt.Sprintf("part-00000-%s-c000.snappy.parquet", uuid.New())
+	fileUrl := tableUrl.JoinPath(fileName)
+	out, err := GetIo(ctx, counter, fileUrl)
+	if err != nil {
+		return nil, err
+	}
+	file := &countingWriter{writer: out}
+	log.Debug().Str("path", fileUrl.Path).Msg("Writing delta data file")
+
+	parquetStream := &data.DataStream{BatchSize: ds.BatchSize, Columns: ds.Columns, DestColumns: deltaColumns(ds.DestColumns)}
+
+	return &DeltaDataWriter{
+		ctx:      ctx,
+		store:    store,
+		mode:     mode,
+		fileName: fileName,
+		schema:   schema,
+		data:     NewParquetDataWriter(parquetStream, file),
+		file:     file,
+		mux:      &sync.Mutex{},
+	}, nil
+}
+
+// deltaType maps the abstract type to the delta primitive the parquet writer matches
+func deltaType(col data.Column) (string, error) {
+	switch data.TypeAlias(col.Type) {
+	case "BOOLEAN":
+		return "boolean", nil
+	case "SMALLINT", "INTEGER":
+		// the parquet writer stores both as int32
+		return "integer", nil
+	case "BIGINT":
+		return "long", nil
+	case "REAL":
+		return "float", nil
+	case "DOUBLE":
+		return "double", nil
+	case "NUMERIC":
+		if col.Precision <= 0 || col.Precision > 38 {
+			return "", fmt.Errorf("delta needs a precision between 1 and 38 for NUMERIC column %s, set one in columns", col.Name)
+		}
+		return fmt.Sprintf("decimal(%d,%d)", col.Precision, col.Scale), nil
+	case "UUID":
+		// delta has no uuid, deltaColumns writes it as text
+		return "string", nil
+	case "DATE":
+		return "date", nil
+	case "TIMESTAMP":
+		return "timestamp_ntz", nil
+	case "TIMESTAMPTZ":
+		return "timestamp", nil
+	default:
+		return "string", nil
+	}
+}
+
+// deltaColumns are the columns the parquet file is written with. The schema has
+// no nested types or uuid, so lists and structs are JSON and uuids are text.
+func deltaColumns(columns []data.Column) []data.Column {
+	flat := flattenNested(columns)
+	for i, col := range flat {
+		if data.TypeAlias(col.Type) == "UUID" {
+			flat[i].Type = "TEXT"
+		}
+	}
+	return flat
+}
+
+func deltaSchemaFor(columns []data.Column) (deltaSchema, error) {
+	schema := deltaSchema{Type: "struct", Fields: make([]deltaSchemaField, len(columns))}
+	for i, col := range columns {
+		t, err := deltaType(col)
+		if err != nil {
+			return schema, err
+		}
+		schema.Fields[i] = deltaSchemaField{Name: col.Name, Type: t, Nullable: true, Metadata: map[string]any{}}
+	}
+	return schema, nil
+}
+
+func (s deltaSchema) hasType(t string) bool {
+	return slices.ContainsFunc(s.Fields, func(f deltaSchemaField) bool { return f.Type == t })
+}
+
+// sameColumns compares names and types, nullability and metadata can differ
+func (s deltaSchema) sameColumns(other deltaSchema) bool {
+	return slices.EqualFunc(s.Fields, other.Fields, func(a, b deltaSchemaField) bool {
+		return strings.EqualFold(a.Name, b.Name) && a.Type == b.Type
+	})
+}
+
+func deltaProtocolFor(schema deltaSchema) *deltaProtocol {
+	if schema.hasType("timestamp_ntz") {
+		return &deltaProtocol{MinReaderVersion: 3, MinWriterVersion: 7, ReaderFeatures: []string{"timestampNtz"}, WriterFeatures: []string{"timestampNtz"}}
+	}
+	return &deltaProtocol{MinReaderVersion: 1, MinWriterVersion: 2}
+}
+
+func deltaVersionName(version int64) string {
+	return fmt.Sprintf("%s/%020d.json", deltaLogDir, version)
+}
+
+// loadDeltaSnapshot replays the json commits, a new table is version -1
+func loadDeltaSnapshot(ctx context.Context, store tableStore) (*deltaSnapshot, error) {
+	names, err := store.List(ctx, deltaLogDir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %w", deltaLogDir, err)
+	}
+
+	var versions []int64
+	for _, name := range names {
+		stem, ok := strings.CutSuffix(name, ".json")
+		if !ok || len(stem) != 20 {
+			continue
+		}
+		version, err := strconv.ParseInt(stem, 10, 64)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+
+	snapshot := &deltaSnapshot{version: -1, files: make(map[string]*deltaAdd)}
+	for i, version := range versions {
+		// the log has to be complete, mvr does not read checkpoints
+		if version != int64(i) {
+			return nil, fmt.Errorf("delta log is missing version %d, checkpoints are not supported", i)
+		}
+
+		body, err := store.Read(ctx, deltaVersionName(version))
+		if err != nil {
+			return nil, fmt.Errorf("error reading delta version %d: %w", version, err)
+		}
+		for _, line := range bytes.Split(body, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var action deltaAction
+			if err := json.Unmarshal(line, &action); err != nil {
+				return nil, fmt.Errorf("error parsing delta version %d: %w", version, err)
+			}
+			switch {
+			case action.Protocol != nil:
+				snapshot.protocol = action.Protocol
+			case action.MetaData != nil:
+				snapshot.metaData = action.MetaData
+			case action.Add != nil:
+				snapshot.files[action.Add.Path] = action.Add
+			case action.Remove != nil:
+				delete(snapshot.files, action.Remove.Path)
+			}
+		}
+		snapshot.version = version
+	}
+	return snapshot, nil
+}
+
+// checkDeltaTable makes sure mvr can write to an existing table
+func checkDeltaTable(snapshot *deltaSnapshot, schema deltaSchema, mode string) error {
+	if snapshot.version < 0 {
+		return nil
+	}
+	if snapshot.protocol == nil || snapshot.metaData == nil {
+		return errors.New("delta table is missing its protocol or metadata")
+	}
+
+	protocol := snapshot.protocol
+	if protocol.MinWriterVersion > 2 && protocol.MinWriterVersion < 7 {
+		return fmt.Errorf("delta writer version %d is not supported", protocol.MinWriterVersion)
+	}
+	for _, feature := range protocol.WriterFeatures {
+		if !slices.Contains(deltaSupportedWriterFeatures, feature) {
+			return fmt.Errorf("delta writer feature %s is not supported", feature)
+		}
+	}
+	if len(snapshot.metaData.PartitionColumns) > 0 {
+		return errors.New("partitioned delta tables are not supported")
+	}
+
+	switch mode {
+	case "append":
+		var existing deltaSchema
+		if err := json.Unmarshal([]byte(snapshot.metaData.SchemaString), &existing); err != nil {
+			return fmt.Errorf("error parsing delta schema: %w", err)
+		}
+		if !existing.sameColumns(schema) {
+			return errors.New("columns do not match the delta table, use overwrite mode to replace it")
+		}
+	case "overwrite":
+		if strings.EqualFold(snapshot.metaData.Configuration["delta.appendOnly"], "true") {
+			return errors.New("delta table is append only")
+		}
+	}
+	return nil
+}
+
+// commitActions builds the next version on top of the snapshot
+func (dw *DeltaDataWriter) commitActions(snapshot *deltaSnapshot, size int64, now time.Time) ([]deltaAction, error) {
+	millis := now.UnixMilli()
+	operation := "Append"
+	if dw.mode == "overwrite" {
+		operation = "Overwrite"
+	}
+	actions := []deltaAction{{CommitInfo: &deltaCommitInfo{
+		Timestamp:           millis,
+		Operation:           "WRITE",
+		OperationParameters: map[string]string{"mode": operation},
+		EngineInfo:          "mvr",
+	}}}
+
+	schemaString, err := json.Marshal(dw.schema)
+	if err != nil {
+		return nil, err
+	}
+
+	// a new table, or an overwrite that changes the columns, gets new metadata
+	newTable := snapshot.version < 0
+	if newTable || (dw.mode == "overwrite" && snapshot.metaData.SchemaString != string(schemaString)) {
+		metaData := &deltaMetaData{
+			ID:               uuid.NewString(),
+			Format:           deltaFormat{Provider: "parquet", Options: map[string]string{}},
+			PartitionColumns: []string{},
+			Configuration:    map[string]string{},
+			CreatedTime:      millis,
+		}
+		if !newTable {
+			// keep the identity of the table
+			metaData.ID = snapshot.metaData.ID
+			metaData.CreatedTime = snapshot.metaData.CreatedTime
+			metaData.Configuration = snapshot.metaData.Configuration
+		}
+		metaData.SchemaString = string(schemaString)
+
+		protocol := deltaProtocolFor(dw.schema)
+		if newTable || protocol.MinReaderVersion > snapshot.protocol.MinReaderVersion || protocol.MinWriterVersion > snapshot.protocol.MinWriterVersion {
+			actions = append(actions, deltaAction{Protocol: protocol})
+		}
+		actions = append(actions, deltaAction{MetaData: metaData})
+	}
+
+	if dw.mode == "overwrite" {
+		paths := make([]string, 0, len(snapshot.files))
+		for path := range snapshot.files {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			add := snapshot.files[path]
+			actions = append(actions, deltaAction{Remove: &deltaRemove{
+				Path:                 add.Path,
+				DeletionTimestamp:    millis,
+				DataChange:           true,
+				ExtendedFileMetadata: true,
+				PartitionValues:      map[string]string{},
+				Size:                 add.Size,
+			}})
+		}
+	}
+
+	stats, err := json.Marshal(map[string]int64{"numRecords": dw.rows})
+	if err != nil {
+		return nil, err
+	}
+	actions = append(actions, deltaAction{Add: &deltaAdd{
+		Path:             dw.fileName,
+		PartitionValues:  map[string]string{},
+		Size:             size,
+		ModificationTime: millis,
+		DataChange:       true,
+		Stats:            string(stats),
+	}})
+	return actions, nil
+}
+
+// commit writes the next version, starting over if another writer took it
+func (dw *DeltaDataWriter) commit() error {
+	for attempt := 0; attempt < deltaCommitAttempts; attempt++ {
+		snapshot, err := loadDeltaSnapshot(dw.ctx, dw.store)
+		if err != nil {
+			return err
+		}
+		if err := checkDeltaTable(snapshot, dw.schema, dw.mode); err != nil {
+			return err
+		}
+
+		actions, err := dw.commitActions(snapshot, dw.file.size, time.Now())
+		if err != nil {
+			return err
+		}
+		var body bytes.Buffer
+		encoder := json.NewEncoder(&body)
+		for _, action := range actions {
+			if err := encoder.Encode(action); err != nil {
+				return err
+			}
+		}
+
+		version := snapshot.version + 1
+		err = dw.store.PutIfAbsent(dw.ctx, deltaVersionName(version), body.Bytes())
+		if errors.Is(err, errFileExists) {
+			log.Debug().Int64("version", version).Msg("Delta version was taken, trying again")
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error committing delta version %d: %w", version, err)
+		}
+		log.Info().Int64("version", version).Str("mode", dw.mode).Msg("Committed delta version")
+		return nil
+	}
+	return fmt.Errorf("could not commit to the delta table after %d attempts", deltaCommitAttempts)
+}
+
+func (dw *DeltaDataWriter) CreateBatchWriter() data.BatchWriter {
+	return &DeltaBatchWriter{dataWriter: dw, batchWriter: dw.data.CreateBatchWriter()}
+}
+
+func (db *DeltaBatchWriter) WriteBatch(batch data.Batch) error {
+	if err := db.batchWriter.WriteBatch(batch); err != nil {
+		return err
+	}
+	db.dataWriter.mux.Lock()
+	db.dataWriter.rows += int64(len(batch.Rows))
+	db.dataWriter.mux.Unlock()
+	return nil
+}
+
+// WriteRecord gives the record to the parquet writer as columns
+func (db *DeltaBatchWriter) WriteRecord(record arrow.RecordBatch) error {
+	if err := db.batchWriter.(data.RecordWriter).WriteRecord(record); err != nil {
+		return err
+	}
+	db.dataWriter.mux.Lock()
+	db.dataWriter.rows += record.NumRows()
+	db.dataWriter.mux.Unlock()
+	return nil
+}
+
+func (dw *DeltaDataWriter) Flush() error {
+	return dw.data.Flush()
+}
+
+// Close finishes the data file and commits it
+func (dw *DeltaDataWriter) Close() error {
+	if err := dw.data.Close(); err != nil {
+		return err
+	}
+	if err := dw.file.Close(); err != nil {
+		return err
+	}
+	return dw.commit()
+}
+
+// Abort leaves the table alone, the data file is never added to the log
+func (dw *DeltaDataWriter) Abort() error {
+	log.Warn().Str("file", dw.fileName).Msg("Not committing delta data file")
+	return dw.file.Abort()
+}
@@ -0,0 +1,261 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+	"github.com/apache/arrow-go/v18/parquet"
+	"github.com/apache/arrow-go/v18/parquet/file"
+	"github.com/johanan/mvr/data"
+	"github.com/zeebo/assert"
+)
+
+type nopCounter struct{}
+
+func (nopCounter) Write(p []byte) (int, error) { return len(p), nil }
+func (nopCounter) Close() error                { return nil }
+
+// writeDelta commits the reader test rows to the table
+func writeDelta(t *testing.T, tableUrl *url.URL, mode string, columns []data.Column) {
+	ds := &data.DataStream{BatchSize: 10, Columns: columns, DestColumns: columns}
+	writer, err := AddTableWriter(context.Background(), "delta", mode, tableUrl, ds, nopCounter{})
+	assert.NoError(t, err)
+	assert.NoError(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: readerTestRows()}))
+	assert.NoError(t, writer.Close())
+}
+
+func readDeltaVersion(t *testing.T, store tableStore, version int64) []deltaAction {
+	body, err := store.Read(context.Background(), deltaVersionName(version))
+	assert.NoError(t, err)
+
+	var actions []deltaAction
+	for _, line := range bytes.Split(bytes.TrimSpace(body), []byte("\n")) {
+		var action deltaAction
+		assert.NoError(t, json.Unmarshal(line, &action))
+		actions = append(actions, action)
+	}
+	return actions
+}
+
+func TestDeltaDataWriter(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	tableUrl, _ := url.Parse("file://" + filepath.ToSlash(filepath.Join(dir, "users")))
+	store, err := newTableStore(tableUrl)
+	assert.NoError(t, err)
+
+	writeDelta(t, tableUrl, "append", readerTestColumns)
+	writeDelta(t, tableUrl, "append", readerTestColumns)
+
+	first := readDeltaVersion(t, store, 0)
+	assert.Equal(t, "Append", first[0].CommitInfo.OperationParameters["mode"])
+	assert.Equal(t, 1, first[1].Protocol.MinReaderVersion)
+	assert.Equal(t, "parquet", first[2].MetaData.Format.Provider)
+	add := first[3].Add
+	assert.NotNil(t, add)
+	assert.Equal(t, `{"numRecords":3}`, add.Stats)
+
+	// the add is the parquet file that was written
+	info, err := os.Stat(filepath.Join(dir, "users", add.Path))
+	assert.NoError(t, err)
+	assert.Equal(t, info.Size(), add.Size)
+
+	// delta has no uuid, so it is the text of the uuid
+	reader, err := file.OpenParquetFile(filepath.Join(dir, "users", add.Path), false)
+	assert.NoError(t, err)
+	defer reader.Close()
+	assert.Equal(t, parquet.Types.ByteArray, reader.MetaData().Schema.Column(6).PhysicalType())
+	ids, _, err := GetRowGroupColumn[string](reader, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11", ids[0])
+
+	// appends only add a file
+	second := readDeltaVersion(t, store, 1)
+	assert.Equal(t, 2, len(second))
+	assert.NotNil(t, second[1].Add)
+
+	snapshot, err := loadDeltaSnapshot(ctx, store)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), snapshot.version)
+	assert.Equal(t, 2, len(snapshot.files))
+
+	// overwrite removes every file and changes the schema
+	changed := append([]data.Column{}, readerTestColumns...)
+	changed[1] = data.Column{Name: "full_name", Type: "TEXT"}
+	writeDelta(t, tableUrl, "overwrite", changed)
+
+	third := readDeltaVersion(t, store, 2)
+	assert.Equal(t, "Overwrite", third[0].CommitInfo.OperationParameters["mode"])
+	assert.Equal(t, first[2].MetaData.ID, third[1].MetaData.ID)
+	removes := 0
+	for _, action := range third {
+		if action.Remove != nil {
+			removes++
+		}
+	}
+	assert.Equal(t, 2, removes)
+
+	snapshot, err = loadDeltaSnapshot(ctx, store)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), snapshot.version)
+	assert.Equal(t, 1, len(snapshot.files))
+
+	// append needs the same columns
+	ds := &data.DataStream{BatchSize: 10, Columns: readerTestColumns, DestColumns: readerTestColumns}
+	_, err = NewDeltaDataWriter(ctx, tableUrl, "append", ds, nopCounter{})
+	assert.Error(t, err)
+}
+
+func TestDeltaDataWriterErrors(t *testing.T) {
+	tableUrl, _ := url.Parse("file://" + filepath.ToSlash(filepath.Join(t.TempDir(), "users")))
+	tests := []struct {
+		name    string
+		mode    string
+		columns []data.Column
+	}{
+		{name: "Unsupported mode", mode: "truncate", columns: readerTestColumns},
+		{name: "Numeric without precision", mode: "append", columns: []data.Column{{Name: "amount", Type: "NUMERIC"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := &data.DataStream{BatchSize: 10, Columns: tt.columns, DestColumns: tt.columns}
+			_, err := NewDeltaDataWriter(context.Background(), tableUrl, tt.mode, ds, nopCounter{})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestDeltaAbort(t *testing.T) {
+	dir := t.TempDir()
+	tableUrl, _ := url.Parse("file://" + filepath.ToSlash(filepath.Join(dir, "users")))
+	ds := &data.DataStream{BatchSize: 10, Columns: readerTestColumns, DestColumns: readerTestColumns}
+	writer, err := NewDeltaDataWriter(context.Background(), tableUrl, "append", ds, nopCounter{})
+	assert.NoError(t, err)
+	assert.NoError(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: readerTestRows()}))
+	assert.NoError(t, writer.Abort())
+
+	_, err = os.Stat(filepath.Join(dir, "users", deltaLogDir))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDeltaCommitRetry(t *testing.T) {
+	dir := t.TempDir()
+	tableUrl, _ := url.Parse("file://" + filepath.ToSlash(filepath.Join(dir, "users")))
+	ds := &data.DataStream{BatchSize: 10, Columns: readerTestColumns, DestColumns: readerTestColumns}
+	writer, err := NewDeltaDataWriter(context.Background(), tableUrl, "append", ds, nopCounter{})
+	assert.NoError(t, err)
+	assert.NoError(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: readerTestRows()}))
+
+	// another writer commits first
+	writeDelta(t, tableUrl, "append", readerTestColumns)
+	assert.NoError(t, writer.Close())
+
+	store, _ := newTableStore(tableUrl)
+	snapshot, err := loadDeltaSnapshot(context.Background(), store)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), snapshot.version)
+	assert.Equal(t, 2, len(snapshot.files))
+}
+
+func TestDeltaSchema(t *testing.T) {
+	columns := []data.Column{
+		{Name: "id", Type: "SMALLINT"},
+		{Name: "amount", Type: "NUMERIC", Precision: 10, Scale: 2},
+		{Name: "created", Type: "TIMESTAMP"},
+		{Name: "updated", Type: "TIMESTAMPTZ"},
+		{Name: "unique_id", Type: "UUID"},
+		{Name: "doc", Type: "JSONB"},
+	}
+	schema, err := deltaSchemaFor(columns)
+	assert.NoError(t, err)
+
+	types := make([]string, len(schema.Fields))
+	for i, field := range schema.Fields {
+		types[i] = field.Type
+	}
+	assert.DeepEqual(t, []string{"integer", "decimal(10,2)", "timestamp_ntz", "timestamp", "string", "string"}, types)
+
+	// timestamp_ntz needs the table feature
+	protocol := deltaProtocolFor(schema)
+	assert.Equal(t, 3, protocol.MinReaderVersion)
+	assert.Equal(t, 7, protocol.MinWriterVersion)
+	assert.DeepEqual(t, []string{"timestampNtz"}, protocol.WriterFeatures)
+}
+
+func TestLocalTableStore(t *testing.T) {
+	ctx := context.Background()
+	store := &localTableStore{root: t.TempDir()}
+	assert.NoError(t, store.PutIfAbsent(ctx, "_delta_log/00000000000000000000.json", []byte("first")))
+	assert.Equal(t, errFileExists, store.PutIfAbsent(ctx, "_delta_log/00000000000000000000.json", []byte("second")))
+
+	body, err := store.Read(ctx, "_delta_log/00000000000000000000.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(body))
+
+	// the temporary files are gone
+	names, err := store.List(ctx, "_delta_log")
+	assert.NoError(t, err)
+	assert.DeepEqual(t, []string{"00000000000000000000.json"}, names)
+}
+
+func TestDelta_Azurite(t *testing.T) {
+	ctx := context.Background()
+	cred, _ := azblob.NewSharedKeyCredential(account, sharedKey)
+	listSas, _ := sas.BlobSignatureValues{
+		Protocol:      sas.ProtocolHTTPSandHTTP,
+		ExpiryTime:    time.Now().Add(time.Hour),
+		ContainerName: "testcontainer",
+		Permissions:   (&sas.ContainerPermissions{Read: true, Write: true, List: true}).String(),
+	}.SignWithSharedKey(cred)
+
+	tableUrl, _ := url.Parse(fmt.Sprintf("azurite://:%s@127.0.0.1:10000/devstoreaccount1/testcontainer/delta/users_%d", listSas.Encode(), time.Now().UnixNano()))
+	writeDelta(t, tableUrl, "append", readerTestColumns)
+	writeDelta(t, tableUrl, "overwrite", readerTestColumns)
+
+	store, err := newTableStore(tableUrl)
+	assert.NoError(t, err)
+	snapshot, err := loadDeltaSnapshot(ctx, store)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), snapshot.version)
+	assert.Equal(t, 1, len(snapshot.files))
+}
+
+func TestDeltaDataWriterRecord(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	tableUrl, _ := url.Parse("file://" + filepath.ToSlash(filepath.Join(dir, "users")))
+	store, err := newTableStore(tableUrl)
+	assert.NoError(t, err)
+
+	record := recordTestRecord()
+	defer record.Release()
+	ds := &data.DataStream{BatchSize: 10, Columns: recordTestColumns, DestColumns: recordTestColumns}
+	writer, err := AddTableWriter(ctx, "delta", "append", tableUrl, ds, nopCounter{})
+	assert.NoError(t, err)
+	assert.NoError(t, writer.CreateBatchWriter().(data.RecordWriter).WriteRecord(record))
+	assert.NoError(t, writer.Close())
+
+	add := readDeltaVersion(t, store, 0)[3].Add
+	assert.Equal(t, `{"numRecords":3}`, add.Stats)
+
+	// the uuid and the list are flattened to text like rows are
+	reader, err := file.OpenParquetFile(filepath.Join(dir, "users", add.Path), false)
+	assert.NoError(t, err)
+	defer reader.Close()
+	ids, _, err := GetRowGroupColumn[string](reader, 9)
+	assert.NoError(t, err)
+	assert.Equal(t, "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11", ids[0])
+	tags, _, err := GetRowGroupColumn[string](reader, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, `["a","b"]`, tags[0])
+}
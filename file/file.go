@@ -17,7 +17,11 @@ import (
 	"github.com/apache/arrow-go/v18/arrow/array"
 	"github.com/apache/arrow-go/v18/arrow/ipc"
 	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/dsnet/compress/bzip2"
+	"github.com/golang/snappy"
 	"github.com/johanan/mvr/data"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
 	"github.com/schollz/progressbar/v3"
 )
 
@@ -97,6 +101,41 @@ func (b *BufferedWriter) Close() error {
 	return closeErr
 }
 
+// Abort throws away what was written when a resource can, otherwise it is Close
+func (b *BufferedWriter) Abort() error {
+	if !b.canAbort() {
+		return b.Close()
+	}
+
+	var closeErr error
+	if b.open {
+		b.open = false
+
+		for _, resource := range b.resources {
+			var err error
+			if aborter, ok := resource.(data.Aborter); ok {
+				err = aborter.Abort()
+			} else {
+				err = resource.Close()
+			}
+			if err != nil {
+				closeErr = errors.Join(closeErr, err)
+			}
+		}
+	}
+
+	return closeErr
+}
+
+func (b *BufferedWriter) canAbort() bool {
+	for _, resource := range b.resources {
+		if _, ok := resource.(data.Aborter); ok {
+			return true
+		}
+	}
+	return false
+}
+
 func GetIo(ctx context.Context, counting io.WriteCloser, filePath *url.URL) (io.WriteCloser, error) {
 	var buf io.WriteCloser
 	switch filePath.Scheme {
@@ -125,6 +164,39 @@ func GetIo(ctx context.Context, counting io.WriteCloser, filePath *url.URL) (io.
 		}
 		f := io.MultiWriter(azureBlob, counting)
 		buf = NewBufferedWriter(f, azureBlob)
+	case "s3":
+		s3Config, err := ParseS3URL(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing s3 url: %s", err)
+		}
+		s3Object, err := s3Config.GetWriter(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error getting s3 writer: %s", err)
+		}
+		f := io.MultiWriter(s3Object, counting)
+		buf = NewBufferedWriter(f, s3Object)
+	case "gs":
+		gcsConfig, err := ParseGCSURL(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing gcs url: %s", err)
+		}
+		gcsObject, err := gcsConfig.GetWriter(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error getting gcs writer: %s", err)
+		}
+		f := io.MultiWriter(gcsObject, counting)
+		buf = NewBufferedWriter(f, gcsObject)
+	case "sftp":
+		sftpConfig, err := ParseSFTPURL(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing sftp url: %s", err)
+		}
+		sftpFile, err := sftpConfig.GetWriter(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error getting sftp writer: %s", err)
+		}
+		f := io.MultiWriter(sftpFile, counting)
+		buf = NewBufferedWriter(f, sftpFile)
 	default:
 		if filePath == nil {
 			return nil, fmt.Errorf("filename in StreamConfig cannot be nil")
@@ -151,79 +223,193 @@ func GetIo(ctx context.Context, counting io.WriteCloser, filePath *url.URL) (io.
 	return buf, nil
 }
 
-func GetPathAndIO(ctx context.Context, path *url.URL, counter io.WriteCloser, compression, format string) (io.WriteCloser, error) {
+func GetPathAndIO(ctx context.Context, path *url.URL, counter io.WriteCloser, sConfig *data.StreamConfig) (io.WriteCloser, error) {
 
 	bufWriter, err := GetIo(ctx, counter, path)
 	if err != nil {
 		return nil, err
 	}
 
-	compressedWriter, err := CreateCompressedWriter(bufWriter, compression, format)
+	compressedWriter, err := CreateCompressedWriter(bufWriter, sConfig.Compression, sConfig.CompressionLevel, sConfig.Format)
 	if err != nil {
+		// nothing was written, do not leave an empty file behind
+		if aborter, ok := bufWriter.(data.Aborter); ok {
+			aborter.Abort()
+		} else {
+			bufWriter.Close()
+		}
 		return nil, err
 	}
 
 	return compressedWriter, nil
 }
 
-func AddCSV(ds *data.DataStream, writer io.WriteCloser) *CSVDataWriter {
-	return NewCSVDataWriter(ds, writer)
-}
-
 func AddJSONL(ds *data.DataStream, writer io.WriteCloser) *JSONLWriter {
 	return NewJSONLWriter(ds, writer)
 }
 
-func AddParquet(ds *data.DataStream, writer io.WriteCloser) *ParquetDataWriter {
-	return NewParquetDataWriter(ds, writer)
-}
-
-func AddFileWriter(format string, ds *data.DataStream, writer io.WriteCloser) (data.DataWriter, error) {
+// AddFileWriter picks the writer for the format of the stream, passing it the options it has
+func AddFileWriter(sConfig *data.StreamConfig, ds *data.DataStream, writer io.WriteCloser) (data.DataWriter, error) {
+	format, compression := sConfig.Format, sConfig.Compression
 	var dataWriter data.DataWriter
 	switch strings.ToLower(format) {
 	case "jsonl":
 		dataWriter = AddJSONL(ds, writer)
-	case "csv":
-		dataWriter = AddCSV(ds, writer)
+	case "csv", "tsv":
+		csvWriter, err := NewCSVDataWriterWithOptions(ds, writer, format, sConfig.CSV)
+		if err != nil {
+			return nil, err
+		}
+		dataWriter = csvWriter
+	case "fixedwidth":
+		fixedWidthWriter, err := NewFixedWidthDataWriter(ds, writer, sConfig.FixedWidth)
+		if err != nil {
+			return nil, err
+		}
+		dataWriter = fixedWidthWriter
 	case "parquet":
-		dataWriter = AddParquet(ds, writer)
+		parquetWriter, err := NewParquetDataWriterWithOptions(ds, writer, compression, sConfig.CompressionLevel, sConfig.Parquet)
+		if err != nil {
+			return nil, err
+		}
+		dataWriter = parquetWriter
 	case "arrow":
-		dataWriter = NewArrowDataWriter(ds, writer)
+		arrowWriter, err := NewArrowDataWriterWithOptions(ds, writer, compression, sConfig.CompressionLevel, sConfig.Arrow)
+		if err != nil {
+			return nil, err
+		}
+		dataWriter = arrowWriter
+	case "avro":
+		avroWriter, err := NewAvroDataWriter(ds, writer, compression)
+		if err != nil {
+			return nil, err
+		}
+		dataWriter = avroWriter
+	case "orc":
+		orcWriter, err := NewORCDataWriter(ds, writer, compression)
+		if err != nil {
+			return nil, err
+		}
+		dataWriter = orcWriter
+	case "xlsx":
+		xlsxWriter, err := NewXLSXDataWriter(ds, writer, compression)
+		if err != nil {
+			return nil, err
+		}
+		dataWriter = xlsxWriter
 	default:
 		return nil, fmt.Errorf("unsupported format: %s", format)
 	}
 	return dataWriter, nil
 }
 
-func CreateCompressedWriter(bufWriter io.WriteCloser, compressionType string, format string) (io.WriteCloser, error) {
-	if format == "parquet" {
+// IsTableFormat is true for formats that commit files to a table directory instead of writing a single file
+func IsTableFormat(format string) bool {
+	switch strings.ToLower(format) {
+	case "delta", "iceberg":
+		return true
+	default:
+		return false
+	}
+}
+
+func AddTableWriter(ctx context.Context, format, mode string, tableUrl *url.URL, ds *data.DataStream, counter io.WriteCloser) (data.DataWriter, error) {
+	switch strings.ToLower(format) {
+	case "delta":
+		return NewDeltaDataWriter(ctx, tableUrl, mode, ds, counter)
+	case "iceberg":
+		return NewIcebergDataWriter(ctx, tableUrl, mode, ds, counter)
+	default:
+		return nil, fmt.Errorf("unsupported table format: %s", format)
+	}
+}
+
+// CreateCompressedWriter wraps the writer in the stream compression. Formats
+// that compress inside the file get the writer back as is.
+func CreateCompressedWriter(bufWriter io.WriteCloser, compressionType string, level int, format string) (io.WriteCloser, error) {
+	// these compress inside the file
+	if format == "parquet" || format == "avro" || format == "orc" || format == "xlsx" {
+		return bufWriter, nil
+	}
+	if format == "arrow" && IsArrowBodyCompression(compressionType) {
 		return bufWriter, nil
 	}
 
-	if compressionType == "gzip" {
-		gzipWriter := gzip.NewWriter(bufWriter)
-		return &gzipWriteCloser{gzipWriter: gzipWriter, bufferedWriter: bufWriter}, nil
+	var compressor io.WriteCloser
+	switch strings.ToLower(compressionType) {
+	case "", "none":
+		return bufWriter, nil
+	case "gzip":
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		gzipWriter, err := gzip.NewWriterLevel(bufWriter, level)
+		if err != nil {
+			return nil, err
+		}
+		compressor = gzipWriter
+	case "snappy":
+		if level != 0 {
+			return nil, errors.New("snappy does not have compression levels")
+		}
+		compressor = snappy.NewBufferedWriter(bufWriter)
+	case "zstd":
+		if level < 0 || level > 22 {
+			return nil, fmt.Errorf("zstd level must be between 1 and 22: %d", level)
+		}
+		options := []zstd.EOption{}
+		if level != 0 {
+			options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		zstdWriter, err := zstd.NewWriter(bufWriter, options...)
+		if err != nil {
+			return nil, err
+		}
+		compressor = zstdWriter
+	case "lz4":
+		lz4Writer := lz4.NewWriter(bufWriter)
+		if level != 0 {
+			if level < 1 || level > 9 {
+				return nil, fmt.Errorf("lz4 level must be between 1 and 9: %d", level)
+			}
+			// Level1 to Level9 are powers of two apart
+			if err := lz4Writer.Apply(lz4.CompressionLevelOption(lz4.Level1 << (level - 1))); err != nil {
+				return nil, err
+			}
+		}
+		compressor = lz4Writer
+	case "bzip2":
+		bzip2Writer, err := bzip2.NewWriter(bufWriter, &bzip2.WriterConfig{Level: level})
+		if err != nil {
+			return nil, err
+		}
+		compressor = bzip2Writer
+	default:
+		return nil, fmt.Errorf("unsupported compression for %s: %s", format, compressionType)
 	}
 
-	return bufWriter, nil
+	return &compressedWriteCloser{compressor: compressor, bufferedWriter: bufWriter}, nil
 }
 
-type gzipWriteCloser struct {
-	gzipWriter     *gzip.Writer
+// compressedWriteCloser finishes the compressed stream before closing the file
+type compressedWriteCloser struct {
+	compressor     io.WriteCloser
 	bufferedWriter io.WriteCloser
+	closed         bool
 }
 
-func (w *gzipWriteCloser) Write(p []byte) (n int, err error) {
-	return w.gzipWriter.Write(p)
+func (w *compressedWriteCloser) Write(p []byte) (n int, err error) {
+	return w.compressor.Write(p)
 }
 
-func (w *gzipWriteCloser) Close() error {
-	// Flush the gzip writer to ensure all data is compressed and sent to the underlying writer
-	if err := w.gzipWriter.Flush(); err != nil {
-		return err
+func (w *compressedWriteCloser) Close() error {
+	// the data writers close their resource, so this can be called twice
+	if w.closed {
+		return nil
 	}
-
-	if err := w.gzipWriter.Close(); err != nil {
+	w.closed = true
+	// closing writes whatever the compressor is holding and the end of the stream
+	if err := w.compressor.Close(); err != nil {
 		return err
 	}
 
@@ -234,6 +420,27 @@ func (w *gzipWriteCloser) Close() error {
 	return nil
 }
 
+func (w *compressedWriteCloser) Abort() error {
+	if bufWriter, ok := w.bufferedWriter.(*BufferedWriter); ok && bufWriter.canAbort() {
+		return bufWriter.Abort()
+	}
+	return w.Close()
+}
+
+// CanAbort is true when aborting the writer throws away what was written, the
+// writers of local files can only close
+func CanAbort(writer io.WriteCloser) bool {
+	switch w := writer.(type) {
+	case *BufferedWriter:
+		return w.canAbort()
+	case *compressedWriteCloser:
+		bufWriter, ok := w.bufferedWriter.(*BufferedWriter)
+		return ok && bufWriter.canAbort()
+	}
+	_, ok := writer.(data.Aborter)
+	return ok
+}
+
 func WriteEmptyFile(format string, writer io.Writer) error {
 	switch format {
 	case "arrow":
@@ -0,0 +1,75 @@
+package file
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/assert"
+)
+
+type closingBuffer struct {
+	bytes.Buffer
+}
+
+func (c *closingBuffer) Close() error {
+	return nil
+}
+
+func TestCreateCompressedWriter(t *testing.T) {
+	input := []byte(strings.Repeat("1,John,10.50\n", 1000))
+
+	tests := []struct {
+		name        string
+		compression string
+		level       int
+		format      string
+		passthrough bool
+		isError     bool
+	}{
+		{name: "None", compression: "", format: "csv", passthrough: true},
+		{name: "Parquet compresses inside", compression: "zstd", format: "parquet", passthrough: true},
+		{name: "Gzip", compression: "gzip", level: 9, format: "csv"},
+		{name: "Snappy", compression: "snappy", format: "jsonl"},
+		{name: "Zstd", compression: "zstd", level: 19, format: "csv"},
+		{name: "Arrow zstd compresses inside", compression: "zstd", format: "arrow", passthrough: true},
+		{name: "Arrow snappy", compression: "snappy", format: "arrow"},
+		{name: "Lz4", compression: "LZ4", level: 9, format: "csv"},
+		{name: "Bzip2", compression: "bzip2", level: 1, format: "csv"},
+		{name: "Gzip level too high", compression: "gzip", level: 10, format: "csv", isError: true},
+		{name: "Snappy has no levels", compression: "snappy", level: 1, format: "csv", isError: true},
+		{name: "Zstd level too high", compression: "zstd", level: 23, format: "csv", isError: true},
+		{name: "Lz4 level too high", compression: "lz4", level: 10, format: "csv", isError: true},
+		{name: "Bzip2 level too high", compression: "bzip2", level: 10, format: "csv", isError: true},
+		{name: "Unknown", compression: "brotli", format: "csv", isError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &closingBuffer{}
+			writer, err := CreateCompressedWriter(out, tt.compression, tt.level, tt.format)
+			if tt.isError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			_, err = writer.Write(input)
+			assert.NoError(t, err)
+			assert.NoError(t, writer.Close())
+			// the data writers close too
+			assert.NoError(t, writer.Close())
+
+			if tt.passthrough {
+				assert.True(t, bytes.Equal(input, out.Bytes()))
+				return
+			}
+			assert.True(t, out.Len() < len(input))
+			reader, err := decompressedReader(out, strings.ToLower(tt.compression))
+			assert.NoError(t, err)
+			result, err := io.ReadAll(reader)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(input, result))
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package file
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/johanan/mvr/data"
+)
+
+// widths for the types that have one when the column has no length
+var fixedWidthDefaults = map[string]int{
+	"BOOLEAN":     5,
+	"SMALLINT":    6,
+	"INTEGER":     11,
+	"BIGINT":      20,
+	"DATE":        10,
+	"TIMESTAMP":   26,
+	"TIMESTAMPTZ": 32,
+	"UUID":        36,
+}
+
+type FixedWidthDataWriter struct {
+	datastream *data.DataStream
+	widths     []int
+	numbers    []bool
+	truncate   bool
+	zeroPad    bool
+	trailer    bool
+	prefix     string
+	terminator string
+	writer     *bufio.Writer
+	resource   io.WriteCloser
+	rows       int64
+	mux        *sync.Mutex
+}
+
+type FixedWidthBatchWriter struct {
+	dataWriter *FixedWidthDataWriter
+	buffer     []byte
+}
+
+func NewFixedWidthDataWriter(datastream *data.DataStream, writer io.WriteCloser, opts *data.FixedWidthOptions) (*FixedWidthDataWriter, error) {
+	if opts == nil {
+		opts = &data.FixedWidthOptions{}
+	}
+	fw := &FixedWidthDataWriter{
+		datastream: datastream,
+		widths:     make([]int, len(datastream.DestColumns)),
+		numbers:    make([]bool, len(datastream.DestColumns)),
+		zeroPad:    opts.ZeroPad,
+		trailer:    opts.Trailer,
+		prefix:     opts.TrailerPrefix,
+		terminator: "\n",
+		writer:     bufio.NewWriter(writer),
+		resource:   writer,
+		mux:        &sync.Mutex{},
+	}
+
+	switch strings.ToLower(opts.Overflow) {
+	case "", "fail":
+	case "truncate":
+		fw.truncate = true
+	default:
+		return nil, fmt.Errorf("fixed width overflow must be fail or truncate: %s", opts.Overflow)
+	}
+	switch strings.ToLower(opts.LineTerminator) {
+	case "", "lf":
+	case "crlf":
+		fw.terminator = "\r\n"
+	default:
+		return nil, fmt.Errorf("fixed width line_terminator must be lf or crlf: %s", opts.LineTerminator)
+	}
+
+	for i, col := range datastream.DestColumns {
+		width, err := fixedWidth(col)
+		if err != nil {
+			return nil, err
+		}
+		fw.widths[i] = width
+		fw.numbers[i] = isNumberType(col)
+	}
+
+	if opts.Header {
+		// the names are text, cut to fit so the header never fails
+		var header []byte
+		for i, col := range datastream.DestColumns {
+			header, _ = fitField(header, col.Name, fw.widths[i], false, true, false)
+		}
+		if _, err := fw.writer.Write(append(header, fw.terminator...)); err != nil {
+			return nil, fmt.Errorf("failed to write header: %w", err)
+		}
+	}
+	return fw, nil
+}
+
+// fixedWidth is the column length, or the width of the type when it has one
+func fixedWidth(col data.Column) (int, error) {
+	if col.Length > 0 {
+		return int(col.Length), nil
+	}
+	aliased := data.TypeAlias(col.Type)
+	if aliased == "NUMERIC" && col.Precision > 0 {
+		// a sign and a decimal point
+		return int(col.Precision) + 2, nil
+	}
+	if width, ok := fixedWidthDefaults[aliased]; ok {
+		return width, nil
+	}
+	return 0, fmt.Errorf("fixed width needs a length for %s column %s, set one in columns", col.Type, col.Name)
+}
+
+func isNumberType(col data.Column) bool {
+	switch data.TypeAlias(col.Type) {
+	case "SMALLINT", "INTEGER", "BIGINT", "REAL", "DOUBLE", "NUMERIC":
+		return true
+	}
+	return false
+}
+
+// fitField pads the value to the width. Numbers are right aligned and
+// everything else is left aligned. A number is never cut, a shorter number is
+// a different number, so only text is truncated.
+func fitField(buf []byte, value string, width int, number, truncate, zeroPad bool) ([]byte, bool) {
+	length := utf8.RuneCountInString(value)
+	if length > width {
+		if number || !truncate {
+			return buf, false
+		}
+		return append(buf, string([]rune(value)[:width])...), true
+	}
+
+	pad := width - length
+	switch {
+	case !number:
+		buf = append(buf, value...)
+		return append(buf, strings.Repeat(" ", pad)...), true
+	case zeroPad:
+		// the sign stays in front of the zeros
+		if rest, ok := strings.CutPrefix(value, "-"); ok {
+			buf = append(buf, '-')
+			value = rest
+		}
+		buf = append(buf, strings.Repeat("0", pad)...)
+		return append(buf, value...), true
+	default:
+		buf = append(buf, strings.Repeat(" ", pad)...)
+		return append(buf, value...), true
+	}
+}
+
+// appendRecord formats a row onto buf, nulls are all spaces
+func (fw *FixedWidthDataWriter) appendRecord(buf []byte, row []any) ([]byte, error) {
+	for i, val := range row {
+		col := fw.datastream.DestColumns[i]
+		if val == nil {
+			buf = append(buf, strings.Repeat(" ", fw.widths[i])...)
+			continue
+		}
+		value, err := ValueToString(val, col)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert column %s: %w", col.Name, err)
+		}
+		// a line break would start a new record
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("value for column %s has a line break", col.Name)
+		}
+		var ok bool
+		if buf, ok = fitField(buf, value, fw.widths[i], fw.numbers[i], fw.truncate, fw.zeroPad); !ok {
+			return nil, fmt.Errorf("value %q for column %s is wider than %d", value, col.Name, fw.widths[i])
+		}
+	}
+	return append(buf, fw.terminator...), nil
+}
+
+func (fw *FixedWidthDataWriter) CreateBatchWriter() data.BatchWriter {
+	return &FixedWidthBatchWriter{dataWriter: fw}
+}
+
+func (fb *FixedWidthBatchWriter) WriteBatch(batch data.Batch) error {
+	fw := fb.dataWriter
+	fb.buffer = fb.buffer[:0]
+	var err error
+	for _, row := range batch.Rows {
+		fb.buffer, err = fw.appendRecord(fb.buffer, row)
+		if err != nil {
+			return err
+		}
+	}
+
+	fw.mux.Lock()
+	defer fw.mux.Unlock()
+	if _, err := fw.writer.Write(fb.buffer); err != nil {
+		return err
+	}
+	fw.rows += int64(len(batch.Rows))
+	return fw.writer.Flush()
+}
+
+func (fw *FixedWidthDataWriter) Flush() error {
+	return fw.writer.Flush()
+}
+
+// trailerRecord is the prefix and the row count, zero padded to the record width
+func (fw *FixedWidthDataWriter) trailerRecord() string {
+	width := 0
+	for _, w := range fw.widths {
+		width += w
+	}
+	count := strconv.FormatInt(fw.rows, 10)
+	if pad := width - utf8.RuneCountInString(fw.prefix) - len(count); pad > 0 {
+		count = strings.Repeat("0", pad) + count
+	}
+	return fw.prefix + count + fw.terminator
+}
+
+// Close writes the trailer, the row count is only known at the end
+func (fw *FixedWidthDataWriter) Close() error {
+	if fw.trailer {
+		if _, err := fw.writer.WriteString(fw.trailerRecord()); err != nil {
+			return err
+		}
+	}
+	if err := fw.Flush(); err != nil {
+		return err
+	}
+	return fw.resource.Close()
+}
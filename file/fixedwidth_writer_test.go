@@ -0,0 +1,81 @@
+package file
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/johanan/mvr/data"
+	"github.com/zeebo/assert"
+)
+
+func TestFixedWidthDataWriter(t *testing.T) {
+	columns := []data.Column{
+		{Name: "id", Type: "INTEGER", Length: 5},
+		{Name: "name", Type: "VARCHAR", Length: 8},
+		{Name: "amount", Type: "NUMERIC", Precision: 6, Scale: 2},
+		{Name: "day", Type: "DATE"},
+	}
+	rows := [][]any{
+		{1, "John", "10.50", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{-22, "Jane Smithson", nil, nil},
+	}
+
+	tests := []struct {
+		name     string
+		opts     *data.FixedWidthOptions
+		expected string
+	}{
+		{
+			name:     "Truncate with header and trailer",
+			opts:     &data.FixedWidthOptions{Overflow: "truncate", Header: true, Trailer: true, TrailerPrefix: "TRL"},
+			expected: "id   name    amount  day       \n    1John       10.502024-01-02\n  -22Jane Smi                  \nTRL0000000000000000000000000002\n",
+		},
+		{
+			name:     "Zero padded numbers",
+			opts:     &data.FixedWidthOptions{Overflow: "truncate", ZeroPad: true, LineTerminator: "crlf"},
+			expected: "00001John    00010.502024-01-02\r\n-0022Jane Smi                  \r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := &data.DataStream{BatchSize: 10, Columns: columns, DestColumns: columns}
+			var buf bytes.Buffer
+			writer, err := AddFileWriter(&data.StreamConfig{Format: "fixedwidth", FixedWidth: tt.opts}, ds, NewBufferedWriter(&buf))
+			assert.NoError(t, err)
+			assert.NoError(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: rows}))
+			assert.NoError(t, writer.Close())
+			assert.Equal(t, tt.expected, buf.String())
+		})
+	}
+}
+
+func TestFixedWidthErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		columns []data.Column
+		row     []any
+		opts    *data.FixedWidthOptions
+	}{
+		{name: "Text without a length", columns: []data.Column{{Name: "name", Type: "TEXT"}}},
+		{name: "Unknown overflow", columns: []data.Column{{Name: "id", Type: "INTEGER"}}, opts: &data.FixedWidthOptions{Overflow: "wrap"}},
+		{name: "Text too wide", columns: []data.Column{{Name: "name", Type: "TEXT", Length: 2}}, row: []any{"John"}},
+		{name: "Numbers are never cut", columns: []data.Column{{Name: "id", Type: "INTEGER", Length: 2}}, row: []any{123}, opts: &data.FixedWidthOptions{Overflow: "truncate"}},
+		{name: "Line break", columns: []data.Column{{Name: "name", Type: "TEXT", Length: 10}}, row: []any{"a\nb"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := &data.DataStream{BatchSize: 10, Columns: tt.columns, DestColumns: tt.columns}
+			var buf bytes.Buffer
+			writer, err := NewFixedWidthDataWriter(ds, NewBufferedWriter(&buf), tt.opts)
+			if tt.row == nil {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Error(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: [][]any{tt.row}}))
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+type GCSConfig struct {
+	bucket      string
+	object      string
+	endpoint    string
+	credentials string
+}
+
+type GCSObject struct {
+	*GCSConfig
+	client *storage.Client
+	writer *storage.Writer
+	cancel context.CancelFunc
+	open   bool
+}
+
+func (g *GCSObject) Write(p []byte) (n int, err error) {
+	return g.writer.Write(p)
+}
+
+func (g *GCSObject) Close() error {
+	if g.open {
+		g.open = false
+
+		defer g.cancel()
+
+		// the upload only finishes when the writer is closed
+		if err := g.writer.Close(); err != nil {
+			g.client.Close()
+			return fmt.Errorf("upload failed: %w", err)
+		}
+		return g.client.Close()
+	}
+	return nil
+}
+
+// Abort cancels the upload session before the object is created
+func (g *GCSObject) Abort() error {
+	if !g.open {
+		return nil
+	}
+	g.open = false
+
+	g.cancel()
+	// the writer only reports the cancel
+	g.writer.Close()
+	return g.client.Close()
+}
+
+func (g *GCSConfig) getClient(ctx context.Context) (*storage.Client, error) {
+	// with no options this is Application Default Credentials
+	var opts []option.ClientOption
+	if g.credentials != "" {
+		opts = append(opts, option.WithAuthCredentialsFile(option.ServiceAccount, g.credentials))
+	}
+	if g.endpoint != "" {
+		// the emulators do not check credentials
+		opts = append(opts, option.WithEndpoint(g.endpoint), option.WithoutAuthentication())
+	}
+
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("GCS: %v", err)
+	}
+	return client, nil
+}
+
+func (g *GCSConfig) GetWriter(ctx context.Context) (*GCSObject, error) {
+	client, err := g.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// storage.Writer runs a resumable upload session and sends it a chunk at a
+	// time, cancelling its context is the only way to stop it
+	ctx, cancel := context.WithCancel(ctx)
+	writer := client.Bucket(g.bucket).Object(g.object).NewWriter(ctx)
+	return &GCSObject{GCSConfig: g, client: client, writer: writer, cancel: cancel, open: true}, nil
+}
+
+// ParseGCSURL reads gs://bucket/object. A service account JSON file can be set
+// with ?credentials= and an emulator with ?endpoint=.
+func ParseGCSURL(gcsUrl *url.URL) (*GCSConfig, error) {
+	if gcsUrl.Scheme != "gs" {
+		return nil, fmt.Errorf("GCS: only gs is supported")
+	}
+
+	bucket := gcsUrl.Hostname()
+	object := strings.TrimPrefix(gcsUrl.Path, "/")
+	if bucket == "" || object == "" {
+		return nil, fmt.Errorf("GCS: bucket and object are required")
+	}
+
+	query := gcsUrl.Query()
+	endpoint := query.Get("endpoint")
+	if endpoint != "" {
+		emulator, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("GCS: invalid endpoint")
+		}
+		// fake-gcs-server serves the JSON API under the same path as Google
+		if emulator.Path == "" || emulator.Path == "/" {
+			emulator.Path = "/storage/v1/"
+		}
+		endpoint = emulator.String()
+	}
+
+	return &GCSConfig{bucket: bucket, object: object, endpoint: endpoint, credentials: query.Get("credentials")}, nil
+}
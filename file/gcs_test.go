@@ -0,0 +1,127 @@
+package file
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"testing"
+
+	"github.com/johanan/mvr/core"
+	"github.com/johanan/mvr/data"
+	"github.com/johanan/mvr/database"
+	"github.com/zeebo/assert"
+)
+
+var local_gcs_url = "gs://testbucket/test/test.csv?endpoint=http://localhost:4443"
+
+func TestGCS_Writer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sc := &data.StreamConfig{StreamName: "public.numbers", Format: "csv"}
+	err := sc.Validate()
+	assert.NoError(t, err)
+	local_url, _ := url.Parse(local_db_url)
+
+	pgr, _ := database.NewPGDataReader(local_url)
+	pgDs, _ := pgr.CreateDataStream(ctx, local_url, sc)
+	assert.NotNil(t, pgDs)
+	defer pgr.Close()
+
+	gcsUrl, _ := url.Parse(local_gcs_url)
+	gcsConfig, err := ParseGCSURL(gcsUrl)
+	assert.NoError(t, err)
+	client, err := gcsConfig.getClient(ctx)
+	assert.NoError(t, err)
+	defer client.Close()
+	_ = client.Bucket("testbucket").Create(ctx, "test", nil)
+
+	gcsWriter, err := gcsConfig.GetWriter(ctx)
+	assert.NoError(t, err)
+
+	buf := NewBufferedWriter(gcsWriter, gcsWriter)
+	writer := NewCSVDataWriter(pgDs, buf)
+
+	err = core.Execute(ctx, 1, sc, pgDs, pgr, writer)
+	assert.NoError(t, err)
+	writer.Close()
+
+	err = gcsWriter.Close()
+	assert.NoError(t, err)
+
+	reader, err := client.Bucket("testbucket").Object("test/test.csv").NewReader(ctx)
+	assert.NoError(t, err)
+	defer reader.Close()
+	body, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.True(t, len(body) > 0)
+}
+
+func TestGCS_Abort(t *testing.T) {
+	ctx := context.Background()
+	gcsUrl, _ := url.Parse("gs://testbucket/test/aborted.csv?endpoint=http://localhost:4443")
+	gcsConfig, err := ParseGCSURL(gcsUrl)
+	assert.NoError(t, err)
+	client, err := gcsConfig.getClient(ctx)
+	assert.NoError(t, err)
+	defer client.Close()
+	_ = client.Bucket("testbucket").Create(ctx, "test", nil)
+
+	gcsWriter, err := gcsConfig.GetWriter(ctx)
+	assert.NoError(t, err)
+	assert.True(t, CanAbort(NewBufferedWriter(gcsWriter, gcsWriter)))
+	_, err = gcsWriter.Write([]byte("partial"))
+	assert.NoError(t, err)
+	assert.NoError(t, gcsWriter.Abort())
+
+	_, err = client.Bucket("testbucket").Object("test/aborted.csv").Attrs(ctx)
+	assert.Error(t, err)
+}
+
+func Test_ParseGCSURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		gcsUrl    string
+		expected  GCSConfig
+		expectErr bool
+	}{
+		{
+			name:     "Bucket and object",
+			gcsUrl:   "gs://bucket/prefix/year/month/test.parquet",
+			expected: GCSConfig{bucket: "bucket", object: "prefix/year/month/test.parquet"},
+		},
+		{
+			name:     "Service account",
+			gcsUrl:   "gs://bucket/test.csv?credentials=/secrets/sa.json",
+			expected: GCSConfig{bucket: "bucket", object: "test.csv", credentials: "/secrets/sa.json"},
+		},
+		{
+			name:     "Emulator",
+			gcsUrl:   "gs://bucket/test.csv?endpoint=http://localhost:4443",
+			expected: GCSConfig{bucket: "bucket", object: "test.csv", endpoint: "http://localhost:4443/storage/v1/"},
+		},
+		{
+			name:     "Emulator with path",
+			gcsUrl:   "gs://bucket/test.csv?endpoint=http://localhost:4443/custom/",
+			expected: GCSConfig{bucket: "bucket", object: "test.csv", endpoint: "http://localhost:4443/custom/"},
+		},
+		{
+			name:      "Missing object",
+			gcsUrl:    "gs://bucket",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gcsUrl, _ := url.Parse(tt.gcsUrl)
+			gcsConfig, err := ParseGCSURL(gcsUrl)
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, *gcsConfig)
+		})
+	}
+}
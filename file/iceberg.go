@@ -0,0 +1,779 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/google/uuid"
+	"github.com/hamba/avro/v2"
+	"github.com/hamba/avro/v2/ocf"
+	"github.com/johanan/mvr/data"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	icebergMetadataDir = "metadata"
+	icebergDataDir     = "data"
+	icebergVersionHint = icebergMetadataDir + "/version-hint.text"
+	// how many times a commit is retried when another writer takes the version
+	icebergCommitAttempts = 10
+	icebergFormatVersion  = 2
+)
+
+var icebergVersionFile = regexp.MustCompile(`^v(\d+)\.metadata\.json$`)
+
+// the manifest schemas need the field-ids, readers project manifests by id
+var icebergManifestSchema = avro.MustParse(`{
+	"type": "record", "name": "manifest_entry", "fields": [
+		{"name": "status", "type": "int", "field-id": 0},
+		{"name": "snapshot_id", "type": ["null", "long"], "default": null, "field-id": 1},
+		{"name": "sequence_number", "type": ["null", "long"], "default": null, "field-id": 3},
+		{"name": "file_sequence_number", "type": ["null", "long"], "default": null, "field-id": 4},
+		{"name": "data_file", "field-id": 2, "type": {"type": "record", "name": "r2", "fields": [
+			{"name": "content", "type": "int", "field-id": 134},
+			{"name": "file_path", "type": "string", "field-id": 100},
+			{"name": "file_format", "type": "string", "field-id": 101},
+			{"name": "partition", "type": {"type": "record", "name": "r102", "fields": []}, "field-id": 102},
+			{"name": "record_count", "type": "long", "field-id": 103},
+			{"name": "file_size_in_bytes", "type": "long", "field-id": 104}
+		]}}
+	]
+}`)
+
+var icebergManifestListSchema = avro.MustParse(`{
+	"type": "record", "name": "manifest_file", "fields": [
+		{"name": "manifest_path", "type": "string", "field-id": 500},
+		{"name": "manifest_length", "type": "long", "field-id": 501},
+		{"name": "partition_spec_id", "type": "int", "field-id": 502},
+		{"name": "content", "type": "int", "field-id": 517},
+		{"name": "sequence_number", "type": "long", "field-id": 515},
+		{"name": "min_sequence_number", "type": "long", "field-id": 516},
+		{"name": "added_snapshot_id", "type": "long", "field-id": 503},
+		{"name": "added_files_count", "type": "int", "field-id": 504},
+		{"name": "existing_files_count", "type": "int", "field-id": 505},
+		{"name": "deleted_files_count", "type": "int", "field-id": 506},
+		{"name": "added_rows_count", "type": "long", "field-id": 512},
+		{"name": "existing_rows_count", "type": "long", "field-id": 513},
+		{"name": "deleted_rows_count", "type": "long", "field-id": 514}
+	]
+}`)
+
+type icebergMetadata struct {
+	FormatVersion      int                    `json:"format-version"`
+	TableUUID          string                 `json:"table-uuid"`
+	Location           string                 `json:"location"`
+	LastSequenceNumber int64                  `json:"last-sequence-number"`
+	LastUpdatedMs      int64                  `json:"last-updated-ms"`
+	LastColumnID       int                    `json:"last-column-id"`
+	CurrentSchemaID    int                    `json:"current-schema-id"`
+	Schemas            []icebergSchema        `json:"schemas"`
+	DefaultSpecID      int                    `json:"default-spec-id"`
+	PartitionSpecs     []icebergPartitionSpec `json:"partition-specs"`
+	LastPartitionID    int                    `json:"last-partition-id"`
+	DefaultSortOrderID int                    `json:"default-sort-order-id"`
+	SortOrders         []json.RawMessage      `json:"sort-orders"`
+	Properties         map[string]string      `json:"properties"`
+	CurrentSnapshotID  int64                  `json:"current-snapshot-id"`
+	Refs               map[string]icebergRef  `json:"refs"`
+	Snapshots          []icebergSnapshot      `json:"snapshots"`
+	SnapshotLog        []icebergSnapshotLog   `json:"snapshot-log"`
+	MetadataLog        []icebergMetadataLog   `json:"metadata-log"`
+}
+
+type icebergSchema struct {
+	Type     string         `json:"type"`
+	SchemaID int            `json:"schema-id"`
+	Fields   []icebergField `json:"fields"`
+}
+
+type icebergField struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Required bool   `json:"required"`
+	// a string for primitives, other engines can write nested types as objects
+	Type any `json:"type"`
+}
+
+type icebergPartitionSpec struct {
+	SpecID int               `json:"spec-id"`
+	Fields []json.RawMessage `json:"fields"`
+}
+
+type icebergRef struct {
+	SnapshotID int64  `json:"snapshot-id"`
+	Type       string `json:"type"`
+}
+
+type icebergSnapshot struct {
+	SnapshotID       int64             `json:"snapshot-id"`
+	ParentSnapshotID *int64            `json:"parent-snapshot-id,omitempty"`
+	SequenceNumber   int64             `json:"sequence-number"`
+	TimestampMs      int64             `json:"timestamp-ms"`
+	ManifestList     string            `json:"manifest-list"`
+	Summary          map[string]string `json:"summary"`
+	SchemaID         int               `json:"schema-id"`
+}
+
+type icebergSnapshotLog struct {
+	TimestampMs int64 `json:"timestamp-ms"`
+	SnapshotID  int64 `json:"snapshot-id"`
+}
+
+type icebergMetadataLog struct {
+	TimestampMs  int64  `json:"timestamp-ms"`
+	MetadataFile string `json:"metadata-file"`
+}
+
+type icebergManifestEntry struct {
+	Status             int32           `avro:"status"`
+	SnapshotID         *int64          `avro:"snapshot_id"`
+	SequenceNumber     *int64          `avro:"sequence_number"`
+	FileSequenceNumber *int64          `avro:"file_sequence_number"`
+	DataFile           icebergDataFile `avro:"data_file"`
+}
+
+type icebergDataFile struct {
+	Content         int32    `avro:"content"`
+	FilePath        string   `avro:"file_path"`
+	FileFormat      string   `avro:"file_format"`
+	Partition       struct{} `avro:"partition"`
+	RecordCount     int64    `avro:"record_count"`
+	FileSizeInBytes int64    `avro:"file_size_in_bytes"`
+}
+
+type icebergManifestFile struct {
+	ManifestPath       string `avro:"manifest_path"`
+	ManifestLength     int64  `avro:"manifest_length"`
+	PartitionSpecID    int32  `avro:"partition_spec_id"`
+	Content            int32  `avro:"content"`
+	SequenceNumber     int64  `avro:"sequence_number"`
+	MinSequenceNumber  int64  `avro:"min_sequence_number"`
+	AddedSnapshotID    int64  `avro:"added_snapshot_id"`
+	AddedFilesCount    int32  `avro:"added_files_count"`
+	ExistingFilesCount int32  `avro:"existing_files_count"`
+	DeletedFilesCount  int32  `avro:"deleted_files_count"`
+	AddedRowsCount     int64  `avro:"added_rows_count"`
+	ExistingRowsCount  int64  `avro:"existing_rows_count"`
+	DeletedRowsCount   int64  `avro:"deleted_rows_count"`
+}
+
+// IcebergDataWriter writes a single parquet file into the data directory and
+// commits it as a new snapshot of the table when it is closed
+type IcebergDataWriter struct {
+	ctx        context.Context
+	store      tableStore
+	mode       string
+	location   string
+	fileName   string
+	fields     []icebergField
+	snapshotID int64
+	data       *ParquetDataWriter
+	file       *countingWriter
+	rows       int64
+	mux        *sync.Mutex
+}
+
+type IcebergBatchWriter struct {
+	dataWriter  *IcebergDataWriter
+	batchWriter data.BatchWriter
+}
+
+func NewIcebergDataWriter(ctx context.Context, tableUrl *url.URL, mode string, ds *data.DataStream, counter io.WriteCloser) (*IcebergDataWriter, error) {
+	switch mode {
+	case "append", "overwrite":
+	default:
+		return nil, fmt.Errorf("unsupported mode for iceberg: %s", mode)
+	}
+
+	columns, fields, err := icebergFieldsFor(ds.DestColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newTableStore(tableUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	// check the table before writing any data
+	_, metadata, err := loadIcebergMetadata(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	location, err := icebergLocation(tableUrl)
+	if err != nil {
+		return nil, err
+	}
+	if metadata != nil {
+		if err := checkIcebergTable(metadata); err != nil {
+			return nil, err
+		}
+		if _, _, err := evolveIcebergSchema(metadata, fields); err != nil {
+			return nil, err
+		}
+		location = metadata.Location
+	}
+
+	fileName := fmt.Sprintf("%s/%s.parquet", icebergDataDir, uuid.New())
+	fileUrl := tableUrl.JoinPath(fileName)
+	out, err := GetIo(ctx, counter, fileUrl)
+	if err != nil {
+		return nil, err
+	}
+	file := &countingWriter{writer: out}
+	log.Debug().Str("path", fileUrl.Path).Msg("Writing iceberg data file")
+
+	// the parquet field ids have to match the table schema
+	parquetStream := &data.DataStream{BatchSize: ds.BatchSize, Columns: ds.Columns, DestColumns: columns}
+	return &IcebergDataWriter{
+		ctx:        ctx,
+		store:      store,
+		mode:       mode,
+		location:   strings.TrimSuffix(location, "/"),
+		fileName:   fileName,
+		fields:     fields,
+		snapshotID: rand.Int64(),
+		data:       NewParquetDataWriter(parquetStream, file),
+		file:       file,
+		mux:        &sync.Mutex{},
+	}, nil
+}
+
+// icebergType maps the abstract type to the iceberg primitive the parquet writer matches
+func icebergType(col data.Column) (string, error) {
+	switch data.TypeAlias(col.Type) {
+	case "BOOLEAN":
+		return "boolean", nil
+	case "SMALLINT", "INTEGER":
+		// the parquet writer stores both as int32
+		return "int", nil
+	case "BIGINT":
+		return "long", nil
+	case "REAL":
+		return "float", nil
+	case "DOUBLE":
+		return "double", nil
+	case "NUMERIC":
+		if col.Precision <= 0 || col.Precision > 38 {
+			return "", fmt.Errorf("iceberg needs a precision between 1 and 38 for NUMERIC column %s, set one in columns", col.Name)
+		}
+		return fmt.Sprintf("decimal(%d, %d)", col.Precision, col.Scale), nil
+	case "UUID":
+		return "uuid", nil
+	case "DATE":
+		return "date", nil
+	case "TIMESTAMP":
+		return "timestamp", nil
+	case "TIMESTAMPTZ":
+		return "timestamptz", nil
+	default:
+		return "string", nil
+	}
+}
+
+// icebergFieldsFor gives every column the field id of its position. Positions
+// start at 0 and iceberg ids at 1, so the columns are copied with the id the
+// parquet writer uses.
+func icebergFieldsFor(columns []data.Column) ([]data.Column, []icebergField, error) {
+	shifted := make([]data.Column, len(columns))
+	fields := make([]icebergField, len(columns))
+	seen := make(map[int]string, len(columns))
+	for i, col := range columns {
+		t, err := icebergType(col)
+		if err != nil {
+			return nil, nil, err
+		}
+		id := col.Position + 1
+		if other, ok := seen[id]; ok {
+			return nil, nil, fmt.Errorf("columns %s and %s have the same position %d, iceberg field ids come from the position", other, col.Name, col.Position)
+		}
+		seen[id] = col.Name
+
+		// the schema has no nested types, so lists and structs are JSON strings
+		shifted[i] = flattenNested([]data.Column{col})[0]
+		shifted[i].Position = id
+		fields[i] = icebergField{ID: id, Name: col.Name, Type: t}
+	}
+	return shifted, fields, nil
+}
+
+// icebergLocation is the table location readers see, without any credentials
+func icebergLocation(tableUrl *url.URL) (string, error) {
+	switch tableUrl.Scheme {
+	case "file", "":
+		abs, err := filepath.Abs(tableUrl.Path)
+		if err != nil {
+			return "", err
+		}
+		return (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String(), nil
+	case "azure", "https":
+		// engines read azure through the dfs endpoint
+		account, _, _ := strings.Cut(tableUrl.Hostname(), ".")
+		container, prefix, _ := strings.Cut(strings.TrimPrefix(tableUrl.Path, "/"), "/")
+		return fmt.Sprintf("abfss://%s@%s.dfs.core.windows.net/%s", container, account, prefix), nil
+	default:
+		return (&url.URL{Scheme: tableUrl.Scheme, Host: tableUrl.Host, Path: tableUrl.Path}).String(), nil
+	}
+}
+
+func icebergVersionName(version int) string {
+	return fmt.Sprintf("%s/v%d.metadata.json", icebergMetadataDir, version)
+}
+
+// loadIcebergMetadata reads the newest metadata file, a new table is version 0 and nil
+func loadIcebergMetadata(ctx context.Context, store tableStore) (int, *icebergMetadata, error) {
+	names, err := store.List(ctx, icebergMetadataDir)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error listing %s: %w", icebergMetadataDir, err)
+	}
+
+	// the listing wins over version-hint.text, the hint can lag behind a commit
+	version := 0
+	for _, name := range names {
+		match := icebergVersionFile.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		if v, err := strconv.Atoi(match[1]); err == nil && v > version {
+			version = v
+		}
+	}
+	if version == 0 {
+		return 0, nil, nil
+	}
+
+	body, err := store.Read(ctx, icebergVersionName(version))
+	if err != nil {
+		return 0, nil, fmt.Errorf("error reading iceberg version %d: %w", version, err)
+	}
+	var metadata icebergMetadata
+	if err := json.Unmarshal(body, &metadata); err != nil {
+		return 0, nil, fmt.Errorf("error parsing iceberg version %d: %w", version, err)
+	}
+	return version, &metadata, nil
+}
+
+// checkIcebergTable makes sure mvr can write to an existing table
+func checkIcebergTable(metadata *icebergMetadata) error {
+	if metadata.FormatVersion != icebergFormatVersion {
+		return fmt.Errorf("iceberg format version %d is not supported", metadata.FormatVersion)
+	}
+	for _, spec := range metadata.PartitionSpecs {
+		if spec.SpecID == metadata.DefaultSpecID && len(spec.Fields) > 0 {
+			return errors.New("partitioned iceberg tables are not supported")
+		}
+	}
+	return nil
+}
+
+func (s icebergSchema) sameFields(fields []icebergField) bool {
+	if len(s.Fields) != len(fields) {
+		return false
+	}
+	for i, field := range s.Fields {
+		if field.ID != fields[i].ID || field.Name != fields[i].Name || field.Type != fields[i].Type {
+			return false
+		}
+	}
+	return true
+}
+
+// icebergPromotion is true when a column can change from one type to the other
+func icebergPromotion(from, to string) bool {
+	switch {
+	case from == to:
+		return true
+	case from == "int" && to == "long", from == "float" && to == "double":
+		return true
+	}
+	var fromPrecision, fromScale, toPrecision, toScale int
+	if _, err := fmt.Sscanf(strings.ReplaceAll(from, " ", ""), "decimal(%d,%d)", &fromPrecision, &fromScale); err != nil {
+		return false
+	}
+	if _, err := fmt.Sscanf(strings.ReplaceAll(to, " ", ""), "decimal(%d,%d)", &toPrecision, &toScale); err != nil {
+		return false
+	}
+	return fromScale == toScale && toPrecision >= fromPrecision
+}
+
+// evolveIcebergSchema finds the schema for the columns, returning a new one
+// when they changed. An id keeps its history, so a column at a position can be
+// renamed or widened but not turned into another type.
+func evolveIcebergSchema(metadata *icebergMetadata, fields []icebergField) (int, bool, error) {
+	latest := make(map[int]icebergField)
+	nextID := 0
+	// newest schema first, so the last type an id had is kept
+	for i := len(metadata.Schemas) - 1; i >= 0; i-- {
+		schema := metadata.Schemas[i]
+		if schema.SchemaID == metadata.CurrentSchemaID && schema.sameFields(fields) {
+			return schema.SchemaID, false, nil
+		}
+		for _, field := range schema.Fields {
+			if _, ok := latest[field.ID]; !ok {
+				latest[field.ID] = field
+			}
+		}
+		nextID = max(nextID, schema.SchemaID+1)
+	}
+
+	for _, field := range fields {
+		existing, ok := latest[field.ID]
+		if !ok {
+			continue
+		}
+		from, _ := existing.Type.(string)
+		if !icebergPromotion(from, field.Type.(string)) {
+			return 0, false, fmt.Errorf("column %s cannot change field %d of the iceberg table from %v to %v, use a new position", field.Name, field.ID, existing.Type, field.Type)
+		}
+	}
+	return nextID, true, nil
+}
+
+// writeAvro encodes the records into an avro file with the iceberg metadata
+func writeAvro[T any](schema avro.Schema, meta map[string]string, records []T) ([]byte, error) {
+	headers := make(map[string][]byte, len(meta))
+	for k, v := range meta {
+		headers[k] = []byte(v)
+	}
+
+	var buf bytes.Buffer
+	encoder, err := ocf.NewEncoderWithSchema(schema, &buf, ocf.WithMetadata(headers), ocf.WithCodec(ocf.Deflate), ocf.WithSchemaMarshaler(ocf.FullSchemaMarshaler))
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return nil, err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func readAvro[T any](body []byte) ([]T, error) {
+	decoder, err := ocf.NewDecoder(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	var records []T
+	for decoder.HasNext() {
+		var record T
+		if err := decoder.Decode(&record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, decoder.Error()
+}
+
+// relativeName turns a path in the metadata back into a name in the table store
+func (iw *IcebergDataWriter) relativeName(path string) (string, error) {
+	name, ok := strings.CutPrefix(path, iw.location+"/")
+	if !ok {
+		return "", fmt.Errorf("iceberg file %s is outside of the table location %s", path, iw.location)
+	}
+	return name, nil
+}
+
+// writeManifest lists the data file, it is the same for every commit attempt
+func (iw *IcebergDataWriter) writeManifest(schema icebergSchema) (icebergManifestFile, error) {
+	schemaJson, err := json.Marshal(schema)
+	if err != nil {
+		return icebergManifestFile{}, err
+	}
+	entry := icebergManifestEntry{
+		// added, the sequence numbers are inherited from the snapshot
+		Status:     1,
+		SnapshotID: &iw.snapshotID,
+		DataFile: icebergDataFile{
+			FilePath:        iw.location + "/" + iw.fileName,
+			FileFormat:      "PARQUET",
+			RecordCount:     iw.rows,
+			FileSizeInBytes: iw.file.size,
+		},
+	}
+	body, err := writeAvro(icebergManifestSchema, map[string]string{
+		"schema":            string(schemaJson),
+		"schema-id":         strconv.Itoa(schema.SchemaID),
+		"partition-spec":    "[]",
+		"partition-spec-id": "0",
+		"format-version":    strconv.Itoa(icebergFormatVersion),
+		"content":           "data",
+	}, []icebergManifestEntry{entry})
+	if err != nil {
+		return icebergManifestFile{}, fmt.Errorf("error writing iceberg manifest: %w", err)
+	}
+
+	name := fmt.Sprintf("%s/%s-m0.avro", icebergMetadataDir, uuid.New())
+	if err := iw.store.PutIfAbsent(iw.ctx, name, body); err != nil {
+		return icebergManifestFile{}, fmt.Errorf("error writing iceberg manifest: %w", err)
+	}
+	return icebergManifestFile{
+		ManifestPath:    iw.location + "/" + name,
+		ManifestLength:  int64(len(body)),
+		AddedSnapshotID: iw.snapshotID,
+		AddedFilesCount: 1,
+		AddedRowsCount:  iw.rows,
+	}, nil
+}
+
+// parentManifests are the manifests an append keeps from the current snapshot
+func (iw *IcebergDataWriter) parentManifests(metadata *icebergMetadata) ([]icebergManifestFile, *icebergSnapshot, error) {
+	if metadata == nil {
+		return nil, nil, nil
+	}
+	var parent *icebergSnapshot
+	for i := range metadata.Snapshots {
+		if metadata.Snapshots[i].SnapshotID == metadata.CurrentSnapshotID {
+			parent = &metadata.Snapshots[i]
+		}
+	}
+	if parent == nil || iw.mode == "overwrite" {
+		return nil, parent, nil
+	}
+
+	name, err := iw.relativeName(parent.ManifestList)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := iw.store.Read(iw.ctx, name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading iceberg manifest list: %w", err)
+	}
+	manifests, err := readAvro[icebergManifestFile](body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading iceberg manifest list: %w", err)
+	}
+	return manifests, parent, nil
+}
+
+// icebergSummary carries the table totals forward, an overwrite starts them over
+func icebergSummary(operation string, parent *icebergSnapshot, files, rows, size int64) map[string]string {
+	total := func(key string) int64 {
+		if parent == nil || operation == "overwrite" {
+			return 0
+		}
+		value, _ := strconv.ParseInt(parent.Summary[key], 10, 64)
+		return value
+	}
+	summary := map[string]string{
+		"operation":              operation,
+		"added-data-files":       strconv.FormatInt(files, 10),
+		"added-records":          strconv.FormatInt(rows, 10),
+		"added-files-size":       strconv.FormatInt(size, 10),
+		"total-data-files":       strconv.FormatInt(total("total-data-files")+files, 10),
+		"total-records":          strconv.FormatInt(total("total-records")+rows, 10),
+		"total-files-size":       strconv.FormatInt(total("total-files-size")+size, 10),
+		"total-delete-files":     "0",
+		"total-position-deletes": "0",
+		"total-equality-deletes": "0",
+	}
+	if operation == "overwrite" && parent != nil {
+		summary["deleted-data-files"] = parent.Summary["total-data-files"]
+		summary["deleted-records"] = parent.Summary["total-records"]
+	}
+	return summary
+}
+
+// nextMetadata writes the manifest list and builds the metadata of the new snapshot
+func (iw *IcebergDataWriter) nextMetadata(version int, current *icebergMetadata, manifest icebergManifestFile, now time.Time) (*icebergMetadata, error) {
+	millis := now.UnixMilli()
+	next := &icebergMetadata{
+		FormatVersion:     icebergFormatVersion,
+		TableUUID:         uuid.NewString(),
+		Location:          iw.location,
+		PartitionSpecs:    []icebergPartitionSpec{{SpecID: 0, Fields: []json.RawMessage{}}},
+		LastPartitionID:   999,
+		SortOrders:        []json.RawMessage{json.RawMessage(`{"order-id":0,"fields":[]}`)},
+		Properties:        map[string]string{},
+		CurrentSnapshotID: -1,
+	}
+	schemaID, changed := 0, true
+	if current != nil {
+		*next = *current
+		// the slices are appended to, keep them away from current
+		next.Schemas = append([]icebergSchema{}, current.Schemas...)
+		next.Snapshots = append([]icebergSnapshot{}, current.Snapshots...)
+		next.SnapshotLog = append([]icebergSnapshotLog{}, current.SnapshotLog...)
+		next.MetadataLog = append(append([]icebergMetadataLog{}, current.MetadataLog...), icebergMetadataLog{
+			TimestampMs:  current.LastUpdatedMs,
+			MetadataFile: iw.location + "/" + icebergVersionName(version),
+		})
+
+		var err error
+		schemaID, changed, err = evolveIcebergSchema(current, iw.fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if changed {
+		next.Schemas = append(next.Schemas, icebergSchema{Type: "struct", SchemaID: schemaID, Fields: iw.fields})
+	}
+	next.CurrentSchemaID = schemaID
+	for _, field := range iw.fields {
+		next.LastColumnID = max(next.LastColumnID, field.ID)
+	}
+
+	manifests, parent, err := iw.parentManifests(current)
+	if err != nil {
+		return nil, err
+	}
+	sequence := next.LastSequenceNumber + 1
+	manifest.SequenceNumber = sequence
+	manifest.MinSequenceNumber = sequence
+	manifests = append([]icebergManifestFile{manifest}, manifests...)
+
+	snapshot := icebergSnapshot{
+		SnapshotID:     iw.snapshotID,
+		SequenceNumber: sequence,
+		TimestampMs:    millis,
+		Summary:        icebergSummary(iw.mode, parent, 1, iw.rows, iw.file.size),
+		SchemaID:       schemaID,
+	}
+	parentID := "null"
+	if parent != nil {
+		snapshot.ParentSnapshotID = &parent.SnapshotID
+		parentID = strconv.FormatInt(parent.SnapshotID, 10)
+	}
+
+	body, err := writeAvro(icebergManifestListSchema, map[string]string{
+		"snapshot-id":        strconv.FormatInt(iw.snapshotID, 10),
+		"parent-snapshot-id": parentID,
+		"sequence-number":    strconv.FormatInt(sequence, 10),
+		"format-version":     strconv.Itoa(icebergFormatVersion),
+	}, manifests)
+	if err != nil {
+		return nil, fmt.Errorf("error writing iceberg manifest list: %w", err)
+	}
+	listName := fmt.Sprintf("%s/snap-%d-1-%s.avro", icebergMetadataDir, iw.snapshotID, uuid.New())
+	if err := iw.store.PutIfAbsent(iw.ctx, listName, body); err != nil {
+		return nil, fmt.Errorf("error writing iceberg manifest list: %w", err)
+	}
+	snapshot.ManifestList = iw.location + "/" + listName
+
+	next.LastSequenceNumber = sequence
+	next.LastUpdatedMs = millis
+	next.CurrentSnapshotID = iw.snapshotID
+	next.Snapshots = append(next.Snapshots, snapshot)
+	next.SnapshotLog = append(next.SnapshotLog, icebergSnapshotLog{TimestampMs: millis, SnapshotID: iw.snapshotID})
+	next.Refs = map[string]icebergRef{"main": {SnapshotID: iw.snapshotID, Type: "branch"}}
+	return next, nil
+}
+
+// commit writes the next metadata version, starting over if another writer took it
+func (iw *IcebergDataWriter) commit() error {
+	_, current, err := loadIcebergMetadata(iw.ctx, iw.store)
+	if err != nil {
+		return err
+	}
+	schema := icebergSchema{Type: "struct", Fields: iw.fields}
+	if current != nil {
+		if schema.SchemaID, _, err = evolveIcebergSchema(current, iw.fields); err != nil {
+			return err
+		}
+	}
+	manifest, err := iw.writeManifest(schema)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < icebergCommitAttempts; attempt++ {
+		version, current, err := loadIcebergMetadata(iw.ctx, iw.store)
+		if err != nil {
+			return err
+		}
+		if current != nil {
+			if err := checkIcebergTable(current); err != nil {
+				return err
+			}
+		}
+
+		next, err := iw.nextMetadata(version, current, manifest, time.Now())
+		if err != nil {
+			return err
+		}
+		body, err := json.MarshalIndent(next, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		version++
+		err = iw.store.PutIfAbsent(iw.ctx, icebergVersionName(version), body)
+		if errors.Is(err, errFileExists) {
+			log.Debug().Int("version", version).Msg("Iceberg version was taken, trying again")
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error committing iceberg version %d: %w", version, err)
+		}
+
+		// the hint is only a shortcut for readers, the metadata file is the commit
+		if err := iw.store.Put(iw.ctx, icebergVersionHint, []byte(strconv.Itoa(version))); err != nil {
+			log.Warn().Err(err).Msg("Could not update the iceberg version hint")
+		}
+		log.Info().Int("version", version).Int64("snapshot", iw.snapshotID).Str("mode", iw.mode).Msg("Committed iceberg version")
+		return nil
+	}
+	return fmt.Errorf("could not commit to the iceberg table after %d attempts", icebergCommitAttempts)
+}
+
+func (iw *IcebergDataWriter) CreateBatchWriter() data.BatchWriter {
+	return &IcebergBatchWriter{dataWriter: iw, batchWriter: iw.data.CreateBatchWriter()}
+}
+
+func (ib *IcebergBatchWriter) WriteBatch(batch data.Batch) error {
+	if err := ib.batchWriter.WriteBatch(batch); err != nil {
+		return err
+	}
+	ib.dataWriter.mux.Lock()
+	ib.dataWriter.rows += int64(len(batch.Rows))
+	ib.dataWriter.mux.Unlock()
+	return nil
+}
+
+// WriteRecord gives the record to the parquet writer as columns
+func (ib *IcebergBatchWriter) WriteRecord(record arrow.RecordBatch) error {
+	if err := ib.batchWriter.(data.RecordWriter).WriteRecord(record); err != nil {
+		return err
+	}
+	ib.dataWriter.mux.Lock()
+	ib.dataWriter.rows += record.NumRows()
+	ib.dataWriter.mux.Unlock()
+	return nil
+}
+
+func (iw *IcebergDataWriter) Flush() error {
+	return iw.data.Flush()
+}
+
+// Close finishes the data file and commits it
+func (iw *IcebergDataWriter) Close() error {
+	if err := iw.data.Close(); err != nil {
+		return err
+	}
+	if err := iw.file.Close(); err != nil {
+		return err
+	}
+	return iw.commit()
+}
+
+// Abort leaves the table alone, the data file is never added to a snapshot
+func (iw *IcebergDataWriter) Abort() error {
+	log.Warn().Str("file", iw.fileName).Msg("Not committing iceberg data file")
+	return iw.file.Abort()
+}
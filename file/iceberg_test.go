@@ -0,0 +1,324 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+	"github.com/apache/arrow-go/v18/parquet/file"
+	"github.com/johanan/mvr/data"
+	"github.com/zeebo/assert"
+)
+
+// writeIceberg commits the reader test rows to the table
+func writeIceberg(t *testing.T, tableUrl *url.URL, mode string, columns []data.Column) {
+	ds := &data.DataStream{BatchSize: 10, Columns: columns, DestColumns: columns}
+	writer, err := AddTableWriter(context.Background(), "iceberg", mode, tableUrl, ds, nopCounter{})
+	assert.NoError(t, err)
+	assert.NoError(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: readerTestRows()}))
+	assert.NoError(t, writer.Close())
+}
+
+// icebergTestColumns are the reader test columns with their positions set like a reader would
+func icebergTestColumns() []data.Column {
+	columns := append([]data.Column{}, readerTestColumns...)
+	for i := range columns {
+		columns[i].Position = i
+	}
+	return columns
+}
+
+// readIcebergFiles follows the current snapshot to its data files
+func readIcebergFiles(t *testing.T, store tableStore, metadata *icebergMetadata) []icebergManifestEntry {
+	ctx := context.Background()
+	var snapshot icebergSnapshot
+	for _, s := range metadata.Snapshots {
+		if s.SnapshotID == metadata.CurrentSnapshotID {
+			snapshot = s
+		}
+	}
+
+	body, err := store.Read(ctx, strings.TrimPrefix(snapshot.ManifestList, metadata.Location+"/"))
+	assert.NoError(t, err)
+	manifests, err := readAvro[icebergManifestFile](body)
+	assert.NoError(t, err)
+
+	var entries []icebergManifestEntry
+	for _, manifest := range manifests {
+		body, err := store.Read(ctx, strings.TrimPrefix(manifest.ManifestPath, metadata.Location+"/"))
+		assert.NoError(t, err)
+		assert.Equal(t, manifest.ManifestLength, int64(len(body)))
+		manifestEntries, err := readAvro[icebergManifestEntry](body)
+		assert.NoError(t, err)
+		entries = append(entries, manifestEntries...)
+	}
+	return entries
+}
+
+func TestIcebergDataWriter(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	tableUrl, _ := url.Parse("file://" + filepath.ToSlash(filepath.Join(dir, "users")))
+	store, err := newTableStore(tableUrl)
+	assert.NoError(t, err)
+	columns := icebergTestColumns()
+
+	writeIceberg(t, tableUrl, "append", columns)
+	writeIceberg(t, tableUrl, "append", columns)
+
+	version, metadata, err := loadIcebergMetadata(ctx, store)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, version)
+	assert.Equal(t, 2, metadata.FormatVersion)
+	assert.Equal(t, "file://"+filepath.ToSlash(filepath.Join(dir, "users")), metadata.Location)
+	assert.Equal(t, int64(2), metadata.LastSequenceNumber)
+	assert.Equal(t, 2, len(metadata.Snapshots))
+	assert.Equal(t, 1, len(metadata.Schemas))
+	assert.Equal(t, 1, len(metadata.MetadataLog))
+	assert.Equal(t, metadata.CurrentSnapshotID, metadata.Refs["main"].SnapshotID)
+	assert.Equal(t, metadata.Snapshots[0].SnapshotID, *metadata.Snapshots[1].ParentSnapshotID)
+	assert.Equal(t, "6", metadata.Snapshots[1].Summary["total-records"])
+
+	hint, err := store.Read(ctx, icebergVersionHint)
+	assert.NoError(t, err)
+	assert.Equal(t, "2", string(hint))
+
+	// the field ids are the positions, starting at 1
+	fields := metadata.Schemas[0].Fields
+	assert.Equal(t, 1, fields[0].ID)
+	assert.Equal(t, "id", fields[0].Name)
+	assert.Equal(t, len(columns), metadata.LastColumnID)
+
+	// appends carry the earlier manifests forward
+	entries := readIcebergFiles(t, store, metadata)
+	assert.Equal(t, 2, len(entries))
+	for _, entry := range entries {
+		assert.Equal(t, int32(1), entry.Status)
+		assert.Nil(t, entry.SequenceNumber)
+		assert.Equal(t, "PARQUET", entry.DataFile.FileFormat)
+		assert.Equal(t, int64(3), entry.DataFile.RecordCount)
+
+		name := strings.TrimPrefix(entry.DataFile.FilePath, metadata.Location+"/")
+		info, err := os.Stat(filepath.Join(dir, "users", name))
+		assert.NoError(t, err)
+		assert.Equal(t, info.Size(), entry.DataFile.FileSizeInBytes)
+
+		// the parquet field ids match the schema
+		reader, err := file.OpenParquetFile(filepath.Join(dir, "users", name), false)
+		assert.NoError(t, err)
+		assert.Equal(t, int32(1), reader.MetaData().Schema.Column(0).SchemaNode().FieldID())
+		reader.Close()
+	}
+
+	// overwrite only has the new file and keeps the table
+	writeIceberg(t, tableUrl, "overwrite", columns)
+	_, overwritten, err := loadIcebergMetadata(ctx, store)
+	assert.NoError(t, err)
+	assert.Equal(t, metadata.TableUUID, overwritten.TableUUID)
+	assert.Equal(t, 1, len(readIcebergFiles(t, store, overwritten)))
+	summary := overwritten.Snapshots[2].Summary
+	assert.Equal(t, "overwrite", summary["operation"])
+	assert.Equal(t, "3", summary["total-records"])
+	assert.Equal(t, "6", summary["deleted-records"])
+}
+
+func TestIcebergSchemaEvolution(t *testing.T) {
+	ctx := context.Background()
+	tableUrl, _ := url.Parse("file://" + filepath.ToSlash(filepath.Join(t.TempDir(), "users")))
+	store, _ := newTableStore(tableUrl)
+	columns := icebergTestColumns()
+	writeIceberg(t, tableUrl, "append", columns)
+
+	// a rename keeps the id and widening is allowed
+	changed := append([]data.Column{}, columns...)
+	changed[0].Type = "BIGINT"
+	changed[1].Name = "full_name"
+	writeIceberg(t, tableUrl, "append", changed)
+
+	_, metadata, err := loadIcebergMetadata(ctx, store)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(metadata.Schemas))
+	assert.Equal(t, 1, metadata.CurrentSchemaID)
+	assert.Equal(t, "long", metadata.Schemas[1].Fields[0].Type)
+	assert.Equal(t, "full_name", metadata.Schemas[1].Fields[1].Name)
+	assert.Equal(t, 1, metadata.Snapshots[1].SchemaID)
+
+	// a new position is a new field id
+	added := append(append([]data.Column{}, changed...), data.Column{Name: "note", Type: "TEXT", Position: 20})
+	rows := readerTestRows()
+	for i := range rows {
+		rows[i] = append(rows[i], "a note")
+	}
+	ds := &data.DataStream{BatchSize: 10, Columns: added, DestColumns: added}
+	writer, err := NewIcebergDataWriter(ctx, tableUrl, "append", ds, nopCounter{})
+	assert.NoError(t, err)
+	assert.NoError(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: rows}))
+	assert.NoError(t, writer.Close())
+	_, metadata, err = loadIcebergMetadata(ctx, store)
+	assert.NoError(t, err)
+	assert.Equal(t, 21, metadata.LastColumnID)
+
+	// the id cannot go back to a narrower type
+	ds = &data.DataStream{BatchSize: 10, Columns: columns, DestColumns: columns}
+	_, err = NewIcebergDataWriter(ctx, tableUrl, "append", ds, nopCounter{})
+	assert.Error(t, err)
+}
+
+func TestIcebergDataWriterRecord(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	tableUrl, _ := url.Parse("file://" + filepath.ToSlash(filepath.Join(dir, "users")))
+	store, err := newTableStore(tableUrl)
+	assert.NoError(t, err)
+	columns := append([]data.Column{}, recordTestColumns...)
+	for i := range columns {
+		columns[i].Position = i
+	}
+
+	record := recordTestRecord()
+	defer record.Release()
+	ds := &data.DataStream{BatchSize: 10, Columns: columns, DestColumns: columns}
+	writer, err := AddTableWriter(ctx, "iceberg", "append", tableUrl, ds, nopCounter{})
+	assert.NoError(t, err)
+	assert.NoError(t, writer.CreateBatchWriter().(data.RecordWriter).WriteRecord(record))
+	assert.NoError(t, writer.Close())
+
+	_, metadata, err := loadIcebergMetadata(ctx, store)
+	assert.NoError(t, err)
+	assert.Equal(t, "3", metadata.Snapshots[0].Summary["total-records"])
+	entries := readIcebergFiles(t, store, metadata)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, int64(3), entries[0].DataFile.RecordCount)
+}
+
+func TestIcebergDataWriterErrors(t *testing.T) {
+	tableUrl, _ := url.Parse("file://" + filepath.ToSlash(filepath.Join(t.TempDir(), "users")))
+	tests := []struct {
+		name    string
+		mode    string
+		columns []data.Column
+	}{
+		{name: "Unsupported mode", mode: "truncate", columns: icebergTestColumns()},
+		{name: "Numeric without precision", mode: "append", columns: []data.Column{{Name: "amount", Type: "NUMERIC"}}},
+		{name: "Duplicate positions", mode: "append", columns: []data.Column{{Name: "id", Type: "INTEGER"}, {Name: "name", Type: "TEXT"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := &data.DataStream{BatchSize: 10, Columns: tt.columns, DestColumns: tt.columns}
+			_, err := NewIcebergDataWriter(context.Background(), tableUrl, tt.mode, ds, nopCounter{})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestIcebergUnsupportedTable(t *testing.T) {
+	ctx := context.Background()
+	tableUrl, _ := url.Parse("file://" + filepath.ToSlash(filepath.Join(t.TempDir(), "users")))
+	store, _ := newTableStore(tableUrl)
+	columns := icebergTestColumns()
+	writeIceberg(t, tableUrl, "append", columns)
+
+	// another engine partitioned the table
+	_, metadata, err := loadIcebergMetadata(ctx, store)
+	assert.NoError(t, err)
+	metadata.PartitionSpecs[0].Fields = []json.RawMessage{json.RawMessage(`{"source-id":1,"field-id":1000,"name":"id","transform":"identity"}`)}
+	body, _ := json.Marshal(metadata)
+	assert.NoError(t, store.PutIfAbsent(ctx, icebergVersionName(2), body))
+
+	ds := &data.DataStream{BatchSize: 10, Columns: columns, DestColumns: columns}
+	_, err = NewIcebergDataWriter(ctx, tableUrl, "append", ds, nopCounter{})
+	assert.Error(t, err)
+}
+
+func TestIcebergAbort(t *testing.T) {
+	dir := t.TempDir()
+	tableUrl, _ := url.Parse("file://" + filepath.ToSlash(filepath.Join(dir, "users")))
+	columns := icebergTestColumns()
+	ds := &data.DataStream{BatchSize: 10, Columns: columns, DestColumns: columns}
+	writer, err := NewIcebergDataWriter(context.Background(), tableUrl, "append", ds, nopCounter{})
+	assert.NoError(t, err)
+	assert.NoError(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: readerTestRows()}))
+	assert.NoError(t, writer.Abort())
+
+	_, err = os.Stat(filepath.Join(dir, "users", icebergMetadataDir))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestIcebergCommitRetry(t *testing.T) {
+	tableUrl, _ := url.Parse("file://" + filepath.ToSlash(filepath.Join(t.TempDir(), "users")))
+	columns := icebergTestColumns()
+	ds := &data.DataStream{BatchSize: 10, Columns: columns, DestColumns: columns}
+	writer, err := NewIcebergDataWriter(context.Background(), tableUrl, "append", ds, nopCounter{})
+	assert.NoError(t, err)
+	assert.NoError(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: readerTestRows()}))
+
+	// another writer commits first
+	writeIceberg(t, tableUrl, "append", columns)
+	assert.NoError(t, writer.Close())
+
+	store, _ := newTableStore(tableUrl)
+	version, metadata, err := loadIcebergMetadata(context.Background(), store)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, version)
+	assert.Equal(t, 2, len(readIcebergFiles(t, store, metadata)))
+}
+
+func TestIcebergType(t *testing.T) {
+	tests := []struct {
+		col      data.Column
+		expected string
+	}{
+		{col: data.Column{Type: "SMALLINT"}, expected: "int"},
+		{col: data.Column{Type: "BIGINT"}, expected: "long"},
+		{col: data.Column{Type: "NUMERIC", Precision: 10, Scale: 2}, expected: "decimal(10, 2)"},
+		{col: data.Column{Type: "UUID"}, expected: "uuid"},
+		{col: data.Column{Type: "TIMESTAMP"}, expected: "timestamp"},
+		{col: data.Column{Type: "TIMESTAMPTZ"}, expected: "timestamptz"},
+		{col: data.Column{Type: "JSONB"}, expected: "string"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.col.Type, func(t *testing.T) {
+			actual, err := icebergType(tt.col)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+
+	assert.True(t, icebergPromotion("decimal(10, 2)", "decimal(12, 2)"))
+	assert.False(t, icebergPromotion("decimal(10, 2)", "decimal(12, 3)"))
+	assert.False(t, icebergPromotion("long", "int"))
+}
+
+func TestIceberg_Azurite(t *testing.T) {
+	ctx := context.Background()
+	cred, _ := azblob.NewSharedKeyCredential(account, sharedKey)
+	listSas, _ := sas.BlobSignatureValues{
+		Protocol:      sas.ProtocolHTTPSandHTTP,
+		ExpiryTime:    time.Now().Add(time.Hour),
+		ContainerName: "testcontainer",
+		Permissions:   (&sas.ContainerPermissions{Read: true, Write: true, List: true}).String(),
+	}.SignWithSharedKey(cred)
+
+	tableUrl, _ := url.Parse(fmt.Sprintf("azurite://:%s@127.0.0.1:10000/devstoreaccount1/testcontainer/iceberg/users_%d", listSas.Encode(), time.Now().UnixNano()))
+	columns := icebergTestColumns()
+	writeIceberg(t, tableUrl, "append", columns)
+	writeIceberg(t, tableUrl, "append", columns)
+
+	store, err := newTableStore(tableUrl)
+	assert.NoError(t, err)
+	version, metadata, err := loadIcebergMetadata(ctx, store)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, version)
+	assert.False(t, strings.Contains(metadata.Location, listSas.Encode()))
+	assert.Equal(t, 2, len(readIcebergFiles(t, store, metadata)))
+}
@@ -0,0 +1,139 @@
+package file
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/johanan/mvr/data"
+)
+
+type jsonlRowReader struct {
+	decoder *json.Decoder
+	closer  io.Closer
+	columns []data.Column
+	first   map[string]any
+}
+
+func newJSONLRowReader(input io.Reader, closer io.Closer) (*jsonlRowReader, error) {
+	decoder := json.NewDecoder(input)
+	decoder.UseNumber()
+
+	// the first object decides the columns, in the order its keys are written
+	var raw json.RawMessage
+	if err := decoder.Decode(&raw); err != nil {
+		if err == io.EOF {
+			return nil, errors.New("jsonl file is empty, at least one object is required to find the columns")
+		}
+		return nil, fmt.Errorf("error reading first jsonl object: %s", err)
+	}
+
+	keys, err := jsonKeys(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	first, err := decodeObject(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]data.Column, len(keys))
+	for i, key := range keys {
+		colType := jsonType(first[key])
+		columns[i] = data.Column{Name: key, DatabaseType: colType, Type: colType, Nullable: true, Position: i}
+	}
+
+	return &jsonlRowReader{decoder: decoder, closer: closer, columns: columns, first: first}, nil
+}
+
+func (r *jsonlRowReader) Columns() []data.Column {
+	return r.columns
+}
+
+func (r *jsonlRowReader) Next() ([]any, error) {
+	object := r.first
+	r.first = nil
+	if object == nil {
+		var raw json.RawMessage
+		if err := r.decoder.Decode(&raw); err != nil {
+			return nil, err
+		}
+		var err error
+		object, err = decodeObject(raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// keys missing from a line are null, keys not in the first line are dropped
+	row := make([]any, len(r.columns))
+	for i, col := range r.columns {
+		row[i] = object[col.Name]
+	}
+	return row, nil
+}
+
+func (r *jsonlRowReader) Close() error {
+	return r.closer.Close()
+}
+
+func decodeObject(raw json.RawMessage) (map[string]any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	var object map[string]any
+	if err := decoder.Decode(&object); err != nil {
+		return nil, fmt.Errorf("each jsonl line must be an object: %s", err)
+	}
+	return object, nil
+}
+
+// jsonKeys returns the top level keys of an object in the order they are written
+func jsonKeys(raw json.RawMessage) ([]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return nil, errors.New("each jsonl line must be an object")
+	}
+
+	var keys []string
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, token.(string))
+
+		// skip over the value, whatever shape it is
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func jsonType(value any) string {
+	switch v := value.(type) {
+	case bool:
+		return "BOOLEAN"
+	case json.Number:
+		if strings.ContainsAny(v.String(), ".eE") {
+			return "DOUBLE"
+		}
+		return "BIGINT"
+	case map[string]any, []any:
+		return "JSONB"
+	default:
+		return "TEXT"
+	}
+}
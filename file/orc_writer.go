@@ -0,0 +1,555 @@
+package file
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	gproto "github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
+	"github.com/johanan/mvr/data"
+	"github.com/scritchley/orc"
+	"github.com/scritchley/orc/proto"
+	"github.com/shopspring/decimal"
+	"github.com/spf13/cast"
+)
+
+// The orc library cannot write decimal, binary or timestamp with local time
+// zone columns, so the file is put together here from its encoders and protobufs.
+const (
+	orcMagic        = "ORC"
+	orcBlockSize    = 256 * 1024
+	orcMaxPrecision = 38
+	// 1 January 2015, timestamps are stored as seconds from it
+	orcTimestampBase int64 = 1420070400
+)
+
+// orcTimestampInstant is timestamp with local time zone, the protobufs of the
+// library are older than it
+const orcTimestampInstant = proto.Type_Kind(18)
+
+type ORCDataWriter struct {
+	datastream  *data.DataStream
+	writer      io.Writer
+	compression proto.CompressionKind
+	types       []*proto.Type
+	cols        []byte
+	offset      uint64
+	stripes     []*proto.StripeInformation
+	rows        uint64
+	// values and nulls are the statistics of each column, the root struct is 0
+	values []uint64
+	nulls  []bool
+	mux    *sync.Mutex
+}
+
+type ORCBatchWriter struct {
+	dataWriter *ORCDataWriter
+}
+
+// orcStripe is a stripe encoded outside of the lock
+type orcStripe struct {
+	body         []byte
+	dataLength   uint64
+	footerLength uint64
+	rows         uint64
+	values       []uint64
+	nulls        []bool
+}
+
+func NewORCDataWriter(datastream *data.DataStream, w io.Writer, compression string) (*ORCDataWriter, error) {
+	codec, err := orcCodec(compression)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := datastream.DestColumns
+	root := &proto.Type{Kind: proto.Type_STRUCT.Enum()}
+	types := []*proto.Type{root}
+	for i, col := range columns {
+		root.Subtypes = append(root.Subtypes, uint32(i+1))
+		root.FieldNames = append(root.FieldNames, col.Name)
+		types = append(types, orcType(col))
+	}
+
+	// uuid and json have no ORC type, the cols metadata has the types
+	cols, err := json.Marshal(mapColumnMetadata(columns))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.WriteString(w, orcMagic); err != nil {
+		return nil, fmt.Errorf("error creating orc writer: %w", err)
+	}
+
+	return &ORCDataWriter{
+		datastream:  datastream,
+		writer:      w,
+		compression: codec,
+		types:       types,
+		cols:        cols,
+		offset:      uint64(len(orcMagic)),
+		values:      make([]uint64, len(types)),
+		nulls:       make([]bool, len(types)),
+		mux:         &sync.Mutex{},
+	}, nil
+}
+
+func orcCodec(compression string) (proto.CompressionKind, error) {
+	switch strings.ToLower(compression) {
+	case "":
+		return proto.CompressionKind_NONE, nil
+	case "zlib":
+		return proto.CompressionKind_ZLIB, nil
+	default:
+		return 0, fmt.Errorf("unsupported compression for orc: %s", compression)
+	}
+}
+
+// orcType maps the abstract type to ORC. NUMERIC without a precision ORC can
+// hold is a string so no digits are lost.
+func orcType(col data.Column) *proto.Type {
+	var kind proto.Type_Kind
+	switch data.TypeAlias(col.Type) {
+	case "BOOLEAN":
+		kind = proto.Type_BOOLEAN
+	case "SMALLINT":
+		kind = proto.Type_SHORT
+	case "INTEGER":
+		kind = proto.Type_INT
+	case "BIGINT":
+		kind = proto.Type_LONG
+	case "REAL":
+		kind = proto.Type_FLOAT
+	case "DOUBLE":
+		kind = proto.Type_DOUBLE
+	case "NUMERIC":
+		if !orcDecimal(col) {
+			return &proto.Type{Kind: proto.Type_STRING.Enum()}
+		}
+		precision, scale := uint32(col.Precision), uint32(col.Scale)
+		return &proto.Type{Kind: proto.Type_DECIMAL.Enum(), Precision: &precision, Scale: &scale}
+	case "DATE":
+		kind = proto.Type_DATE
+	case "TIMESTAMP":
+		kind = proto.Type_TIMESTAMP
+	case "TIMESTAMPTZ":
+		kind = orcTimestampInstant
+	case "BYTEA", "UUID":
+		kind = proto.Type_BINARY
+	default:
+		kind = proto.Type_STRING
+	}
+	return &proto.Type{Kind: kind.Enum()}
+}
+
+func orcDecimal(col data.Column) bool {
+	return col.Precision > 0 && col.Precision <= orcMaxPrecision
+}
+
+func (ow *ORCDataWriter) CreateBatchWriter() data.BatchWriter {
+	return &ORCBatchWriter{dataWriter: ow}
+}
+
+func (ob *ORCBatchWriter) WriteBatch(batch data.Batch) error {
+	ow := ob.dataWriter
+	if len(batch.Rows) == 0 {
+		return nil
+	}
+
+	stripe, err := ow.encodeStripe(batch.Rows)
+	if err != nil {
+		return err
+	}
+
+	ow.mux.Lock()
+	defer ow.mux.Unlock()
+	// every batch is its own stripe
+	if _, err := ow.writer.Write(stripe.body); err != nil {
+		return err
+	}
+	offset := ow.offset
+	ow.stripes = append(ow.stripes, &proto.StripeInformation{
+		Offset:       &offset,
+		IndexLength:  new(uint64),
+		DataLength:   &stripe.dataLength,
+		FooterLength: &stripe.footerLength,
+		NumberOfRows: &stripe.rows,
+	})
+	ow.offset += uint64(len(stripe.body))
+	ow.rows += stripe.rows
+	for i := range ow.values {
+		ow.values[i] += stripe.values[i]
+		ow.nulls[i] = ow.nulls[i] || stripe.nulls[i]
+	}
+	return nil
+}
+
+// encodeStripe writes the streams of every column and the stripe footer, there
+// are no row indexes
+func (ow *ORCDataWriter) encodeStripe(rows [][]any) (*orcStripe, error) {
+	columns := ow.datastream.DestColumns
+	stripe := &orcStripe{rows: uint64(len(rows)), values: make([]uint64, len(ow.types)), nulls: make([]bool, len(ow.types))}
+	stripe.values[0] = stripe.rows
+	footer := &proto.StripeFooter{
+		Columns:        []*proto.ColumnEncoding{{Kind: proto.ColumnEncoding_DIRECT.Enum()}},
+		WriterTimezone: gproto.String("UTC"),
+	}
+
+	var body bytes.Buffer
+	values := make([]any, len(rows))
+	for i, col := range columns {
+		for r, row := range rows {
+			value, err := orcValue(row[i], col)
+			if err != nil {
+				return nil, fmt.Errorf("failed to convert column %s: %w", col.Name, err)
+			}
+			values[r] = value
+			if value == nil {
+				stripe.nulls[i+1] = true
+			} else {
+				stripe.values[i+1]++
+			}
+		}
+
+		streams, encoding, err := orcStreams(ow.types[i+1], values)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write column %s: %w", col.Name, err)
+		}
+		footer.Columns = append(footer.Columns, &proto.ColumnEncoding{Kind: encoding.Enum()})
+		for _, stream := range streams {
+			compressed := ow.compress(stream.data)
+			length := uint64(len(compressed))
+			footer.Streams = append(footer.Streams, &proto.Stream{Kind: stream.kind.Enum(), Column: gproto.Uint32(uint32(i + 1)), Length: &length})
+			body.Write(compressed)
+		}
+	}
+	stripe.dataLength = uint64(body.Len())
+
+	encoded, err := gproto.Marshal(footer)
+	if err != nil {
+		return nil, err
+	}
+	compressed := ow.compress(encoded)
+	stripe.footerLength = uint64(len(compressed))
+	body.Write(compressed)
+	stripe.body = body.Bytes()
+	return stripe, nil
+}
+
+type orcStream struct {
+	kind proto.Stream_Kind
+	data []byte
+}
+
+// orcStreams encodes the values of a column, PRESENT is left out when there
+// are no nulls
+func orcStreams(t *proto.Type, values []any) ([]orcStream, proto.ColumnEncoding_Kind, error) {
+	var present, dataBuf, secondary bytes.Buffer
+	presentWriter := orc.NewBooleanWriter(&present)
+	hasNull := false
+	for _, value := range values {
+		hasNull = hasNull || value == nil
+		if err := presentWriter.WriteBool(value != nil); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := presentWriter.Close(); err != nil {
+		return nil, 0, err
+	}
+
+	encoding := proto.ColumnEncoding_DIRECT_V2
+	// the LENGTH or SECONDARY stream, string, binary, decimal and timestamp have one
+	var secondaryKind *proto.Stream_Kind
+	var err error
+	switch kind := t.GetKind(); kind {
+	case proto.Type_BOOLEAN:
+		encoding = proto.ColumnEncoding_DIRECT
+		w := orc.NewBooleanWriter(&dataBuf)
+		err = orcEach(values, func(value bool) error { return w.WriteBool(value) }, w.Close)
+	case proto.Type_SHORT, proto.Type_INT, proto.Type_LONG:
+		w := orc.NewRunLengthIntegerWriterV2(&dataBuf, true)
+		err = orcEach(values, w.WriteInt, w.Close)
+	case proto.Type_DATE:
+		w := orc.NewRunLengthIntegerWriterV2(&dataBuf, true)
+		err = orcEach(values, func(value time.Time) error {
+			// orcValue makes dates midnight UTC
+			days := value.Unix() / 86400
+			if value.Unix() < 0 && value.Unix()%86400 != 0 {
+				days--
+			}
+			return w.WriteInt(days)
+		}, w.Close)
+	case proto.Type_FLOAT:
+		encoding = proto.ColumnEncoding_DIRECT
+		err = orcEach(values, func(value float32) error {
+			return binary.Write(&dataBuf, binary.LittleEndian, math.Float32bits(value))
+		}, nil)
+	case proto.Type_DOUBLE:
+		encoding = proto.ColumnEncoding_DIRECT
+		err = orcEach(values, func(value float64) error {
+			return binary.Write(&dataBuf, binary.LittleEndian, math.Float64bits(value))
+		}, nil)
+	case proto.Type_STRING:
+		secondaryKind = proto.Stream_LENGTH.Enum()
+		lengths := orc.NewRunLengthIntegerWriterV2(&secondary, false)
+		err = orcEach(values, func(value string) error {
+			dataBuf.WriteString(value)
+			return lengths.WriteInt(int64(len(value)))
+		}, lengths.Close)
+	case proto.Type_BINARY:
+		secondaryKind = proto.Stream_LENGTH.Enum()
+		lengths := orc.NewRunLengthIntegerWriterV2(&secondary, false)
+		err = orcEach(values, func(value []byte) error {
+			dataBuf.Write(value)
+			return lengths.WriteInt(int64(len(value)))
+		}, lengths.Close)
+	case proto.Type_DECIMAL:
+		// the unscaled value as a zigzag varint and the scale of every value
+		secondaryKind = proto.Stream_SECONDARY.Enum()
+		scale := int32(t.GetScale())
+		scales := orc.NewRunLengthIntegerWriterV2(&secondary, true)
+		err = orcEach(values, func(value decimal.Decimal) error {
+			unscaled := value.Shift(scale).BigInt()
+			if len(new(big.Int).Abs(unscaled).String()) > int(t.GetPrecision()) {
+				return fmt.Errorf("%s does not fit decimal(%d,%d)", value, t.GetPrecision(), scale)
+			}
+			writeORCVarint(&dataBuf, unscaled)
+			return scales.WriteInt(int64(scale))
+		}, scales.Close)
+	case proto.Type_TIMESTAMP, orcTimestampInstant:
+		secondaryKind = proto.Stream_SECONDARY.Enum()
+		seconds := orc.NewRunLengthIntegerWriterV2(&dataBuf, true)
+		nanos := orc.NewRunLengthIntegerWriterV2(&secondary, false)
+		err = orcEach(values, func(value time.Time) error {
+			// like the Java writer, seconds before 1970 are truncated toward zero
+			secs := value.Unix()
+			if secs < 0 && value.Nanosecond() > 0 {
+				secs++
+			}
+			if err := seconds.WriteInt(secs - orcTimestampBase); err != nil {
+				return err
+			}
+			return nanos.WriteInt(orcNanos(int64(value.Nanosecond())))
+		}, func() error {
+			if err := seconds.Close(); err != nil {
+				return err
+			}
+			return nanos.Close()
+		})
+	default:
+		return nil, 0, fmt.Errorf("orc cannot write %s", kind)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var streams []orcStream
+	if hasNull {
+		streams = append(streams, orcStream{kind: proto.Stream_PRESENT, data: present.Bytes()})
+	}
+	streams = append(streams, orcStream{kind: proto.Stream_DATA, data: dataBuf.Bytes()})
+	if secondaryKind != nil {
+		streams = append(streams, orcStream{kind: *secondaryKind, data: secondary.Bytes()})
+	}
+	return streams, encoding, nil
+}
+
+// orcEach writes the values that are not null, they have to be what orcValue
+// returns for the column
+func orcEach[T any](values []any, write func(T) error, close func() error) error {
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+		v, ok := value.(T)
+		if !ok {
+			var want T
+			return fmt.Errorf("expected %T, got %T", want, value)
+		}
+		if err := write(v); err != nil {
+			return err
+		}
+	}
+	if close == nil {
+		return nil
+	}
+	return close()
+}
+
+// writeORCVarint writes the zigzag base 128 varint of a decimal, it is not
+// limited to 64 bits
+func writeORCVarint(buf *bytes.Buffer, value *big.Int) {
+	zigzag := new(big.Int).Lsh(value, 1)
+	if value.Sign() < 0 {
+		zigzag.Neg(zigzag).Sub(zigzag, big.NewInt(1))
+	}
+	low := big.NewInt(0x7f)
+	group := new(big.Int)
+	for {
+		group.And(zigzag, low)
+		zigzag.Rsh(zigzag, 7)
+		if zigzag.Sign() == 0 {
+			buf.WriteByte(byte(group.Uint64()))
+			return
+		}
+		buf.WriteByte(byte(group.Uint64()) | 0x80)
+	}
+}
+
+// orcNanos drops the trailing zeros of the nanoseconds and keeps how many in
+// the low 3 bits
+func orcNanos(nanos int64) int64 {
+	if nanos == 0 || nanos%100 != 0 {
+		return nanos << 3
+	}
+	nanos /= 100
+	zeros := int64(1)
+	for nanos%10 == 0 && zeros < 7 {
+		nanos /= 10
+		zeros++
+	}
+	return nanos<<3 | zeros
+}
+
+// compress splits a stream into the chunks of the codec, a chunk that does not
+// get smaller is kept as it is
+func (ow *ORCDataWriter) compress(raw []byte) []byte {
+	if ow.compression == proto.CompressionKind_NONE {
+		return raw
+	}
+
+	var out, deflated bytes.Buffer
+	fw, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+	for len(raw) > 0 {
+		chunk := raw[:min(len(raw), orcBlockSize)]
+		raw = raw[len(chunk):]
+
+		deflated.Reset()
+		fw.Reset(&deflated)
+		fw.Write(chunk)
+		fw.Close()
+		header, body := deflated.Len()<<1, deflated.Bytes()
+		if deflated.Len() >= len(chunk) {
+			header, body = len(chunk)<<1|1, chunk
+		}
+		out.Write([]byte{byte(header), byte(header >> 8), byte(header >> 16)})
+		out.Write(body)
+	}
+	return out.Bytes()
+}
+
+func (ow *ORCDataWriter) Flush() error {
+	return nil
+}
+
+// Close writes the footer and postscript, there is no stripe metadata
+func (ow *ORCDataWriter) Close() error {
+	ow.mux.Lock()
+	defer ow.mux.Unlock()
+
+	statistics := make([]*proto.ColumnStatistics, len(ow.types))
+	for i := range ow.types {
+		statistics[i] = &proto.ColumnStatistics{NumberOfValues: gproto.Uint64(ow.values[i]), HasNull: gproto.Bool(ow.nulls[i])}
+	}
+	footer := &proto.Footer{
+		HeaderLength:   gproto.Uint64(uint64(len(orcMagic))),
+		ContentLength:  gproto.Uint64(ow.offset),
+		Stripes:        ow.stripes,
+		Types:          ow.types,
+		Metadata:       []*proto.UserMetadataItem{{Name: gproto.String("cols"), Value: ow.cols}},
+		NumberOfRows:   gproto.Uint64(ow.rows),
+		Statistics:     statistics,
+		RowIndexStride: gproto.Uint32(0),
+	}
+	encoded, err := gproto.Marshal(footer)
+	if err != nil {
+		return err
+	}
+	compressed := ow.compress(encoded)
+
+	postScript, err := gproto.Marshal(&proto.PostScript{
+		FooterLength:         gproto.Uint64(uint64(len(compressed))),
+		Compression:          ow.compression.Enum(),
+		CompressionBlockSize: gproto.Uint64(orcBlockSize),
+		Version:              []uint32{0, 12},
+		MetadataLength:       gproto.Uint64(0),
+		WriterVersion:        gproto.Uint32(orc.WriterVersion),
+		Magic:                gproto.String(orcMagic),
+	})
+	if err != nil {
+		return err
+	}
+	tail := append(compressed, postScript...)
+	if _, err := ow.writer.Write(append(tail, byte(len(postScript)))); err != nil {
+		return err
+	}
+
+	if closer, ok := ow.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// orcValue turns a value into the Go type orcStreams writes for the column
+func orcValue(value any, col data.Column) (any, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	switch data.TypeAlias(col.Type) {
+	case "BOOLEAN":
+		return cast.ToBoolE(value)
+	case "SMALLINT", "INTEGER", "BIGINT":
+		return cast.ToInt64E(value)
+	case "REAL":
+		f, err := toFloat64(value)
+		return float32(f), err
+	case "DOUBLE":
+		return toFloat64(value)
+	case "NUMERIC":
+		dec, err := toDecimal(value)
+		if err != nil {
+			return nil, err
+		}
+		if !orcDecimal(col) {
+			return dec.String(), nil
+		}
+		return dec.Round(int32(col.Scale)), nil
+	case "UUID":
+		s, err := toUUIDString(value)
+		if err != nil {
+			return nil, err
+		}
+		id, err := uuid.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		return id[:], nil
+	case "DATE", "TIMESTAMP", "TIMESTAMPTZ":
+		t, err := toTime(value, col)
+		if err != nil {
+			return nil, err
+		}
+		switch col.Type {
+		case "TIMESTAMPTZ":
+			return t.UTC(), nil
+		case "TIMESTAMP":
+			// an orc timestamp has no zone, keep the wall clock
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC), nil
+		}
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+	case "BYTEA":
+		return toBytea(value)
+	}
+
+	return ValueToString(value, col)
+}
@@ -0,0 +1,337 @@
+package file
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"math/big"
+	"testing"
+	"time"
+
+	gproto "github.com/golang/protobuf/proto"
+	"github.com/johanan/mvr/data"
+	"github.com/scritchley/orc"
+	"github.com/scritchley/orc/proto"
+	"github.com/shopspring/decimal"
+	"github.com/zeebo/assert"
+)
+
+// readORC reads back the types the writer uses, the orc library cannot read
+// timestamp with local time zone or decimals past 64 bits
+func readORC(t *testing.T, file []byte) (*proto.Footer, [][]any) {
+	psLen := int(file[len(file)-1])
+	var ps proto.PostScript
+	assert.NoError(t, gproto.Unmarshal(file[len(file)-1-psLen:len(file)-1], &ps))
+	var codec orc.CompressionCodec = orc.CompressionNone{}
+	if ps.GetCompression() == proto.CompressionKind_ZLIB {
+		codec = orc.CompressionZlib{}
+	}
+	decompress := func(b []byte) []byte {
+		out, err := io.ReadAll(codec.Decoder(bytes.NewReader(b)))
+		assert.NoError(t, err)
+		return out
+	}
+
+	footerEnd := len(file) - 1 - psLen
+	var footer proto.Footer
+	assert.NoError(t, gproto.Unmarshal(decompress(file[footerEnd-int(ps.GetFooterLength()):footerEnd]), &footer))
+
+	var rows [][]any
+	for _, stripe := range footer.Stripes {
+		pos := stripe.GetOffset() + stripe.GetIndexLength()
+		dataEnd := pos + stripe.GetDataLength()
+		var stripeFooter proto.StripeFooter
+		assert.NoError(t, gproto.Unmarshal(decompress(file[dataEnd:dataEnd+stripe.GetFooterLength()]), &stripeFooter))
+		streams := make(map[[2]uint32][]byte)
+		for _, s := range stripeFooter.Streams {
+			streams[[2]uint32{s.GetColumn(), uint32(s.GetKind())}] = decompress(file[pos : pos+s.GetLength()])
+			pos += s.GetLength()
+		}
+
+		stripeRows := make([][]any, stripe.GetNumberOfRows())
+		for r := range stripeRows {
+			stripeRows[r] = make([]any, len(footer.Types)-1)
+		}
+		for c := 1; c < len(footer.Types); c++ {
+			stream := func(kind proto.Stream_Kind) *bytes.Reader {
+				return bytes.NewReader(streams[[2]uint32{uint32(c), uint32(kind)}])
+			}
+			_, hasPresent := streams[[2]uint32{uint32(c), uint32(proto.Stream_PRESENT)}]
+			present := orc.NewBooleanReader(stream(proto.Stream_PRESENT))
+			dataStream := stream(proto.Stream_DATA)
+			bools := orc.NewBooleanReader(dataStream)
+			ints := orc.NewRunLengthIntegerReaderV2(dataStream, true, false)
+			lengths := orc.NewRunLengthIntegerReaderV2(stream(proto.Stream_LENGTH), false, false)
+			scales := orc.NewRunLengthIntegerReaderV2(stream(proto.Stream_SECONDARY), true, false)
+			nanos := orc.NewRunLengthIntegerReaderV2(stream(proto.Stream_SECONDARY), false, false)
+
+			for r := range stripeRows {
+				if hasPresent {
+					assert.True(t, present.Next())
+					if !present.Bool() {
+						continue
+					}
+				}
+				var value any
+				switch kind := footer.Types[c].GetKind(); kind {
+				case proto.Type_BOOLEAN:
+					assert.True(t, bools.Next())
+					value = bools.Bool()
+				case proto.Type_SHORT, proto.Type_INT, proto.Type_LONG:
+					assert.True(t, ints.Next())
+					value = ints.Int()
+				case proto.Type_DATE:
+					assert.True(t, ints.Next())
+					value = time.Unix(ints.Int()*86400, 0).UTC()
+				case proto.Type_FLOAT:
+					var bits uint32
+					assert.NoError(t, binary.Read(dataStream, binary.LittleEndian, &bits))
+					value = math.Float32frombits(bits)
+				case proto.Type_DOUBLE:
+					var bits uint64
+					assert.NoError(t, binary.Read(dataStream, binary.LittleEndian, &bits))
+					value = math.Float64frombits(bits)
+				case proto.Type_STRING, proto.Type_BINARY:
+					assert.True(t, lengths.Next())
+					b := make([]byte, lengths.Int())
+					_, err := io.ReadFull(dataStream, b)
+					assert.NoError(t, err)
+					value = b
+					if kind == proto.Type_STRING {
+						value = string(b)
+					}
+				case proto.Type_DECIMAL:
+					assert.True(t, scales.Next())
+					value = decimal.NewFromBigInt(readORCVarint(t, dataStream), -int32(scales.Int()))
+				case proto.Type_TIMESTAMP, orcTimestampInstant:
+					assert.True(t, ints.Next())
+					assert.True(t, nanos.Next())
+					n := nanos.Int()
+					ns := n >> 3
+					if zeros := n & 7; zeros != 0 {
+						ns *= int64(math.Pow10(int(zeros) + 1))
+					}
+					value = time.Unix(orcTimestampBase+ints.Int(), ns).UTC()
+				default:
+					t.Fatalf("unexpected kind %s", kind)
+				}
+				stripeRows[r][c-1] = value
+			}
+		}
+		rows = append(rows, stripeRows...)
+	}
+	return &footer, rows
+}
+
+func readORCVarint(t *testing.T, r io.ByteReader) *big.Int {
+	zigzag := new(big.Int)
+	for shift := uint(0); ; shift += 7 {
+		b, err := r.ReadByte()
+		assert.NoError(t, err)
+		zigzag.Or(zigzag, new(big.Int).Lsh(big.NewInt(int64(b&0x7f)), shift))
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	value := new(big.Int).Rsh(zigzag, 1)
+	if zigzag.Bit(0) == 1 {
+		value.Neg(value).Sub(value, big.NewInt(1))
+	}
+	return value
+}
+
+func TestORCDataWriter(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression string
+		isError     bool
+	}{
+		{name: "No codec"},
+		{name: "Zlib", compression: "zlib"},
+		{name: "Gzip is not an orc codec", compression: "gzip", isError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := &data.DataStream{BatchSize: 10, Columns: readerTestColumns, DestColumns: readerTestColumns}
+			var buf bytes.Buffer
+			writer, err := AddFileWriter(&data.StreamConfig{Format: "orc", Compression: tt.compression}, ds, NewBufferedWriter(&buf))
+			if tt.isError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			// two batch writers make two stripes
+			rows := readerTestRows()
+			assert.NoError(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: rows[:2]}))
+			assert.NoError(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: rows[2:]}))
+			assert.NoError(t, writer.Close())
+
+			footer, records := readORC(t, buf.Bytes())
+			assert.Equal(t, uint64(3), footer.GetNumberOfRows())
+			assert.Equal(t, 2, len(footer.Stripes))
+			assert.Equal(t, "cols", footer.Metadata[0].GetName())
+			var kinds []proto.Type_Kind
+			for _, orcType := range footer.Types {
+				kinds = append(kinds, orcType.GetKind())
+			}
+			assert.DeepEqual(t, []proto.Type_Kind{proto.Type_STRUCT, proto.Type_INT, proto.Type_STRING, proto.Type_BOOLEAN, proto.Type_DECIMAL, orcTimestampInstant, proto.Type_DATE, proto.Type_BINARY}, kinds)
+			assert.Equal(t, uint32(10), footer.Types[4].GetPrecision())
+			assert.Equal(t, uint32(2), footer.Types[4].GetScale())
+			assert.Equal(t, uint64(2), footer.Statistics[3].GetNumberOfValues())
+			assert.True(t, footer.Statistics[3].GetHasNull())
+
+			assert.Equal(t, 3, len(records))
+			first := records[0]
+			assert.Equal(t, int64(1), first[0])
+			assert.Equal(t, "John", first[1])
+			assert.Equal(t, true, first[2])
+			assert.Equal(t, "10.5", first[3].(decimal.Decimal).String())
+			assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC), first[4])
+			assert.Equal(t, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), first[5])
+			assert.Equal(t, "a0eebc999c0b4ef8bb6d6bb9bd380a11", data.ByteaToString(first[6].([]byte))[2:])
+
+			assert.Equal(t, "Jane, \"Doe\"", records[1][1])
+			assert.Equal(t, "-3.25", records[1][3].(decimal.Decimal).String())
+
+			last := records[2]
+			assert.Equal(t, "", last[1])
+			assert.Equal(t, nil, last[2])
+			assert.Equal(t, nil, last[3])
+			assert.Equal(t, nil, last[4])
+		})
+	}
+}
+
+func TestORCDecimalAndTimestamptz(t *testing.T) {
+	columns := []data.Column{
+		{Name: "amount", Type: "NUMERIC", Precision: 38, Scale: 10},
+		{Name: "created", Type: "TIMESTAMPTZ"},
+		{Name: "local", Type: "TIMESTAMP"},
+		{Name: "unbounded", Type: "NUMERIC"},
+		{Name: "payload", Type: "BYTEA"},
+	}
+	zone := time.FixedZone("local", -5*60*60)
+	rows := [][]any{
+		{decimal.RequireFromString("1234567890123456789012345678.1234567890"), time.Date(2024, 1, 2, 3, 4, 5, 123456789, zone), time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), "1e40", []byte{0, 1, 255}},
+		{decimal.RequireFromString("-0.00000000005"), time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC), time.Date(1900, 6, 1, 0, 0, 0, 0, time.UTC), "-1.5", "\\x0a0b"},
+		{nil, nil, nil, nil, nil},
+	}
+
+	var buf bytes.Buffer
+	ds := &data.DataStream{BatchSize: 10, DestColumns: columns}
+	writer, err := NewORCDataWriter(ds, NewWriteCloseBuffer(&buf), "zlib")
+	assert.NoError(t, err)
+	assert.NoError(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: rows}))
+	assert.NoError(t, writer.Close())
+
+	footer, records := readORC(t, buf.Bytes())
+	assert.Equal(t, orcTimestampInstant, footer.Types[2].GetKind())
+	assert.Equal(t, proto.Type_TIMESTAMP, footer.Types[3].GetKind())
+	assert.Equal(t, uint32(38), footer.Types[1].GetPrecision())
+	// a NUMERIC without a precision is text so nothing is rounded
+	assert.Equal(t, proto.Type_STRING, footer.Types[4].GetKind())
+
+	assert.Equal(t, "1234567890123456789012345678.123456789", records[0][0].(decimal.Decimal).String())
+	assert.Equal(t, int32(-10), records[0][0].(decimal.Decimal).Exponent())
+	assert.Equal(t, time.Date(2024, 1, 2, 8, 4, 5, 123456789, time.UTC), records[0][1])
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), records[0][2])
+	assert.Equal(t, "10000000000000000000000000000000000000000", records[0][3])
+	assert.DeepEqual(t, []byte{0, 1, 255}, records[0][4])
+
+	// rounded half away from zero to the scale
+	assert.Equal(t, "-0.0000000001", records[1][0].(decimal.Decimal).String())
+	assert.Equal(t, time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC), records[1][1])
+	assert.Equal(t, time.Date(1900, 6, 1, 0, 0, 0, 0, time.UTC), records[1][2])
+	assert.DeepEqual(t, []byte{10, 11}, records[1][4])
+	assert.DeepEqual(t, []any{nil, nil, nil, nil, nil}, records[2])
+}
+
+func TestORCLibraryReads(t *testing.T) {
+	// without timestamptz and with small decimals the orc library can read the file too
+	columns := []data.Column{
+		{Name: "id", Type: "BIGINT"},
+		{Name: "name", Type: "TEXT"},
+		{Name: "amount", Type: "NUMERIC", Precision: 10, Scale: 2},
+		{Name: "score", Type: "REAL"},
+		{Name: "day", Type: "DATE"},
+		{Name: "created", Type: "TIMESTAMP"},
+		{Name: "payload", Type: "BYTEA"},
+	}
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	rows := [][]any{
+		{int64(1), "John", "10.50", float32(1.5), created, created, []byte{1, 2}},
+		{int64(2), nil, "-3.25", nil, created, nil, nil},
+	}
+
+	var buf bytes.Buffer
+	ds := &data.DataStream{BatchSize: 10, DestColumns: columns}
+	writer, err := NewORCDataWriter(ds, NewWriteCloseBuffer(&buf), "")
+	assert.NoError(t, err)
+	assert.NoError(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: rows}))
+	assert.NoError(t, writer.Close())
+
+	reader, err := orc.NewReader(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, "struct<id:bigint,name:string,amount:decimal(10,2),score:float,day:date,created:timestamp,payload:binary>", reader.Schema().String())
+	var records [][]any
+	cursor := reader.Select(reader.Schema().Columns()...)
+	for cursor.Stripes() {
+		for cursor.Next() {
+			records = append(records, cursor.Row())
+		}
+	}
+	assert.NoError(t, cursor.Err())
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, int64(1), records[0][0])
+	assert.Equal(t, "10.50", records[0][2].(orc.Decimal).String())
+	assert.Equal(t, float32(1.5), records[0][3])
+	assert.Equal(t, created, records[0][5])
+	assert.DeepEqual(t, []byte{1, 2}, records[0][6])
+	assert.Equal(t, nil, records[1][1])
+	assert.Equal(t, "-3.25", records[1][2].(orc.Decimal).String())
+}
+
+func TestORCValue(t *testing.T) {
+	local := time.FixedZone("local", -5*60*60)
+	tests := []struct {
+		name     string
+		value    any
+		col      data.Column
+		expected any
+	}{
+		{name: "Numeric is rounded to the scale", value: "12345.555", col: data.Column{Type: "NUMERIC", Precision: 10, Scale: 2}, expected: decimal.RequireFromString("12345.56")},
+		{name: "Numeric without a precision is text", value: decimal.RequireFromString("12345.5"), col: data.Column{Type: "NUMERIC"}, expected: "12345.5"},
+		{name: "Timestamp keeps the wall clock", value: time.Date(2024, 1, 2, 3, 4, 5, 0, local), col: data.Column{Type: "TIMESTAMP"}, expected: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{name: "Timestamptz is UTC", value: time.Date(2024, 1, 2, 3, 4, 5, 0, local), col: data.Column{Type: "TIMESTAMPTZ"}, expected: time.Date(2024, 1, 2, 8, 4, 5, 0, time.UTC)},
+		{name: "Timestamp string", value: "2024-01-02 03:04:05", col: data.Column{Type: "TIMESTAMP"}, expected: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{name: "Bytea", value: []byte{1, 2}, col: data.Column{Type: "BYTEA"}, expected: []byte{1, 2}},
+		{name: "Bytea hex", value: "\\x0102", col: data.Column{Type: "BYTEA"}, expected: []byte{1, 2}},
+		{name: "Uuid", value: "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11", col: data.Column{Type: "UUID"}, expected: []byte{0xa0, 0xee, 0xbc, 0x99, 0x9c, 0x0b, 0x4e, 0xf8, 0xbb, 0x6d, 0x6b, 0xb9, 0xbd, 0x38, 0x0a, 0x11}},
+		{name: "Json", value: map[string]any{"a": 1}, col: data.Column{Type: "JSONB"}, expected: `{"a":1}`},
+		{name: "Smallint", value: int16(7), col: data.Column{Type: "SMALLINT"}, expected: int64(7)},
+		{name: "Numeric set to a double", value: decimal.RequireFromString("10.25"), col: data.Column{Type: "DOUBLE"}, expected: 10.25},
+		{name: "Real", value: float32(1.5), col: data.Column{Type: "REAL"}, expected: float32(1.5)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := orcValue(tt.value, tt.col)
+			assert.NoError(t, err)
+			if dec, ok := tt.expected.(decimal.Decimal); ok {
+				assert.True(t, dec.Equal(value.(decimal.Decimal)))
+				return
+			}
+			assert.DeepEqual(t, tt.expected, value)
+		})
+	}
+}
+
+func TestORCDecimalTooLarge(t *testing.T) {
+	ds := &data.DataStream{BatchSize: 10, DestColumns: []data.Column{{Name: "amount", Type: "NUMERIC", Precision: 5, Scale: 2}}}
+	writer, err := NewORCDataWriter(ds, NewWriteCloseBuffer(&bytes.Buffer{}), "")
+	assert.NoError(t, err)
+	assert.Error(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: [][]any{{"12345.67"}}}))
+}
@@ -0,0 +1,59 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet/file"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+	"github.com/rs/zerolog/log"
+)
+
+func newParquetRowReader(input io.Reader, closer io.Closer) (*recordRowReader, error) {
+	rs, err := readerAt(input)
+	if err != nil {
+		return nil, err
+	}
+
+	parquetReader, err := file.NewParquetReader(rs)
+	if err != nil {
+		return nil, fmt.Errorf("error opening parquet file: %s", err)
+	}
+
+	fileReader, err := pqarrow.NewFileReader(parquetReader, pqarrow.ArrowReadProperties{BatchSize: 64 * 1024}, memory.NewGoAllocator())
+	if err != nil {
+		parquetReader.Close()
+		return nil, fmt.Errorf("error opening parquet file: %s", err)
+	}
+
+	schema, err := fileReader.Schema()
+	if err != nil {
+		parquetReader.Close()
+		return nil, fmt.Errorf("error reading parquet schema: %s", err)
+	}
+
+	// NewParquetDataWriter stores the original column types under cols
+	var metadata []ColumnMetadata
+	if cols := parquetReader.MetaData().KeyValueMetadata().FindValue("cols"); cols != nil {
+		if err := json.Unmarshal([]byte(*cols), &metadata); err != nil {
+			log.Debug().Err(err).Msg("Ignoring unreadable cols metadata")
+			metadata = nil
+		}
+	}
+
+	records, err := fileReader.GetRecordReader(context.Background(), nil, nil)
+	if err != nil {
+		parquetReader.Close()
+		return nil, fmt.Errorf("error reading parquet row groups: %s", err)
+	}
+
+	return &recordRowReader{
+		records: records,
+		closers: []func() error{func() error { records.Release(); return nil }, parquetReader.Close, closer.Close},
+		schema:  schema,
+		columns: arrowColumns(schema, metadata),
+	}, nil
+}
@@ -2,6 +2,7 @@ package file
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -11,6 +12,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
 	"github.com/apache/arrow-go/v18/parquet"
 	"github.com/apache/arrow-go/v18/parquet/compress"
 	"github.com/apache/arrow-go/v18/parquet/file"
@@ -24,6 +27,30 @@ import (
 
 var epochDate = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
 
+// row groups close at whichever comes first
+const (
+	defaultRowGroupRows  = 1_000_000
+	defaultRowGroupBytes = 128 * 1024 * 1024
+)
+
+var parquetCodecs = map[string]compress.Compression{
+	"":             compress.Codecs.Snappy,
+	"snappy":       compress.Codecs.Snappy,
+	"none":         compress.Codecs.Uncompressed,
+	"uncompressed": compress.Codecs.Uncompressed,
+	"gzip":         compress.Codecs.Gzip,
+	"zstd":         compress.Codecs.Zstd,
+	"lz4":          compress.Codecs.Lz4Raw,
+	"brotli":       compress.Codecs.Brotli,
+}
+
+// the levels each codec takes, the rest have none
+var parquetCodecLevels = map[compress.Compression][2]int{
+	compress.Codecs.Gzip:   {1, 9},
+	compress.Codecs.Zstd:   {1, 22},
+	compress.Codecs.Brotli: {1, 11},
+}
+
 type ColumnMetadata struct {
 	Name   string `json:"name"`
 	Type   string `json:"type"`
@@ -33,16 +60,46 @@ type ColumnMetadata struct {
 type ParquetDataWriter struct {
 	datastream *data.DataStream
 	writer     *file.Writer
-	mux        sync.Mutex
+	// nested columns have a leaf for every primitive inside them
+	nodes  []*parquetNode
+	leaves []parquetLeaf
+	// the open row group stays open across batches until it is full
+	rowGroup     file.BufferedRowGroupWriter
+	rowGroupRows int64
+	maxRows      int64
+	maxBytes     int64
+	mux          sync.Mutex
 }
 
 type ParquetBatchWriter struct {
 	dataWriter       *ParquetDataWriter
 	columnBuffers    []interface{}
 	definitionLevels [][]int16
+	// only the leaves inside a list have repetition levels
+	repetitionLevels [][]int16
 	scaleFactors     map[int]*big.Float
 }
 
+// parquetNode is a column or a part of one, lists have an element and structs
+// have fields. maxDef is the definition level when the node has a value.
+type parquetNode struct {
+	col     data.Column
+	maxDef  int16
+	maxRep  int16
+	leaf    int
+	leaves  []int
+	element *parquetNode
+	fields  []*parquetNode
+}
+
+// parquetLeaf is a primitive column of the file
+type parquetLeaf struct {
+	col    data.Column
+	path   string
+	maxDef int16
+	maxRep int16
+}
+
 type ParquetDecimal struct {
 	Type         DecimalType // Discriminator to indicate the active type
 	Int32Val     int32
@@ -80,7 +137,6 @@ var parquetTypeMap = map[string]MappedType{
 	"VARCHAR":     {parquet.Types.ByteArray, schema.StringLogicalType{}, reflect.TypeOf(string(""))},
 	"JSONB":       {parquet.Types.ByteArray, schema.JSONLogicalType{}, reflect.TypeOf(string(""))},
 	"JSON":        {parquet.Types.ByteArray, schema.JSONLogicalType{}, reflect.TypeOf(string(""))},
-	"_TEXT":       {parquet.Types.ByteArray, schema.StringLogicalType{}, reflect.TypeOf(string(""))},
 }
 
 func numericLookup(precision int, scale int) MappedType {
@@ -96,7 +152,7 @@ func numericLookup(precision int, scale int) MappedType {
 
 func checkType(col data.Column) MappedType {
 	aliased := data.TypeAlias(col.Type)
-	if aliased == "NUMERIC" {
+	if aliased == "NUMERIC" && col.Precision > 0 {
 		return numericLookup(int(col.Precision), int(col.Scale))
 	}
 	if t, ok := parquetTypeMap[aliased]; ok {
@@ -105,6 +161,20 @@ func checkType(col data.Column) MappedType {
 	return MappedType{parquet.Types.ByteArray, schema.StringLogicalType{}, reflect.TypeOf(string(""))}
 }
 
+// flattenNested makes lists and structs JSON text, for the table formats that
+// only have primitive types in their schemas
+func flattenNested(columns []data.Column) []data.Column {
+	flat := make([]data.Column, len(columns))
+	for i, col := range columns {
+		flat[i] = col
+		if data.IsList(col) || data.IsStruct(col) {
+			flat[i].Type = "JSONB"
+			flat[i].Fields = nil
+		}
+	}
+	return flat
+}
+
 func mapColumnMetadata(columns []data.Column) []ColumnMetadata {
 	columnMetadata := make([]ColumnMetadata, len(columns))
 	for col := range columns {
@@ -114,22 +184,48 @@ func mapColumnMetadata(columns []data.Column) []ColumnMetadata {
 	return columnMetadata
 }
 
+// NewParquetDataWriter writes snappy parquet with the default row groups
 func NewParquetDataWriter(datastream *data.DataStream, ioWriter io.Writer) *ParquetDataWriter {
+	pw, err := NewParquetDataWriterWithOptions(datastream, ioWriter, "snappy", 0, nil)
+	if err != nil {
+		panic(err)
+	}
+	return pw
+}
+
+// NewParquetDataWriterWithOptions writes parquet with the codec and layout of the stream
+func NewParquetDataWriterWithOptions(datastream *data.DataStream, ioWriter io.Writer, compression string, level int, opts *data.ParquetOptions) (*ParquetDataWriter, error) {
+	if opts == nil {
+		opts = &data.ParquetOptions{}
+	}
+	if opts.RowGroupRows < 0 || opts.RowGroupBytes < 0 {
+		return nil, fmt.Errorf("parquet row groups must be a positive size: %d rows, %d bytes", opts.RowGroupRows, opts.RowGroupBytes)
+	}
 	columnCount := len(datastream.DestColumns)
 
 	nodes := make([]schema.Node, columnCount)
+	parquetNodes := make([]*parquetNode, columnCount)
+	var leaves []parquetLeaf
 
 	for i, col := range datastream.DestColumns {
-		nodes[i] = buildNode(col)
+		var err error
+		nodes[i], parquetNodes[i], err = buildParquetNode(col, int32(col.Position), "", 0, 0, &leaves)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	root, err := schema.NewGroupNode("schema", parquet.Repetitions.Required, nodes, 1)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	s := schema.NewSchema(root)
-	writerProp := parquet.WithCompression(compress.Codecs.Snappy)
-	prop := parquet.NewWriterProperties(writerProp)
+
+	writerProps, err := parquetWriterProperties(leaves, compression, level, opts)
+	if err != nil {
+		return nil, err
+	}
+	prop := parquet.NewWriterProperties(writerProps...)
 	fileProp := file.WithWriterProps(prop)
 	writer := file.NewParquetWriter(ioWriter, s.Root(), fileProp)
 
@@ -138,226 +234,264 @@ func NewParquetDataWriter(datastream *data.DataStream, ioWriter io.Writer) *Parq
 	if err == nil {
 		writer.AppendKeyValueMetadata("cols", string(columnMetadataJSON))
 	}
-	return &ParquetDataWriter{datastream: datastream, writer: writer}
+
+	pw := &ParquetDataWriter{datastream: datastream, writer: writer, nodes: parquetNodes, leaves: leaves, maxRows: opts.RowGroupRows, maxBytes: opts.RowGroupBytes}
+	if pw.maxRows == 0 {
+		pw.maxRows = defaultRowGroupRows
+	}
+	if pw.maxBytes == 0 {
+		pw.maxBytes = defaultRowGroupBytes
+	}
+	return pw, nil
+}
+
+// parquetWriterProperties maps the compression and the parquet options to the writer
+func parquetWriterProperties(leaves []parquetLeaf, compression string, level int, opts *data.ParquetOptions) ([]parquet.WriterProperty, error) {
+	codec, ok := parquetCodecs[strings.ToLower(compression)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported parquet compression: %s", compression)
+	}
+	props := []parquet.WriterProperty{parquet.WithCompression(codec)}
+
+	if level != 0 {
+		levels, ok := parquetCodecLevels[codec]
+		if !ok {
+			return nil, fmt.Errorf("parquet %s does not have compression levels", compression)
+		}
+		if level < levels[0] || level > levels[1] {
+			return nil, fmt.Errorf("parquet %s level must be between %d and %d: %d", compression, levels[0], levels[1], level)
+		}
+		props = append(props, parquet.WithCompressionLevel(level))
+	}
+
+	if opts.DataPageSize < 0 {
+		return nil, fmt.Errorf("parquet data_page_size must be positive: %d", opts.DataPageSize)
+	}
+	if opts.DataPageSize > 0 {
+		props = append(props, parquet.WithDataPageSize(opts.DataPageSize))
+	}
+
+	if opts.Dictionary != nil {
+		props = append(props, parquet.WithDictionaryDefault(*opts.Dictionary))
+	}
+	for name, dictionary := range opts.DictionaryColumns {
+		// a nested column is every leaf inside it
+		found := false
+		for _, leaf := range leaves {
+			if leaf.path == name || strings.HasPrefix(leaf.path, name+".") {
+				props = append(props, parquet.WithDictionaryFor(leaf.path, dictionary))
+				found = true
+			}
+		}
+		// a typo would silently do nothing
+		if !found {
+			return nil, fmt.Errorf("parquet dictionary_columns has unknown column %s", name)
+		}
+	}
+
+	if opts.Statistics != nil {
+		props = append(props, parquet.WithStats(*opts.Statistics))
+	}
+	if opts.PageStatistics {
+		if opts.Statistics != nil && !*opts.Statistics {
+			return nil, errors.New("parquet page_statistics needs statistics")
+		}
+		props = append(props, parquet.WithPageIndexEnabled(true))
+	}
+	return props, nil
 }
 
 func (pw *ParquetDataWriter) CreateBatchWriter() data.BatchWriter {
 	// allocate column buffers and definition levels
-	columnCount := len(pw.datastream.DestColumns)
-	columnBuffers := make([]interface{}, columnCount)
-	definitionLevels := make([][]int16, columnCount)
+	leafCount := len(pw.leaves)
+	columnBuffers := make([]interface{}, leafCount)
+	definitionLevels := make([][]int16, leafCount)
+	repetitionLevels := make([][]int16, leafCount)
 
-	for i := 0; i < columnCount; i++ {
-		mapped := checkType(pw.datastream.DestColumns[i])
+	for i, leaf := range pw.leaves {
+		mapped := checkType(leaf.col)
 		columnBuffers[i] = reflect.MakeSlice(reflect.SliceOf(mapped.GoType), 0, pw.datastream.BatchSize).Interface()
 		definitionLevels[i] = make([]int16, 0, pw.datastream.BatchSize)
+		if leaf.maxRep > 0 {
+			repetitionLevels[i] = make([]int16, 0, pw.datastream.BatchSize)
+		}
 	}
 
 	scaleFactors := make(map[int]*big.Float)
 
-	return &ParquetBatchWriter{dataWriter: pw, columnBuffers: columnBuffers, definitionLevels: definitionLevels, scaleFactors: scaleFactors}
+	return &ParquetBatchWriter{dataWriter: pw, columnBuffers: columnBuffers, definitionLevels: definitionLevels, repetitionLevels: repetitionLevels, scaleFactors: scaleFactors}
 }
 
 func (pb *ParquetBatchWriter) WriteBatch(batch data.Batch) error {
 	for _, row := range batch.Rows {
-		for i, col := range pb.dataWriter.datastream.DestColumns {
-			if row[i] == nil {
-				pb.definitionLevels[i] = append(pb.definitionLevels[i], 0)
-				continue
-			}
-			// has value so set definition level to 1
-			pb.definitionLevels[i] = append(pb.definitionLevels[i], 1)
-
-			switch col.Type {
-			case "SMALLINT":
-				buf, ok := pb.columnBuffers[i].([]int32)
-				if !ok {
-					return fmt.Errorf("type assertion failed for INT2")
-				}
-				switch v := row[i].(type) {
-				case int32:
-					pb.columnBuffers[i] = append(buf, v)
-				default:
-					pb.columnBuffers[i] = append(buf, cast.ToInt32(row[i]))
-				}
-			case "INTEGER":
-				buf, ok := pb.columnBuffers[i].([]int32)
-				if !ok {
-					return fmt.Errorf("type assertion failed for INT4")
-				}
-				switch v := row[i].(type) {
-				case *big.Int:
-					pb.columnBuffers[i] = append(buf, int32(v.Int64()))
-				case int32:
-					pb.columnBuffers[i] = append(buf, v)
-				default:
-					pb.columnBuffers[i] = append(buf, cast.ToInt32(row[i]))
-				}
-			case "BIGINT":
-				buf, ok := pb.columnBuffers[i].([]int64)
-				if !ok {
-					return fmt.Errorf("type assertion failed for INT8")
-				}
-				switch v := row[i].(type) {
-				case *big.Int:
-					pb.columnBuffers[i] = append(buf, v.Int64())
-				case int32:
-					pb.columnBuffers[i] = append(buf, int64(v))
-				case int64:
-					pb.columnBuffers[i] = append(buf, v)
-				case decimal.Decimal:
-					pb.columnBuffers[i] = append(buf, v.IntPart())
-				default:
-					pb.columnBuffers[i] = append(buf, cast.ToInt64(row[i]))
-				}
-			case "REAL":
-				buf, ok := pb.columnBuffers[i].([]float32)
-				if !ok {
-					return fmt.Errorf("type assertion failed for FLOAT4")
-				}
-				switch v := row[i].(type) {
-				case *big.Float:
-					f32, _ := v.Float32()
-					pb.columnBuffers[i] = append(buf, f32)
-				default:
-					pb.columnBuffers[i] = append(buf, cast.ToFloat32(row[i]))
-				}
-			case "DOUBLE":
-				buf, ok := pb.columnBuffers[i].([]float64)
-				if !ok {
-					return fmt.Errorf("type assertion failed for FLOAT8")
-				}
-				switch v := row[i].(type) {
-				case *big.Float:
-					f64, _ := v.Float64()
-					pb.columnBuffers[i] = append(buf, f64)
-				case decimal.Decimal:
-					f64, _ := v.Float64()
-					pb.columnBuffers[i] = append(buf, f64)
-				default:
-					pb.columnBuffers[i] = append(buf, cast.ToFloat64(row[i]))
-				}
-			case "JSONB", "JSON", "_TEXT":
-				buf, ok := pb.columnBuffers[i].([]string)
-				if !ok {
-					return fmt.Errorf("type assertion failed for JSON types")
-				}
-				switch v := row[i].(type) {
-				case string:
-					pb.columnBuffers[i] = append(buf, v)
-				default:
-					j, err := json.Marshal(row[i])
-					if err != nil {
-						return fmt.Errorf("failed to marshal JSON for column %s: %v", col.Name, err)
-					}
-					pb.columnBuffers[i] = append(buf, string(j))
-				}
-			case "UUID":
-				buf, ok := pb.columnBuffers[i].([][]byte)
-				if !ok {
-					return fmt.Errorf("type assertion failed for UUID")
-				}
+		for i, node := range pb.dataWriter.nodes {
+			if err := pb.shred(node, row[i], 0, 0); err != nil {
+				return fmt.Errorf("failed to convert column %s: %w", node.col.Name, err)
+			}
+		}
+	}
 
-				switch v := row[i].(type) {
-				case string:
-					uuidValue, err := uuid.Parse(v)
+	return pb.writeBuffers(len(batch.Rows))
+}
+
+// WriteRecord fills the buffers a column at a time. Columns whose arrow type
+// matches the leaf are copied without converting each value, the rest are
+// shredded value by value like rows.
+func (pb *ParquetBatchWriter) WriteRecord(record arrow.RecordBatch) error {
+	nodes := pb.dataWriter.nodes
+	if int(record.NumCols()) != len(nodes) {
+		return fmt.Errorf("record has %d columns, expected %d", record.NumCols(), len(nodes))
+	}
+	for i, node := range nodes {
+		arr := record.Column(i)
+		copied, err := pb.appendColumn(node, arr)
+		if err != nil {
+			return fmt.Errorf("failed to convert column %s: %w", node.col.Name, err)
+		}
+		if copied {
+			continue
+		}
+		for r := range arr.Len() {
+			if err := pb.shred(node, data.ArrowValue(arr, r), 0, 0); err != nil {
+				return fmt.Errorf("failed to convert column %s: %w", node.col.Name, err)
+			}
+		}
+	}
+	return pb.writeBuffers(int(record.NumRows()))
+}
+
+// appendColumn copies a column of a primitive type into its leaf, false when
+// the arrow type is not the one the leaf is written from
+func (pb *ParquetBatchWriter) appendColumn(node *parquetNode, arr arrow.Array) (bool, error) {
+	if node.element != nil || node.fields != nil {
+		return false, nil
+	}
+	leaf := node.leaf
+	col := node.col
+	switch buf := pb.columnBuffers[leaf].(type) {
+	case []bool:
+		if a, ok := arr.(*array.Boolean); ok && col.Type == "BOOLEAN" {
+			pb.columnBuffers[leaf] = appendArrow(pb, node, arr, buf, a.Value)
+			return true, nil
+		}
+	case []int32:
+		switch a := arr.(type) {
+		case *array.Int16:
+			if col.Type == "SMALLINT" || col.Type == "INTEGER" {
+				pb.columnBuffers[leaf] = appendArrow(pb, node, arr, buf, func(i int) int32 { return int32(a.Value(i)) })
+				return true, nil
+			}
+		case *array.Int32:
+			if col.Type == "SMALLINT" || col.Type == "INTEGER" {
+				pb.columnBuffers[leaf] = appendArrow(pb, node, arr, buf, a.Value)
+				return true, nil
+			}
+		case *array.Date32:
+			if col.Type == "DATE" {
+				pb.columnBuffers[leaf] = appendArrow(pb, node, arr, buf, func(i int) int32 { return int32(a.Value(i)) })
+				return true, nil
+			}
+		case *array.Decimal128:
+			if sameDecimal(a, col) {
+				pb.columnBuffers[leaf] = appendArrow(pb, node, arr, buf, func(i int) int32 { return int32(a.Value(i).LowBits()) })
+				return true, nil
+			}
+		}
+	case []int64:
+		switch a := arr.(type) {
+		case *array.Int32:
+			if col.Type == "BIGINT" {
+				pb.columnBuffers[leaf] = appendArrow(pb, node, arr, buf, func(i int) int64 { return int64(a.Value(i)) })
+				return true, nil
+			}
+		case *array.Int64:
+			if col.Type == "BIGINT" {
+				pb.columnBuffers[leaf] = appendArrow(pb, node, arr, buf, a.Value)
+				return true, nil
+			}
+		case *array.Timestamp:
+			if col.Type == "TIMESTAMP" || col.Type == "TIMESTAMPTZ" {
+				unit := a.DataType().(*arrow.TimestampType).Unit
+				pb.columnBuffers[leaf] = appendArrow(pb, node, arr, buf, func(i int) int64 { return a.Value(i).ToTime(unit).UnixMicro() })
+				return true, nil
+			}
+		case *array.Decimal128:
+			if sameDecimal(a, col) {
+				pb.columnBuffers[leaf] = appendArrow(pb, node, arr, buf, func(i int) int64 { return int64(a.Value(i).LowBits()) })
+				return true, nil
+			}
+		}
+	case []float32:
+		if a, ok := arr.(*array.Float32); ok && col.Type == "REAL" {
+			pb.columnBuffers[leaf] = appendArrow(pb, node, arr, buf, a.Value)
+			return true, nil
+		}
+	case []float64:
+		if a, ok := arr.(*array.Float64); ok && col.Type == "DOUBLE" {
+			pb.columnBuffers[leaf] = appendArrow(pb, node, arr, buf, a.Value)
+			return true, nil
+		}
+	case []string:
+		switch col.Type {
+		case "TEXT", "VARCHAR", "JSON", "JSONB":
+			switch a := arr.(type) {
+			case *array.String:
+				pb.columnBuffers[leaf] = appendArrow(pb, node, arr, buf, a.Value)
+				return true, nil
+			case *array.LargeString:
+				pb.columnBuffers[leaf] = appendArrow(pb, node, arr, buf, a.Value)
+				return true, nil
+			}
+		}
+	case [][]byte:
+		switch a := arr.(type) {
+		case *array.FixedSizeBinary:
+			if col.Type == "UUID" && a.DataType().(*arrow.FixedSizeBinaryType).ByteWidth == 16 {
+				pb.columnBuffers[leaf] = appendArrow(pb, node, arr, buf, a.Value)
+				return true, nil
+			}
+		case *array.Decimal128:
+			if sameDecimal(a, col) {
+				var err error
+				pb.columnBuffers[leaf] = appendArrow(pb, node, arr, buf, func(i int) []byte {
 					if err != nil {
-						return fmt.Errorf("failed to parse UUID for column %s: %v", col.Name, err)
+						return nil
 					}
-					pb.columnBuffers[i] = append(buf, uuidValue[:])
-				case [16]uint8:
-					pb.columnBuffers[i] = append(buf, v[:])
-				case uuid.UUID:
-					pb.columnBuffers[i] = append(buf, v[:])
-				case []byte:
-					pb.columnBuffers[i] = append(buf, v[:])
-				default:
-					return fmt.Errorf("expected string or UUID for UUID column %s, got %T", col.Name, v)
-				}
-			case "NUMERIC":
-				decimalValue, err := convertToParquetDecimal(row[i], int(col.Precision), int(col.Scale), pb.scaleFactors)
-				if err != nil {
-					return fmt.Errorf("failed to convert DECIMAL for column %s: %v", col.Name, err)
-				}
-				switch decimalValue.Type {
-				case Int32Decimal:
-					buf, ok := pb.columnBuffers[i].([]int32)
-					if !ok {
-						return fmt.Errorf("type assertion failed for DECIMAL")
-					}
-					pb.columnBuffers[i] = append(buf, decimalValue.Int32Val)
-				case Int64Decimal:
-					buf, ok := pb.columnBuffers[i].([]int64)
-					if !ok {
-						return fmt.Errorf("type assertion failed for DECIMAL")
-					}
-					pb.columnBuffers[i] = append(buf, decimalValue.Int64Val)
-				case ByteArrayDecimal:
-					buf, ok := pb.columnBuffers[i].([][]byte)
-					if !ok {
-						return fmt.Errorf("type assertion failed for DECIMAL")
-					}
-					pb.columnBuffers[i] = append(buf, decimalValue.ByteArrayVal)
-				default:
-					return fmt.Errorf("unknown DECIMAL type %v", decimalValue.Type)
-				}
-			case "DATE":
-				buf, ok := pb.columnBuffers[i].([]int32)
-				if !ok {
-					return fmt.Errorf("type assertion failed for DATE")
-				}
-				dateValue, ok := row[i].(time.Time)
-				if !ok {
-					return fmt.Errorf("expected time.Time for DATE column %s, got %T", col.Name, row[i])
-				}
-				// Convert the date to the number of days since the Unix epoch
-				daysSinceEpoch := int32(dateValue.Sub(epochDate).Truncate(24*time.Hour).Hours() / 24)
-				pb.columnBuffers[i] = append(buf, daysSinceEpoch)
-			case "BOOLEAN":
-				buf, ok := pb.columnBuffers[i].([]bool)
-				if !ok {
-					return fmt.Errorf("type assertion failed for BOOL")
-				}
-				switch v := row[i].(type) {
-				case bool:
-					pb.columnBuffers[i] = append(buf, v)
-				default:
-					return fmt.Errorf("expected bool for BOOL column %s, got %T", col.Name, row[i])
-				}
-			case "TIMESTAMP", "TIMESTAMPTZ":
-				buf, ok := pb.columnBuffers[i].([]int64)
-				if !ok {
-					return fmt.Errorf("type assertion failed for TIMESTAMP")
-				}
-				v, ok := row[i].(time.Time)
-				if !ok {
-					return fmt.Errorf("expected time.Time for TIMESTAMP column %s, got %T", col.Name, row[i])
-				}
-				pb.columnBuffers[i] = append(buf, v.UnixMicro())
-			case "TEXT", "VARCHAR":
-				buf, ok := pb.columnBuffers[i].([]string)
-				if !ok {
-					return fmt.Errorf("type assertion failed for TEXT")
-				}
-				// reuse the CSV logic to convert to string
-				value, err := ValueToString(row[i], col)
-				if err != nil {
-					return fmt.Errorf("failed to convert TEXT for column %s: %v", col.Name, err)
-				}
-				pb.columnBuffers[i] = append(buf, value)
-			default:
-				// cast everything else to string
-				buf, ok := pb.columnBuffers[i].([]string)
-				if !ok {
-					return fmt.Errorf("type assertion failed for default")
-				}
-				pb.columnBuffers[i] = append(buf, cast.ToString(row[i]))
+					var fixed []byte
+					fixed, err = bigIntToFixedBytes(a.Value(i).BigInt(), int(col.Precision))
+					return fixed
+				})
+				return true, err
 			}
 		}
 	}
+	return false, nil
+}
+
+// appendArrow adds the values of the column to the buffer, with the levels
+// that say which of them are null
+func appendArrow[T any](pb *ParquetBatchWriter, node *parquetNode, arr arrow.Array, buf []T, value func(i int) T) []T {
+	for i := range arr.Len() {
+		if arr.IsNull(i) {
+			pb.addLevels(node, 0, 0)
+			continue
+		}
+		pb.addLevels(node, node.maxDef, 0)
+		buf = append(buf, value(i))
+	}
+	return buf
+}
 
+// sameDecimal is true when the unscaled decimals can be written as they are
+func sameDecimal(arr *array.Decimal128, col data.Column) bool {
+	t := arr.DataType().(*arrow.Decimal128Type)
+	return col.Type == "NUMERIC" && col.Precision > 0 && int64(t.Precision) <= col.Precision && int64(t.Scale) == col.Scale
+}
+
+// writeBuffers writes the rows in the buffers and empties them for the next batch
+func (pb *ParquetBatchWriter) writeBuffers(rowCount int) error {
 	pb.dataWriter.mux.Lock()
-	err := pb.dataWriter.writeRowGroup(pb.columnBuffers, pb.definitionLevels, len(batch.Rows))
+	err := pb.dataWriter.writeRows(pb.columnBuffers, pb.definitionLevels, pb.repetitionLevels, rowCount)
 	pb.dataWriter.mux.Unlock()
 	if err != nil {
 		return err
@@ -382,105 +516,495 @@ func (pb *ParquetBatchWriter) WriteBatch(batch data.Batch) error {
 			pb.columnBuffers[i] = pb.columnBuffers[i].([]bool)[:0]
 		}
 		pb.definitionLevels[i] = pb.definitionLevels[i][:0]
+		if pb.repetitionLevels[i] != nil {
+			pb.repetitionLevels[i] = pb.repetitionLevels[i][:0]
+		}
 	}
 
 	return nil
 }
 
-func (pw *ParquetDataWriter) Flush() error {
-	return nil
-}
-
-func (pw *ParquetDataWriter) Close() error {
-	pw.writer.FlushWithFooter()
-	return pw.writer.Close()
-}
+// shred adds the value of the node to the leaves under it, with the levels
+// that say how much of it is there. def and rep are the levels when the value
+// is null, the parent is there but this node is not.
+func (pb *ParquetBatchWriter) shred(node *parquetNode, value any, def, rep int16) error {
+	if value == nil {
+		pb.addLevels(node, def, rep)
+		return nil
+	}
 
-func (pw *ParquetDataWriter) writeRowGroup(columnBuffers []any, definitionLevels [][]int16, rowCount int) error {
-	rg := pw.writer.AppendBufferedRowGroup()
-	defer rg.Close()
-	for i := range pw.datastream.DestColumns {
-		rgCol, err := rg.Column(i)
+	switch {
+	case node.element != nil:
+		items, err := listItems(value)
 		if err != nil {
 			return err
 		}
-
-		switch chunker := rgCol.(type) {
-		case *file.Int32ColumnChunkWriter:
-			buf, ok := columnBuffers[i].([]int32)
-			if !ok {
-				return fmt.Errorf("type assertion failed for INT4")
+		if len(items) == 0 {
+			// the list is there but has no elements
+			pb.addLevels(node, node.maxDef, rep)
+			return nil
+		}
+		for i, item := range items {
+			itemRep := rep
+			if i > 0 {
+				itemRep = node.maxRep
 			}
-			_, err := chunker.WriteBatch(buf, definitionLevels[i][:rowCount], nil)
-			if err != nil {
+			// the repeated group is one level past the list
+			if err := pb.shred(node.element, item, node.maxDef+1, itemRep); err != nil {
 				return err
 			}
-		case *file.Int64ColumnChunkWriter:
-			buf, ok := columnBuffers[i].([]int64)
-			if !ok {
-				return fmt.Errorf("type assertion failed for INT8 writer")
-			}
-			_, err := chunker.WriteBatch(buf, definitionLevels[i][:rowCount], nil)
-			if err != nil {
+		}
+		return nil
+	case node.fields != nil:
+		fields, err := structFields(value)
+		if err != nil {
+			return err
+		}
+		for _, field := range node.fields {
+			if err := pb.shred(field, structField(fields, field.col.Name), node.maxDef, rep); err != nil {
 				return err
 			}
-		case *file.Float32ColumnChunkWriter:
-			buf, ok := columnBuffers[i].([]float32)
-			if !ok {
-				return fmt.Errorf("type assertion failed for FLOAT4")
+		}
+		return nil
+	default:
+		pb.addLevels(node, node.maxDef, rep)
+		return pb.appendValue(node.leaf, node.col, value)
+	}
+}
+
+func (pb *ParquetBatchWriter) addLevels(node *parquetNode, def, rep int16) {
+	for _, leaf := range node.leaves {
+		pb.definitionLevels[leaf] = append(pb.definitionLevels[leaf], def)
+		if pb.repetitionLevels[leaf] != nil {
+			pb.repetitionLevels[leaf] = append(pb.repetitionLevels[leaf], rep)
+		}
+	}
+}
+
+// listItems takes postgres arrays, any other slice or a JSON array
+func listItems(value any) ([]any, error) {
+	switch v := value.(type) {
+	case []any:
+		return v, nil
+	case string:
+		var items []any
+		if err := json.Unmarshal([]byte(v), &items); err != nil {
+			return nil, fmt.Errorf("expected a JSON array: %w", err)
+		}
+		return items, nil
+	}
+
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("expected a list, got %T", value)
+	}
+	items := make([]any, rv.Len())
+	for i := range items {
+		items[i] = rv.Index(i).Interface()
+	}
+	return items, nil
+}
+
+// structFields takes a decoded JSON object or the JSON text of one
+func structFields(value any) (map[string]any, error) {
+	switch v := value.(type) {
+	case map[string]any:
+		return v, nil
+	case string:
+		return unmarshalObject([]byte(v))
+	case []byte:
+		return unmarshalObject(v)
+	default:
+		return nil, fmt.Errorf("expected an object, got %T", value)
+	}
+}
+
+func unmarshalObject(text []byte) (map[string]any, error) {
+	var fields map[string]any
+	if err := json.Unmarshal(text, &fields); err != nil {
+		return nil, fmt.Errorf("expected a JSON object: %w", err)
+	}
+	return fields, nil
+}
+
+// structField finds the field by name, ignoring case when the exact name is not there
+func structField(fields map[string]any, name string) any {
+	if value, ok := fields[name]; ok {
+		return value
+	}
+	for key, value := range fields {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return nil
+}
+
+// appendString adds the text of the value to a string leaf
+func (pb *ParquetBatchWriter) appendString(leaf int, value any, col data.Column) error {
+	buf, ok := pb.columnBuffers[leaf].([]string)
+	if !ok {
+		return fmt.Errorf("type assertion failed for TEXT")
+	}
+	str, err := ValueToString(value, col)
+	if err != nil {
+		return err
+	}
+	pb.columnBuffers[leaf] = append(buf, str)
+	return nil
+}
+
+// appendValue converts the value to the type of the leaf and adds it to its buffer
+func (pb *ParquetBatchWriter) appendValue(leaf int, col data.Column, value any) error {
+	switch col.Type {
+	case "SMALLINT":
+		buf, ok := pb.columnBuffers[leaf].([]int32)
+		if !ok {
+			return fmt.Errorf("type assertion failed for INT2")
+		}
+		switch v := value.(type) {
+		case int32:
+			pb.columnBuffers[leaf] = append(buf, v)
+		default:
+			pb.columnBuffers[leaf] = append(buf, cast.ToInt32(value))
+		}
+	case "INTEGER":
+		buf, ok := pb.columnBuffers[leaf].([]int32)
+		if !ok {
+			return fmt.Errorf("type assertion failed for INT4")
+		}
+		switch v := value.(type) {
+		case *big.Int:
+			pb.columnBuffers[leaf] = append(buf, int32(v.Int64()))
+		case int32:
+			pb.columnBuffers[leaf] = append(buf, v)
+		default:
+			pb.columnBuffers[leaf] = append(buf, cast.ToInt32(value))
+		}
+	case "BIGINT":
+		buf, ok := pb.columnBuffers[leaf].([]int64)
+		if !ok {
+			return fmt.Errorf("type assertion failed for INT8")
+		}
+		switch v := value.(type) {
+		case *big.Int:
+			pb.columnBuffers[leaf] = append(buf, v.Int64())
+		case int32:
+			pb.columnBuffers[leaf] = append(buf, int64(v))
+		case int64:
+			pb.columnBuffers[leaf] = append(buf, v)
+		case decimal.Decimal:
+			pb.columnBuffers[leaf] = append(buf, v.IntPart())
+		default:
+			pb.columnBuffers[leaf] = append(buf, cast.ToInt64(value))
+		}
+	case "REAL":
+		buf, ok := pb.columnBuffers[leaf].([]float32)
+		if !ok {
+			return fmt.Errorf("type assertion failed for FLOAT4")
+		}
+		switch v := value.(type) {
+		case *big.Float:
+			f32, _ := v.Float32()
+			pb.columnBuffers[leaf] = append(buf, f32)
+		default:
+			pb.columnBuffers[leaf] = append(buf, cast.ToFloat32(value))
+		}
+	case "DOUBLE":
+		buf, ok := pb.columnBuffers[leaf].([]float64)
+		if !ok {
+			return fmt.Errorf("type assertion failed for FLOAT8")
+		}
+		switch v := value.(type) {
+		case *big.Float:
+			f64, _ := v.Float64()
+			pb.columnBuffers[leaf] = append(buf, f64)
+		case decimal.Decimal:
+			f64, _ := v.Float64()
+			pb.columnBuffers[leaf] = append(buf, f64)
+		default:
+			pb.columnBuffers[leaf] = append(buf, cast.ToFloat64(value))
+		}
+	case "JSONB", "JSON":
+		buf, ok := pb.columnBuffers[leaf].([]string)
+		if !ok {
+			return fmt.Errorf("type assertion failed for JSON types")
+		}
+		switch v := value.(type) {
+		case string:
+			pb.columnBuffers[leaf] = append(buf, v)
+		default:
+			j, err := json.Marshal(value)
+			if err != nil {
+				return fmt.Errorf("failed to marshal JSON for column %s: %v", col.Name, err)
 			}
-			_, err := chunker.WriteBatch(buf, definitionLevels[i][:rowCount], nil)
+			pb.columnBuffers[leaf] = append(buf, string(j))
+		}
+	case "UUID":
+		buf, ok := pb.columnBuffers[leaf].([][]byte)
+		if !ok {
+			return fmt.Errorf("type assertion failed for UUID")
+		}
+
+		switch v := value.(type) {
+		case string:
+			uuidValue, err := uuid.Parse(v)
 			if err != nil {
-				return err
+				return fmt.Errorf("failed to parse UUID for column %s: %v", col.Name, err)
 			}
-		case *file.Float64ColumnChunkWriter:
-			buf, ok := columnBuffers[i].([]float64)
+			pb.columnBuffers[leaf] = append(buf, uuidValue[:])
+		case [16]uint8:
+			pb.columnBuffers[leaf] = append(buf, v[:])
+		case uuid.UUID:
+			pb.columnBuffers[leaf] = append(buf, v[:])
+		case []byte:
+			pb.columnBuffers[leaf] = append(buf, v[:])
+		default:
+			return fmt.Errorf("expected string or UUID for UUID column %s, got %T", col.Name, v)
+		}
+	case "NUMERIC":
+		if col.Precision <= 0 {
+			// without a precision it is text, like avro
+			return pb.appendString(leaf, value, col)
+		}
+		decimalValue, err := convertToParquetDecimal(value, int(col.Precision), int(col.Scale), pb.scaleFactors)
+		if err != nil {
+			return fmt.Errorf("failed to convert DECIMAL for column %s: %v", col.Name, err)
+		}
+		switch decimalValue.Type {
+		case Int32Decimal:
+			buf, ok := pb.columnBuffers[leaf].([]int32)
 			if !ok {
-				return fmt.Errorf("type assertion failed for FLOAT8")
-			}
-			_, err := chunker.WriteBatch(buf, definitionLevels[i][:rowCount], nil)
-			if err != nil {
-				return err
+				return fmt.Errorf("type assertion failed for DECIMAL")
 			}
-		case *file.ByteArrayColumnChunkWriter:
-			buf, ok := columnBuffers[i].([]string)
+			pb.columnBuffers[leaf] = append(buf, decimalValue.Int32Val)
+		case Int64Decimal:
+			buf, ok := pb.columnBuffers[leaf].([]int64)
 			if !ok {
-				return fmt.Errorf("type assertion failed for BYTE_ARRAY")
+				return fmt.Errorf("type assertion failed for DECIMAL")
 			}
-			byteArray := make([]parquet.ByteArray, len(buf))
-			for j := 0; j < len(buf); j++ {
-				byteArray[j] = parquet.ByteArray(buf[j])
+			pb.columnBuffers[leaf] = append(buf, decimalValue.Int64Val)
+		case ByteArrayDecimal:
+			buf, ok := pb.columnBuffers[leaf].([][]byte)
+			if !ok {
+				return fmt.Errorf("type assertion failed for DECIMAL")
 			}
-			_, err := chunker.WriteBatch(byteArray, definitionLevels[i][:rowCount], nil)
+			pb.columnBuffers[leaf] = append(buf, decimalValue.ByteArrayVal)
+		default:
+			return fmt.Errorf("unknown DECIMAL type %v", decimalValue.Type)
+		}
+	case "DATE":
+		buf, ok := pb.columnBuffers[leaf].([]int32)
+		if !ok {
+			return fmt.Errorf("type assertion failed for DATE")
+		}
+		dateValue, ok := value.(time.Time)
+		if !ok {
+			return fmt.Errorf("expected time.Time for DATE column %s, got %T", col.Name, value)
+		}
+		// Convert the date to the number of days since the Unix epoch
+		daysSinceEpoch := int32(dateValue.Sub(epochDate).Truncate(24*time.Hour).Hours() / 24)
+		pb.columnBuffers[leaf] = append(buf, daysSinceEpoch)
+	case "BOOLEAN":
+		buf, ok := pb.columnBuffers[leaf].([]bool)
+		if !ok {
+			return fmt.Errorf("type assertion failed for BOOL")
+		}
+		switch v := value.(type) {
+		case bool:
+			pb.columnBuffers[leaf] = append(buf, v)
+		default:
+			return fmt.Errorf("expected bool for BOOL column %s, got %T", col.Name, value)
+		}
+	case "TIMESTAMP", "TIMESTAMPTZ":
+		buf, ok := pb.columnBuffers[leaf].([]int64)
+		if !ok {
+			return fmt.Errorf("type assertion failed for TIMESTAMP")
+		}
+		v, ok := value.(time.Time)
+		if !ok {
+			return fmt.Errorf("expected time.Time for TIMESTAMP column %s, got %T", col.Name, value)
+		}
+		pb.columnBuffers[leaf] = append(buf, v.UnixMicro())
+	case "TEXT", "VARCHAR":
+		buf, ok := pb.columnBuffers[leaf].([]string)
+		if !ok {
+			return fmt.Errorf("type assertion failed for TEXT")
+		}
+		// reuse the CSV logic to convert to string
+		value, err := ValueToString(value, col)
+		if err != nil {
+			return fmt.Errorf("failed to convert TEXT for column %s: %v", col.Name, err)
+		}
+		pb.columnBuffers[leaf] = append(buf, value)
+	default:
+		// cast everything else to string
+		buf, ok := pb.columnBuffers[leaf].([]string)
+		if !ok {
+			return fmt.Errorf("type assertion failed for default")
+		}
+		pb.columnBuffers[leaf] = append(buf, cast.ToString(value))
+	}
+	return nil
+}
+
+func (pw *ParquetDataWriter) Flush() error {
+	return nil
+}
+
+func (pw *ParquetDataWriter) Close() error {
+	if pw.rowGroup != nil {
+		if err := pw.rowGroup.Close(); err != nil {
+			return err
+		}
+	}
+	pw.writer.FlushWithFooter()
+	return pw.writer.Close()
+}
+
+// writeRows adds the rows to the open row group, starting a new one each time
+// it is full, so a batch can be split over row groups or share one with others
+func (pw *ParquetDataWriter) writeRows(columnBuffers []any, definitionLevels, repetitionLevels [][]int16, rowCount int) error {
+	levelOffsets := make([]int, len(pw.leaves))
+	valueOffsets := make([]int, len(pw.leaves))
+	for start := 0; start < rowCount; {
+		if pw.rowGroup == nil {
+			pw.rowGroup = pw.writer.AppendBufferedRowGroup()
+			pw.rowGroupRows = 0
+		}
+		end := min(rowCount, start+int(pw.maxRows-pw.rowGroupRows))
+
+		for i, leaf := range pw.leaves {
+			rgCol, err := pw.rowGroup.Column(i)
 			if err != nil {
 				return err
 			}
-		case *file.FixedLenByteArrayColumnChunkWriter:
-			buf, ok := columnBuffers[i].([][]byte)
-			if !ok {
-				return fmt.Errorf("type assertion failed for FIXED_LEN_BYTE_ARRAY")
+			// a flat column has a level for every row, a list a level for every element
+			levelEnd := levelOffsets[i] + end - start
+			var reps []int16
+			if leaf.maxRep > 0 {
+				levelEnd = rowsEnd(repetitionLevels[i], levelOffsets[i], end-start)
+				reps = repetitionLevels[i][levelOffsets[i]:levelEnd]
 			}
-			// loop over and set as parquet.FixedLenByteArray
-			fixedLenByteArray := make([]parquet.FixedLenByteArray, len(buf))
-			for j := 0; j < len(buf); j++ {
-				fixedLenByteArray[j] = parquet.FixedLenByteArray(buf[j])
+			levels := definitionLevels[i][levelOffsets[i]:levelEnd]
+			// nulls and empty lists only have levels
+			values := 0
+			for _, level := range levels {
+				if level == leaf.maxDef {
+					values++
+				}
 			}
-			_, err := chunker.WriteBatch(fixedLenByteArray, definitionLevels[i][:rowCount], nil)
-			if err != nil {
+			if err := writeColumnChunk(rgCol, columnBuffers[i], valueOffsets[i], valueOffsets[i]+values, levels, reps); err != nil {
 				return err
 			}
-		case *file.BooleanColumnChunkWriter:
-			buf, ok := columnBuffers[i].([]bool)
-			if !ok {
-				return fmt.Errorf("type assertion failed for BOOLEAN")
-			}
-			_, err := chunker.WriteBatch(buf, definitionLevels[i][:rowCount], nil)
-			if err != nil {
+			levelOffsets[i] = levelEnd
+			valueOffsets[i] += values
+		}
+		pw.rowGroupRows += int64(end - start)
+
+		// the bytes are the pages so far and the ones still being encoded
+		if pw.rowGroupRows >= pw.maxRows || pw.rowGroup.TotalBytesWritten()+pw.rowGroup.TotalCompressedBytes() >= pw.maxBytes {
+			if err := pw.rowGroup.Close(); err != nil {
 				return err
 			}
-		default:
-			return fmt.Errorf("type assertion failed for default")
+			pw.rowGroup = nil
+		}
+		start = end
+	}
+	return nil
+}
+
+// rowsEnd is the level after the rows from start, every row starts at repetition level 0
+func rowsEnd(reps []int16, start, rows int) int {
+	end := start
+	for ; end < len(reps); end++ {
+		if reps[end] == 0 {
+			if rows == 0 {
+				break
+			}
+			rows--
+		}
+	}
+	return end
+}
+
+// writeColumnChunk writes the values from lo to hi of one column buffer
+func writeColumnChunk(rgCol file.ColumnChunkWriter, columnBuffer any, lo, hi int, levels, reps []int16) error {
+	switch chunker := rgCol.(type) {
+	case *file.Int32ColumnChunkWriter:
+		buf, ok := columnBuffer.([]int32)
+		if !ok {
+			return fmt.Errorf("type assertion failed for INT4")
+		}
+		_, err := chunker.WriteBatch(buf[lo:hi], levels, reps)
+		if err != nil {
+			return err
+		}
+	case *file.Int64ColumnChunkWriter:
+		buf, ok := columnBuffer.([]int64)
+		if !ok {
+			return fmt.Errorf("type assertion failed for INT8 writer")
+		}
+		_, err := chunker.WriteBatch(buf[lo:hi], levels, reps)
+		if err != nil {
+			return err
 		}
+	case *file.Float32ColumnChunkWriter:
+		buf, ok := columnBuffer.([]float32)
+		if !ok {
+			return fmt.Errorf("type assertion failed for FLOAT4")
+		}
+		_, err := chunker.WriteBatch(buf[lo:hi], levels, reps)
+		if err != nil {
+			return err
+		}
+	case *file.Float64ColumnChunkWriter:
+		buf, ok := columnBuffer.([]float64)
+		if !ok {
+			return fmt.Errorf("type assertion failed for FLOAT8")
+		}
+		_, err := chunker.WriteBatch(buf[lo:hi], levels, reps)
+		if err != nil {
+			return err
+		}
+	case *file.ByteArrayColumnChunkWriter:
+		buf, ok := columnBuffer.([]string)
+		if !ok {
+			return fmt.Errorf("type assertion failed for BYTE_ARRAY")
+		}
+		byteArray := make([]parquet.ByteArray, hi-lo)
+		for j := lo; j < hi; j++ {
+			byteArray[j-lo] = parquet.ByteArray(buf[j])
+		}
+		_, err := chunker.WriteBatch(byteArray, levels, reps)
+		if err != nil {
+			return err
+		}
+	case *file.FixedLenByteArrayColumnChunkWriter:
+		buf, ok := columnBuffer.([][]byte)
+		if !ok {
+			return fmt.Errorf("type assertion failed for FIXED_LEN_BYTE_ARRAY")
+		}
+		// loop over and set as parquet.FixedLenByteArray
+		fixedLenByteArray := make([]parquet.FixedLenByteArray, hi-lo)
+		for j := lo; j < hi; j++ {
+			fixedLenByteArray[j-lo] = parquet.FixedLenByteArray(buf[j])
+		}
+		_, err := chunker.WriteBatch(fixedLenByteArray, levels, reps)
+		if err != nil {
+			return err
+		}
+	case *file.BooleanColumnChunkWriter:
+		buf, ok := columnBuffer.([]bool)
+		if !ok {
+			return fmt.Errorf("type assertion failed for BOOLEAN")
+		}
+		_, err := chunker.WriteBatch(buf[lo:hi], levels, reps)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("type assertion failed for default")
 	}
 	return nil
 }
@@ -592,10 +1116,58 @@ func convertToParquetDecimal(value any, precision, scale int, scaleFactors map[i
 	}
 }
 
-func buildNode(col data.Column) schema.Node {
+// buildParquetNode builds the schema of the column and the node that shreds its
+// values. Every level is optional, lists are the three level LIST with a
+// repeated group named list and an element.
+func buildParquetNode(col data.Column, fieldID int32, parent string, def, rep int16, leaves *[]parquetLeaf) (schema.Node, *parquetNode, error) {
+	path := col.Name
+	if parent != "" {
+		path = parent + "." + col.Name
+	}
+	def++
+	node := &parquetNode{col: col, maxDef: def, maxRep: rep}
+
+	switch {
+	case data.IsList(col):
+		node.maxRep = rep + 1
+		elementNode, element, err := buildParquetNode(data.ListElement(col), -1, path+".list", def+1, rep+1, leaves)
+		if err != nil {
+			return nil, nil, err
+		}
+		node.element = element
+		node.leaves = element.leaves
+		list, err := schema.NewGroupNode("list", parquet.Repetitions.Repeated, schema.FieldList{elementNode}, -1)
+		if err != nil {
+			return nil, nil, err
+		}
+		group, err := schema.NewGroupNodeLogical(col.Name, parquet.Repetitions.Optional, schema.FieldList{list}, schema.ListLogicalType{}, fieldID)
+		return group, node, err
+	case data.IsStruct(col):
+		fields := make(schema.FieldList, len(col.Fields))
+		for i, field := range col.Fields {
+			fieldNode, child, err := buildParquetNode(field, -1, path, def, rep, leaves)
+			if err != nil {
+				return nil, nil, err
+			}
+			fields[i] = fieldNode
+			node.fields = append(node.fields, child)
+			node.leaves = append(node.leaves, child.leaves...)
+		}
+		group, err := schema.NewGroupNode(col.Name, parquet.Repetitions.Optional, fields, fieldID)
+		return group, node, err
+	default:
+		node.leaf = len(*leaves)
+		node.leaves = []int{node.leaf}
+		*leaves = append(*leaves, parquetLeaf{col: col, path: path, maxDef: def, maxRep: rep})
+		primitive, err := buildNode(col, fieldID)
+		return primitive, node, err
+	}
+}
+
+func buildNode(col data.Column, fieldID int32) (schema.Node, error) {
 	mapped := checkType(col)
 	if mapped.LogicalType == nil {
-		return schema.MustPrimitive(schema.NewPrimitiveNode(col.Name, parquet.Repetitions.Optional, mapped.ParquetType, int32(col.Position), -1))
+		return schema.NewPrimitiveNode(col.Name, parquet.Repetitions.Optional, mapped.ParquetType, fieldID, -1)
 	}
 
 	var typeLen int
@@ -607,11 +1179,7 @@ func buildNode(col data.Column) schema.Node {
 			typeLen = calculateBytesForPrecision(int(col.Precision))
 		}
 	}
-	node, err := schema.NewPrimitiveNodeLogical(col.Name, parquet.Repetitions.Optional, mapped.LogicalType, mapped.ParquetType, typeLen, int32(col.Position))
-	if err != nil {
-		panic(err)
-	}
-	return node
+	return schema.NewPrimitiveNodeLogical(col.Name, parquet.Repetitions.Optional, mapped.LogicalType, mapped.ParquetType, typeLen, fieldID)
 }
 
 func convertDecimalStringToUnscaledInt(decimalStr string, scale int) (*big.Int, error) {
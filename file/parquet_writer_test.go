@@ -10,7 +10,10 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
 	"github.com/apache/arrow-go/v18/parquet"
+	"github.com/apache/arrow-go/v18/parquet/compress"
 	"github.com/apache/arrow-go/v18/parquet/file"
 	"github.com/johanan/mvr/core"
 	"github.com/johanan/mvr/data"
@@ -573,3 +576,235 @@ func TestParquetWriter(t *testing.T) {
 	assert.Equal(t, 2, metadata.Schema.NumColumns())
 	assert.Equal(t, 5, metadata.FileMetaData.NumRows)
 }
+
+func TestParquetWriterOptions(t *testing.T) {
+	columns := []data.Column{
+		{Name: "id", Type: "BIGINT"},
+		{Name: "name", Type: "TEXT"},
+		{Name: "status", Type: "TEXT"},
+	}
+	// three batches of five, with nulls so the values and rows do not line up
+	var rows [][]any
+	batches := make([]data.Batch, 3)
+	for i := range 15 {
+		row := []any{int64(i), nil, "active"}
+		if i%3 != 0 {
+			row[1] = "name"
+		}
+		rows = append(rows, row)
+		batches[i/5].Rows = append(batches[i/5].Rows, row)
+	}
+
+	dictionary := false
+	var buf bytes.Buffer
+	ds := &data.DataStream{BatchSize: 5, DestColumns: columns}
+	pdw, err := NewParquetDataWriterWithOptions(ds, NewWriteCloseBuffer(&buf), "zstd", 3, &data.ParquetOptions{
+		RowGroupRows:      4,
+		Dictionary:        &dictionary,
+		DictionaryColumns: map[string]bool{"status": true},
+		PageStatistics:    true,
+	})
+	assert.NoError(t, err)
+	bw := pdw.CreateBatchWriter()
+	for _, batch := range batches {
+		assert.NoError(t, bw.WriteBatch(batch))
+	}
+	assert.NoError(t, pdw.Close())
+
+	reader, err := file.NewParquetReader(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	// row groups are filled across batches, not one per batch
+	assert.Equal(t, 4, reader.NumRowGroups())
+	for i, expected := range []int64{4, 4, 4, 3} {
+		rgMeta := reader.MetaData().RowGroup(i)
+		assert.Equal(t, expected, rgMeta.NumRows())
+		for col := range columns {
+			chunkMeta, err := rgMeta.ColumnChunk(col)
+			assert.NoError(t, err)
+			assert.Equal(t, compress.Codecs.Zstd, chunkMeta.Compression())
+			// only status is dictionary encoded
+			assert.Equal(t, col == 2, chunkMeta.HasDictionaryPage())
+			statsSet, err := chunkMeta.StatsSet()
+			assert.NoError(t, err)
+			assert.True(t, statsSet)
+		}
+		pageIndex, err := reader.GetPageIndexReader().RowGroup(i)
+		assert.NoError(t, err)
+		columnIndex, err := pageIndex.GetColumnIndex(0)
+		assert.NoError(t, err)
+		assert.NotNil(t, columnIndex)
+	}
+
+	rowReader, err := newParquetRowReader(bytes.NewReader(buf.Bytes()), NewWriteCloseBuffer(&bytes.Buffer{}))
+	assert.NoError(t, err)
+	var result [][]any
+	for {
+		row, err := rowReader.Next()
+		if err != nil {
+			break
+		}
+		result = append(result, row)
+	}
+	assert.DeepEqual(t, rows, result)
+}
+
+func TestParquetWriterOptionsErrors(t *testing.T) {
+	ds := &data.DataStream{DestColumns: []data.Column{{Name: "id", Type: "BIGINT"}}}
+	tests := []struct {
+		name        string
+		compression string
+		level       int
+		opts        *data.ParquetOptions
+	}{
+		{name: "Unknown codec", compression: "lzo"},
+		{name: "Snappy has no levels", compression: "snappy", level: 1},
+		{name: "Zstd level too high", compression: "zstd", level: 23},
+		{name: "Unknown dictionary column", compression: "none", opts: &data.ParquetOptions{DictionaryColumns: map[string]bool{"missing": false}}},
+		{name: "Negative row group", compression: "gzip", opts: &data.ParquetOptions{RowGroupRows: -1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewParquetDataWriterWithOptions(ds, &bytes.Buffer{}, tt.compression, tt.level, tt.opts)
+			assert.Error(t, err)
+		})
+	}
+}
+
+// nestedColumns has lists with empty and null items, a struct and a list of structs
+func nestedColumns() ([]data.Column, [][]any, [][]any) {
+	columns := []data.Column{
+		{Name: "id", Type: "BIGINT"},
+		{Name: "tags", Type: "_TEXT"},
+		{Name: "scores", Type: "_INT4"},
+		{Name: "address", Type: "STRUCT", Fields: []data.Column{{Name: "city", Type: "TEXT"}, {Name: "zip", Type: "INTEGER"}}},
+		{Name: "items", Type: "_STRUCT", Fields: []data.Column{{Name: "sku", Type: "TEXT"}, {Name: "qty", Type: "INTEGER"}}},
+	}
+	rows := [][]any{
+		{int64(1), []any{"a", nil, "b"}, []int32{1, 2}, map[string]any{"city": "Paris", "zip": float64(75001)}, `[{"sku":"x","qty":2}]`},
+		{int64(2), []any{}, nil, `{"city":"Oslo"}`, []any{}},
+		{int64(3), nil, []int32{}, nil, nil},
+		{int64(4), []string{"c"}, []int32{3}, map[string]any{"City": "Rome", "zip": nil}, []any{map[string]any{"sku": "y", "qty": float64(1)}, nil}},
+		{int64(5), `["d","e"]`, []int32{4, 5, 6}, map[string]any{}, `[{"sku":"z"}]`},
+	}
+	expected := [][]any{
+		{int64(1), []any{"a", nil, "b"}, []any{int32(1), int32(2)}, map[string]any{"city": "Paris", "zip": int32(75001)}, []any{map[string]any{"sku": "x", "qty": int32(2)}}},
+		{int64(2), []any{}, nil, map[string]any{"city": "Oslo", "zip": nil}, []any{}},
+		{int64(3), nil, []any{}, nil, nil},
+		{int64(4), []any{"c"}, []any{int32(3)}, map[string]any{"city": "Rome", "zip": nil}, []any{map[string]any{"sku": "y", "qty": int32(1)}, nil}},
+		{int64(5), []any{"d", "e"}, []any{int32(4), int32(5), int32(6)}, map[string]any{"city": nil, "zip": nil}, []any{map[string]any{"sku": "z", "qty": nil}}},
+	}
+	return columns, rows, expected
+}
+
+func TestParquetWriterNested(t *testing.T) {
+	columns, rows, expected := nestedColumns()
+
+	var buf bytes.Buffer
+	ds := &data.DataStream{BatchSize: 3, DestColumns: columns}
+	// row groups split the batches between rows, not between list items
+	pdw, err := NewParquetDataWriterWithOptions(ds, NewWriteCloseBuffer(&buf), "snappy", 0, &data.ParquetOptions{
+		RowGroupRows:      2,
+		DictionaryColumns: map[string]bool{"items": false},
+	})
+	assert.NoError(t, err)
+	bw := pdw.CreateBatchWriter()
+	assert.NoError(t, bw.WriteBatch(data.Batch{Rows: rows[:3]}))
+	assert.NoError(t, bw.WriteBatch(data.Batch{Rows: rows[3:]}))
+	assert.NoError(t, pdw.Close())
+
+	reader, err := file.NewParquetReader(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, reader.NumRowGroups())
+	assert.Equal(t, "tags.list.element", reader.MetaData().Schema.Column(1).Path())
+	assert.Equal(t, "items.list.element.qty", reader.MetaData().Schema.Column(6).Path())
+
+	rowReader, err := newParquetRowReader(bytes.NewReader(buf.Bytes()), NewWriteCloseBuffer(&bytes.Buffer{}))
+	assert.NoError(t, err)
+	assert.Equal(t, "_TEXT", rowReader.Columns()[1].Type)
+	assert.Equal(t, "STRUCT", rowReader.Columns()[3].Type)
+	assert.Equal(t, 2, len(rowReader.Columns()[3].Fields))
+	var result [][]any
+	for {
+		row, err := rowReader.Next()
+		if err != nil {
+			break
+		}
+		result = append(result, row)
+	}
+	assert.DeepEqual(t, expected, result)
+}
+
+func TestParquetWriterNestedErrors(t *testing.T) {
+	columns, _, _ := nestedColumns()
+	ds := &data.DataStream{DestColumns: columns}
+	tests := []struct {
+		name string
+		row  []any
+	}{
+		{name: "List is not a list", row: []any{int64(1), 5, nil, nil, nil}},
+		{name: "List is not JSON", row: []any{int64(1), "{a,b}", nil, nil, nil}},
+		{name: "Struct is not an object", row: []any{int64(1), nil, nil, `["Paris"]`, nil}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pdw, err := NewParquetDataWriterWithOptions(ds, NewWriteCloseBuffer(&bytes.Buffer{}), "", 0, nil)
+			assert.NoError(t, err)
+			assert.Error(t, pdw.CreateBatchWriter().WriteBatch(data.Batch{Rows: [][]any{tt.row}}))
+		})
+	}
+}
+
+func TestParquetWriterRecord(t *testing.T) {
+	record := recordTestRecord()
+	defer record.Release()
+
+	write := func(batch data.Batch) ([][]any, error) {
+		var buf bytes.Buffer
+		ds := &data.DataStream{BatchSize: 3, DestColumns: recordTestColumns}
+		pdw := NewParquetDataWriter(ds, NewWriteCloseBuffer(&buf))
+		bw := pdw.CreateBatchWriter()
+		var err error
+		if batch.Record != nil {
+			err = bw.(data.RecordWriter).WriteRecord(batch.Record)
+		} else {
+			err = bw.WriteBatch(batch)
+		}
+		if err != nil {
+			return nil, err
+		}
+		assert.NoError(t, pdw.Close())
+
+		rowReader, err := newParquetRowReader(bytes.NewReader(buf.Bytes()), NewWriteCloseBuffer(&bytes.Buffer{}))
+		assert.NoError(t, err)
+		defer rowReader.Close()
+		var rows [][]any
+		for {
+			row, err := rowReader.Next()
+			if err != nil {
+				break
+			}
+			rows = append(rows, row)
+		}
+		return rows, nil
+	}
+
+	// a record writes the same file as its rows, the lists are shredded a value
+	// at a time
+	expected, err := write(data.Batch{Rows: data.RecordRows(record)})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(expected))
+	actual, err := write(data.Batch{Record: record})
+	assert.NoError(t, err)
+	assert.DeepEqual(t, expected, actual)
+
+	// a decimal wider than the column is converted too, which fails like its rows
+	columns := []data.Column{{Name: "amount", Type: "NUMERIC", Precision: 4, Scale: 2}}
+	pdw := NewParquetDataWriter(&data.DataStream{BatchSize: 3, DestColumns: columns}, NewWriteCloseBuffer(&bytes.Buffer{}))
+	amount := array.NewRecordBatch(arrow.NewSchema(record.Schema().Fields()[4:5], nil), record.Columns()[4:5], record.NumRows())
+	defer amount.Release()
+	rowsErr := pdw.CreateBatchWriter().WriteBatch(data.Batch{Rows: data.RecordRows(amount)})
+	recordErr := pdw.CreateBatchWriter().(data.RecordWriter).WriteRecord(amount)
+	assert.Equal(t, rowsErr == nil, recordErr == nil)
+}
@@ -0,0 +1,500 @@
+package file
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/golang/snappy"
+	"github.com/google/uuid"
+	"github.com/johanan/mvr/data"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/shopspring/decimal"
+	"github.com/spf13/cast"
+)
+
+// rowReader walks a single source file row by row
+type rowReader interface {
+	Columns() []data.Column
+	// Next returns io.EOF once every row has been read
+	Next() ([]any, error)
+	Close() error
+}
+
+// recordReader is a rowReader that can send arrow records as they are
+type recordReader interface {
+	rowReader
+	Columnar(columns []data.Column) bool
+	NextRecord() (arrow.RecordBatch, error)
+}
+
+// FileDataReader reads csv, jsonl, parquet and arrow files as if they were a database
+type FileDataReader struct {
+	mux     sync.Mutex
+	streams map[*data.DataStream]rowReader
+}
+
+func NewFileDataReader(connUrl *url.URL) (*FileDataReader, error) {
+	switch connUrl.Scheme {
+	case "file", "azure", "azurite":
+	default:
+		return nil, fmt.Errorf("unsupported file source: %s", connUrl.Scheme)
+	}
+
+	return &FileDataReader{streams: make(map[*data.DataStream]rowReader)}, nil
+}
+
+func (reader *FileDataReader) Close() error {
+	reader.mux.Lock()
+	defer reader.mux.Unlock()
+
+	var closeErr error
+	for ds, rows := range reader.streams {
+		if err := rows.Close(); err != nil {
+			closeErr = errors.Join(closeErr, err)
+		}
+		delete(reader.streams, ds)
+	}
+	return closeErr
+}
+
+func (reader *FileDataReader) CreateDataStream(ctx context.Context, connUrl *url.URL, config *data.StreamConfig) (*data.DataStream, error) {
+	sourceUrl, err := sourcePath(connUrl, config.StreamName)
+	if err != nil {
+		return nil, err
+	}
+
+	format, compression := sourceFormat(sourceUrl)
+	log.Debug().Str("path", sourceUrl.Path).Str("format", format).Str("compression", compression).Msg("Opening source file")
+
+	rows, err := openRowReader(ctx, sourceUrl, format, compression, config.CSV)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := rows.Columns()
+	srcColumns := make([]data.Column, len(columns))
+	copy(srcColumns, columns)
+	destColumns := make([]data.Column, len(columns))
+	copy(destColumns, columns)
+
+	if len(config.Columns) > 0 {
+		destColumns = data.OverrideColumns(destColumns, config.Columns)
+	}
+
+	ds := &data.DataStream{TotalRows: 0, BatchChan: make(chan data.Batch, config.GetBatchCount()), BatchSize: config.GetBatchSize(), Columns: srcColumns, DestColumns: destColumns}
+
+	reader.mux.Lock()
+	reader.streams[ds] = rows
+	reader.mux.Unlock()
+
+	for i, col := range columns {
+		log.Debug().Str("column", col.Name).Str("type", col.Type).Str("dest_type", destColumns[i].Type).Msg("Column")
+	}
+	return ds, nil
+}
+
+func (reader *FileDataReader) ExecuteDataStream(ctx context.Context, ds *data.DataStream, config *data.StreamConfig) error {
+	reader.mux.Lock()
+	rows, ok := reader.streams[ds]
+	delete(reader.streams, ds)
+	reader.mux.Unlock()
+
+	defer func() {
+		close(ds.BatchChan)
+		log.Debug().Msg("Closed batch channel")
+	}()
+
+	if !ok {
+		return errors.New("data stream was not created by this reader")
+	}
+	defer rows.Close()
+
+	if records, ok := rows.(recordReader); ok && records.Columnar(ds.DestColumns) {
+		log.Debug().Msg("Sending records")
+		return sendRecords(ctx, records, ds)
+	}
+
+	batch := data.Batch{Rows: make([][]any, 0, ds.BatchSize)}
+	for {
+		row, err := rows.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read row: %w", err)
+		}
+
+		// files carry very little type information, so coerce to the destination
+		for i, col := range ds.DestColumns {
+			value, err := fileValue(row[i], col)
+			if err != nil {
+				return fmt.Errorf("failed to convert column %s: %w", col.Name, err)
+			}
+			row[i] = value
+		}
+
+		batch.Rows = append(batch.Rows, row)
+
+		if len(batch.Rows) >= ds.BatchSize {
+			log.Trace().Msg("Sending batch")
+			select {
+			case ds.BatchChan <- batch:
+				batch = data.Batch{Rows: make([][]any, 0, ds.BatchSize)}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	// Send any remaining rows
+	if len(batch.Rows) > 0 {
+		log.Trace().Msg("Sending remaining batch")
+		select {
+		case ds.BatchChan <- batch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	log.Debug().Msg("Finished reading rows")
+
+	return nil
+}
+
+// sendRecords sends the records as batches of columns, sliced to the batch size
+func sendRecords(ctx context.Context, records recordReader, ds *data.DataStream) error {
+	for {
+		record, err := records.NextRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read record: %w", err)
+		}
+
+		size := int64(ds.BatchSize)
+		for start := int64(0); start < record.NumRows(); start += size {
+			slice := record.NewSlice(start, min(start+size, record.NumRows()))
+			log.Trace().Msg("Sending record")
+			select {
+			case ds.BatchChan <- data.Batch{Record: slice}:
+			case <-ctx.Done():
+				slice.Release()
+				record.Release()
+				return ctx.Err()
+			}
+		}
+		record.Release()
+	}
+
+	log.Debug().Msg("Finished reading records")
+	return nil
+}
+
+// sourcePath resolves the file to read. A source url ending in a slash is a
+// directory or prefix and the stream name is the file inside of it.
+func sourcePath(connUrl *url.URL, streamName string) (*url.URL, error) {
+	sourceUrl := *connUrl
+	if !strings.HasSuffix(sourceUrl.Path, "/") {
+		return &sourceUrl, nil
+	}
+
+	if strings.TrimSpace(streamName) == "" {
+		return nil, errors.New("stream_name is required when the source is a directory")
+	}
+
+	filePath, err := url.JoinPath(sourceUrl.Path, streamName)
+	if err != nil {
+		return nil, fmt.Errorf("error joining path: %s", err)
+	}
+	sourceUrl.Path = filePath
+	return &sourceUrl, nil
+}
+
+// compressionExts are the extensions of compressed streams
+var compressionExts = map[string]string{
+	".gz":   "gzip",
+	".sz":   "snappy",
+	".zst":  "zstd",
+	".zstd": "zstd",
+	".lz4":  "lz4",
+	".bz2":  "bzip2",
+}
+
+// sourceFormat uses the format and compression query parameters, falling back to the file extension
+func sourceFormat(sourceUrl *url.URL) (string, string) {
+	q := sourceUrl.Query()
+	name := strings.ToLower(path.Base(sourceUrl.Path))
+
+	compression := strings.ToLower(q.Get("compression"))
+	if codec, ok := compressionExts[path.Ext(name)]; ok {
+		name = strings.TrimSuffix(name, path.Ext(name))
+		if compression == "" {
+			compression = codec
+		}
+	}
+
+	format := strings.ToLower(q.Get("format"))
+	if format == "" {
+		switch path.Ext(name) {
+		case ".csv":
+			format = "csv"
+		case ".tsv", ".tab":
+			format = "tsv"
+		case ".jsonl", ".ndjson", ".json":
+			format = "jsonl"
+		case ".parquet":
+			format = "parquet"
+		case ".arrow", ".arrows", ".ipc", ".feather":
+			format = "arrow"
+		}
+	}
+
+	return format, compression
+}
+
+func openRowReader(ctx context.Context, sourceUrl *url.URL, format, compression string, csvOpts *data.CSVOptions) (rowReader, error) {
+	source, err := openSource(ctx, sourceUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	input, err := decompressedReader(source, compression)
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+
+	var rows rowReader
+	switch format {
+	case "csv", "tsv":
+		rows, err = newCSVRowReader(input, source, format, csvOpts)
+	case "jsonl":
+		rows, err = newJSONLRowReader(input, source)
+	case "parquet":
+		rows, err = newParquetRowReader(input, source)
+	case "arrow":
+		rows, err = newArrowRowReader(input, source)
+	case "":
+		err = fmt.Errorf("unable to determine the format of %s, add ?format= to the source", path.Base(sourceUrl.Path))
+	default:
+		err = fmt.Errorf("unsupported format: %s", format)
+	}
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+	return rows, nil
+}
+
+// decompressedReader undoes the stream compression of the writers
+func decompressedReader(source io.Reader, compression string) (io.Reader, error) {
+	switch compression {
+	case "", "none":
+		return source, nil
+	case "gzip":
+		gz, err := gzip.NewReader(source)
+		if err != nil {
+			return nil, fmt.Errorf("error opening gzip reader: %s", err)
+		}
+		return gz, nil
+	case "snappy":
+		return snappy.NewReader(source), nil
+	case "zstd":
+		// a single decoder decodes in the calling goroutine, so nothing needs closing
+		zr, err := zstd.NewReader(source, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("error opening zstd reader: %s", err)
+		}
+		return zr, nil
+	case "lz4":
+		return lz4.NewReader(source), nil
+	case "bzip2":
+		return bzip2.NewReader(source), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", compression)
+	}
+}
+
+func openSource(ctx context.Context, sourceUrl *url.URL) (io.ReadCloser, error) {
+	switch sourceUrl.Scheme {
+	case "azurite":
+		blobConfig, err := ParseAzurite(sourceUrl)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing azurite url: %s", err)
+		}
+		return blobConfig.GetReader(ctx)
+	case "azure":
+		blobConfig, err := ParseAzureBlobURL(sourceUrl)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing azure blob url: %s", err)
+		}
+		return blobConfig.GetReader(ctx)
+	default:
+		f, err := os.Open(sourceUrl.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file %s: %v", sourceUrl.Path, err)
+		}
+		return f, nil
+	}
+}
+
+type readAtSeeker interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+// readerAt returns a random access reader, only buffering into memory when the
+// source cannot seek (blobs or compressed files)
+func readerAt(input io.Reader) (readAtSeeker, error) {
+	if f, ok := input.(*os.File); ok {
+		return f, nil
+	}
+
+	buf, err := io.ReadAll(input)
+	if err != nil {
+		return nil, fmt.Errorf("error reading source: %s", err)
+	}
+	return bytes.NewReader(buf), nil
+}
+
+func isTextType(colType string) bool {
+	switch colType {
+	case "TEXT", "VARCHAR", "JSON", "JSONB", "_TEXT", "BYTEA":
+		return true
+	}
+	return false
+}
+
+func fileValue(value any, col data.Column) (any, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	if s, ok := value.(string); ok && s == "" && !isTextType(col.Type) {
+		// an empty field is the only way most files can say null
+		return nil, nil
+	}
+
+	switch col.Type {
+	case "BOOLEAN":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			return strconv.ParseBool(strings.TrimSpace(v))
+		default:
+			return cast.ToBoolE(v)
+		}
+	case "SMALLINT", "INTEGER", "BIGINT":
+		switch v := value.(type) {
+		case string:
+			return strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		case json.Number:
+			return v.Int64()
+		default:
+			return cast.ToInt64E(v)
+		}
+	case "REAL", "DOUBLE":
+		switch v := value.(type) {
+		case string:
+			return strconv.ParseFloat(strings.TrimSpace(v), 64)
+		case json.Number:
+			return v.Float64()
+		case decimal.Decimal:
+			f, _ := v.Float64()
+			return f, nil
+		default:
+			return cast.ToFloat64E(v)
+		}
+	case "NUMERIC":
+		switch v := value.(type) {
+		case decimal.Decimal:
+			return v, nil
+		case string:
+			return decimal.NewFromString(strings.TrimSpace(v))
+		case json.Number:
+			return decimal.NewFromString(v.String())
+		case float32:
+			return decimal.NewFromFloat32(v), nil
+		case float64:
+			return decimal.NewFromFloat(v), nil
+		case uint64:
+			return decimal.NewFromUint64(v), nil
+		default:
+			i, err := cast.ToInt64E(v)
+			if err != nil {
+				return nil, err
+			}
+			return decimal.NewFromInt(i), nil
+		}
+	case "DATE", "TIMESTAMP", "TIMESTAMPTZ":
+		switch v := value.(type) {
+		case time.Time:
+			return v, nil
+		case string:
+			return data.ParseTimestamp(v)
+		default:
+			return nil, fmt.Errorf("unable to convert %T to a timestamp", value)
+		}
+	case "UUID":
+		switch v := value.(type) {
+		case uuid.UUID:
+			return v, nil
+		case []byte:
+			return uuid.FromBytes(v)
+		case string:
+			return uuid.Parse(strings.TrimSpace(v))
+		default:
+			return nil, fmt.Errorf("unable to convert %T to a uuid", value)
+		}
+	case "BYTEA":
+		if v, ok := value.([]byte); ok {
+			return data.ByteaToString(v), nil
+		}
+		return cast.ToString(value), nil
+	case "JSON", "JSONB", "_TEXT":
+		if v, ok := value.([]byte); ok {
+			return string(v), nil
+		}
+		return value, nil
+	default:
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case []byte:
+			return string(v), nil
+		case json.Number:
+			return v.String(), nil
+		case uuid.UUID:
+			return v.String(), nil
+		case time.Time:
+			return v.Format(time.RFC3339Nano), nil
+		case map[string]any, []any:
+			j, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			return string(j), nil
+		default:
+			return value, nil
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package file
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/google/uuid"
+	"github.com/johanan/mvr/data"
+	"github.com/shopspring/decimal"
+	"github.com/zeebo/assert"
+)
+
+var readerTestColumns = []data.Column{
+	{Name: "id", Type: "INTEGER"},
+	{Name: "name", Type: "TEXT"},
+	{Name: "active", Type: "BOOLEAN"},
+	{Name: "amount", Type: "NUMERIC", Precision: 10, Scale: 2},
+	{Name: "created", Type: "TIMESTAMPTZ"},
+	{Name: "day", Type: "DATE"},
+	{Name: "unique_id", Type: "UUID"},
+}
+
+func readerTestRows() [][]any {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC)
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	return [][]any{
+		{int32(1), "John", true, decimal.RequireFromString("10.50"), created, day, uuid.MustParse("a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11")},
+		{int32(2), "Jane, \"Doe\"", false, decimal.RequireFromString("-3.25"), created.Add(time.Hour), day.AddDate(0, 0, 1), uuid.MustParse("b0eebc99-9c0b-4ef8-bb6d-6bb9bd380a12")},
+		{int32(3), "", nil, nil, nil, nil, nil},
+	}
+}
+
+// writeReaderFixture writes the test rows with the existing writers so the reader sees real output
+func writeReaderFixture(t *testing.T, dir, format, compression string) string {
+	ds := &data.DataStream{BatchSize: 10, Columns: readerTestColumns, DestColumns: readerTestColumns}
+	name := "data." + format
+	// arrow lz4 and zstd are inside the file
+	if !(format == "arrow" && IsArrowBodyCompression(compression)) {
+		for ext, codec := range compressionExts {
+			if codec == compression && ext != ".zstd" {
+				name += ext
+			}
+		}
+	}
+
+	f, err := os.Create(filepath.Join(dir, name))
+	assert.NoError(t, err)
+
+	writer, err := CreateCompressedWriter(NewBufferedWriter(f, f), compression, 0, format)
+	assert.NoError(t, err)
+
+	dataWriter, err := AddFileWriter(&data.StreamConfig{Format: format, Compression: compression}, ds, writer)
+	assert.NoError(t, err)
+	assert.NoError(t, dataWriter.CreateBatchWriter().WriteBatch(data.Batch{Rows: readerTestRows()}))
+	assert.NoError(t, dataWriter.Flush())
+	assert.NoError(t, dataWriter.Close())
+	assert.NoError(t, writer.Close())
+	return name
+}
+
+func readAll(t *testing.T, source *url.URL, config *data.StreamConfig) (*data.DataStream, [][]any) {
+	ctx := context.Background()
+	reader, err := NewFileDataReader(source)
+	assert.NoError(t, err)
+	defer reader.Close()
+
+	ds, err := reader.CreateDataStream(ctx, source, config)
+	assert.NoError(t, err)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- reader.ExecuteDataStream(ctx, ds, config)
+	}()
+
+	var rows [][]any
+	for batch := range ds.BatchChan {
+		if batch.Record != nil {
+			batch.Rows = data.RecordRows(batch.Record)
+			batch.Record.Release()
+		}
+		rows = append(rows, batch.Rows...)
+	}
+	assert.NoError(t, <-errCh)
+	return ds, rows
+}
+
+func TestFileDataReader(t *testing.T) {
+	// csv and jsonl only know strings and numbers, so they need the types back
+	overrides := []data.Column{
+		{Name: "id", Type: "INTEGER"},
+		{Name: "active", Type: "BOOLEAN"},
+		{Name: "amount", Type: "NUMERIC", Precision: 10, Scale: 2},
+		{Name: "created", Type: "TIMESTAMPTZ"},
+		{Name: "day", Type: "DATE"},
+		{Name: "unique_id", Type: "UUID"},
+	}
+
+	tests := []struct {
+		name        string
+		format      string
+		compression string
+		columns     []data.Column
+	}{
+		{name: "CSV", format: "csv", columns: overrides},
+		{name: "CSV gzip", format: "csv", compression: "gzip", columns: overrides},
+		{name: "TSV", format: "tsv", columns: overrides},
+		{name: "JSONL", format: "jsonl", columns: overrides},
+		{name: "Parquet uses cols metadata", format: "parquet"},
+		{name: "Arrow uses field metadata", format: "arrow"},
+		{name: "Arrow gzip", format: "arrow", compression: "gzip"},
+		{name: "CSV snappy", format: "csv", compression: "snappy", columns: overrides},
+		{name: "JSONL zstd", format: "jsonl", compression: "zstd", columns: overrides},
+		{name: "Arrow lz4 buffers", format: "arrow", compression: "lz4"},
+		{name: "Arrow snappy stream", format: "arrow", compression: "snappy"},
+		{name: "CSV bzip2", format: "csv", compression: "bzip2", columns: overrides},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			name := writeReaderFixture(t, dir, tt.format, tt.compression)
+			source, _ := url.Parse("file://" + dir + "/")
+
+			ds, rows := readAll(t, source, &data.StreamConfig{StreamName: name, Columns: tt.columns})
+
+			// jsonl writes its keys sorted, so match the columns up by name
+			expectedIndex := make(map[string]int)
+			for i, col := range readerTestColumns {
+				expectedIndex[col.Name] = i
+			}
+			assert.Equal(t, len(readerTestColumns), len(ds.DestColumns))
+			for _, col := range ds.DestColumns {
+				assert.Equal(t, readerTestColumns[expectedIndex[col.Name]].Type, col.Type)
+			}
+
+			expected := readerTestRows()
+			assert.Equal(t, len(expected), len(rows))
+			for i, row := range rows {
+				for j, got := range row {
+					col := ds.DestColumns[j]
+					want := expected[i][expectedIndex[col.Name]]
+					if want == nil {
+						// text formats cannot tell an empty string from null
+						if got != nil {
+							assert.Equal(t, "", got)
+						}
+						continue
+					}
+					wantStr, err := ValueToString(want, col)
+					assert.NoError(t, err)
+					gotStr, err := ValueToString(got, col)
+					assert.NoError(t, err)
+					assert.Equal(t, wantStr, gotStr)
+				}
+			}
+		})
+	}
+}
+
+func TestFileDataReader_CSVDialect(t *testing.T) {
+	empty := ""
+	noHeader := false
+	tests := []struct {
+		name    string
+		format  string
+		opts    *data.CSVOptions
+		columns []string
+	}{
+		{name: "Pipe with empty nulls", format: "csv", opts: &data.CSVOptions{Delimiter: "pipe", NullValue: &empty}},
+		{name: "Single quotes and crlf", format: "csv", opts: &data.CSVOptions{Quote: "'", QuoteAll: true, LineTerminator: "crlf", BOM: true}},
+		{name: "TSV", format: "tsv"},
+		{name: "No header", format: "csv", opts: &data.CSVOptions{Delimiter: ";", Header: &noHeader}, columns: []string{"column_1", "column_2", "column_3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			columns := readerTestColumns[:3]
+			f, err := os.Create(filepath.Join(dir, "data.txt"))
+			assert.NoError(t, err)
+			config := &data.StreamConfig{Format: tt.format, CSV: tt.opts}
+			ds := &data.DataStream{BatchSize: 10, Columns: columns, DestColumns: columns}
+			dataWriter, err := AddFileWriter(config, ds, f)
+			assert.NoError(t, err)
+			var written [][]any
+			for _, row := range readerTestRows() {
+				written = append(written, row[:3])
+			}
+			assert.NoError(t, dataWriter.CreateBatchWriter().WriteBatch(data.Batch{Rows: written}))
+			assert.NoError(t, dataWriter.Close())
+
+			source, _ := url.Parse("file://" + dir + "/data.txt?format=" + tt.format)
+			ds, rows := readAll(t, source, &data.StreamConfig{CSV: tt.opts})
+
+			names := tt.columns
+			if names == nil {
+				names = []string{"id", "name", "active"}
+			}
+			assert.Equal(t, len(names), len(ds.Columns))
+			for i, name := range names {
+				assert.Equal(t, name, ds.Columns[i].Name)
+			}
+			// an empty string is quoted, so only the null is read as null
+			assert.DeepEqual(t, [][]any{{"1", "John", "true"}, {"2", "Jane, \"Doe\"", "false"}, {"3", "", nil}}, rows)
+		})
+	}
+}
+
+func TestCSVRowReaderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "Unclosed quote", input: "a,b\n1,\"2\n"},
+		{name: "Text after a quote", input: "a,b\n1,\"2\"x\n"},
+		{name: "Too many fields", input: "a,b\n1,2,3\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := newCSVRowReader(strings.NewReader(tt.input), io.NopCloser(nil), "csv", nil)
+			assert.NoError(t, err)
+			_, err = rows.Next()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestFileDataReader_Records(t *testing.T) {
+	record := recordTestRecord()
+	defer record.Release()
+
+	tests := []struct {
+		name    string
+		format  string
+		columns int
+		records bool
+	}{
+		{name: "Arrow", format: "arrow", columns: 9, records: true},
+		{name: "Parquet", format: "parquet", columns: 9, records: true},
+		// uuids and lists are converted from rows
+		{name: "Arrow with uuids", format: "arrow", columns: 10},
+		{name: "Parquet with lists", format: "parquet", columns: 11},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			columns := recordTestColumns[:tt.columns]
+			source := array.NewRecordBatch(arrow.NewSchema(record.Schema().Fields()[:tt.columns], nil), record.Columns()[:tt.columns], record.NumRows())
+			defer source.Release()
+
+			dir := t.TempDir()
+			f, err := os.Create(filepath.Join(dir, "data."+tt.format))
+			assert.NoError(t, err)
+			ds := &data.DataStream{BatchSize: 10, DestColumns: columns}
+			dataWriter, err := AddFileWriter(&data.StreamConfig{Format: tt.format}, ds, f)
+			assert.NoError(t, err)
+			assert.NoError(t, dataWriter.CreateBatchWriter().(data.RecordWriter).WriteRecord(source))
+			assert.NoError(t, dataWriter.Close())
+
+			sourceUrl, _ := url.Parse("file://" + dir + "/")
+			config := &data.StreamConfig{StreamName: "data." + tt.format, BatchSize: 2}
+			reader, err := NewFileDataReader(sourceUrl)
+			assert.NoError(t, err)
+			defer reader.Close()
+			ds, err = reader.CreateDataStream(context.Background(), sourceUrl, config)
+			assert.NoError(t, err)
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- reader.ExecuteDataStream(context.Background(), ds, config)
+			}()
+
+			var sizes []int
+			var rows [][]any
+			for batch := range ds.BatchChan {
+				assert.Equal(t, tt.records, batch.Record != nil)
+				sizes = append(sizes, batch.Len())
+				if batch.Record != nil {
+					batch.Rows = data.RecordRows(batch.Record)
+					batch.Record.Release()
+				}
+				rows = append(rows, batch.Rows...)
+			}
+			assert.NoError(t, <-errCh)
+			assert.DeepEqual(t, []int{2, 1}, sizes)
+
+			expected := data.RecordRows(source)
+			assert.Equal(t, len(expected), len(rows))
+			for i, row := range rows {
+				for j, got := range row {
+					wantStr, err := ValueToString(expected[i][j], columns[j])
+					assert.NoError(t, err)
+					gotStr, err := ValueToString(got, columns[j])
+					assert.NoError(t, err)
+					assert.Equal(t, wantStr, gotStr)
+				}
+			}
+		})
+	}
+}
+
+func TestFileDataReader_Inference(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "legacy.csv"), []byte("\uFEFFid,name\n1,John\n2,NULL\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "events.jsonl"), []byte(`{"z":1,"a":1.5,"ok":true,"tags":["x"],"note":null}`+"\n"+`{"z":2,"extra":"dropped"}`+"\n"), 0644))
+
+	gz, err := os.Create(filepath.Join(dir, "events.gz"))
+	assert.NoError(t, err)
+	gzw := gzip.NewWriter(gz)
+	_, err = gzw.Write([]byte(`{"z":3}` + "\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, gzw.Close())
+	assert.NoError(t, gz.Close())
+
+	tests := []struct {
+		name     string
+		source   string
+		stream   string
+		expected []data.Column
+		rows     [][]any
+	}{
+		{
+			name:     "CSV header with BOM",
+			source:   "file://" + dir + "/",
+			stream:   "legacy.csv",
+			expected: []data.Column{{Name: "id", Type: "TEXT"}, {Name: "name", Type: "TEXT"}},
+			rows:     [][]any{{"1", "John"}, {"2", nil}},
+		},
+		{
+			name:     "JSONL keeps key order",
+			source:   "file://" + dir + "/events.jsonl",
+			expected: []data.Column{{Name: "z", Type: "BIGINT"}, {Name: "a", Type: "DOUBLE"}, {Name: "ok", Type: "BOOLEAN"}, {Name: "tags", Type: "JSONB"}, {Name: "note", Type: "TEXT"}},
+			rows:     [][]any{{int64(1), 1.5, true, []any{"x"}, nil}, {int64(2), nil, nil, nil, nil}},
+		},
+		{
+			name:     "Format from query",
+			source:   "file://" + dir + "/events.gz?format=jsonl",
+			expected: []data.Column{{Name: "z", Type: "BIGINT"}},
+			rows:     [][]any{{int64(3)}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, _ := url.Parse(tt.source)
+			ds, rows := readAll(t, source, &data.StreamConfig{StreamName: tt.stream})
+
+			assert.Equal(t, len(tt.expected), len(ds.DestColumns))
+			for i, col := range tt.expected {
+				assert.Equal(t, col.Name, ds.DestColumns[i].Name)
+				assert.Equal(t, col.Type, ds.DestColumns[i].Type)
+			}
+			assert.DeepEqual(t, tt.rows, rows)
+		})
+	}
+}
+
+func TestSourcePath(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		stream   string
+		expected string
+		isError  bool
+	}{
+		{name: "File", source: "file:///data/users.csv", stream: "users", expected: "/data/users.csv"},
+		{name: "Directory", source: "file:///data/", stream: "in/users.csv", expected: "/data/in/users.csv"},
+		{name: "Directory without stream", source: "file:///data/", isError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, _ := url.Parse(tt.source)
+			result, err := sourcePath(source, tt.stream)
+			if tt.isError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, result.Path)
+		})
+	}
+}
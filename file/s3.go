@@ -0,0 +1,160 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type S3Config struct {
+	bucket    string
+	key       string
+	endpoint  string
+	region    string
+	profile   string
+	accessKey string
+	secretKey string
+}
+
+type S3Object struct {
+	*S3Config
+	writer *io.PipeWriter
+	wg     *sync.WaitGroup
+	errCh  chan error
+	open   bool
+}
+
+func (s *S3Object) Write(p []byte) (n int, err error) {
+	return s.writer.Write(p)
+}
+
+func (s *S3Object) Close() error {
+	if s.open {
+		s.open = false
+
+		if err := s.writer.Close(); err != nil {
+			return fmt.Errorf("failed to close writer: %w", err)
+		}
+		s.wg.Wait()
+		select {
+		case err := <-s.errCh:
+			if err != nil {
+				return fmt.Errorf("upload failed: %w", err)
+			}
+		default:
+		}
+	}
+	return nil
+}
+
+// Abort fails the upload, the uploader abandons a multipart upload so nothing
+// is left under the key
+func (s *S3Object) Abort() error {
+	if !s.open {
+		return nil
+	}
+	s.open = false
+
+	s.writer.CloseWithError(errAborted)
+	s.wg.Wait()
+	return nil
+}
+
+func (s *S3Config) getClient(ctx context.Context) (*s3.Client, error) {
+	// credentials come from the environment or the shared config unless the url has them
+	var opts []func(*config.LoadOptions) error
+	if s.profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(s.profile))
+	}
+	if s.region != "" {
+		opts = append(opts, config.WithRegion(s.region))
+	}
+	if s.accessKey != "" {
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(s.accessKey, s.secretKey, "")))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("S3: %v", err)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if s.endpoint != "" {
+			// MinIO and most other S3 compatible stores only do path style
+			o.BaseEndpoint = aws.String(s.endpoint)
+			o.UsePathStyle = true
+			if o.Region == "" {
+				o.Region = "us-east-1"
+			}
+		}
+	})
+	return client, nil
+}
+
+func (s *S3Config) GetWriter(ctx context.Context) (*S3Object, error) {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer wg.Done()
+		defer pr.Close()
+		// the uploader switches to a multipart upload once the first part is full
+		uploader := manager.NewUploader(client)
+		_, err := uploader.Upload(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.key),
+			Body:   pr,
+		})
+		if err != nil {
+			pw.CloseWithError(err)
+			errCh <- err
+		}
+	}()
+
+	return &S3Object{S3Config: s, writer: pw, wg: &wg, errCh: errCh, open: true}, nil
+}
+
+// ParseS3URL reads s3://bucket/key. The endpoint, region and profile can be set
+// in the query and an access key and secret as the user and password.
+func ParseS3URL(s3Url *url.URL) (*S3Config, error) {
+	if s3Url.Scheme != "s3" {
+		return nil, fmt.Errorf("S3: only s3 is supported")
+	}
+
+	bucket := s3Url.Hostname()
+	key := strings.TrimPrefix(s3Url.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("S3: bucket and key are required")
+	}
+
+	query := s3Url.Query()
+	s3Config := &S3Config{
+		bucket:   bucket,
+		key:      key,
+		endpoint: query.Get("endpoint"),
+		region:   query.Get("region"),
+		profile:  query.Get("profile"),
+	}
+	if s3Url.User != nil {
+		s3Config.accessKey = s3Url.User.Username()
+		s3Config.secretKey, _ = s3Url.User.Password()
+	}
+
+	return s3Config, nil
+}
@@ -0,0 +1,133 @@
+package file
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/johanan/mvr/core"
+	"github.com/johanan/mvr/data"
+	"github.com/johanan/mvr/database"
+	"github.com/zeebo/assert"
+)
+
+var local_s3_url = "s3://minioadmin:minioadmin@testbucket/test/test.csv?endpoint=http://127.0.0.1:9000"
+
+func TestS3_Writer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sc := &data.StreamConfig{StreamName: "public.numbers", Format: "csv"}
+	err := sc.Validate()
+	assert.NoError(t, err)
+	local_url, _ := url.Parse(local_db_url)
+
+	pgr, _ := database.NewPGDataReader(local_url)
+	pgDs, _ := pgr.CreateDataStream(ctx, local_url, sc)
+	assert.NotNil(t, pgDs)
+	defer pgr.Close()
+
+	s3Url, _ := url.Parse(local_s3_url)
+	s3Config, err := ParseS3URL(s3Url)
+	assert.NoError(t, err)
+	client, err := s3Config.getClient(ctx)
+	assert.NoError(t, err)
+	_, _ = client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String("testbucket")})
+
+	s3Writer, err := s3Config.GetWriter(ctx)
+	assert.NoError(t, err)
+
+	buf := NewBufferedWriter(s3Writer, s3Writer)
+	writer := NewCSVDataWriter(pgDs, buf)
+
+	err = core.Execute(ctx, 1, sc, pgDs, pgr, writer)
+	assert.NoError(t, err)
+	writer.Close()
+
+	err = s3Writer.Close()
+	assert.NoError(t, err)
+
+	obj, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("testbucket"), Key: aws.String("test/test.csv")})
+	assert.NoError(t, err)
+	defer obj.Body.Close()
+	body, err := io.ReadAll(obj.Body)
+	assert.NoError(t, err)
+	assert.True(t, len(body) > 0)
+}
+
+func TestS3_Abort(t *testing.T) {
+	ctx := context.Background()
+	s3Url, _ := url.Parse("s3://minioadmin:minioadmin@testbucket/test/aborted.csv?endpoint=http://127.0.0.1:9000")
+	s3Config, err := ParseS3URL(s3Url)
+	assert.NoError(t, err)
+	client, err := s3Config.getClient(ctx)
+	assert.NoError(t, err)
+	_, _ = client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String("testbucket")})
+
+	s3Writer, err := s3Config.GetWriter(ctx)
+	assert.NoError(t, err)
+	assert.True(t, CanAbort(NewBufferedWriter(s3Writer, s3Writer)))
+	_, err = s3Writer.Write([]byte("partial"))
+	assert.NoError(t, err)
+	assert.NoError(t, s3Writer.Abort())
+
+	_, err = client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("testbucket"), Key: aws.String("test/aborted.csv")})
+	assert.Error(t, err)
+}
+
+func Test_ParseS3URL(t *testing.T) {
+	tests := []struct {
+		name      string
+		s3Url     string
+		expected  S3Config
+		expectErr bool
+	}{
+		{
+			name:     "Bucket and key",
+			s3Url:    "s3://bucket/prefix/year/month/test.parquet",
+			expected: S3Config{bucket: "bucket", key: "prefix/year/month/test.parquet"},
+		},
+		{
+			name:     "MinIO with credentials",
+			s3Url:    "s3://access:secret@bucket/test.csv?endpoint=http://localhost:9000&region=us-west-2",
+			expected: S3Config{bucket: "bucket", key: "test.csv", endpoint: "http://localhost:9000", region: "us-west-2", accessKey: "access", secretKey: "secret"},
+		},
+		{
+			name:     "Profile",
+			s3Url:    "s3://bucket/test.csv?profile=reporting",
+			expected: S3Config{bucket: "bucket", key: "test.csv", profile: "reporting"},
+		},
+		{
+			name:      "Missing key",
+			s3Url:     "s3://bucket/",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3Url, _ := url.Parse(tt.s3Url)
+			s3Config, err := ParseS3URL(s3Url)
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, *s3Config)
+		})
+	}
+}
+
+func Test_S3FullPath(t *testing.T) {
+	s3Url, _ := url.Parse("s3://bucket/exports?endpoint=http://localhost:9000")
+	full, err := BuildFullPath(s3Url, "users.parquet")
+	assert.NoError(t, err)
+
+	s3Config, err := ParseS3URL(full)
+	assert.NoError(t, err)
+	assert.Equal(t, "exports/users.parquet", s3Config.key)
+	assert.Equal(t, "http://localhost:9000", s3Config.endpoint)
+}
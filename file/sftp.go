@@ -0,0 +1,266 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var errAborted = errors.New("upload aborted")
+
+type SFTPConfig struct {
+	user     string
+	password string
+	host     string
+	path     string
+}
+
+// SFTPFile writes to a temporary name next to the destination and renames it
+// into place on Close, so whoever picks the file up never sees part of it.
+type SFTPFile struct {
+	*SFTPConfig
+	conn     *ssh.Client
+	client   *sftp.Client
+	file     *sftp.File
+	tempPath string
+	writer   *io.PipeWriter
+	wg       *sync.WaitGroup
+	errCh    chan error
+	stop     func() bool
+	open     bool
+}
+
+func (s *SFTPFile) Write(p []byte) (n int, err error) {
+	return s.writer.Write(p)
+}
+
+func (s *SFTPFile) Close() error {
+	if !s.open {
+		return nil
+	}
+	s.open = false
+	defer s.closeConn()
+
+	if err := s.writer.Close(); err != nil {
+		return fmt.Errorf("failed to close writer: %w", err)
+	}
+	s.wg.Wait()
+	select {
+	case err := <-s.errCh:
+		if err != nil {
+			s.file.Close()
+			s.client.Remove(s.tempPath)
+			return fmt.Errorf("upload failed: %w", err)
+		}
+	default:
+	}
+
+	if err := s.file.Close(); err != nil {
+		s.client.Remove(s.tempPath)
+		return fmt.Errorf("upload failed: %w", err)
+	}
+
+	// plain sftp rename fails when the destination exists, the openssh extension replaces it
+	if _, ok := s.client.HasExtension("posix-rename@openssh.com"); ok {
+		if err := s.client.PosixRename(s.tempPath, s.path); err != nil {
+			return fmt.Errorf("failed to rename %s to %s: %w", s.tempPath, s.path, err)
+		}
+		return nil
+	}
+	if _, err := s.client.Stat(s.path); err == nil {
+		if err := s.client.Remove(s.path); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", s.path, err)
+		}
+	}
+	if err := s.client.Rename(s.tempPath, s.path); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", s.tempPath, s.path, err)
+	}
+	return nil
+}
+
+// Abort removes the temporary file and leaves the destination alone
+func (s *SFTPFile) Abort() error {
+	if !s.open {
+		return nil
+	}
+	s.open = false
+	defer s.closeConn()
+
+	s.writer.CloseWithError(errAborted)
+	s.wg.Wait()
+	s.file.Close()
+	if err := s.client.Remove(s.tempPath); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", s.tempPath, err)
+	}
+	return nil
+}
+
+func (s *SFTPFile) closeConn() {
+	s.stop()
+	s.client.Close()
+	s.conn.Close()
+}
+
+// sftpAuth uses the key in MVR_SFTP_KEY or the file in MVR_SFTP_KEY_FILE, and
+// the password from the connection string if there is one.
+func sftpAuth(password string) ([]ssh.AuthMethod, error) {
+	privateKey := os.Getenv("MVR_SFTP_KEY")
+	keyFile := os.Getenv("MVR_SFTP_KEY_FILE")
+
+	if privateKey == "" && keyFile != "" {
+		fileBytes, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		privateKey = string(fileBytes)
+	}
+
+	var methods []ssh.AuthMethod
+	if privateKey != "" {
+		var signer ssh.Signer
+		var err error
+		if passphrase := os.Getenv("MVR_SFTP_KEY_PASSPHRASE"); passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(privateKey), []byte(passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey([]byte(privateKey))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse sftp key: %w", err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if password != "" {
+		methods = append(methods, ssh.Password(password))
+	}
+
+	if len(methods) == 0 {
+		return nil, errors.New("MVR_SFTP_KEY or MVR_SFTP_KEY_FILE is required for sftp")
+	}
+	return methods, nil
+}
+
+// sftpHostKeyCallback checks the server against MVR_SFTP_KNOWN_HOSTS or ~/.ssh/known_hosts
+func sftpHostKeyCallback() (ssh.HostKeyCallback, error) {
+	knownHostsFile := os.Getenv("MVR_SFTP_KNOWN_HOSTS")
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find known_hosts: %w", err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	callback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known_hosts %s: %w", knownHostsFile, err)
+	}
+	return callback, nil
+}
+
+func (s *SFTPConfig) getClient() (*ssh.Client, *sftp.Client, error) {
+	auth, err := sftpAuth(s.password)
+	if err != nil {
+		return nil, nil, err
+	}
+	hostKeyCallback, err := sftpHostKeyCallback()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := ssh.Dial("tcp", s.host, &ssh.ClientConfig{User: s.user, Auth: auth, HostKeyCallback: hostKeyCallback})
+	if err != nil {
+		return nil, nil, fmt.Errorf("SFTP: %v", err)
+	}
+
+	client, err := sftp.NewClient(conn, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("SFTP: %v", err)
+	}
+	return conn, client, nil
+}
+
+func (s *SFTPConfig) GetWriter(ctx context.Context) (*SFTPFile, error) {
+	conn, client, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, name := path.Split(s.path)
+	tempPath := path.Join(dir, "."+name+".mvr.tmp")
+	if err := client.MkdirAll(dir); err != nil {
+		client.Close()
+		conn.Close()
+		return nil, fmt.Errorf("SFTP: failed to create directory %s: %v", dir, err)
+	}
+
+	file, err := client.Create(tempPath)
+	if err != nil {
+		client.Close()
+		conn.Close()
+		return nil, fmt.Errorf("SFTP: failed to create %s: %v", tempPath, err)
+	}
+	log.Debug().Str("path", tempPath).Msg("Uploading to temporary file")
+
+	pr, pw := io.Pipe()
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer wg.Done()
+		defer pr.Close()
+		// ReadFrom keeps several writes in flight instead of waiting on each one
+		_, err := file.ReadFrom(pr)
+		if err != nil {
+			pr.CloseWithError(err)
+			errCh <- err
+		}
+	}()
+
+	// stop the upload if the context is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		pw.CloseWithError(ctx.Err())
+	})
+
+	return &SFTPFile{SFTPConfig: s, conn: conn, client: client, file: file, tempPath: tempPath, writer: pw, wg: &wg, errCh: errCh, stop: stop, open: true}, nil
+}
+
+// ParseSFTPURL reads sftp://user@host:port/path, the port defaults to 22
+func ParseSFTPURL(sftpUrl *url.URL) (*SFTPConfig, error) {
+	if sftpUrl.Scheme != "sftp" {
+		return nil, fmt.Errorf("SFTP: only sftp is supported")
+	}
+	if sftpUrl.User == nil || sftpUrl.User.Username() == "" {
+		return nil, fmt.Errorf("SFTP: user is required")
+	}
+	if sftpUrl.Path == "" || sftpUrl.Path == "/" {
+		return nil, fmt.Errorf("SFTP: path is required")
+	}
+
+	port := sftpUrl.Port()
+	if port == "" {
+		port = "22"
+	}
+	password, _ := sftpUrl.User.Password()
+
+	return &SFTPConfig{
+		user:     sftpUrl.User.Username(),
+		password: password,
+		host:     net.JoinHostPort(sftpUrl.Hostname(), port),
+		path:     sftpUrl.Path,
+	}, nil
+}
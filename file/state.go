@@ -0,0 +1,88 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/johanan/mvr/data"
+)
+
+// WatermarkState is what an incremental stream keeps between runs
+type WatermarkState struct {
+	Column string `json:"column"`
+	// Value is the largest cursor value written, bound to the param on the next run
+	Value string `json:"value"`
+	// Rows is how many rows the last run wrote
+	Rows      int       `json:"rows"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// StateLocation is where an incremental stream keeps its state, the state
+// setting or <stream_name>.state.json in the destination
+func StateLocation(destUrl *url.URL, sConfig *data.StreamConfig) (*url.URL, error) {
+	state := sConfig.Incremental.State
+	if state == "" {
+		if sConfig.StreamName == "" {
+			return nil, fmt.Errorf("incremental needs a stream_name or a state to name the state file")
+		}
+		state = sConfig.StreamName + ".state.json"
+	}
+	if parsed, err := url.Parse(state); err == nil && parsed.Scheme != "" {
+		return parsed, nil
+	}
+	return BuildFullPath(destUrl, state)
+}
+
+// stateStore opens the directory of the state file
+func stateStore(location *url.URL) (tableStore, string, error) {
+	dir := *location
+	dir.Path = path.Dir(location.Path)
+	store, err := newTableStore(&dir)
+	if err != nil {
+		return nil, "", fmt.Errorf("incremental state must be a file or azure url: %w", err)
+	}
+	return store, path.Base(location.Path), nil
+}
+
+// LoadWatermark reads the state of the last successful run, nil when there has not been one
+func LoadWatermark(ctx context.Context, location *url.URL) (*WatermarkState, error) {
+	store, name, err := stateStore(location)
+	if err != nil {
+		return nil, err
+	}
+	body, err := store.Read(ctx, name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading incremental state: %w", err)
+	}
+
+	var state WatermarkState
+	if err := json.Unmarshal(body, &state); err != nil {
+		return nil, fmt.Errorf("error parsing incremental state %s: %w", name, err)
+	}
+	return &state, nil
+}
+
+// SaveWatermark replaces the state, only call it once the data is safely written
+func SaveWatermark(ctx context.Context, location *url.URL, state *WatermarkState) error {
+	store, name, err := stateStore(location)
+	if err != nil {
+		return err
+	}
+	body, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := store.Put(ctx, name, body); err != nil {
+		return fmt.Errorf("error writing incremental state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package file
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/johanan/mvr/data"
+	"github.com/zeebo/assert"
+)
+
+func TestStateLocation(t *testing.T) {
+	dest, _ := url.Parse("file:///data/out/")
+	tests := []struct {
+		name     string
+		config   data.StreamConfig
+		expected string
+		isError  bool
+	}{
+		{name: "Stream name", config: data.StreamConfig{StreamName: "public.users"}, expected: "file:///data/out/public.users.state.json"},
+		{name: "Relative state", config: data.StreamConfig{SQL: "SELECT 1", Incremental: &data.IncrementalOptions{State: "state/users.json"}}, expected: "file:///data/out/state/users.json"},
+		{name: "Full url", config: data.StreamConfig{StreamName: "users", Incremental: &data.IncrementalOptions{State: "azure://account.blob.core.windows.net/state/users.json"}}, expected: "azure://account.blob.core.windows.net/state/users.json"},
+		{name: "No name", config: data.StreamConfig{SQL: "SELECT 1"}, isError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.config.Incremental == nil {
+				tt.config.Incremental = &data.IncrementalOptions{}
+			}
+			location, err := StateLocation(dest, &tt.config)
+			if tt.isError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, location.String())
+		})
+	}
+}
+
+func TestWatermarkState(t *testing.T) {
+	ctx := context.Background()
+	location := &url.URL{Scheme: "file", Path: filepath.Join(t.TempDir(), "state", "users.state.json")}
+
+	// no state before the first run
+	state, err := LoadWatermark(ctx, location)
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+
+	saved := &WatermarkState{Column: "updated_at", Value: "2024-10-08T17:22:00Z", Rows: 10, UpdatedAt: time.Date(2024, 10, 9, 0, 0, 0, 0, time.UTC)}
+	assert.NoError(t, SaveWatermark(ctx, location, saved))
+	state, err = LoadWatermark(ctx, location)
+	assert.NoError(t, err)
+	assert.Equal(t, *saved, *state)
+
+	// the next run replaces it
+	saved.Value = "2024-10-09T00:00:00Z"
+	assert.NoError(t, SaveWatermark(ctx, location, saved))
+	state, err = LoadWatermark(ctx, location)
+	assert.NoError(t, err)
+	assert.Equal(t, saved.Value, state.Value)
+
+	assert.NoError(t, os.WriteFile(location.Path, []byte("not json"), 0644))
+	_, err = LoadWatermark(ctx, location)
+	assert.Error(t, err)
+
+	_, err = LoadWatermark(ctx, &url.URL{Scheme: "s3", Host: "bucket", Path: "/users.state.json"})
+	assert.Error(t, err)
+}
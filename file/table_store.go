@@ -0,0 +1,228 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/johanan/mvr/data"
+)
+
+// errFileExists is returned by PutIfAbsent when another writer got there first
+var errFileExists = errors.New("file already exists")
+
+// tableStore is the little bit of storage a table format needs for its metadata.
+// Names are relative to the table directory and always use forward slashes.
+type tableStore interface {
+	// List returns the names of the files directly under dir
+	List(ctx context.Context, dir string) ([]string, error)
+	// Read returns an error that is os.ErrNotExist when the file is not there
+	Read(ctx context.Context, name string) ([]byte, error)
+	// PutIfAbsent writes the file only if it does not exist, returning errFileExists if it does
+	PutIfAbsent(ctx context.Context, name string, body []byte) error
+	// Put writes the file, replacing it if it exists
+	Put(ctx context.Context, name string, body []byte) error
+}
+
+func newTableStore(tableUrl *url.URL) (tableStore, error) {
+	switch tableUrl.Scheme {
+	case "file", "":
+		return &localTableStore{root: tableUrl.Path}, nil
+	case "azure", "https", "azurite":
+		return newAzureTableStore(tableUrl)
+	default:
+		return nil, fmt.Errorf("unsupported table destination: %s", tableUrl.Scheme)
+	}
+}
+
+type localTableStore struct {
+	root string
+}
+
+func (l *localTableStore) List(ctx context.Context, dir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(l.root, filepath.FromSlash(dir)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (l *localTableStore) Read(ctx context.Context, name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(l.root, filepath.FromSlash(name)))
+}
+
+// PutIfAbsent writes a temporary file and links it into place, the link fails
+// if the name is taken so readers only ever see a whole file
+func (l *localTableStore) PutIfAbsent(ctx context.Context, name string, body []byte) error {
+	return l.put(name, body, func(temp, target string) error {
+		if err := os.Link(temp, target); err != nil {
+			if errors.Is(err, os.ErrExist) {
+				return errFileExists
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+func (l *localTableStore) Put(ctx context.Context, name string, body []byte) error {
+	return l.put(name, body, os.Rename)
+}
+
+func (l *localTableStore) put(name string, body []byte, place func(temp, target string) error) error {
+	target := filepath.Join(l.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(body); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return place(temp.Name(), target)
+}
+
+type azureTableStore struct {
+	client    *azblob.Client
+	container string
+	prefix    string
+}
+
+func newAzureTableStore(tableUrl *url.URL) (*azureTableStore, error) {
+	// the parsers clear the credentials from the url they are given
+	copied := *tableUrl
+	var config *AzureBlobConfig
+	var err error
+	if tableUrl.Scheme == "azurite" {
+		config, err = ParseAzurite(&copied)
+	} else {
+		config, err = ParseAzureBlobURL(&copied)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	segments := strings.Split(strings.Trim(config.blobUrl.Path, "/"), "/")
+	// azurite puts the account in the path
+	if tableUrl.Scheme == "azurite" && len(segments) > 0 {
+		config.base = config.base + "/" + segments[0]
+		segments = segments[1:]
+	}
+	if len(segments) < 2 {
+		return nil, fmt.Errorf("AzureBlob: a container and a table path are required")
+	}
+
+	client, err := config.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return &azureTableStore{client: client, container: segments[0], prefix: strings.Join(segments[1:], "/")}, nil
+}
+
+func (a *azureTableStore) List(ctx context.Context, dir string) ([]string, error) {
+	prefix := path.Join(a.prefix, dir) + "/"
+	pager := a.client.NewListBlobsFlatPager(a.container, &azblob.ListBlobsFlatOptions{Prefix: &prefix})
+
+	var names []string
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("AzureBlob: %v", err)
+		}
+		for _, item := range page.Segment.BlobItems {
+			name := strings.TrimPrefix(*item.Name, prefix)
+			// only the files directly under dir
+			if !strings.Contains(name, "/") {
+				names = append(names, name)
+			}
+		}
+	}
+	return names, nil
+}
+
+func (a *azureTableStore) Read(ctx context.Context, name string) ([]byte, error) {
+	resp, err := a.client.DownloadStream(ctx, a.container, path.Join(a.prefix, name), nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil, fmt.Errorf("AzureBlob: %s: %w", name, os.ErrNotExist)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("AzureBlob: %v", err)
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (a *azureTableStore) PutIfAbsent(ctx context.Context, name string, body []byte) error {
+	_, err := a.client.UploadStream(ctx, a.container, path.Join(a.prefix, name), bytes.NewReader(body), &azblob.UploadStreamOptions{
+		AccessConditions: &blob.AccessConditions{ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfNoneMatch: to.Ptr(azcore.ETagAny)}},
+	})
+	if bloberror.HasCode(err, bloberror.BlobAlreadyExists, bloberror.ConditionNotMet) {
+		return errFileExists
+	}
+	if err != nil {
+		return fmt.Errorf("AzureBlob: %v", err)
+	}
+	return nil
+}
+
+func (a *azureTableStore) Put(ctx context.Context, name string, body []byte) error {
+	_, err := a.client.UploadStream(ctx, a.container, path.Join(a.prefix, name), bytes.NewReader(body), nil)
+	if err != nil {
+		return fmt.Errorf("AzureBlob: %v", err)
+	}
+	return nil
+}
+
+// countingWriter keeps the size of a data file for the table metadata
+type countingWriter struct {
+	writer io.WriteCloser
+	size   int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	c.size += int64(n)
+	return n, err
+}
+
+func (c *countingWriter) Close() error {
+	return c.writer.Close()
+}
+
+func (c *countingWriter) Abort() error {
+	if aborter, ok := c.writer.(data.Aborter); ok {
+		return aborter.Abort()
+	}
+	return c.writer.Close()
+}
@@ -0,0 +1,233 @@
+package file
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/johanan/mvr/data"
+	"github.com/spf13/cast"
+	"github.com/xuri/excelize/v2"
+)
+
+// Excel keeps 15 significant digits of a number, anything longer is written as text
+const xlsxMaxDigits = 15
+
+type XLSXDataWriter struct {
+	datastream *data.DataStream
+	writer     io.Writer
+	file       *excelize.File
+	stream     *excelize.StreamWriter
+	header     []any
+	styles     []int
+	sheets     int
+	row        int
+	// rowsPerSheet counts the header, a sheet is full at excelize.TotalRows
+	rowsPerSheet int
+	mux          *sync.Mutex
+}
+
+type XLSXBatchWriter struct {
+	dataWriter *XLSXDataWriter
+}
+
+func NewXLSXDataWriter(datastream *data.DataStream, w io.Writer, compression string) (*XLSXDataWriter, error) {
+	// the workbook is already a zip
+	if compression != "" {
+		return nil, fmt.Errorf("unsupported compression for xlsx: %s", compression)
+	}
+
+	file := excelize.NewFile()
+	headerStyle, err := file.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]any, len(datastream.DestColumns))
+	styles := make([]int, len(datastream.DestColumns))
+	for i, col := range datastream.DestColumns {
+		header[i] = excelize.Cell{StyleID: headerStyle, Value: col.Name}
+		if numFmt := xlsxNumFmt(col); numFmt != "" {
+			styles[i], err = file.NewStyle(&excelize.Style{CustomNumFmt: &numFmt})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	xw := &XLSXDataWriter{
+		datastream:   datastream,
+		writer:       w,
+		file:         file,
+		header:       header,
+		styles:       styles,
+		rowsPerSheet: excelize.TotalRows,
+		mux:          &sync.Mutex{},
+	}
+	if err := xw.nextSheet(); err != nil {
+		return nil, err
+	}
+	return xw, nil
+}
+
+// xlsxNumFmt is the number format for the typed cells of a column
+func xlsxNumFmt(col data.Column) string {
+	switch data.TypeAlias(col.Type) {
+	case "NUMERIC":
+		if col.Scale > 0 {
+			return "0." + strings.Repeat("0", int(col.Scale))
+		}
+		if col.Precision > 0 {
+			return "0"
+		}
+	case "DATE":
+		return "yyyy-mm-dd"
+	case "TIMESTAMP":
+		return "yyyy-mm-dd hh:mm:ss.000"
+	case "TIMESTAMPTZ":
+		// Excel has no timezones, the cell holds UTC and says so
+		return `yyyy-mm-dd hh:mm:ss.000 "UTC"`
+	}
+	return ""
+}
+
+// nextSheet finishes the current sheet and starts a new one with the header
+func (xw *XLSXDataWriter) nextSheet() error {
+	if xw.stream != nil {
+		if err := xw.stream.Flush(); err != nil {
+			return err
+		}
+	}
+
+	xw.sheets++
+	name := fmt.Sprintf("Sheet%d", xw.sheets)
+	if xw.sheets > 1 {
+		if _, err := xw.file.NewSheet(name); err != nil {
+			return err
+		}
+	}
+
+	stream, err := xw.file.NewStreamWriter(name)
+	if err != nil {
+		return err
+	}
+	if err := stream.SetPanes(&excelize.Panes{Freeze: true, YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft"}); err != nil {
+		return err
+	}
+	if err := stream.SetRow("A1", xw.header); err != nil {
+		return err
+	}
+	xw.stream = stream
+	xw.row = 1
+	return nil
+}
+
+func (xw *XLSXDataWriter) CreateBatchWriter() data.BatchWriter {
+	return &XLSXBatchWriter{dataWriter: xw}
+}
+
+func (xb *XLSXBatchWriter) WriteBatch(batch data.Batch) error {
+	xw := xb.dataWriter
+
+	// the stream writer needs ascending row numbers, so only SetRow is locked
+	rows := make([][]any, len(batch.Rows))
+	for r, row := range batch.Rows {
+		cells := make([]any, len(row))
+		for i, val := range row {
+			col := xw.datastream.DestColumns[i]
+			value, err := xlsxValue(val, col)
+			if err != nil {
+				return fmt.Errorf("failed to convert column %s: %w", col.Name, err)
+			}
+			cells[i] = excelize.Cell{StyleID: xw.styles[i], Value: value}
+		}
+		rows[r] = cells
+	}
+
+	xw.mux.Lock()
+	defer xw.mux.Unlock()
+	for _, cells := range rows {
+		if xw.row >= xw.rowsPerSheet {
+			if err := xw.nextSheet(); err != nil {
+				return err
+			}
+		}
+		xw.row++
+		cell, err := excelize.CoordinatesToCellName(1, xw.row)
+		if err != nil {
+			return err
+		}
+		if err := xw.stream.SetRow(cell, cells); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (xw *XLSXDataWriter) Flush() error {
+	return nil
+}
+
+// Close writes the workbook, nothing reaches the writer before this
+func (xw *XLSXDataWriter) Close() error {
+	defer xw.file.Close()
+	if err := xw.stream.Flush(); err != nil {
+		return err
+	}
+	if err := xw.file.Write(xw.writer); err != nil {
+		return err
+	}
+	if closer, ok := xw.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// xlsxValue turns a value into the Go type excelize writes as a typed cell
+func xlsxValue(value any, col data.Column) (any, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	switch data.TypeAlias(col.Type) {
+	case "BOOLEAN":
+		return cast.ToBoolE(value)
+	case "SMALLINT", "INTEGER", "BIGINT":
+		return cast.ToInt64E(value)
+	case "REAL", "DOUBLE":
+		return toFloat64(value)
+	case "NUMERIC":
+		dec, err := toDecimal(value)
+		if err != nil {
+			return nil, err
+		}
+		if col.Precision > 0 {
+			dec = dec.Round(int32(col.Scale))
+		}
+		if digits := len(strings.TrimPrefix(dec.Coefficient().String(), "-")); digits > xlsxMaxDigits {
+			return dec.String(), nil
+		}
+		return dec.InexactFloat64(), nil
+	case "UUID":
+		return toUUIDString(value)
+	case "DATE", "TIMESTAMP", "TIMESTAMPTZ":
+		t, err := toTime(value, col)
+		if err != nil {
+			return nil, err
+		}
+		if col.Type == "TIMESTAMPTZ" {
+			return t.UTC(), nil
+		}
+		return t, nil
+	case "BYTEA":
+		switch v := value.(type) {
+		case []byte:
+			return data.ByteaToString(v), nil
+		case string:
+			return v, nil
+		}
+	}
+
+	return ValueToString(value, col)
+}
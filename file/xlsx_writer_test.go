@@ -0,0 +1,121 @@
+package file
+
+import (
+	"bytes"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johanan/mvr/data"
+	"github.com/shopspring/decimal"
+	"github.com/spf13/cast"
+	"github.com/xuri/excelize/v2"
+	"github.com/zeebo/assert"
+)
+
+func TestXLSXDataWriter(t *testing.T) {
+	ds := &data.DataStream{BatchSize: 10, Columns: readerTestColumns, DestColumns: readerTestColumns}
+	var buf bytes.Buffer
+	writer, err := AddFileWriter(&data.StreamConfig{Format: "xlsx"}, ds, NewBufferedWriter(&buf))
+	assert.NoError(t, err)
+
+	rows := readerTestRows()
+	assert.NoError(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: rows[:2]}))
+	assert.NoError(t, writer.CreateBatchWriter().WriteBatch(data.Batch{Rows: rows[2:]}))
+	assert.NoError(t, writer.Close())
+
+	f, err := excelize.OpenReader(&buf)
+	assert.NoError(t, err)
+	defer f.Close()
+	assert.DeepEqual(t, []string{"Sheet1"}, f.GetSheetList())
+
+	// header is bold
+	style, err := f.GetCellStyle("Sheet1", "A1")
+	assert.NoError(t, err)
+	header, err := f.GetStyle(style)
+	assert.NoError(t, err)
+	assert.True(t, header.Font.Bold)
+
+	sheet, err := f.GetRows("Sheet1")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(sheet))
+	assert.DeepEqual(t, []string{"id", "name", "active", "amount", "created", "day", "unique_id"}, sheet[0])
+	assert.Equal(t, "1", sheet[1][0])
+	assert.Equal(t, "John", sheet[1][1])
+	assert.Equal(t, "TRUE", sheet[1][2])
+	assert.Equal(t, "10.50", sheet[1][3])
+	assert.True(t, strings.HasPrefix(sheet[1][4], "2024-01-02 03:04:05"))
+	assert.True(t, strings.HasSuffix(sheet[1][4], " UTC"))
+	assert.Equal(t, "2024-01-02", sheet[1][5])
+	assert.Equal(t, "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11", sheet[1][6])
+	assert.DeepEqual(t, []string{"3"}, sheet[3])
+
+	// the cells are typed, not text
+	raw, err := f.GetRows("Sheet1", excelize.Options{RawCellValue: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "1", raw[1][2])
+	assert.Equal(t, "10.5", raw[1][3])
+	// days since 1899-12-30, the fraction keeps the milliseconds
+	created := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC).Add(time.Duration(cast.ToFloat64(raw[1][4]) * 24 * float64(time.Hour)))
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 123000000, time.UTC), created.Round(time.Millisecond))
+}
+
+func TestXLSXSheetRollover(t *testing.T) {
+	columns := []data.Column{{Name: "id", Type: "INTEGER"}}
+	ds := &data.DataStream{BatchSize: 10, Columns: columns, DestColumns: columns}
+	var buf bytes.Buffer
+	writer, err := NewXLSXDataWriter(ds, &buf, "")
+	assert.NoError(t, err)
+	// a header and two rows per sheet
+	writer.rowsPerSheet = 3
+
+	batch := data.Batch{Rows: [][]any{{1}, {2}, {3}, {4}, {5}}}
+	assert.NoError(t, writer.CreateBatchWriter().WriteBatch(batch))
+	assert.NoError(t, writer.Close())
+
+	f, err := excelize.OpenReader(&buf)
+	assert.NoError(t, err)
+	defer f.Close()
+	assert.DeepEqual(t, []string{"Sheet1", "Sheet2", "Sheet3"}, f.GetSheetList())
+
+	expected := [][][]string{
+		{{"id"}, {"1"}, {"2"}},
+		{{"id"}, {"3"}, {"4"}},
+		{{"id"}, {"5"}},
+	}
+	for i, sheet := range f.GetSheetList() {
+		rows, err := f.GetRows(sheet)
+		assert.NoError(t, err)
+		assert.DeepEqual(t, expected[i], rows)
+	}
+}
+
+func TestXLSXValue(t *testing.T) {
+	local := time.FixedZone("local", -5*60*60)
+	tests := []struct {
+		name     string
+		value    any
+		col      data.Column
+		expected any
+	}{
+		{name: "Numeric is rounded to the scale", value: "10.555", col: data.Column{Type: "NUMERIC", Precision: 10, Scale: 2}, expected: 10.56},
+		{name: "Numeric too long for Excel is text", value: "1234567890123456789.5", col: data.Column{Type: "NUMERIC"}, expected: "1234567890123456789.5"},
+		{name: "Timestamptz is UTC", value: time.Date(2024, 1, 2, 3, 4, 5, 0, local), col: data.Column{Type: "TIMESTAMPTZ"}, expected: time.Date(2024, 1, 2, 8, 4, 5, 0, time.UTC)},
+		{name: "Timestamp string", value: "2024-01-02 03:04:05", col: data.Column{Type: "TIMESTAMP"}, expected: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{name: "Bytea", value: []byte{1, 2}, col: data.Column{Type: "BYTEA"}, expected: "\\x0102"},
+		{name: "Json", value: map[string]any{"a": 1}, col: data.Column{Type: "JSONB"}, expected: `{"a":1}`},
+		{name: "Bigint", value: int32(7), col: data.Column{Type: "BIGINT"}, expected: int64(7)},
+		{name: "Numeric as double", value: decimal.RequireFromString("10.25"), col: data.Column{Type: "DOUBLE"}, expected: 10.25},
+		{name: "Big float as real", value: big.NewFloat(2.5), col: data.Column{Type: "REAL"}, expected: 2.5},
+		{name: "Numeric text as double", value: []byte("3.75"), col: data.Column{Type: "DOUBLE"}, expected: 3.75},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := xlsxValue(tt.value, tt.col)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, value)
+		})
+	}
+}
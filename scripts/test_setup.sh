@@ -127,3 +127,45 @@ INSERT INTO dbo.strings (char_value, varchar_value, text_value, json_value, json
 ('a', 'a', 'a', '{}', '{}', '[]'), 
 ('b', 'b', 'b', '{\"key\": \"value\"}', '{\"key\": \"value\"}', '[\"a\"]');"
 
+
+until docker exec mysql_test mysqladmin ping -h 127.0.0.1 -uroot -pmysql --silent >/dev/null 2>&1; do
+  echo "Waiting for MySQL..."
+  sleep 2
+done
+
+echo "MySQL setup"
+
+docker exec mysql_test mysql -uroot -pmysql testdb -e "
+DROP TABLE IF EXISTS users;
+CREATE TABLE users (
+  name VARCHAR(100) NOT NULL,
+  created DATETIME DEFAULT CURRENT_TIMESTAMP,
+  createdz TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  unique_id BINARY(16) DEFAULT (UUID_TO_BIN(UUID())),
+  nullable_id BINARY(16) NULL,
+  active TINYINT(1) DEFAULT 1
+);"
+
+docker exec mysql_test mysql -uroot -pmysql testdb -e "
+INSERT INTO users (name, created, createdz, unique_id, active) VALUES
+('John Doe', '2024-10-08 17:22:00', '2024-10-08 17:22:00', UUID_TO_BIN('a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11'), 1),
+('Test Tester', '2024-10-08 17:22:00', '2024-10-08 17:22:00', UUID_TO_BIN('a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a12'), 0);"
+
+docker exec mysql_test mysql -uroot -pmysql testdb -e "
+DROP TABLE IF EXISTS numbers;
+CREATE TABLE numbers (
+  smallint_value SMALLINT,
+  integer_value INT,
+  bigint_value BIGINT,
+  decimal_value DECIMAL(38, 15),
+  double_value DOUBLE,
+  float_value FLOAT
+);"
+
+docker exec mysql_test mysql -uroot -pmysql testdb -e "
+INSERT INTO numbers (smallint_value, integer_value, bigint_value, decimal_value, double_value, float_value) VALUES
+(1, 1, 1, 1.0, 1.0, 1.0),
+(2, 2, 2, 2.0, 2.0, 2.0),
+(3, 3, 3, 3.0, 3.0, 3.0),
+(32767, 2147483647, 9223372036854775807, 507531.111989867000000, 1.2345678901234567890123456789e+20, 12345678.9),
+(0, 0, 0, 468797.177024568000000, 1234567890.12345, 12345.67);"